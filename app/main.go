@@ -1,15 +1,20 @@
 package main
 
 import (
+	"context"
+	"github.com/c16a/hermes"
 	"github.com/c16a/hermes/lib/config"
-	"github.com/c16a/hermes/lib/mqtt"
-	"github.com/c16a/hermes/lib/transports"
 	"go.uber.org/zap"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "passwd" {
+		os.Exit(runPasswd(os.Args[2:], os.Stdin, os.Stderr))
+	}
 
 	configFilePath := os.Getenv("CONFIG_FILE_PATH")
 
@@ -23,11 +28,25 @@ func main() {
 		log.Fatal(err)
 	}
 
-	ctx, err := mqtt.NewServerContext(serverConfig, logger)
+	broker, err := hermes.New(hermes.Options{Config: serverConfig, Logger: logger})
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	go transports.StartWebSocketServer(serverConfig, ctx, logger)
-	transports.StartTcpServer(serverConfig, ctx, logger)
+	signalCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err = broker.Start(signalCtx); err != nil {
+		log.Fatal(err)
+	}
+
+	<-signalCtx.Done()
+	// a second signal kills the process right away
+	stop()
+
+	logger.Info("Shutting down")
+	if err = broker.Shutdown(context.Background()); err != nil {
+		logger.Error("shutdown did not complete", zap.Error(err))
+	}
+	_ = logger.Sync()
 }
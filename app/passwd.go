@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/c16a/hermes/lib/auth"
+	"io"
+	"strings"
+)
+
+const passwdUsage = `Usage:
+  hermes passwd add [-algorithm bcrypt|argon2id] [-password <password>] <file> <username>
+  hermes passwd remove <file> <username>
+
+If no password is given, it is read from the first line of the standard input.
+`
+
+// runPasswd adds users to and removes them from a password file of the file auth type
+func runPasswd(args []string, stdin io.Reader, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, passwdUsage)
+		return 2
+	}
+
+	var err error
+	switch args[0] {
+	case "add":
+		flags := flag.NewFlagSet("passwd add", flag.ContinueOnError)
+		flags.SetOutput(stderr)
+		algorithm := flags.String("algorithm", auth.HashBcrypt, "hash algorithm, bcrypt or argon2id")
+		password := flags.String("password", "", "password of the user")
+		if flags.Parse(args[1:]) != nil || flags.NArg() != 2 {
+			fmt.Fprint(stderr, passwdUsage)
+			return 2
+		}
+		if len(*password) == 0 {
+			*password, err = readPassword(stdin)
+		}
+		if err == nil {
+			err = auth.AddUser(flags.Arg(0), flags.Arg(1), *password, *algorithm)
+		}
+	case "remove":
+		if len(args) != 3 {
+			fmt.Fprint(stderr, passwdUsage)
+			return 2
+		}
+		err = auth.RemoveUser(args[1], args[2])
+	default:
+		fmt.Fprint(stderr, passwdUsage)
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func readPassword(stdin io.Reader) (string, error) {
+	line, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if len(password) == 0 {
+		return "", errors.New("no password given")
+	}
+	return password, nil
+}
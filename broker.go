@@ -0,0 +1,237 @@
+// Package hermes embeds an MQTT broker in another Go program.
+//
+// A Broker serves network clients on the addresses in its configuration, just like the
+// standalone hermes binary, and in-process clients created with NewClient.
+package hermes
+
+import (
+	"context"
+	"errors"
+	"github.com/c16a/hermes/lib/admin"
+	"github.com/c16a/hermes/lib/bridge"
+	"github.com/c16a/hermes/lib/cluster"
+	"github.com/c16a/hermes/lib/config"
+	"github.com/c16a/hermes/lib/metrics"
+	"github.com/c16a/hermes/lib/mqtt"
+	"github.com/c16a/hermes/lib/transports"
+	"github.com/eclipse/paho.golang/packets"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// defaultShutdownTimeout bounds Shutdown if the configuration sets no timeout
+const defaultShutdownTimeout = 30 * time.Second
+
+// Options configure a Broker
+type Options struct {
+	// Config is the configuration of the broker, as read from a config file by config.ParseConfig.
+	// If nil, the broker has no listeners and no persistence, and only serves in-process clients.
+	Config *config.Config
+
+	// Logger defaults to a logger which discards everything
+	Logger *zap.Logger
+}
+
+// server is a network listener of the broker
+type server interface {
+	Addr() net.Addr
+	Serve()
+	Close() error
+	Shutdown(ctx context.Context) error
+}
+
+// Broker is an MQTT broker embedded in the current process
+type Broker struct {
+	config *config.Config
+	logger *zap.Logger
+	ctx    *mqtt.ServerContext
+
+	mu          sync.Mutex
+	started     bool
+	servers     []server
+	serving     sync.WaitGroup
+	clusterNode mqtt.ClusterNode
+	bridges     []io.Closer
+}
+
+// New creates a broker from its options. The broker does not accept network connections until it is started,
+// but in-process clients can already be used.
+func New(opts Options) (*Broker, error) {
+	serverConfig := opts.Config
+	if serverConfig == nil {
+		serverConfig = &config.Config{Server: &config.Server{MaxQos: 2}}
+	}
+	if serverConfig.Server == nil {
+		return nil, errors.New("config has no server section")
+	}
+
+	logger := opts.Logger
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	ctx, err := mqtt.NewServerContext(serverConfig, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Broker{
+		config: serverConfig,
+		logger: logger,
+		ctx:    ctx,
+	}, nil
+}
+
+// Start joins the cluster and connects the bridges in the configuration, if any, and starts listening
+// on the configured TCP, WebSocket, admin API and metrics addresses. An empty address disables the listener.
+//
+// Start returns once the broker is listening, and the broker keeps running until Shutdown is called.
+// The context only bounds the startup.
+func (b *Broker) Start(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.started {
+		return errors.New("broker already started")
+	}
+
+	var servers []server
+	if len(b.config.Server.TcpAddress) > 0 {
+		tcpServer, err := transports.NewTcpServer(b.config, b.ctx, b.logger)
+		if err != nil {
+			return err
+		}
+		servers = append(servers, tcpServer)
+	}
+	if len(b.config.Server.HttpAddress) > 0 {
+		wsServer, err := transports.NewWebSocketServer(b.config, b.ctx, b.logger)
+		if err != nil {
+			closeServers(servers)
+			return err
+		}
+		servers = append(servers, wsServer)
+	}
+	if adminConfig := b.config.Server.Admin; adminConfig != nil && len(adminConfig.Address) > 0 {
+		adminServer, err := admin.NewServer(b.config, b.ctx, b.logger)
+		if err != nil {
+			closeServers(servers)
+			return err
+		}
+		servers = append(servers, adminServer)
+	}
+	if metricsConfig := b.config.Server.Metrics; metricsConfig != nil && len(metricsConfig.Address) > 0 {
+		metricsServer, err := metrics.NewServer(metricsConfig.Address, b.ctx.Metrics(), b.logger)
+		if err != nil {
+			closeServers(servers)
+			return err
+		}
+		servers = append(servers, metricsServer)
+	}
+
+	if err := ctx.Err(); err != nil {
+		closeServers(servers)
+		return err
+	}
+
+	clusterNode, err := cluster.StartCluster(b.config, b.ctx, b.logger)
+	if err != nil {
+		closeServers(servers)
+		return err
+	}
+	b.clusterNode = clusterNode
+	b.bridges = bridge.StartBridges(b.config, b.ctx, b.logger)
+
+	for _, s := range servers {
+		b.serving.Add(1)
+		go func(s server) {
+			defer b.serving.Done()
+			s.Serve()
+		}(s)
+	}
+	b.servers = servers
+	b.started = true
+	return nil
+}
+
+// Shutdown stops the broker gracefully.
+//
+// The listeners stop accepting connections, and every client is sent a DISCONNECT with reason code
+// Server shutting down. Messages being handled when a connection is closed are still published, and
+// once all connections are drained, the broker stops its bridges, leaves the cluster and closes the persistence provider.
+//
+// Draining is bounded by the context, and by the configured shutdown timeout. If it takes longer,
+// the broker is closed anyway, and the error of the context is returned.
+func (b *Broker) Shutdown(ctx context.Context) error {
+	timeout := time.Duration(b.config.Server.ShutdownTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	b.mu.Lock()
+	servers, clusterNode, bridges := b.servers, b.clusterNode, b.bridges
+	b.servers, b.clusterNode, b.bridges = nil, nil, nil
+	b.mu.Unlock()
+
+	closeServers(servers)
+	b.ctx.DisconnectAll(ctx, packets.DisconnectServerShuttingDown)
+
+	var drainErr error
+	for _, s := range servers {
+		if err := s.Shutdown(ctx); err != nil && drainErr == nil {
+			drainErr = err
+			b.logger.Error("connections were not drained in time", zap.Error(err))
+		}
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		b.serving.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+	}
+
+	// bridges save outbound messages through the persistence provider, so they are stopped before it is closed
+	for _, closer := range bridges {
+		_ = closer.Close()
+	}
+	if closer, ok := clusterNode.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			b.logger.Error("failed to leave the cluster", zap.Error(err))
+		}
+	}
+	if err := b.ctx.Close(); err != nil {
+		return err
+	}
+	return drainErr
+}
+
+// Addrs returns the addresses the broker listens on, once it is started
+func (b *Broker) Addrs() []net.Addr {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var addrs []net.Addr
+	for _, s := range b.servers {
+		addrs = append(addrs, s.Addr())
+	}
+	return addrs
+}
+
+// ServerContext returns the state of the broker, for lower level access such as adding hooks
+func (b *Broker) ServerContext() *mqtt.ServerContext {
+	return b.ctx
+}
+
+func closeServers(servers []server) {
+	for _, s := range servers {
+		s.Close()
+	}
+}
@@ -0,0 +1,182 @@
+package hermes
+
+import (
+	"context"
+	"github.com/c16a/hermes/lib/config"
+	"github.com/eclipse/paho.golang/packets"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBroker(t *testing.T) {
+	broker, err := New(Options{
+		Config: &config.Config{
+			Server: &config.Server{
+				MaxQos:     2,
+				TcpAddress: "127.0.0.1:0",
+				Metrics:    &config.Metrics{Address: "127.0.0.1:0"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = broker.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan *packets.Publish, 10)
+	inProcess := broker.NewClient("in-process", func(publish *packets.Publish) {
+		received <- publish
+	})
+	if err = inProcess.Subscribe("sensors/#", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	addrs := broker.Addrs()
+	if len(addrs) != 2 {
+		t.Fatalf("broker listens on %v", addrs)
+	}
+	conn, err := net.Dial("tcp", addrs[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	writePacket(t, conn, packets.CONNECT, &packets.Connect{ClientID: "network", CleanStart: true})
+	readPacket(t, conn, packets.CONNACK)
+	writePacket(t, conn, packets.SUBSCRIBE, &packets.Subscribe{
+		PacketID:      1,
+		Subscriptions: map[string]packets.SubOptions{"commands/#": {}},
+	})
+	readPacket(t, conn, packets.SUBACK)
+
+	t.Run("Network message is delivered in process", func(t *testing.T) {
+		writePacket(t, conn, packets.PUBLISH, &packets.Publish{Topic: "sensors/temp", Payload: []byte("21")})
+		select {
+		case publish := <-received:
+			if publish.Topic != "sensors/temp" || string(publish.Payload) != "21" {
+				t.Errorf("received %s on %s", publish.Payload, publish.Topic)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("no message received")
+		}
+	})
+
+	t.Run("In process message is delivered over the network", func(t *testing.T) {
+		if err := inProcess.Publish("commands/reset", []byte("now"), 0); err != nil {
+			t.Fatal(err)
+		}
+		publish := readPacket(t, conn, packets.PUBLISH).Content.(*packets.Publish)
+		if publish.Topic != "commands/reset" || string(publish.Payload) != "now" {
+			t.Errorf("received %s on %s", publish.Payload, publish.Topic)
+		}
+	})
+
+	t.Run("Metrics are served", func(t *testing.T) {
+		response, err := http.Get("http://" + addrs[1].String() + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		body, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, want := range []string{
+			`hermes_connections{transport="tcp"} 1`,
+			`hermes_packets_total{direction="in",type="connect"} 1`,
+			`hermes_packets_total{direction="out",type="suback"} 1`,
+			`hermes_subscriptions 2`,
+			`hermes_publish_deliver_latency_seconds_count 2`,
+		} {
+			if !strings.Contains(string(body), want) {
+				t.Errorf("metrics do not contain %s", want)
+			}
+		}
+	})
+
+	t.Run("Shutdown stops the listener and disconnects clients", func(t *testing.T) {
+		if err := broker.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := net.Dial("tcp", addrs[0].String()); err == nil {
+			t.Error("broker still accepts connections")
+		}
+		disconnect := readPacket(t, conn, packets.DISCONNECT).Content.(*packets.Disconnect)
+		if disconnect.ReasonCode != packets.DisconnectServerShuttingDown {
+			t.Errorf("DISCONNECT reason code = 0x%02x, want 0x%02x", disconnect.ReasonCode, packets.DisconnectServerShuttingDown)
+		}
+		if _, err := packets.ReadPacket(conn); err == nil {
+			t.Error("connection is still open")
+		}
+	})
+}
+
+func TestBroker_WithoutConfig(t *testing.T) {
+	broker, err := New(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan *packets.Publish, 1)
+	subscriber := broker.NewClient("subscriber", func(publish *packets.Publish) {
+		received <- publish
+	})
+	if err = subscriber.Subscribe("foo", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = broker.NewClient("publisher", nil).Publish("foo", []byte("Hello World"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case publish := <-received:
+		if string(publish.Payload) != "Hello World" {
+			t.Errorf("received %s", publish.Payload)
+		}
+	default:
+		t.Error("no message received")
+	}
+
+	if err = subscriber.Unsubscribe("foo"); err != nil {
+		t.Error(err)
+	}
+	if err = subscriber.Unsubscribe("foo"); err != nil {
+		t.Errorf("Unsubscribe() = %v for a missing subscription", err)
+	}
+
+	subscriber.Disconnect()
+	if err = subscriber.Publish("foo", []byte("Hello World"), 0); err != errNotConnected {
+		t.Errorf("Publish() after Disconnect() = %v, want %v", err, errNotConnected)
+	}
+	if err = subscriber.Subscribe("foo", 0); err != errNotConnected {
+		t.Errorf("Subscribe() after Disconnect() = %v, want %v", err, errNotConnected)
+	}
+}
+
+func writePacket(t *testing.T, conn net.Conn, packetType byte, content packets.Packet) {
+	t.Helper()
+	cp := packets.NewControlPacket(packetType)
+	cp.Content = content
+	if _, err := cp.WriteTo(conn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readPacket(t *testing.T, conn net.Conn, packetType byte) *packets.ControlPacket {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	cp, err := packets.ReadPacket(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp.Type != packetType {
+		t.Fatalf("read %s packet", cp.PacketType())
+	}
+	return cp
+}
@@ -0,0 +1,112 @@
+package hermes
+
+import (
+	"errors"
+	"fmt"
+	"github.com/c16a/hermes/lib/mqtt"
+	"github.com/eclipse/paho.golang/packets"
+	"io"
+	"sync"
+)
+
+// errNotConnected is returned when a client is used after it has disconnected
+var errNotConnected = errors.New("client is not connected")
+
+// MessageHandler is called for every message delivered to a client
+type MessageHandler func(publish *packets.Publish)
+
+// Client publishes and subscribes to messages inside the broker process, without a network connection.
+//
+// Clients skip authentication, and have persistent sessions. A client created again with the
+// same ID after it has disconnected keeps its subscriptions, and gets the messages it has missed.
+type Client struct {
+	broker   *Broker
+	clientID string
+	conn     io.Writer
+
+	mu           sync.RWMutex
+	disconnected bool
+}
+
+// NewClient connects a client inside the broker process.
+//
+// The handler is called for every message delivered to the client, while the message is being routed,
+// so it must not block for long. It may be nil for clients which only publish.
+func (b *Broker) NewClient(clientID string, handler MessageHandler) *Client {
+	if handler == nil {
+		handler = func(*packets.Publish) {}
+	}
+	client := &Client{
+		broker:   b,
+		clientID: clientID,
+		conn:     mqtt.NewInternalConnection(handler),
+	}
+	b.ctx.AddInternalClient(client.conn, clientID)
+	return client
+}
+
+// ID returns the ID of the client
+func (client *Client) ID() string {
+	return client.clientID
+}
+
+func (client *Client) isDisconnected() bool {
+	client.mu.RLock()
+	defer client.mu.RUnlock()
+	return client.disconnected
+}
+
+// Subscribe subscribes the client to a topic filter
+func (client *Client) Subscribe(topicFilter string, qos byte) error {
+	if client.isDisconnected() {
+		return errNotConnected
+	}
+	codes := client.broker.ctx.Subscribe(client.conn, &packets.Subscribe{
+		Subscriptions: map[string]packets.SubOptions{topicFilter: {QoS: qos}},
+	})
+	if len(codes) == 0 {
+		return errNotConnected
+	}
+	if codes[0] >= packets.SubackUnspecifiederror {
+		return fmt.Errorf("subscription to %s rejected with reason code 0x%02x", topicFilter, codes[0])
+	}
+	return nil
+}
+
+// Unsubscribe removes the subscription of the client to a topic filter
+func (client *Client) Unsubscribe(topicFilter string) error {
+	if client.isDisconnected() {
+		return errNotConnected
+	}
+	codes := client.broker.ctx.Unsubscribe(client.conn, &packets.Unsubscribe{Topics: []string{topicFilter}})
+	if codes[0] >= packets.UnsubackUnspecifiedError {
+		return fmt.Errorf("unsubscribe from %s failed with reason code 0x%02x", topicFilter, codes[0])
+	}
+	return nil
+}
+
+// Publish publishes a message on behalf of the client, and returns an error if a hook rejects it,
+// or if the client has disconnected
+func (client *Client) Publish(topic string, payload []byte, qos byte) error {
+	if client.isDisconnected() {
+		return errNotConnected
+	}
+	code := client.broker.ctx.Publish(client.conn, &packets.Publish{
+		Topic:   topic,
+		Payload: payload,
+		QoS:     qos,
+	})
+	if code >= packets.PubackUnspecifiedError {
+		return fmt.Errorf("message to %s rejected with reason code 0x%02x", topic, code)
+	}
+	return nil
+}
+
+// Disconnect disconnects the client. Messages for its subscriptions are saved
+// while it is disconnected, if a persistence provider is configured.
+func (client *Client) Disconnect() {
+	client.mu.Lock()
+	client.disconnected = true
+	client.mu.Unlock()
+	client.broker.ctx.Disconnect(client.conn, &packets.Disconnect{})
+}
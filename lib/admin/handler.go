@@ -0,0 +1,279 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/c16a/hermes/lib/mqtt"
+	"github.com/eclipse/paho.golang/packets"
+	"go.uber.org/zap"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const sessionsPath = "/api/sessions"
+
+// subscribeRequest is the body of POST /api/sessions/<clientID>/subscriptions
+type subscribeRequest struct {
+	TopicFilter       string `json:"topic_filter"`
+	QoS               byte   `json:"qos"`
+	NoLocal           bool   `json:"no_local"`
+	RetainAsPublished bool   `json:"retain_as_published"`
+	RetainHandling    byte   `json:"retain_handling"`
+}
+
+// publishRequest is the body of POST /api/publish
+//
+// The payload is either given as text, or as base64 for binary payloads.
+type publishRequest struct {
+	Topic         string `json:"topic"`
+	Payload       string `json:"payload"`
+	PayloadBase64 []byte `json:"payload_base64"`
+	QoS           byte   `json:"qos"`
+	Retain        bool   `json:"retain"`
+}
+
+// reasonCodeResponse reports the MQTT reason code an operation ended with
+type reasonCodeResponse struct {
+	ReasonCode byte `json:"reason_code"`
+}
+
+type errorResponse struct {
+	Error      string `json:"error"`
+	ReasonCode *byte  `json:"reason_code,omitempty"`
+}
+
+// handler serves the admin API:
+//
+//	GET    /api/sessions                                      lists all sessions
+//	GET    /api/sessions/<clientID>                           describes a session and its subscriptions
+//	DELETE /api/sessions/<clientID>                           deletes a session, disconnecting the client
+//	POST   /api/sessions/<clientID>/disconnect                disconnects a client, keeping a persistent session
+//	POST   /api/sessions/<clientID>/subscriptions             subscribes a client to a topic filter
+//	DELETE /api/sessions/<clientID>/subscriptions?topic_filter=<filter>  unsubscribes a client
+//	POST   /api/publish                                       publishes a message
+//
+// Client IDs are path escaped, so that for example a slash is sent as %2F.
+type handler struct {
+	ctx    *mqtt.ServerContext
+	tokens [][]byte
+	logger *zap.Logger
+}
+
+func newHandler(ctx *mqtt.ServerContext, tokens []string, logger *zap.Logger) *handler {
+	h := &handler{ctx: ctx, logger: logger}
+	for _, token := range tokens {
+		// an empty token would let in any request with an empty bearer token
+		if len(token) > 0 {
+			h.tokens = append(h.tokens, []byte(token))
+		}
+	}
+	return h
+}
+
+func (h *handler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if !h.authorised(request) {
+		writer.Header().Set("WWW-Authenticate", `Bearer realm="hermes"`)
+		writeError(writer, http.StatusUnauthorized, "invalid or missing token", nil)
+		return
+	}
+
+	path := request.URL.EscapedPath()
+	switch {
+	case path == "/api/publish":
+		h.handlePublish(writer, request)
+	case path == sessionsPath:
+		h.handleSessions(writer, request)
+	case strings.HasPrefix(path, sessionsPath+"/"):
+		parts := strings.Split(strings.TrimPrefix(path, sessionsPath+"/"), "/")
+		clientID, err := url.PathUnescape(parts[0])
+		if err != nil || len(clientID) == 0 || len(parts) > 2 {
+			writeError(writer, http.StatusNotFound, "not found", nil)
+			return
+		}
+		if len(parts) == 1 {
+			h.handleSession(writer, request, clientID)
+			return
+		}
+		switch parts[1] {
+		case "disconnect":
+			h.handleDisconnect(writer, request, clientID)
+		case "subscriptions":
+			h.handleSubscriptions(writer, request, clientID)
+		default:
+			writeError(writer, http.StatusNotFound, "not found", nil)
+		}
+	default:
+		writeError(writer, http.StatusNotFound, "not found", nil)
+	}
+}
+
+func (h *handler) authorised(request *http.Request) bool {
+	authorization := request.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return false
+	}
+	token := []byte(strings.TrimPrefix(authorization, "Bearer "))
+	if len(token) == 0 {
+		return false
+	}
+
+	authorised := false
+	for _, allowed := range h.tokens {
+		// every token is compared, so that timing does not reveal which one matched
+		if subtle.ConstantTimeCompare(token, allowed) == 1 {
+			authorised = true
+		}
+	}
+	return authorised
+}
+
+func (h *handler) handleSessions(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		writeMethodNotAllowed(writer, http.MethodGet)
+		return
+	}
+	writeJSON(writer, http.StatusOK, h.ctx.Sessions())
+}
+
+func (h *handler) handleSession(writer http.ResponseWriter, request *http.Request, clientID string) {
+	switch request.Method {
+	case http.MethodGet:
+		session, err := h.ctx.Session(clientID)
+		if err != nil {
+			writeClientError(writer, err)
+			return
+		}
+		writeJSON(writer, http.StatusOK, session)
+	case http.MethodDelete:
+		if err := h.ctx.DeleteSession(clientID, packets.DisconnectAdministrativeAction); err != nil {
+			writeClientError(writer, err)
+			return
+		}
+		h.logger.Info(fmt.Sprintf("Session for clientID: %s deleted through admin API", clientID))
+		writer.WriteHeader(http.StatusNoContent)
+	default:
+		writeMethodNotAllowed(writer, http.MethodGet, http.MethodDelete)
+	}
+}
+
+func (h *handler) handleDisconnect(writer http.ResponseWriter, request *http.Request, clientID string) {
+	if request.Method != http.MethodPost {
+		writeMethodNotAllowed(writer, http.MethodPost)
+		return
+	}
+	if err := h.ctx.KickClient(clientID, packets.DisconnectAdministrativeAction); err != nil {
+		writeClientError(writer, err)
+		return
+	}
+	h.logger.Info(fmt.Sprintf("ClientID: %s disconnected through admin API", clientID))
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) handleSubscriptions(writer http.ResponseWriter, request *http.Request, clientID string) {
+	switch request.Method {
+	case http.MethodPost:
+		var body subscribeRequest
+		if err := json.NewDecoder(request.Body).Decode(&body); err != nil || len(body.TopicFilter) == 0 {
+			writeError(writer, http.StatusBadRequest, "body needs a topic_filter", nil)
+			return
+		}
+		codes, err := h.ctx.SubscribeClient(clientID, &packets.Subscribe{
+			Subscriptions: map[string]packets.SubOptions{
+				body.TopicFilter: {
+					QoS:               body.QoS,
+					NoLocal:           body.NoLocal,
+					RetainAsPublished: body.RetainAsPublished,
+					RetainHandling:    body.RetainHandling,
+				},
+			},
+		})
+		if err != nil {
+			writeClientError(writer, err)
+			return
+		}
+		if codes[0] >= packets.SubackUnspecifiederror {
+			writeError(writer, http.StatusForbidden, "subscription rejected", &codes[0])
+			return
+		}
+		writeJSON(writer, http.StatusOK, &reasonCodeResponse{ReasonCode: codes[0]})
+	case http.MethodDelete:
+		topicFilter := request.URL.Query().Get("topic_filter")
+		if len(topicFilter) == 0 {
+			writeError(writer, http.StatusBadRequest, "topic_filter query parameter is missing", nil)
+			return
+		}
+		codes, err := h.ctx.UnsubscribeClient(clientID, &packets.Unsubscribe{Topics: []string{topicFilter}})
+		if err != nil {
+			writeClientError(writer, err)
+			return
+		}
+		if codes[0] == packets.UnsubackNoSubscriptionFound {
+			writeError(writer, http.StatusNotFound, "no subscription found", &codes[0])
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	default:
+		writeMethodNotAllowed(writer, http.MethodPost, http.MethodDelete)
+	}
+}
+
+func (h *handler) handlePublish(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		writeMethodNotAllowed(writer, http.MethodPost)
+		return
+	}
+
+	var body publishRequest
+	if err := json.NewDecoder(request.Body).Decode(&body); err != nil || len(body.Topic) == 0 {
+		writeError(writer, http.StatusBadRequest, "body needs a topic", nil)
+		return
+	}
+	if body.QoS > 2 {
+		writeError(writer, http.StatusBadRequest, "qos must be 0, 1 or 2", nil)
+		return
+	}
+	payload := body.PayloadBase64
+	if payload == nil {
+		payload = []byte(body.Payload)
+	}
+
+	code := h.ctx.Publish(nil, &packets.Publish{
+		Topic:   body.Topic,
+		Payload: payload,
+		QoS:     body.QoS,
+		Retain:  body.Retain,
+	})
+	if code >= packets.PubackUnspecifiedError {
+		writeError(writer, http.StatusForbidden, "message rejected", &code)
+		return
+	}
+	writeJSON(writer, http.StatusOK, &reasonCodeResponse{ReasonCode: code})
+}
+
+func writeClientError(writer http.ResponseWriter, err error) {
+	switch err {
+	case mqtt.ErrClientNotFound:
+		writeError(writer, http.StatusNotFound, err.Error(), nil)
+	case mqtt.ErrClientNotConnected:
+		writeError(writer, http.StatusConflict, err.Error(), nil)
+	default:
+		writeError(writer, http.StatusInternalServerError, err.Error(), nil)
+	}
+}
+
+func writeMethodNotAllowed(writer http.ResponseWriter, methods ...string) {
+	writer.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(writer, http.StatusMethodNotAllowed, "method not allowed", nil)
+}
+
+func writeError(writer http.ResponseWriter, status int, message string, reasonCode *byte) {
+	writeJSON(writer, status, &errorResponse{Error: message, ReasonCode: reasonCode})
+}
+
+func writeJSON(writer http.ResponseWriter, status int, value interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	_ = json.NewEncoder(writer).Encode(value)
+}
@@ -0,0 +1,160 @@
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/c16a/hermes/lib/config"
+	"github.com/c16a/hermes/lib/mqtt"
+	"github.com/eclipse/paho.golang/packets"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// recordingConn records what is written to a client connection, and whether it was closed
+type recordingConn struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (c *recordingConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestHandler(t *testing.T) {
+	ctx, err := mqtt.NewServerContext(&config.Config{
+		Server: &config.Server{MaxQos: 2, Persistence: &config.Persistence{}},
+	}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sensor := &recordingConn{}
+	ctx.AddClient(sensor, &packets.Connect{ClientID: "sensor/1", Username: "alice"})
+	ctx.AddClient(&recordingConn{}, &packets.Connect{ClientID: "doomed"})
+	ctx.AddInternalClient(mqtt.NewInternalConnection(func(*packets.Publish) {}), "observer")
+
+	server := httptest.NewServer(newHandler(ctx, []string{"secret"}, zap.NewNop()))
+	defer server.Close()
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		token      string
+		body       string
+		wantStatus int
+	}{
+		{"Missing token is rejected", http.MethodGet, "/api/sessions", "", "", http.StatusUnauthorized},
+		{"Invalid token is rejected", http.MethodGet, "/api/sessions", "wrong", "", http.StatusUnauthorized},
+		{"Sessions are listed", http.MethodGet, "/api/sessions", "secret", "", http.StatusOK},
+		{"Unknown session is not found", http.MethodGet, "/api/sessions/nobody", "secret", "", http.StatusNotFound},
+		{"Subscription is added", http.MethodPost, "/api/sessions/sensor%2F1/subscriptions", "secret", `{"topic_filter": "commands/#", "qos": 1}`, http.StatusOK},
+		{"Subscription without topic filter is rejected", http.MethodPost, "/api/sessions/sensor%2F1/subscriptions", "secret", `{}`, http.StatusBadRequest},
+		{"Message with an invalid QoS is rejected", http.MethodPost, "/api/publish", "secret", `{"topic": "commands/reset", "qos": 3}`, http.StatusBadRequest},
+		{"Message is published", http.MethodPost, "/api/publish", "secret", `{"topic": "commands/reset", "payload": "now"}`, http.StatusOK},
+		{"Subscription is removed", http.MethodDelete, "/api/sessions/sensor%2F1/subscriptions?topic_filter=commands/%23", "secret", "", http.StatusNoContent},
+		{"Missing subscription is not found", http.MethodDelete, "/api/sessions/sensor%2F1/subscriptions?topic_filter=commands/%23", "secret", "", http.StatusNotFound},
+		{"Client is disconnected", http.MethodPost, "/api/sessions/sensor%2F1/disconnect", "secret", "", http.StatusNoContent},
+		{"Disconnected client cannot be disconnected again", http.MethodPost, "/api/sessions/sensor%2F1/disconnect", "secret", "", http.StatusConflict},
+		{"Internal client cannot be disconnected", http.MethodPost, "/api/sessions/observer/disconnect", "secret", "", http.StatusConflict},
+		{"Session is deleted", http.MethodDelete, "/api/sessions/doomed", "secret", "", http.StatusNoContent},
+		{"Deleted session is not found", http.MethodGet, "/api/sessions/doomed", "secret", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := http.NewRequest(tt.method, server.URL+tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tt.token) > 0 {
+				request.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+			if response.StatusCode != tt.wantStatus {
+				t.Errorf("%s %s = %d, want %d", tt.method, tt.path, response.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+
+	t.Run("Published message reached the subscribed client", func(t *testing.T) {
+		cp, err := packets.ReadPacket(&sensor.Buffer)
+		if err != nil {
+			t.Fatalf("no message delivered: %v", err)
+		}
+		if publish, ok := cp.Content.(*packets.Publish); !ok || publish.Topic != "commands/reset" {
+			t.Error("published message was not delivered")
+		}
+	})
+
+	t.Run("Disconnected client was sent a DISCONNECT and kept its session", func(t *testing.T) {
+		cp, err := packets.ReadPacket(&sensor.Buffer)
+		if err != nil {
+			t.Fatalf("no DISCONNECT written: %v", err)
+		}
+		if disconnect, ok := cp.Content.(*packets.Disconnect); !ok || disconnect.ReasonCode != packets.DisconnectAdministrativeAction {
+			t.Error("client was not sent a DISCONNECT with reason code Administrative action")
+		}
+		if !sensor.closed {
+			t.Error("connection was not closed")
+		}
+
+		session, err := ctx.Session("sensor/1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if session.Connected || session.Username != "alice" {
+			t.Errorf("session is %+v", session)
+		}
+	})
+
+	t.Run("Sessions are described", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodGet, server.URL+"/api/sessions", nil)
+		request.Header.Set("Authorization", "Bearer secret")
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+
+		var sessions []*mqtt.SessionInfo
+		if err = json.NewDecoder(response.Body).Decode(&sessions); err != nil {
+			t.Fatal(err)
+		}
+		if len(sessions) != 2 || sessions[0].ClientID != "observer" || !sessions[0].Internal || sessions[1].ClientID != "sensor/1" {
+			t.Errorf("sessions are %+v", sessions)
+		}
+	})
+}
+
+func TestHandler_EmptyToken(t *testing.T) {
+	ctx, err := mqtt.NewServerContext(&config.Config{
+		Server: &config.Server{MaxQos: 2, Persistence: &config.Persistence{}},
+	}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// served directly, since the trailing space of the header would not survive a connection
+	request := httptest.NewRequest(http.MethodGet, "/api/sessions", nil)
+	request.Header.Set("Authorization", "Bearer ")
+	recorder := httptest.NewRecorder()
+	newHandler(ctx, []string{""}, zap.NewNop()).ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("empty token got %d, want %d", recorder.Code, http.StatusUnauthorized)
+	}
+
+	_, err = NewServer(&config.Config{
+		Server: &config.Server{Admin: &config.Admin{Address: "127.0.0.1:0", Tokens: []string{""}}},
+	}, ctx, zap.NewNop())
+	if err == nil {
+		t.Error("admin API was started with an empty token")
+	}
+}
@@ -0,0 +1,79 @@
+package admin
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/c16a/hermes/lib/config"
+	"github.com/c16a/hermes/lib/mqtt"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+)
+
+// Server serves the admin HTTP API on its own listener
+type Server struct {
+	listener   net.Listener
+	httpServer *http.Server
+	logger     *zap.Logger
+}
+
+// NewServer starts listening on the configured admin address.
+//
+// Requests are only served once Serve is called.
+func NewServer(serverConfig *config.Config, ctx *mqtt.ServerContext, logger *zap.Logger) (*Server, error) {
+	adminConfig := serverConfig.Server.Admin
+	if len(adminConfig.Tokens) == 0 {
+		return nil, errors.New("admin API needs at least one token")
+	}
+	for _, token := range adminConfig.Tokens {
+		if len(token) == 0 {
+			return nil, errors.New("admin API tokens must not be empty")
+		}
+	}
+
+	listener, err := net.Listen("tcp", adminConfig.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	if tlsConfigFromFile := adminConfig.Tls; tlsConfigFromFile != nil {
+		cert, err := tls.LoadX509KeyPair(tlsConfigFromFile.CertFile, tlsConfigFromFile.KeyFile)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		listener = tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{cert}})
+	}
+
+	return &Server{
+		listener:   listener,
+		httpServer: &http.Server{Handler: newHandler(ctx, adminConfig.Tokens, logger)},
+		logger:     logger,
+	}, nil
+}
+
+// Addr returns the address the server listens on
+func (server *Server) Addr() net.Addr {
+	return server.listener.Addr()
+}
+
+// Serve serves requests until the server is closed
+func (server *Server) Serve() {
+	server.logger.Info(fmt.Sprintf("Starting admin API on %s", server.listener.Addr()))
+
+	if err := server.httpServer.Serve(server.listener); err != nil && err != http.ErrServerClosed {
+		server.logger.Error("admin API failed", zap.Error(err))
+	}
+}
+
+// Close stops accepting connections, and leaves requests in progress alone
+func (server *Server) Close() error {
+	return server.listener.Close()
+}
+
+// Shutdown stops accepting connections, and waits for requests in progress until the context is done
+func (server *Server) Shutdown(ctx context.Context) error {
+	return server.httpServer.Shutdown(ctx)
+}
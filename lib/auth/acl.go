@@ -0,0 +1,238 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/c16a/hermes/lib/config"
+	"io/ioutil"
+	"strings"
+)
+
+// Action is what a client does on a topic
+type Action string
+
+const (
+	ActionPublish   Action = "publish"
+	ActionSubscribe Action = "subscribe"
+)
+
+// Acl decides where clients may publish and subscribe.
+//
+// A client is denied if any deny rule which applies to it touches the topic, and allowed if
+// an allow rule which applies to it covers the topic. If no rule matches, the default permission applies.
+type Acl struct {
+	rules        []*aclRule
+	groups       map[string][]string
+	defaultAllow bool
+}
+
+type aclRule struct {
+	user   string
+	group  string
+	action Action
+	levels []string
+	allow  bool
+}
+
+// FetchAclFromConfig loads the ACL in the configuration, or returns nil if there is none
+func FetchAclFromConfig(serverConfig *config.Config) (*Acl, error) {
+	aclConfig := serverConfig.Server.Acl
+	if aclConfig == nil {
+		return nil, nil
+	}
+	return LoadAcl(aclConfig)
+}
+
+// LoadAcl creates an ACL from its rules, which may be kept in a file
+func LoadAcl(aclConfig *config.Acl) (*Acl, error) {
+	if len(aclConfig.File) > 0 {
+		fileBytes, err := ioutil.ReadFile(aclConfig.File)
+		if err != nil {
+			return nil, err
+		}
+		var fileConfig config.Acl
+		if err := json.Unmarshal(fileBytes, &fileConfig); err != nil {
+			return nil, fmt.Errorf("invalid ACL file %s: %w", aclConfig.File, err)
+		}
+		fileConfig.File = ""
+		if len(fileConfig.Default) == 0 {
+			fileConfig.Default = aclConfig.Default
+		}
+		aclConfig = &fileConfig
+	}
+	return NewAcl(aclConfig)
+}
+
+// NewAcl creates an ACL from its rules
+func NewAcl(aclConfig *config.Acl) (*Acl, error) {
+	acl := &Acl{groups: make(map[string][]string)}
+
+	switch aclConfig.Default {
+	case "", "deny":
+	case "allow":
+		acl.defaultAllow = true
+	default:
+		return nil, fmt.Errorf("invalid default ACL permission: %s", aclConfig.Default)
+	}
+
+	for group, usernames := range aclConfig.Groups {
+		for _, username := range usernames {
+			acl.groups[username] = append(acl.groups[username], group)
+		}
+	}
+
+	for index, ruleConfig := range aclConfig.Rules {
+		rule := &aclRule{
+			user:   ruleConfig.User,
+			group:  ruleConfig.Group,
+			action: Action(ruleConfig.Action),
+			levels: strings.Split(ruleConfig.Topic, "/"),
+		}
+		switch rule.action {
+		case "", ActionPublish, ActionSubscribe:
+		default:
+			return nil, fmt.Errorf("ACL rule %d has invalid action: %s", index, ruleConfig.Action)
+		}
+		switch ruleConfig.Permission {
+		case "allow":
+			rule.allow = true
+		case "deny":
+		default:
+			return nil, fmt.Errorf("ACL rule %d has invalid permission: %s", index, ruleConfig.Permission)
+		}
+		if len(ruleConfig.Topic) == 0 {
+			return nil, fmt.Errorf("ACL rule %d has no topic", index)
+		}
+		acl.rules = append(acl.rules, rule)
+	}
+	return acl, nil
+}
+
+// Allowed checks if a client may publish to a topic, or subscribe to a topic filter.
+//
+// Shared subscriptions are checked against the topic filter they share.
+func (acl *Acl) Allowed(username string, clientID string, action Action, topic string) bool {
+	return acl.AllowedInGroups(username, clientID, nil, action, topic)
+}
+
+// AllowedInGroups checks if a client, which is a member of groups on top of those the ACL puts it in,
+// may publish to a topic, or subscribe to a topic filter
+func (acl *Acl) AllowedInGroups(username string, clientID string, groups []string, action Action, topic string) bool {
+	levels := topicLevels(action, topic)
+	if len(groups) > 0 {
+		groups = append(groups[:len(groups):len(groups)], acl.groups[username]...)
+	} else {
+		groups = acl.groups[username]
+	}
+
+	allowed := false
+	for _, rule := range acl.rules {
+		if !rule.appliesTo(username, action, groups) {
+			continue
+		}
+		ruleLevels, ok := rule.expand(username, clientID)
+		if rule.allow {
+			// a username or client ID which looks like a wildcard must not widen a rule
+			allowed = allowed || ok && covers(ruleLevels, levels)
+		} else if !ok || overlaps(ruleLevels, levels) {
+			return false
+		}
+	}
+	return allowed || acl.defaultAllow
+}
+
+// topicLevels splits a topic into its levels. Shared subscriptions are split into the levels of the topic filter they share.
+func topicLevels(action Action, topic string) []string {
+	levels := strings.Split(topic, "/")
+	if action == ActionSubscribe && len(levels) >= 3 && strings.EqualFold(levels[0], "$share") {
+		return levels[2:]
+	}
+	return levels
+}
+
+func (rule *aclRule) appliesTo(username string, action Action, groups []string) bool {
+	if len(rule.action) > 0 && rule.action != action {
+		return false
+	}
+	if len(rule.user) > 0 && rule.user != "*" && rule.user != username {
+		return false
+	}
+	if len(rule.group) > 0 {
+		for _, group := range groups {
+			if group == rule.group {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// expand replaces the placeholders in the topic of the rule.
+// It fails if a replacement would change the structure of the topic.
+func (rule *aclRule) expand(username string, clientID string) ([]string, bool) {
+	levels := make([]string, len(rule.levels))
+	ok := true
+	for index, level := range rule.levels {
+		if strings.Contains(level, "%u") {
+			level = strings.ReplaceAll(level, "%u", username)
+			ok = ok && len(username) > 0 && !strings.ContainsAny(username, "/+#")
+		}
+		if strings.Contains(level, "%c") {
+			level = strings.ReplaceAll(level, "%c", clientID)
+			ok = ok && len(clientID) > 0 && !strings.ContainsAny(clientID, "/+#")
+		}
+		levels[index] = level
+	}
+	return levels, ok
+}
+
+// covers checks if every topic matched by a topic filter is also matched by the pattern
+func covers(pattern []string, filter []string) bool {
+	if isWildcard(pattern[0]) && strings.HasPrefix(filter[0], "$") {
+		return false
+	}
+	for index, level := range pattern {
+		if level == "#" {
+			return true
+		}
+		if index >= len(filter) {
+			return false
+		}
+		if level == "+" {
+			if filter[index] == "#" {
+				return false
+			}
+			continue
+		}
+		if isWildcard(filter[index]) || !strings.EqualFold(level, filter[index]) {
+			return false
+		}
+	}
+	return len(pattern) == len(filter)
+}
+
+// overlaps checks if any topic is matched by both the pattern and a topic filter
+func overlaps(pattern []string, filter []string) bool {
+	if isWildcard(pattern[0]) && strings.HasPrefix(filter[0], "$") || isWildcard(filter[0]) && strings.HasPrefix(pattern[0], "$") {
+		return false
+	}
+	for index := 0; ; index++ {
+		if index < len(pattern) && pattern[index] == "#" || index < len(filter) && filter[index] == "#" {
+			return true
+		}
+		if index >= len(pattern) || index >= len(filter) {
+			return len(pattern) == len(filter)
+		}
+		if isWildcard(pattern[index]) || isWildcard(filter[index]) {
+			continue
+		}
+		if !strings.EqualFold(pattern[index], filter[index]) {
+			return false
+		}
+	}
+}
+
+func isWildcard(level string) bool {
+	return level == "+" || level == "#"
+}
@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"github.com/c16a/hermes/lib/config"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestAcl_Allowed(t *testing.T) {
+	acl, err := NewAcl(&config.Acl{
+		Groups: map[string][]string{
+			"operators": {"alice"},
+		},
+		Rules: []*config.AclRule{
+			{Topic: "devices/%c/#", Permission: "allow"},
+			{Topic: "users/%u/inbox", Action: "subscribe", Permission: "allow"},
+			{User: "*", Topic: "users/+/inbox", Action: "publish", Permission: "allow"},
+			{Group: "operators", Topic: "devices/#", Permission: "allow"},
+			{Group: "operators", Topic: "devices/+/secrets/#", Permission: "deny"},
+			{User: "bob", Topic: "#", Action: "subscribe", Permission: "allow"},
+			{User: "bob", Topic: "billing/#", Permission: "deny"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		clientID string
+		action   Action
+		topic    string
+		want     bool
+	}{
+		{"Client publishes under its own ID", "carol", "sensor1", ActionPublish, "devices/sensor1/temp", true},
+		{"Client publishes under another ID", "carol", "sensor1", ActionPublish, "devices/sensor2/temp", false},
+		{"Client subscribes to its own inbox", "carol", "sensor1", ActionSubscribe, "users/carol/inbox", true},
+		{"Client subscribes to another inbox", "carol", "sensor1", ActionSubscribe, "users/dave/inbox", false},
+		{"Client subscribes to all inboxes", "carol", "sensor1", ActionSubscribe, "users/+/inbox", false},
+		{"Client publishes to another inbox", "carol", "sensor1", ActionPublish, "users/dave/inbox", true},
+		{"Wildcard in client ID does not widen a rule", "carol", "+", ActionSubscribe, "devices/+/temp", false},
+		{"Group member subscribes", "alice", "console", ActionSubscribe, "devices/+/temp", true},
+		{"Group member is denied", "alice", "console", ActionPublish, "devices/sensor1/secrets/key", false},
+		{"Group deny overlaps a subscription", "alice", "console", ActionSubscribe, "devices/#", false},
+		{"Shared subscription is checked against its filter", "alice", "console", ActionSubscribe, "$share/ops/devices/+/temp", true},
+		{"User subscribes to everything except a denied topic", "bob", "bob", ActionSubscribe, "#", false},
+		{"User subscribes", "bob", "bob", ActionSubscribe, "weather/today", true},
+		{"User wildcard does not match $ topics", "bob", "bob", ActionSubscribe, "$SYS/broker/uptime", false},
+		{"No rule matches", "carol", "sensor1", ActionPublish, "weather/today", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := acl.Allowed(tt.username, tt.clientID, tt.action, tt.topic); got != tt.want {
+				t.Errorf("Allowed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchAclFromConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acl.json")
+	err := ioutil.WriteFile(path, []byte(`{"rules": [{"user": "alice", "topic": "alice/#", "permission": "deny"}]}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acl, err := FetchAclFromConfig(&config.Config{
+		Server: &config.Server{Acl: &config.Acl{File: path, Default: "allow"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acl.Allowed("alice", "abcd", ActionPublish, "alice/foo") {
+		t.Error("rule from file was not applied")
+	}
+	if !acl.Allowed("alice", "abcd", ActionPublish, "foo") {
+		t.Error("default permission was not applied")
+	}
+
+	if _, err := NewAcl(&config.Acl{Rules: []*config.AclRule{{Topic: "#", Permission: "maybe"}}}); err == nil {
+		t.Error("NewAcl() accepted an invalid permission")
+	}
+}
+
+func TestAcl_AllowedInGroups(t *testing.T) {
+	acl, err := NewAcl(&config.Acl{
+		Groups: map[string][]string{"operators": {"alice"}},
+		Rules: []*config.AclRule{
+			{Group: "operators", Topic: "devices/#", Permission: "allow"},
+			{Group: "auditors", Topic: "audit/#", Permission: "allow"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !acl.AllowedInGroups("alice", "abcd", []string{"auditors"}, ActionSubscribe, "audit/#") {
+		t.Error("group of the identity was not applied")
+	}
+	if !acl.AllowedInGroups("alice", "abcd", []string{"auditors"}, ActionSubscribe, "devices/#") {
+		t.Error("group of the ACL was not applied alongside the groups of the identity")
+	}
+	if acl.AllowedInGroups("bob", "abcd", []string{"auditors"}, ActionSubscribe, "devices/#") {
+		t.Error("group of another user was applied")
+	}
+}
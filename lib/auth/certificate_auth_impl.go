@@ -0,0 +1,64 @@
+package auth
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+var errNoCertificate = errors.New("no client certificate presented")
+
+// CertificateAuthImpl identifies clients by their TLS client certificate, and ignores passwords.
+//
+// Certificates are verified against the client CA when the connection is set up,
+// so any certificate which reaches the provider is trusted.
+type CertificateAuthImpl struct {
+	usernameField string
+}
+
+func NewCertificateAuthImpl(usernameField string) (*CertificateAuthImpl, error) {
+	switch usernameField {
+	case "":
+		usernameField = "cn"
+	case "cn", "san_dns", "san_email", "san_uri":
+	default:
+		return nil, fmt.Errorf("invalid certificate username: %s", usernameField)
+	}
+	return &CertificateAuthImpl{usernameField: usernameField}, nil
+}
+
+// Validate always fails, since a password alone cannot identify a client
+func (impl *CertificateAuthImpl) Validate(string, string) error {
+	return errNoCertificate
+}
+
+func (impl *CertificateAuthImpl) Authenticate(credentials *Credentials) (*Identity, error) {
+	if credentials.Certificate == nil {
+		return nil, errNoCertificate
+	}
+	username := certificateUsername(credentials.Certificate, impl.usernameField)
+	if len(username) == 0 {
+		return nil, fmt.Errorf("client certificate has no %s", impl.usernameField)
+	}
+	return &Identity{Username: username}, nil
+}
+
+func certificateUsername(cert *x509.Certificate, field string) string {
+	switch field {
+	case "san_dns":
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	case "san_email":
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	case "san_uri":
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+	default:
+		return cert.Subject.CommonName
+	}
+	return ""
+}
@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/url"
+	"testing"
+)
+
+func TestCertificateAuthImpl_Authenticate(t *testing.T) {
+	deviceURI, _ := url.Parse("spiffe://example.com/device-1")
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "device-1"},
+		DNSNames:       []string{"device-1.example.com"},
+		EmailAddresses: []string{"device-1@example.com"},
+		URIs:           []*url.URL{deviceURI},
+	}
+
+	tests := []struct {
+		usernameField string
+		certificate   *x509.Certificate
+		want          string
+		wantErr       bool
+	}{
+		{"", cert, "device-1", false},
+		{"san_dns", cert, "device-1.example.com", false},
+		{"san_email", cert, "device-1@example.com", false},
+		{"san_uri", cert, "spiffe://example.com/device-1", false},
+		{"san_dns", &x509.Certificate{Subject: pkix.Name{CommonName: "device-1"}}, "", true},
+		{"cn", nil, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.usernameField, func(t *testing.T) {
+			impl, err := NewCertificateAuthImpl(tt.usernameField)
+			if err != nil {
+				t.Fatal(err)
+			}
+			identity, err := impl.Authenticate(&Credentials{Username: "ignored", Password: "ignored", Certificate: tt.certificate})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Authenticate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && identity.Username != tt.want {
+				t.Errorf("Authenticate() username = %s, want %s", identity.Username, tt.want)
+			}
+		})
+	}
+
+	if _, err := NewCertificateAuthImpl("serial"); err == nil {
+		t.Error("NewCertificateAuthImpl() accepted an unknown field")
+	}
+}
@@ -0,0 +1,143 @@
+package auth
+
+import (
+	"errors"
+	"io"
+	"strings"
+)
+
+// Chain authenticates clients with several providers in order.
+//
+// Unless every provider must accept a client, the first provider which accepts it identifies it, and alone authorizes its topics.
+// Otherwise, the first provider identifies it, and the topic filters and groups other providers give it apply too.
+type Chain struct {
+	providers  []AuthorisationProvider
+	requireAll bool
+}
+
+func NewChain(providers []AuthorisationProvider, requireAll bool) *Chain {
+	return &Chain{providers: providers, requireAll: requireAll}
+}
+
+func (chain *Chain) Validate(username string, password string) error {
+	_, err := chain.Authenticate(&Credentials{Username: username, Password: password})
+	return err
+}
+
+func (chain *Chain) Authenticate(credentials *Credentials) (*Identity, error) {
+	if chain.requireAll {
+		return chain.authenticateAll(credentials)
+	}
+
+	var messages []string
+	var lastErr error
+	for _, provider := range chain.providers {
+		identity, err := Authenticate(provider, credentials)
+		if err == nil {
+			// a provider nested in this one may have been recorded already
+			if identity.provider == nil {
+				identity.provider = provider
+			}
+			return identity, nil
+		}
+		messages = append(messages, err.Error())
+		lastErr = err
+	}
+	err := errors.New("no auth provider accepted the client: " + strings.Join(messages, "; "))
+	// the last provider had the final say
+	var rejected *RejectedError
+	if errors.As(lastErr, &rejected) {
+		err = &RejectedError{Provider: rejected.Provider, Err: err}
+	}
+	return nil, err
+}
+
+func (chain *Chain) authenticateAll(credentials *Credentials) (*Identity, error) {
+	var identity *Identity
+	for _, provider := range chain.providers {
+		other, err := Authenticate(provider, credentials)
+		if err != nil {
+			return nil, err
+		}
+		if identity == nil {
+			identity = other
+			continue
+		}
+
+		identity.others = append(identity.others, other)
+		identity.Groups = append(identity.Groups, other.Groups...)
+		if !other.ExpiresAt.IsZero() && (identity.ExpiresAt.IsZero() || other.ExpiresAt.Before(identity.ExpiresAt)) {
+			identity.ExpiresAt = other.ExpiresAt
+		}
+	}
+	if identity == nil {
+		return nil, errors.New("no auth providers in chain")
+	}
+	return identity, nil
+}
+
+// Authorize lets a client publish or subscribe on a topic if every provider which authorizes topics lets it.
+// It is only asked for clients which every provider accepted, since the provider which accepted
+// a client is asked directly otherwise.
+func (chain *Chain) Authorize(clientID string, username string, action Action, topic string) bool {
+	for _, provider := range chain.providers {
+		if authorizer, ok := provider.(TopicAuthorizer); ok && !authorizer.Authorize(clientID, username, action, topic) {
+			return false
+		}
+	}
+	return true
+}
+
+// Close closes the providers of the chain
+func (chain *Chain) Close() error {
+	var err error
+	for _, provider := range chain.providers {
+		if closer, ok := provider.(io.Closer); ok {
+			if closeErr := closer.Close(); closeErr != nil {
+				err = closeErr
+			}
+		}
+	}
+	return err
+}
+
+// AnonymousProvider lets clients without credentials in, and passes other clients on to a provider, if there is one
+type AnonymousProvider struct {
+	provider AuthorisationProvider
+	username string
+	acl      *Acl
+}
+
+// NewAnonymousProvider lets anonymous clients in with a username and an ACL which applies to them instead of the one of the broker
+func NewAnonymousProvider(provider AuthorisationProvider, username string, acl *Acl) *AnonymousProvider {
+	return &AnonymousProvider{provider: provider, username: username, acl: acl}
+}
+
+func (impl *AnonymousProvider) Validate(username string, password string) error {
+	_, err := impl.Authenticate(&Credentials{Username: username, Password: password})
+	return err
+}
+
+func (impl *AnonymousProvider) Authenticate(credentials *Credentials) (*Identity, error) {
+	if len(credentials.Username) == 0 && len(credentials.Password) == 0 && credentials.Certificate == nil {
+		return &Identity{Username: impl.username, Acl: impl.acl}, nil
+	}
+	if impl.provider == nil {
+		return nil, errors.New("only anonymous clients are allowed")
+	}
+	return Authenticate(impl.provider, credentials)
+}
+
+func (impl *AnonymousProvider) Authorize(clientID string, username string, action Action, topic string) bool {
+	if authorizer, ok := impl.provider.(TopicAuthorizer); ok {
+		return authorizer.Authorize(clientID, username, action, topic)
+	}
+	return true
+}
+
+func (impl *AnonymousProvider) Close() error {
+	if closer, ok := impl.provider.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
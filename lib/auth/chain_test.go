@@ -0,0 +1,194 @@
+package auth
+
+import (
+	"errors"
+	"github.com/c16a/hermes/lib/config"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// staticProvider accepts one password, and gives the clients it accepts an identity
+type staticProvider struct {
+	password string
+	identity Identity
+	topics   map[string]bool
+}
+
+func (p *staticProvider) Validate(string, string) error {
+	return nil
+}
+
+func (p *staticProvider) Authenticate(credentials *Credentials) (*Identity, error) {
+	if credentials.Password != p.password {
+		return nil, errors.New("invalid password")
+	}
+	identity := p.identity
+	identity.Username = credentials.Username
+	return &identity, nil
+}
+
+func (p *staticProvider) Authorize(_ string, _ string, _ Action, topic string) bool {
+	return p.topics == nil || p.topics[topic]
+}
+
+func TestChain_Authenticate(t *testing.T) {
+	soon, later := time.Now().Add(time.Minute), time.Now().Add(time.Hour)
+	first := &staticProvider{password: "secret", identity: Identity{Groups: []string{"operators"}, ExpiresAt: later}}
+	second := &staticProvider{
+		password: "secret",
+		identity: Identity{Groups: []string{"auditors"}, Publish: []string{"devices/#"}, ExpiresAt: soon},
+		topics:   map[string]bool{"devices/a": true},
+	}
+	third := &staticProvider{password: "other"}
+
+	firstChain := NewChain([]AuthorisationProvider{third, first}, false)
+	if _, err := firstChain.Authenticate(&Credentials{Username: "alice", Password: "other"}); err != nil {
+		t.Errorf("first provider did not let the client in: %v", err)
+	}
+	if _, err := firstChain.Authenticate(&Credentials{Username: "alice", Password: "secret"}); err != nil {
+		t.Errorf("second provider did not let the client in: %v", err)
+	}
+	if _, err := firstChain.Authenticate(&Credentials{Username: "alice", Password: "wrong"}); err == nil {
+		t.Error("client which no provider accepts was let in")
+	}
+
+	// only the provider which accepted a client authorizes its topics
+	restricting := &staticProvider{password: "other", topics: map[string]bool{"devices/a": true}}
+	restrictingChain := NewChain([]AuthorisationProvider{restricting, first}, false)
+	identity, err := restrictingChain.Authenticate(&Credentials{Username: "alice", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !Authorize(restrictingChain, identity, "c1", "alice", ActionPublish, "chat/general") {
+		t.Error("provider which refused the client restricted its topics")
+	}
+	if identity, err = restrictingChain.Authenticate(&Credentials{Username: "alice", Password: "other"}); err != nil {
+		t.Fatal(err)
+	}
+	if Authorize(restrictingChain, identity, "c1", "alice", ActionPublish, "chat/general") {
+		t.Error("provider which accepted the client did not restrict its topics")
+	}
+
+	allChain := NewChain([]AuthorisationProvider{first, second}, true)
+	identity, err = allChain.Authenticate(&Credentials{Username: "alice", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(identity.Groups, []string{"operators", "auditors"}) {
+		t.Errorf("identity has groups %v, want those of all providers", identity.Groups)
+	}
+	if !identity.ExpiresAt.Equal(soon) {
+		t.Errorf("identity expires at %s, want the earliest expiry %s", identity.ExpiresAt, soon)
+	}
+	if identity.Allowed(ActionPublish, "chat/general") {
+		t.Error("topic filters of the second provider were not applied")
+	}
+	if !identity.Allowed(ActionPublish, "devices/a") {
+		t.Error("topic within the filters of all providers was denied")
+	}
+	if !allChain.Authorize("c1", "alice", ActionPublish, "devices/a") || allChain.Authorize("c1", "alice", ActionPublish, "devices/b") {
+		t.Error("Authorize() did not ask the providers which authorize topics")
+	}
+
+	if _, err := NewChain([]AuthorisationProvider{first, &staticProvider{password: "other"}}, true).Authenticate(&Credentials{Password: "secret"}); err == nil {
+		t.Error("client was let in although a provider refused it")
+	}
+}
+
+func TestAnonymousProvider_Authenticate(t *testing.T) {
+	acl, err := NewAcl(&config.Acl{Rules: []*config.AclRule{{Topic: "public/#", Permission: "allow"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider := NewAnonymousProvider(&staticProvider{password: "secret"}, "guest", acl)
+	identity, err := provider.Authenticate(&Credentials{ClientID: "c1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Username != "guest" || identity.Acl != acl {
+		t.Errorf("anonymous identity = %+v, want guest with the anonymous ACL", identity)
+	}
+	if _, err := provider.Authenticate(&Credentials{Username: "alice", Password: "wrong"}); err == nil {
+		t.Error("client with invalid credentials was let in")
+	}
+	if identity, err := provider.Authenticate(&Credentials{Username: "alice", Password: "secret"}); err != nil || identity.Acl != nil {
+		t.Errorf("client with valid credentials got %+v, %v", identity, err)
+	}
+
+	anonymousOnly := NewAnonymousProvider(nil, "", nil)
+	if _, err := anonymousOnly.Authenticate(&Credentials{Username: "alice", Password: "secret"}); err == nil {
+		t.Error("client with credentials was let in although only anonymous clients are allowed")
+	}
+}
+
+func TestDecidedBy(t *testing.T) {
+	certificate, err := NewCertificateAuthImpl("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := NewAnonymousProvider(NewChain([]AuthorisationProvider{&staticProvider{password: "secret"}, certificate}, false), "guest", nil)
+
+	tests := []struct {
+		name        string
+		credentials *Credentials
+		want        string
+	}{
+		{"Accepted anonymously", &Credentials{}, "anonymous"},
+		{"Accepted by a provider of the chain", &Credentials{Username: "alice", Password: "secret"}, "custom"},
+		{"Rejected by the last provider of the chain", &Credentials{Username: "alice", Password: "wrong"}, "certificate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := Authenticate(chain, tt.credentials)
+			if got := DecidedBy(identity, err); got != tt.want {
+				t.Errorf("DecidedBy() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchProvidersFromConfig(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "passwords")
+	if err := ioutil.WriteFile(passwordFile, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	provider, listenerProviders, err := FetchProvidersFromConfig(&config.Config{Server: &config.Server{Auth: &config.Auth{
+		Providers:    []string{"file", "jwt"},
+		PasswordFile: passwordFile,
+		Jwt:          &config.Jwt{Secrets: []string{"secret"}},
+		Listeners: map[string]*config.ListenerAuth{
+			"websocket": {},
+			"internal":  {Providers: []string{"file"}, Anonymous: &config.Anonymous{}},
+		},
+	}}}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, ok := provider.(*Chain)
+	if !ok || len(chain.providers) != 2 {
+		t.Fatalf("default provider = %T, want a chain of two providers", provider)
+	}
+	defer chain.Close()
+	if listenerProviders["websocket"] != nil {
+		t.Errorf("open listener has provider %T", listenerProviders["websocket"])
+	}
+	anonymous, ok := listenerProviders["internal"].(*AnonymousProvider)
+	if !ok || anonymous.provider != chain.providers[0] {
+		t.Error("listeners do not share the provider of an auth type")
+	}
+
+	_, _, err = FetchProvidersFromConfig(&config.Config{Server: &config.Server{Auth: &config.Auth{
+		Providers: []string{"jwt"},
+		Mode:      "some",
+		Jwt:       &config.Jwt{Secrets: []string{"secret"}},
+	}}}, zap.NewNop())
+	if err == nil {
+		t.Error("invalid auth mode was accepted")
+	}
+}
@@ -0,0 +1,285 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// passwordFileCheckInterval is how often the password file is checked for changes
+const passwordFileCheckInterval = 2 * time.Second
+
+// FileAuthImpl validates passwords against the bcrypt or argon2id hashes in a password file.
+//
+// Every line of the file is a username and a hash, separated by a colon. Empty lines and lines starting
+// with # are ignored. The file is read again whenever it changes.
+type FileAuthImpl struct {
+	path   string
+	logger *zap.Logger
+
+	mu      sync.RWMutex
+	users   map[string]string
+	modTime time.Time
+	size    int64
+
+	// dummyHash is compared against for unknown users, so that they take as long to reject as a wrong password,
+	// and do not reveal which users exist
+	dummyHash string
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewFileAuthImpl reads a password file, and keeps watching it for changes until it is closed
+func NewFileAuthImpl(path string, logger *zap.Logger) (*FileAuthImpl, error) {
+	if len(path) == 0 {
+		return nil, errors.New("no password file configured")
+	}
+
+	impl := &FileAuthImpl{
+		path:   path,
+		logger: logger,
+		done:   make(chan struct{}),
+	}
+	if err := impl.reload(); err != nil {
+		return nil, err
+	}
+
+	go impl.watch()
+	return impl, nil
+}
+
+func (impl *FileAuthImpl) Validate(username string, password string) error {
+	impl.mu.RLock()
+	hash, ok := impl.users[username]
+	dummyHash := impl.dummyHash
+	impl.mu.RUnlock()
+
+	if !ok {
+		if len(dummyHash) > 0 {
+			_ = comparePassword(dummyHash, password)
+		}
+		return errInvalidCredentials
+	}
+	return comparePassword(hash, password)
+}
+
+// Close stops watching the password file
+func (impl *FileAuthImpl) Close() error {
+	impl.closeOnce.Do(func() {
+		close(impl.done)
+	})
+	return nil
+}
+
+func (impl *FileAuthImpl) watch() {
+	ticker := time.NewTicker(passwordFileCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			info, err := os.Stat(impl.path)
+			if err != nil {
+				impl.logger.Error("failed to check password file", zap.Error(err))
+				continue
+			}
+			impl.mu.RLock()
+			changed := !info.ModTime().Equal(impl.modTime) || info.Size() != impl.size
+			impl.mu.RUnlock()
+			if !changed {
+				continue
+			}
+			// users keep the previous passwords if the file cannot be read
+			if err := impl.reload(); err != nil {
+				impl.logger.Error("failed to reload password file", zap.Error(err))
+			} else {
+				impl.logger.Info(fmt.Sprintf("Reloaded password file %s", impl.path))
+			}
+		case <-impl.done:
+			return
+		}
+	}
+}
+
+func (impl *FileAuthImpl) reload() error {
+	info, err := os.Stat(impl.path)
+	if err != nil {
+		return err
+	}
+	fileBytes, err := ioutil.ReadFile(impl.path)
+	if err != nil {
+		return err
+	}
+	users, err := parsePasswordFile(fileBytes)
+	if err != nil {
+		return fmt.Errorf("invalid password file %s: %w", impl.path, err)
+	}
+	dummyHash, err := newDummyHash(users)
+	if err != nil {
+		return err
+	}
+
+	impl.mu.Lock()
+	impl.users = users
+	impl.dummyHash = dummyHash
+	impl.modTime = info.ModTime()
+	impl.size = info.Size()
+	impl.mu.Unlock()
+	return nil
+}
+
+// newDummyHash hashes a random password with the algorithm used for most users, or returns an empty hash if there are none
+func newDummyHash(users map[string]string) (string, error) {
+	counts := make(map[string]int, 0)
+	for _, hash := range users {
+		counts[hashAlgorithm(hash)]++
+	}
+	if len(counts) == 0 {
+		return "", nil
+	}
+	algorithm := HashBcrypt
+	if counts[HashArgon2id] > counts[HashBcrypt] {
+		algorithm = HashArgon2id
+	}
+
+	password := make([]byte, 16)
+	if _, err := rand.Read(password); err != nil {
+		return "", err
+	}
+	return HashPassword(string(password), algorithm)
+}
+
+func parsePasswordFile(fileBytes []byte) (map[string]string, error) {
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(fileBytes))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, hash, ok := cutColon(line)
+		if !ok || len(username) == 0 || len(hash) == 0 {
+			return nil, fmt.Errorf("line %d is not of the form username:hash", lineNumber)
+		}
+		users[username] = hash
+	}
+	return users, scanner.Err()
+}
+
+// AddUser adds a user to a password file, or changes the password of an existing user.
+// The file is created if it does not exist.
+func AddUser(path string, username string, password string, algorithm string) error {
+	if len(username) == 0 || strings.ContainsAny(username, ":\r\n") {
+		return fmt.Errorf("invalid username: %q", username)
+	}
+	hash, err := HashPassword(password, algorithm)
+	if err != nil {
+		return err
+	}
+
+	lines, err := readPasswordFileLines(path)
+	if err != nil {
+		return err
+	}
+	entry := username + ":" + hash
+	replaced := false
+	for index, line := range lines {
+		if lineUsername(line) == username {
+			lines[index] = entry
+			replaced = true
+		}
+	}
+	if !replaced {
+		lines = append(lines, entry)
+	}
+	return writePasswordFileLines(path, lines)
+}
+
+// RemoveUser removes a user from a password file
+func RemoveUser(path string, username string) error {
+	lines, err := readPasswordFileLines(path)
+	if err != nil {
+		return err
+	}
+	var kept []string
+	for _, line := range lines {
+		if lineUsername(line) != username {
+			kept = append(kept, line)
+		}
+	}
+	if len(kept) == len(lines) {
+		return fmt.Errorf("no user %s in %s", username, path)
+	}
+	return writePasswordFileLines(path, kept)
+}
+
+func readPasswordFileLines(path string) ([]string, error) {
+	fileBytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimRight(string(fileBytes), "\n"), "\n")
+	if len(lines) == 1 && len(lines[0]) == 0 {
+		return nil, nil
+	}
+	return lines, nil
+}
+
+// writePasswordFileLines replaces a password file, so that it is never read half written
+func writePasswordFileLines(path string, lines []string) error {
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if info, err := os.Stat(path); err == nil {
+		if err := file.Chmod(info.Mode()); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	var content bytes.Buffer
+	for _, line := range lines {
+		content.WriteString(line)
+		content.WriteByte('\n')
+	}
+	if _, err := file.Write(content.Bytes()); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+func lineUsername(line string) string {
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "#") {
+		return ""
+	}
+	username, _, _ := cutColon(line)
+	return username
+}
+
+func cutColon(line string) (string, string, bool) {
+	index := strings.IndexByte(line, ':')
+	if index < 0 {
+		return line, "", false
+	}
+	return line[:index], line[index+1:], true
+}
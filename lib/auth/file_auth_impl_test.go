@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"go.uber.org/zap"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileAuthImpl_Validate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "passwords")
+	if err := AddUser(path, "alice", "wonderland", HashBcrypt); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddUser(path, "bob", "builder", HashArgon2id); err != nil {
+		t.Fatal(err)
+	}
+
+	impl, err := NewFileAuthImpl(path, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer impl.Close()
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		wantErr  bool
+	}{
+		{"bcrypt password is valid", "alice", "wonderland", false},
+		{"bcrypt password is invalid", "alice", "builder", true},
+		{"argon2id password is valid", "bob", "builder", false},
+		{"argon2id password is invalid", "bob", "wonderland", true},
+		{"Unknown user", "carol", "wonderland", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := impl.Validate(tt.username, tt.password); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("Changes are reloaded", func(t *testing.T) {
+		if err := AddUser(path, "alice", "looking-glass", HashBcrypt); err != nil {
+			t.Fatal(err)
+		}
+		if err := RemoveUser(path, "bob"); err != nil {
+			t.Fatal(err)
+		}
+		if err := impl.reload(); err != nil {
+			t.Fatal(err)
+		}
+		if err := impl.Validate("alice", "looking-glass"); err != nil {
+			t.Errorf("changed password is invalid: %v", err)
+		}
+		if err := impl.Validate("bob", "builder"); err == nil {
+			t.Error("removed user is still valid")
+		}
+	})
+}
+
+func TestNewDummyHash(t *testing.T) {
+	if hash, err := newDummyHash(nil); err != nil || len(hash) > 0 {
+		t.Errorf("newDummyHash() = %q, %v without users", hash, err)
+	}
+
+	argon2Hash, err := HashPassword("builder", HashArgon2id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := newDummyHash(map[string]string{"bob": argon2Hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// unknown users cost as much as users with the algorithm of most users
+	if hashAlgorithm(hash) != HashArgon2id {
+		t.Errorf("dummy hash %s does not use argon2id", hash)
+	}
+	if err = comparePassword(hash, ""); err == nil {
+		t.Error("dummy hash matches an empty password")
+	}
+}
+
+func TestParsePasswordFile(t *testing.T) {
+	users, err := parsePasswordFile([]byte("# users\n\nalice:$2a$10$hash\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users["alice"] != "$2a$10$hash" {
+		t.Errorf("parsePasswordFile() = %v", users)
+	}
+
+	if _, err := parsePasswordFile([]byte("alice\n")); err == nil {
+		t.Error("parsePasswordFile() accepted a line without a hash")
+	}
+}
@@ -0,0 +1,197 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/c16a/hermes/lib/config"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHttpAuthTimeout = 5 * time.Second
+
+	// maxCachedResults bounds the cache, which is swept for expired results once it grows beyond it
+	maxCachedResults = 10000
+)
+
+var errDenied = errors.New("denied by auth endpoint")
+
+// HttpAuthImpl asks a webhook whether clients may connect, and optionally whether they may publish or subscribe.
+//
+// Requests are POSTed as JSON. A 2xx response allows the client, and a 4xx response denies it.
+// Anything else, including a timeout, is a failure, which allows or denies the client according to the failure policy.
+type HttpAuthImpl struct {
+	config   *config.HttpAuth
+	client   *http.Client
+	failOpen bool
+	cacheTtl time.Duration
+	logger   *zap.Logger
+	cacheMu  sync.Mutex
+	cache    map[[sha256.Size]byte]cachedResult
+}
+
+type cachedResult struct {
+	allowed   bool
+	expiresAt time.Time
+}
+
+// httpAuthRequest is the body of a request to the endpoint
+type httpAuthRequest struct {
+	Action        string `json:"action"`
+	ClientID      string `json:"client_id"`
+	Username      string `json:"username"`
+	Password      string `json:"password,omitempty"`
+	RemoteAddress string `json:"remote_address,omitempty"`
+	Listener      string `json:"listener,omitempty"`
+	Topic         string `json:"topic,omitempty"`
+}
+
+func NewHttpAuthImpl(httpConfig *config.HttpAuth, logger *zap.Logger) (*HttpAuthImpl, error) {
+	if httpConfig == nil || len(httpConfig.Url) == 0 {
+		return nil, errors.New("no auth endpoint configured")
+	}
+
+	impl := &HttpAuthImpl{
+		config:   httpConfig,
+		client:   &http.Client{Timeout: defaultHttpAuthTimeout},
+		cacheTtl: time.Duration(httpConfig.CacheTtl) * time.Second,
+		logger:   logger,
+		cache:    make(map[[sha256.Size]byte]cachedResult),
+	}
+	if httpConfig.Timeout > 0 {
+		impl.client.Timeout = time.Duration(httpConfig.Timeout) * time.Second
+	}
+	switch httpConfig.FailurePolicy {
+	case "", "deny":
+	case "allow":
+		impl.failOpen = true
+	default:
+		return nil, fmt.Errorf("invalid failure policy: %s", httpConfig.FailurePolicy)
+	}
+	return impl, nil
+}
+
+func (impl *HttpAuthImpl) Validate(username string, password string) error {
+	_, err := impl.Authenticate(&Credentials{Username: username, Password: password})
+	return err
+}
+
+func (impl *HttpAuthImpl) Authenticate(credentials *Credentials) (*Identity, error) {
+	allowed := impl.ask(&httpAuthRequest{
+		Action:        "connect",
+		ClientID:      credentials.ClientID,
+		Username:      credentials.Username,
+		Password:      credentials.Password,
+		RemoteAddress: credentials.RemoteAddress,
+		Listener:      credentials.Listener,
+	})
+	if !allowed {
+		return nil, errDenied
+	}
+	return &Identity{Username: credentials.Username}, nil
+}
+
+// Authorize asks the endpoint whether a client may publish or subscribe on a topic, if enabled
+func (impl *HttpAuthImpl) Authorize(clientID string, username string, action Action, topic string) bool {
+	if !impl.config.Authorize {
+		return true
+	}
+	return impl.ask(&httpAuthRequest{
+		Action:   string(action),
+		ClientID: clientID,
+		Username: username,
+		Topic:    topic,
+	})
+}
+
+// ask returns the cached result of a request, or sends it to the endpoint
+func (impl *HttpAuthImpl) ask(request *httpAuthRequest) bool {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return false
+	}
+
+	// the key is hashed, so that passwords are not kept in memory
+	key := sha256.Sum256(body)
+	if allowed, ok := impl.cached(key); ok {
+		return allowed
+	}
+
+	allowed, err := impl.send(body)
+	if err != nil {
+		impl.logger.Error(fmt.Sprintf("auth endpoint failed for %s of clientID: %s", request.Action, request.ClientID), zap.Error(err))
+		return impl.failOpen
+	}
+	impl.store(key, allowed)
+	return allowed
+}
+
+func (impl *HttpAuthImpl) send(body []byte) (bool, error) {
+	httpRequest, err := http.NewRequest(http.MethodPost, impl.config.Url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	for name, value := range impl.config.Headers {
+		httpRequest.Header.Set(name, value)
+	}
+
+	response, err := impl.client.Do(httpRequest)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+	// drain the body, so that the connection can be reused
+	_, _ = io.Copy(ioutil.Discard, response.Body)
+
+	switch {
+	case response.StatusCode >= 200 && response.StatusCode < 300:
+		return true, nil
+	case response.StatusCode >= 400 && response.StatusCode < 500:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected status %s", response.Status)
+	}
+}
+
+func (impl *HttpAuthImpl) cached(key [sha256.Size]byte) (allowed bool, ok bool) {
+	if impl.cacheTtl <= 0 {
+		return false, false
+	}
+	impl.cacheMu.Lock()
+	defer impl.cacheMu.Unlock()
+
+	result, ok := impl.cache[key]
+	if !ok || time.Now().After(result.expiresAt) {
+		return false, false
+	}
+	return result.allowed, true
+}
+
+func (impl *HttpAuthImpl) store(key [sha256.Size]byte, allowed bool) {
+	if impl.cacheTtl <= 0 {
+		return
+	}
+	impl.cacheMu.Lock()
+	defer impl.cacheMu.Unlock()
+
+	now := time.Now()
+	if len(impl.cache) >= maxCachedResults {
+		for k, result := range impl.cache {
+			if now.After(result.expiresAt) {
+				delete(impl.cache, k)
+			}
+		}
+	}
+	if len(impl.cache) < maxCachedResults {
+		impl.cache[key] = cachedResult{allowed: allowed, expiresAt: now.Add(impl.cacheTtl)}
+	}
+}
@@ -0,0 +1,182 @@
+package auth
+
+import (
+	"encoding/json"
+	"github.com/c16a/hermes/lib/config"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestEndpoint(t *testing.T, handler func(request *httpAuthRequest) int) (*httptest.Server, *int32) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if r.Method != http.MethodPost || r.Header.Get("X-Api-Key") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var request httpAuthRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(handler(&request))
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func TestHttpAuthImpl_Authenticate(t *testing.T) {
+	server, _ := newTestEndpoint(t, func(request *httpAuthRequest) int {
+		switch {
+		case request.Action != "connect":
+			return http.StatusBadRequest
+		case request.Username == "broken":
+			return http.StatusInternalServerError
+		case request.Password == "password" && request.RemoteAddress == "10.0.0.1:1234" && request.Listener == "tcp":
+			return http.StatusOK
+		default:
+			return http.StatusForbidden
+		}
+	})
+
+	tests := []struct {
+		name          string
+		failurePolicy string
+		credentials   *Credentials
+		wantErr       bool
+	}{
+		{"Allowed", "", &Credentials{ClientID: "c1", Username: "alice", Password: "password", RemoteAddress: "10.0.0.1:1234", Listener: "tcp"}, false},
+		{"Denied", "allow", &Credentials{ClientID: "c1", Username: "alice", Password: "wrong", RemoteAddress: "10.0.0.1:1234", Listener: "tcp"}, true},
+		{"Failure with deny policy", "deny", &Credentials{ClientID: "c1", Username: "broken", Password: "password"}, true},
+		{"Failure with allow policy", "allow", &Credentials{ClientID: "c1", Username: "broken", Password: "password"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			impl, err := NewHttpAuthImpl(&config.HttpAuth{
+				Url:           server.URL,
+				Headers:       map[string]string{"X-Api-Key": "secret"},
+				FailurePolicy: tt.failurePolicy,
+			}, zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+			identity, err := impl.Authenticate(tt.credentials)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Authenticate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && identity.Username != tt.credentials.Username {
+				t.Errorf("Authenticate() username = %s, want %s", identity.Username, tt.credentials.Username)
+			}
+		})
+	}
+}
+
+func TestHttpAuthImpl_Timeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	for _, failurePolicy := range []string{"deny", "allow"} {
+		impl, err := NewHttpAuthImpl(&config.HttpAuth{Url: server.URL, Timeout: 1, FailurePolicy: failurePolicy}, zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		err = impl.Validate("alice", "password")
+		if (err == nil) != (failurePolicy == "allow") {
+			t.Errorf("Validate() with %s policy error = %v", failurePolicy, err)
+		}
+		if elapsed := time.Since(start); elapsed > 3*time.Second {
+			t.Errorf("Validate() took %s, longer than the timeout", elapsed)
+		}
+	}
+}
+
+func TestHttpAuthImpl_Cache(t *testing.T) {
+	status := int32(http.StatusOK)
+	server, calls := newTestEndpoint(t, func(*httpAuthRequest) int {
+		return int(atomic.LoadInt32(&status))
+	})
+	impl, err := NewHttpAuthImpl(&config.HttpAuth{
+		Url:      server.URL,
+		Headers:  map[string]string{"X-Api-Key": "secret"},
+		CacheTtl: 60,
+	}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := impl.Validate("alice", "password"); err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&status, http.StatusForbidden)
+	if err := impl.Validate("alice", "password"); err != nil {
+		t.Errorf("cached result was not used: %v", err)
+	}
+	if got := atomic.LoadInt32(calls); got != 1 {
+		t.Errorf("endpoint was called %d times, want 1", got)
+	}
+	if err := impl.Validate("alice", "other"); err == nil {
+		t.Error("other credentials were allowed by the cached result")
+	}
+
+	// failures are not cached
+	atomic.StoreInt32(&status, http.StatusBadGateway)
+	_ = impl.Validate("bob", "password")
+	atomic.StoreInt32(&status, http.StatusOK)
+	if err := impl.Validate("bob", "password"); err != nil {
+		t.Errorf("failure was cached: %v", err)
+	}
+}
+
+func TestHttpAuthImpl_Authorize(t *testing.T) {
+	server, _ := newTestEndpoint(t, func(request *httpAuthRequest) int {
+		if request.Action == string(ActionPublish) && request.Topic == "devices/c1/state" && request.ClientID == "c1" {
+			return http.StatusOK
+		}
+		if request.Action == string(ActionSubscribe) && request.Topic == "commands/#" && request.Username == "alice" {
+			return http.StatusNoContent
+		}
+		return http.StatusForbidden
+	})
+
+	impl, err := NewHttpAuthImpl(&config.HttpAuth{
+		Url:       server.URL,
+		Headers:   map[string]string{"X-Api-Key": "secret"},
+		Authorize: true,
+	}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		action Action
+		topic  string
+		want   bool
+	}{
+		{"Allowed publish", ActionPublish, "devices/c1/state", true},
+		{"Denied publish", ActionPublish, "devices/c2/state", false},
+		{"Allowed subscribe", ActionSubscribe, "commands/#", true},
+		{"Denied subscribe", ActionSubscribe, "#", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := impl.Authorize("c1", "alice", tt.action, tt.topic); got != tt.want {
+				t.Errorf("Authorize() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	impl.config.Authorize = false
+	if !impl.Authorize("c1", "alice", ActionPublish, "devices/c2/state") {
+		t.Error("Authorize() asked the endpoint although authorization is disabled")
+	}
+}
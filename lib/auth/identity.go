@@ -0,0 +1,175 @@
+package auth
+
+import (
+	"crypto/x509"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Identity is what an auth provider knows about an authenticated client
+type Identity struct {
+	Username string
+
+	// Publish and Subscribe are the topic filters the client is restricted to, if not nil
+	Publish   []string
+	Subscribe []string
+
+	// Groups are the ACL groups the client is a member of, on top of those the ACL puts its username in
+	Groups []string
+
+	// Acl applies to the client instead of the ACL of the broker, if set
+	Acl *Acl
+
+	// ExpiresAt is when the credentials of the client expire, if not zero
+	ExpiresAt time.Time
+
+	// others are the identities other providers of a chain gave the client, whose topic filters restrict it too
+	others []*Identity
+
+	// provider is the one provider of a chain which accepted the client, and so authorizes its topics
+	provider AuthorisationProvider
+
+	// decidedBy is the type of the provider which accepted the client, or identified it if all providers must accept it
+	decidedBy string
+}
+
+// RejectedError is returned when a client is rejected, along with the type of the provider which rejected it
+type RejectedError struct {
+	Provider string
+	Err      error
+}
+
+func (err *RejectedError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *RejectedError) Unwrap() error {
+	return err.Err
+}
+
+// DecidedBy returns the type of the provider which accepted a client with an identity, or rejected it with an error,
+// such as "ldap" or "file"
+func DecidedBy(identity *Identity, err error) string {
+	var rejected *RejectedError
+	if errors.As(err, &rejected) {
+		return rejected.Provider
+	}
+	if identity != nil && len(identity.decidedBy) > 0 {
+		return identity.decidedBy
+	}
+	return "unknown"
+}
+
+// providerType names a provider in DecidedBy
+func providerType(provider AuthorisationProvider) string {
+	switch provider.(type) {
+	case *LdapAuthImpl:
+		return "ldap"
+	case *FileAuthImpl:
+		return "file"
+	case *JwtAuthImpl:
+		return "jwt"
+	case *CertificateAuthImpl:
+		return "certificate"
+	case *HttpAuthImpl:
+		return "http"
+	case *AnonymousProvider:
+		return "anonymous"
+	case *Chain:
+		return "chain"
+	}
+	return "custom"
+}
+
+// Credentials are what a client authenticates with
+type Credentials struct {
+	ClientID string
+	Username string
+	Password string
+
+	// Certificate is the verified client certificate of a TLS connection, if the client presented one
+	Certificate *x509.Certificate
+
+	// RemoteAddress is the address the client connects from, and Listener the name of the listener it connects to.
+	// Both are empty for clients which do not connect over the network.
+	RemoteAddress string
+	Listener      string
+}
+
+// IdentityProvider is an auth provider which knows more about a client than whether its password is valid
+type IdentityProvider interface {
+	AuthorisationProvider
+
+	// Authenticate validates the credentials of a client, and returns its identity
+	Authenticate(credentials *Credentials) (*Identity, error)
+}
+
+// TopicAuthorizer is an auth provider which also decides where clients may publish and subscribe
+type TopicAuthorizer interface {
+	Authorize(clientID string, username string, action Action, topic string) bool
+}
+
+// Authenticate validates the credentials of a client against a provider, and returns its identity.
+//
+// Providers which only validate passwords identify clients by the username they connect with.
+// Unless a provider nested in this one decided already, the identity or error records that this provider decided.
+func Authenticate(provider AuthorisationProvider, credentials *Credentials) (*Identity, error) {
+	var identity *Identity
+	var err error
+	if identityProvider, ok := provider.(IdentityProvider); ok {
+		identity, err = identityProvider.Authenticate(credentials)
+	} else if err = provider.Validate(credentials.Username, credentials.Password); err == nil {
+		identity = &Identity{Username: credentials.Username}
+	}
+
+	if err != nil {
+		var rejected *RejectedError
+		if !errors.As(err, &rejected) {
+			err = &RejectedError{Provider: providerType(provider), Err: err}
+		}
+		return nil, err
+	}
+	if len(identity.decidedBy) == 0 {
+		identity.decidedBy = providerType(provider)
+	}
+	return identity, nil
+}
+
+// Authorize checks with a provider if it lets a client publish or subscribe on a topic, which it does
+// if it does not authorize topics. If a chain identified the client by the first provider accepting it,
+// only that provider is asked.
+func Authorize(provider AuthorisationProvider, identity *Identity, clientID string, username string, action Action, topic string) bool {
+	if identity != nil && identity.provider != nil {
+		provider = identity.provider
+	}
+	if authorizer, ok := provider.(TopicAuthorizer); ok {
+		return authorizer.Authorize(clientID, username, action, topic)
+	}
+	return true
+}
+
+// Allowed checks if the topic filters of the identity cover a topic, or a topic filter to subscribe to
+func (identity *Identity) Allowed(action Action, topic string) bool {
+	for _, other := range identity.others {
+		if !other.Allowed(action, topic) {
+			return false
+		}
+	}
+
+	filters := identity.Publish
+	if action == ActionSubscribe {
+		filters = identity.Subscribe
+	}
+	if filters == nil {
+		return true
+	}
+
+	levels := topicLevels(action, topic)
+	for _, filter := range filters {
+		if covers(strings.Split(filter, "/"), levels) {
+			return true
+		}
+	}
+	return false
+}
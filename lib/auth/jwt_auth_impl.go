@@ -0,0 +1,241 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/c16a/hermes/lib/config"
+	"github.com/golang-jwt/jwt/v4"
+	"io/ioutil"
+	"math/big"
+	"time"
+)
+
+const defaultUsernameClaim = "sub"
+
+// JwtAuthImpl validates JWTs passed as the password, signed with HS256 secrets or with
+// the RS256 or ES256 keys of a JSON Web Key Set
+type JwtAuthImpl struct {
+	config  *config.Jwt
+	secrets [][]byte
+	keys    []*jsonWebKey
+	parser  *jwt.Parser
+}
+
+type jsonWebKey struct {
+	kid string
+	alg string
+	key interface{}
+}
+
+func NewJwtAuthImpl(jwtConfig *config.Jwt) (*JwtAuthImpl, error) {
+	if jwtConfig == nil || len(jwtConfig.Secrets) == 0 && len(jwtConfig.JwksFile) == 0 {
+		return nil, errors.New("no JWT secrets or keys configured")
+	}
+
+	impl := &JwtAuthImpl{
+		config: jwtConfig,
+		parser: jwt.NewParser(jwt.WithValidMethods([]string{"HS256", "RS256", "ES256"})),
+	}
+	for _, secret := range jwtConfig.Secrets {
+		impl.secrets = append(impl.secrets, []byte(secret))
+	}
+	if len(jwtConfig.JwksFile) > 0 {
+		keys, err := readJwksFile(jwtConfig.JwksFile)
+		if err != nil {
+			return nil, err
+		}
+		impl.keys = keys
+	}
+	return impl, nil
+}
+
+func (impl *JwtAuthImpl) Validate(_ string, password string) error {
+	_, err := impl.parse(password)
+	return err
+}
+
+// Authenticate validates the JWT in the password, and maps its claims to the identity of the client.
+// The username the client connects with is ignored.
+func (impl *JwtAuthImpl) Authenticate(credentials *Credentials) (*Identity, error) {
+	claims, err := impl.parse(credentials.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	usernameClaim := impl.config.UsernameClaim
+	if len(usernameClaim) == 0 {
+		usernameClaim = defaultUsernameClaim
+	}
+	username, ok := claims[usernameClaim].(string)
+	if !ok || len(username) == 0 {
+		return nil, fmt.Errorf("token has no %s claim", usernameClaim)
+	}
+	identity := &Identity{Username: username}
+
+	if len(impl.config.ClientIDClaim) > 0 && !containsString(stringsClaim(claims, impl.config.ClientIDClaim), credentials.ClientID) {
+		return nil, fmt.Errorf("token does not allow client ID %s", credentials.ClientID)
+	}
+	if len(impl.config.PublishClaim) > 0 {
+		identity.Publish = stringsClaim(claims, impl.config.PublishClaim)
+	}
+	if len(impl.config.SubscribeClaim) > 0 {
+		identity.Subscribe = stringsClaim(claims, impl.config.SubscribeClaim)
+	}
+
+	switch exp := claims["exp"].(type) {
+	case float64:
+		identity.ExpiresAt = time.Unix(int64(exp), 0)
+	case json.Number:
+		if seconds, err := exp.Int64(); err == nil {
+			identity.ExpiresAt = time.Unix(seconds, 0)
+		}
+	}
+	return identity, nil
+}
+
+// parse verifies the signature of a token, and checks its exp, nbf, iss and aud claims
+func (impl *JwtAuthImpl) parse(tokenString string) (jwt.MapClaims, error) {
+	unverified, _, err := impl.parser.ParseUnverified(tokenString, jwt.MapClaims{})
+	if err != nil {
+		return nil, err
+	}
+	candidates := impl.candidateKeys(unverified)
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no key to verify %s token", unverified.Method.Alg())
+	}
+
+	// the claims are only trusted once the signature is verified with one of the keys
+	for _, key := range candidates {
+		claims := jwt.MapClaims{}
+		_, err = impl.parser.ParseWithClaims(tokenString, claims, func(*jwt.Token) (interface{}, error) {
+			return key, nil
+		})
+		var validationErr *jwt.ValidationError
+		if errors.As(err, &validationErr) && validationErr.Errors&jwt.ValidationErrorSignatureInvalid != 0 {
+			continue
+		}
+		if err != nil {
+			// the signature is valid, but the token is expired or not valid yet
+			return nil, err
+		}
+		if len(impl.config.Issuer) > 0 && !claims.VerifyIssuer(impl.config.Issuer, true) {
+			return nil, errors.New("token has an invalid issuer")
+		}
+		if len(impl.config.Audience) > 0 && !claims.VerifyAudience(impl.config.Audience, true) {
+			return nil, errors.New("token has an invalid audience")
+		}
+		return claims, nil
+	}
+	return nil, err
+}
+
+// candidateKeys returns the keys which may have signed a token, by its algorithm and key ID
+func (impl *JwtAuthImpl) candidateKeys(token *jwt.Token) []interface{} {
+	alg := token.Method.Alg()
+	if alg == "HS256" {
+		candidates := make([]interface{}, 0, len(impl.secrets))
+		for _, secret := range impl.secrets {
+			candidates = append(candidates, secret)
+		}
+		return candidates
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	var candidates []interface{}
+	for _, key := range impl.keys {
+		if key.alg != alg || len(kid) > 0 && key.kid != kid {
+			continue
+		}
+		candidates = append(candidates, key.key)
+	}
+	return candidates
+}
+
+func readJwksFile(path string) ([]*jsonWebKey, error) {
+	fileBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(fileBytes, &jwks); err != nil {
+		return nil, fmt.Errorf("invalid JWKS file %s: %w", path, err)
+	}
+
+	var keys []*jsonWebKey
+	for index, k := range jwks.Keys {
+		if len(k.Use) > 0 && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, nErr := decodeBigInt(k.N)
+			e, eErr := decodeBigInt(k.E)
+			if nErr != nil || eErr != nil || !e.IsInt64() {
+				return nil, fmt.Errorf("JWKS key %d is not a valid RSA key", index)
+			}
+			keys = append(keys, &jsonWebKey{kid: k.Kid, alg: "RS256", key: &rsa.PublicKey{N: n, E: int(e.Int64())}})
+		case "EC":
+			if k.Crv != "P-256" {
+				return nil, fmt.Errorf("JWKS key %d has unsupported curve %s", index, k.Crv)
+			}
+			x, xErr := decodeBigInt(k.X)
+			y, yErr := decodeBigInt(k.Y)
+			if xErr != nil || yErr != nil || !elliptic.P256().IsOnCurve(x, y) {
+				return nil, fmt.Errorf("JWKS key %d is not a valid P-256 key", index)
+			}
+			keys = append(keys, &jsonWebKey{kid: k.Kid, alg: "ES256", key: &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}})
+		default:
+			return nil, fmt.Errorf("JWKS key %d has unsupported type %s", index, k.Kty)
+		}
+	}
+	return keys, nil
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	valueBytes, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(valueBytes), nil
+}
+
+// stringsClaim returns a claim which is a string or a list of strings as a list
+func stringsClaim(claims jwt.MapClaims, name string) []string {
+	values := []string{}
+	switch claim := claims[name].(type) {
+	case string:
+		values = append(values, claim)
+	case []interface{}:
+		for _, value := range claim {
+			if s, ok := value.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	return values
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"github.com/c16a/hermes/lib/config"
+	"github.com/golang-jwt/jwt/v4"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestJwtAuthImpl_Authenticate(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode := func(i *big.Int) string {
+		return base64.RawURLEncoding.EncodeToString(i.Bytes())
+	}
+	jwksPath := filepath.Join(t.TempDir(), "jwks.json")
+	jwks := fmt.Sprintf(`{"keys": [
+		{"kty": "RSA", "kid": "rsa", "use": "sig", "n": "%s", "e": "%s"},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": "%s", "y": "%s"}
+	]}`, encode(rsaKey.N), encode(big.NewInt(int64(rsaKey.E))), encode(ecKey.X), encode(ecKey.Y))
+	if err := ioutil.WriteFile(jwksPath, []byte(jwks), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	impl, err := NewJwtAuthImpl(&config.Jwt{
+		Secrets:        []string{"old-secret", "secret"},
+		JwksFile:       jwksPath,
+		Issuer:         "https://auth.example.com",
+		Audience:       "hermes",
+		ClientIDClaim:  "client_ids",
+		PublishClaim:   "publish",
+		SubscribeClaim: "subscribe",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	claims := func(changes jwt.MapClaims) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"sub":        "alice",
+			"iss":        "https://auth.example.com",
+			"aud":        "hermes",
+			"exp":        expiresAt.Unix(),
+			"client_ids": []string{"web-1", "web-2"},
+			"publish":    []string{"chat/alice/#"},
+			"subscribe":  "chat/#",
+		}
+		for name, value := range changes {
+			if value == nil {
+				delete(c, name)
+			} else {
+				c[name] = value
+			}
+		}
+		return c
+	}
+	sign := func(method jwt.SigningMethod, kid string, key interface{}, c jwt.MapClaims) string {
+		token := jwt.NewWithClaims(method, c)
+		if len(kid) > 0 {
+			token.Header["kid"] = kid
+		}
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+
+	tests := []struct {
+		name     string
+		clientID string
+		token    string
+		wantErr  bool
+	}{
+		{"HS256 token", "web-1", sign(jwt.SigningMethodHS256, "", []byte("secret"), claims(nil)), false},
+		{"RS256 token", "web-2", sign(jwt.SigningMethodRS256, "rsa", rsaKey, claims(nil)), false},
+		{"ES256 token", "web-1", sign(jwt.SigningMethodES256, "ec", ecKey, claims(nil)), false},
+		{"Unknown secret", "web-1", sign(jwt.SigningMethodHS256, "", []byte("guess"), claims(nil)), true},
+		{"Unknown key ID", "web-1", sign(jwt.SigningMethodRS256, "other", rsaKey, claims(nil)), true},
+		{"Expired token", "web-1", sign(jwt.SigningMethodHS256, "", []byte("secret"), claims(jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()})), true},
+		{"Token not valid yet", "web-1", sign(jwt.SigningMethodHS256, "", []byte("secret"), claims(jwt.MapClaims{"nbf": time.Now().Add(time.Minute).Unix()})), true},
+		{"Wrong issuer", "web-1", sign(jwt.SigningMethodHS256, "", []byte("secret"), claims(jwt.MapClaims{"iss": "https://evil.example.com"})), true},
+		{"Wrong audience", "web-1", sign(jwt.SigningMethodHS256, "", []byte("secret"), claims(jwt.MapClaims{"aud": "other"})), true},
+		{"Client ID not allowed", "web-3", sign(jwt.SigningMethodHS256, "", []byte("secret"), claims(nil)), true},
+		{"No username", "web-1", sign(jwt.SigningMethodHS256, "", []byte("secret"), claims(jwt.MapClaims{"sub": nil})), true},
+		{"Not a token", "web-1", "password", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := impl.Authenticate(&Credentials{ClientID: tt.clientID, Username: "ignored", Password: tt.token})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Authenticate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			want := &Identity{
+				Username:  "alice",
+				Publish:   []string{"chat/alice/#"},
+				Subscribe: []string{"chat/#"},
+				ExpiresAt: expiresAt,
+			}
+			if !reflect.DeepEqual(identity, want) {
+				t.Errorf("Authenticate() = %+v, want %+v", identity, want)
+			}
+		})
+	}
+}
+
+func TestIdentity_Allowed(t *testing.T) {
+	identity := &Identity{Publish: []string{"chat/alice/#"}}
+
+	if !identity.Allowed(ActionPublish, "chat/alice/general") {
+		t.Error("publish within the topic filters was denied")
+	}
+	if identity.Allowed(ActionPublish, "chat/bob/general") {
+		t.Error("publish outside the topic filters was allowed")
+	}
+	if !identity.Allowed(ActionSubscribe, "chat/#") {
+		t.Error("subscribe was restricted without topic filters")
+	}
+}
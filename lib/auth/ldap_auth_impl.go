@@ -1,23 +1,302 @@
 package auth
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"github.com/c16a/hermes/lib/config"
 	"github.com/go-ldap/ldap/v3"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"time"
 )
 
+const (
+	defaultLdapPoolSize       = 4
+	defaultLdapTimeout        = 5 * time.Second
+	defaultLdapUserFilter     = "(uid=%s)"
+	defaultLdapGroupFilter    = "(member=%s)"
+	defaultLdapGroupAttribute = "cn"
+)
+
+var errEmptyPassword = errors.New("empty password")
+
+// ldapConn is the part of an LDAP connection the provider uses
+type ldapConn interface {
+	Bind(username string, password string) error
+	UnauthenticatedBind(username string) error
+	Search(request *ldap.SearchRequest) (*ldap.SearchResult, error)
+	IsClosing() bool
+	Close()
+}
+
+// LdapAuthImpl validates passwords by binding to an LDAP server, over a pool of connections.
+//
+// Clients bind either with a DN built from their username, or with the DN of the entry
+// a service account finds for them. Their groups are looked up if a group base DN is configured.
 type LdapAuthImpl struct {
-	config *config.Config
+	config *config.Ldap
+	dial   func() (ldapConn, error)
+
+	// slots bounds the number of open connections, and idle keeps the connections which are not in use
+	slots chan struct{}
+	idle  chan ldapConn
+}
+
+func NewLdapAuthImpl(authConfig *config.Auth) (*LdapAuthImpl, error) {
+	ldapConfig := authConfig.Ldap
+	if ldapConfig == nil {
+		if len(authConfig.LdapHost) == 0 {
+			return nil, errors.New("no LDAP server configured")
+		}
+		ldapConfig = &config.Ldap{
+			Url:    fmt.Sprintf("ldap://%s", net.JoinHostPort(authConfig.LdapHost, fmt.Sprint(authConfig.LdapPort))),
+			UserDn: "cn=%s," + authConfig.LdapDn,
+		}
+	}
+	if len(ldapConfig.UserDn) == 0 && len(ldapConfig.BaseDn) == 0 {
+		return nil, errors.New("LDAP config needs either a user DN or a base DN to search users in")
+	}
+
+	serverUrl, err := url.Parse(ldapConfig.Url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LDAP url: %w", err)
+	}
+	switch {
+	case serverUrl.Scheme == "ldaps" && ldapConfig.StartTls:
+		return nil, errors.New("StartTLS cannot be used with ldaps")
+	case serverUrl.Scheme != "ldap" && serverUrl.Scheme != "ldaps":
+		return nil, fmt.Errorf("unsupported LDAP url scheme: %s", serverUrl.Scheme)
+	}
+
+	tlsConfig := &tls.Config{ServerName: serverUrl.Hostname()}
+	if len(ldapConfig.CaFile) > 0 {
+		caBytes, err := ioutil.ReadFile(ldapConfig.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caBytes) {
+			return nil, fmt.Errorf("no certificates in LDAP CA file %s", ldapConfig.CaFile)
+		}
+	}
+
+	timeout := defaultLdapTimeout
+	if ldapConfig.Timeout > 0 {
+		timeout = time.Duration(ldapConfig.Timeout) * time.Second
+	}
+	poolSize := defaultLdapPoolSize
+	if ldapConfig.PoolSize > 0 {
+		poolSize = ldapConfig.PoolSize
+	}
+
+	impl := &LdapAuthImpl{
+		config: ldapConfig,
+		slots:  make(chan struct{}, poolSize),
+		idle:   make(chan ldapConn, poolSize),
+	}
+	impl.dial = func() (ldapConn, error) {
+		conn, err := ldap.DialURL(ldapConfig.Url,
+			ldap.DialWithDialer(&net.Dialer{Timeout: timeout}),
+			ldap.DialWithTLSConfig(tlsConfig),
+		)
+		if err != nil {
+			return nil, err
+		}
+		conn.SetTimeout(timeout)
+		if ldapConfig.StartTls {
+			if err := conn.StartTLS(tlsConfig); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		return conn, nil
+	}
+	return impl, nil
 }
 
 func (impl *LdapAuthImpl) Validate(username string, password string) error {
-	authConfig := impl.config.Server.Auth
+	_, err := impl.Authenticate(&Credentials{Username: username, Password: password})
+	return err
+}
+
+// Authenticate binds as the client, and looks up its groups
+func (impl *LdapAuthImpl) Authenticate(credentials *Credentials) (identity *Identity, err error) {
+	// servers treat a bind with an empty password as an unauthenticated bind, which succeeds
+	if len(credentials.Password) == 0 {
+		return nil, errEmptyPassword
+	}
+	if len(credentials.Username) == 0 {
+		return nil, errors.New("empty username")
+	}
 
-	l, err := ldap.Dial("tcp", fmt.Sprintf("%s:%d", authConfig.LdapHost, authConfig.LdapPort))
+	conn, err := impl.acquire()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer func() {
+		impl.release(conn, err)
+	}()
 
-	cn := fmt.Sprintf("cn=%s,%s", username, authConfig.LdapDn)
-	return l.Bind(cn, password)
+	userDn, err := impl.userDn(conn, credentials.Username)
+	if err != nil {
+		return nil, err
+	}
+	if err = conn.Bind(userDn, credentials.Password); err != nil {
+		return nil, err
+	}
+
+	identity = &Identity{Username: credentials.Username}
+	if len(impl.config.GroupBaseDn) > 0 {
+		if identity.Groups, err = impl.groups(conn, userDn); err != nil {
+			return nil, err
+		}
+	}
+	return identity, nil
+}
+
+// userDn returns the DN a user binds as, which is searched for if no user DN is configured.
+//
+// Without a service account the search is anonymous, rather than as whichever user the pooled connection was bound as last.
+func (impl *LdapAuthImpl) userDn(conn ldapConn, username string) (string, error) {
+	if len(impl.config.UserDn) > 0 {
+		return fmt.Sprintf(impl.config.UserDn, escapeDnValue(username)), nil
+	}
+
+	var err error
+	if len(impl.config.BindDn) > 0 {
+		err = impl.bindServiceAccount(conn)
+	} else {
+		err = conn.UnauthenticatedBind("")
+	}
+	if err != nil {
+		return "", err
+	}
+	filter := impl.config.UserFilter
+	if len(filter) == 0 {
+		filter = defaultLdapUserFilter
+	}
+	result, err := conn.Search(ldap.NewSearchRequest(
+		impl.config.BaseDn, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(filter, ldap.EscapeFilter(username)), []string{"dn"}, nil,
+	))
+	if err != nil {
+		return "", err
+	}
+	if len(result.Entries) != 1 {
+		return "", fmt.Errorf("found %d LDAP entries for user %s", len(result.Entries), username)
+	}
+	return result.Entries[0].DN, nil
+}
+
+// groups returns the names of the groups a user is a member of
+func (impl *LdapAuthImpl) groups(conn ldapConn, userDn string) ([]string, error) {
+	if err := impl.bindServiceAccount(conn); err != nil {
+		return nil, err
+	}
+	filter := impl.config.GroupFilter
+	if len(filter) == 0 {
+		filter = defaultLdapGroupFilter
+	}
+	attribute := impl.config.GroupAttribute
+	if len(attribute) == 0 {
+		attribute = defaultLdapGroupAttribute
+	}
+	result, err := conn.Search(ldap.NewSearchRequest(
+		impl.config.GroupBaseDn, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf(filter, ldap.EscapeFilter(userDn)), []string{attribute}, nil,
+	))
+	if err != nil {
+		return nil, err
+	}
+	groups := []string{}
+	for _, entry := range result.Entries {
+		if name := entry.GetAttributeValue(attribute); len(name) > 0 {
+			groups = append(groups, name)
+		}
+	}
+	return groups, nil
+}
+
+// bindServiceAccount binds as the service account if there is one, and keeps binding as the user otherwise,
+// which is only meant for searches on behalf of the user bound last
+func (impl *LdapAuthImpl) bindServiceAccount(conn ldapConn) error {
+	if len(impl.config.BindDn) == 0 {
+		return nil
+	}
+	return conn.Bind(impl.config.BindDn, impl.config.BindPassword)
+}
+
+// acquire takes an idle connection from the pool, or opens one if there is room
+func (impl *LdapAuthImpl) acquire() (ldapConn, error) {
+	impl.slots <- struct{}{}
+	for {
+		select {
+		case conn := <-impl.idle:
+			if conn.IsClosing() {
+				continue
+			}
+			return conn, nil
+		default:
+			conn, err := impl.dial()
+			if err != nil {
+				<-impl.slots
+				return nil, err
+			}
+			return conn, nil
+		}
+	}
+}
+
+// release returns a connection to the pool, unless it failed other than by the server rejecting a request
+func (impl *LdapAuthImpl) release(conn ldapConn, err error) {
+	defer func() {
+		<-impl.slots
+	}()
+
+	var ldapErr *ldap.Error
+	if err != nil && (!errors.As(err, &ldapErr) || ldapErr.ResultCode >= ldap.ErrorNetwork) || conn.IsClosing() {
+		conn.Close()
+		return
+	}
+	select {
+	case impl.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// Close closes the idle connections of the pool
+func (impl *LdapAuthImpl) Close() error {
+	for {
+		select {
+		case conn := <-impl.idle:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// escapeDnValue escapes a value to be used as an attribute value of a DN, as described in RFC 4514
+func escapeDnValue(value string) string {
+	var builder strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == 0:
+			builder.WriteString(`\00`)
+		case strings.IndexByte(`"+,;<>\=`, c) >= 0,
+			i == 0 && (c == ' ' || c == '#'),
+			i == len(value)-1 && c == ' ':
+			builder.WriteByte('\\')
+			builder.WriteByte(c)
+		default:
+			builder.WriteByte(c)
+		}
+	}
+	return builder.String()
 }
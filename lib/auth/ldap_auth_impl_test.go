@@ -0,0 +1,253 @@
+package auth
+
+import (
+	"errors"
+	"github.com/c16a/hermes/lib/config"
+	"github.com/go-ldap/ldap/v3"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// fakeDirectory is an LDAP server with a service account, two users and a group
+type fakeDirectory struct {
+	mu     sync.Mutex
+	dials  int
+	closed int
+	broken bool
+
+	// searchers are the DNs searches were made as, which is empty for anonymous searches
+	searchers []string
+}
+
+var fakeEntries = map[string]string{
+	"cn=service,dc=example,dc=com":           "service-password",
+	"cn=alice,ou=users,dc=example,dc=com":    "alice-password",
+	`cn=bob\, jr,ou=users,dc=example,dc=com`: "bob-password",
+}
+
+type fakeLdapConn struct {
+	directory *fakeDirectory
+	boundAs   string
+	anonymous bool
+	closing   bool
+}
+
+func (d *fakeDirectory) dial() (ldapConn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dials++
+	return &fakeLdapConn{directory: d}, nil
+}
+
+func (c *fakeLdapConn) Bind(username string, password string) error {
+	c.directory.mu.Lock()
+	broken := c.directory.broken
+	c.directory.mu.Unlock()
+	if broken {
+		c.closing = true
+		return ldap.NewError(ldap.ErrorNetwork, errors.New("connection reset"))
+	}
+	c.anonymous = false
+	if want, ok := fakeEntries[username]; !ok || want != password {
+		c.boundAs = ""
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+	}
+	c.boundAs = username
+	return nil
+}
+
+func (c *fakeLdapConn) UnauthenticatedBind(username string) error {
+	c.boundAs = ""
+	c.anonymous = true
+	return nil
+}
+
+func (c *fakeLdapConn) Search(request *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	if len(c.boundAs) == 0 && !c.anonymous {
+		return nil, ldap.NewError(ldap.LDAPResultInsufficientAccessRights, errors.New("not bound"))
+	}
+	c.directory.mu.Lock()
+	c.directory.searchers = append(c.directory.searchers, c.boundAs)
+	c.directory.mu.Unlock()
+	result := &ldap.SearchResult{}
+	switch request.Filter {
+	case "(sAMAccountName=alice)":
+		result.Entries = append(result.Entries, ldap.NewEntry("cn=alice,ou=users,dc=example,dc=com", nil))
+	case `(sAMAccountName=bob, jr)`:
+		result.Entries = append(result.Entries, ldap.NewEntry(`cn=bob\, jr,ou=users,dc=example,dc=com`, nil))
+	case "(member=cn=alice,ou=users,dc=example,dc=com)":
+		result.Entries = append(result.Entries,
+			ldap.NewEntry("cn=operators,ou=groups,dc=example,dc=com", map[string][]string{"cn": {"operators"}}),
+			ldap.NewEntry("cn=devices,ou=groups,dc=example,dc=com", map[string][]string{"cn": {"devices"}}),
+		)
+	}
+	return result, nil
+}
+
+func (c *fakeLdapConn) IsClosing() bool {
+	return c.closing
+}
+
+func (c *fakeLdapConn) Close() {
+	c.directory.mu.Lock()
+	defer c.directory.mu.Unlock()
+	c.closing = true
+	c.directory.closed++
+}
+
+func newTestLdapAuthImpl(t *testing.T, ldapConfig *config.Ldap) (*LdapAuthImpl, *fakeDirectory) {
+	impl, err := NewLdapAuthImpl(&config.Auth{Ldap: ldapConfig})
+	if err != nil {
+		t.Fatal(err)
+	}
+	directory := &fakeDirectory{}
+	impl.dial = directory.dial
+	return impl, directory
+}
+
+func TestLdapAuthImpl_SearchThenBind(t *testing.T) {
+	impl, _ := newTestLdapAuthImpl(t, &config.Ldap{
+		Url:          "ldaps://ad.example.com",
+		BindDn:       "cn=service,dc=example,dc=com",
+		BindPassword: "service-password",
+		BaseDn:       "ou=users,dc=example,dc=com",
+		UserFilter:   "(sAMAccountName=%s)",
+		GroupBaseDn:  "ou=groups,dc=example,dc=com",
+	})
+
+	tests := []struct {
+		name       string
+		username   string
+		password   string
+		wantGroups []string
+		wantErr    bool
+	}{
+		{"Valid password", "alice", "alice-password", []string{"operators", "devices"}, false},
+		{"Invalid password", "alice", "wrong", nil, true},
+		{"Empty password", "alice", "", nil, true},
+		{"Unknown user", "mallory", "alice-password", nil, true},
+		{"Filter injection", "*)(sAMAccountName=alice", "alice-password", nil, true},
+		{"Special characters", "bob, jr", "bob-password", []string{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := impl.Authenticate(&Credentials{Username: tt.username, Password: tt.password})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Authenticate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if identity.Username != tt.username || !reflect.DeepEqual(identity.Groups, tt.wantGroups) {
+				t.Errorf("Authenticate() = %s in %v, want %s in %v", identity.Username, identity.Groups, tt.username, tt.wantGroups)
+			}
+		})
+	}
+}
+
+func TestLdapAuthImpl_AnonymousSearch(t *testing.T) {
+	impl, directory := newTestLdapAuthImpl(t, &config.Ldap{
+		Url:        "ldap://ldap.example.com",
+		BaseDn:     "ou=users,dc=example,dc=com",
+		UserFilter: "(sAMAccountName=%s)",
+		PoolSize:   1,
+	})
+
+	if err := impl.Validate("alice", "alice-password"); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+	// the only connection of the pool is still bound as alice
+	if err := impl.Validate("bob, jr", "bob-password"); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+	if !reflect.DeepEqual(directory.searchers, []string{"", ""}) {
+		t.Errorf("users were searched for as %q, want anonymously", directory.searchers)
+	}
+}
+
+func TestLdapAuthImpl_DirectBind(t *testing.T) {
+	impl, _ := newTestLdapAuthImpl(t, &config.Ldap{
+		Url:    "ldap://ldap.example.com",
+		UserDn: "cn=%s,ou=users,dc=example,dc=com",
+	})
+
+	if err := impl.Validate("alice", "alice-password"); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+	if err := impl.Validate("bob, jr", "bob-password"); err != nil {
+		t.Errorf("Validate() with special characters error = %v", err)
+	}
+	if err := impl.Validate("alice", ""); !errors.Is(err, errEmptyPassword) {
+		t.Errorf("Validate() with empty password error = %v, want %v", err, errEmptyPassword)
+	}
+	if err := impl.Validate("alice,ou=users,dc=example,dc=com", "alice-password"); err == nil {
+		t.Error("Validate() allowed a username which injects a DN")
+	}
+}
+
+func TestLdapAuthImpl_Pool(t *testing.T) {
+	impl, directory := newTestLdapAuthImpl(t, &config.Ldap{
+		Url:      "ldap://ldap.example.com",
+		UserDn:   "cn=%s,ou=users,dc=example,dc=com",
+		PoolSize: 2,
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = impl.Validate("alice", "alice-password")
+		}()
+	}
+	wg.Wait()
+	if directory.dials > 2 {
+		t.Errorf("opened %d connections, want at most the pool size of 2", directory.dials)
+	}
+	if err := impl.Validate("alice", "wrong"); err == nil {
+		t.Error("Validate() allowed an invalid password")
+	}
+	if directory.closed != 0 {
+		t.Errorf("closed %d connections after rejected passwords, want them to be reused", directory.closed)
+	}
+
+	// connections which fail are discarded, and replaced once the server is back
+	directory.broken = true
+	if err := impl.Validate("alice", "alice-password"); err == nil {
+		t.Error("Validate() succeeded over a broken connection")
+	}
+	directory.broken = false
+	if err := impl.Validate("alice", "alice-password"); err != nil {
+		t.Errorf("Validate() error = %v after the server came back", err)
+	}
+	if directory.closed != 1 {
+		t.Errorf("closed %d connections, want the broken one", directory.closed)
+	}
+
+	_ = impl.Close()
+	if directory.closed != directory.dials {
+		t.Errorf("closed %d of %d connections", directory.closed, directory.dials)
+	}
+}
+
+func TestNewLdapAuthImpl(t *testing.T) {
+	tests := []struct {
+		name       string
+		authConfig *config.Auth
+		wantErr    bool
+	}{
+		{"Legacy host and DN", &config.Auth{LdapHost: "localhost", LdapPort: 389, LdapDn: "dc=example,dc=com"}, false},
+		{"Nothing configured", &config.Auth{}, true},
+		{"StartTLS over ldaps", &config.Auth{Ldap: &config.Ldap{Url: "ldaps://localhost", StartTls: true, UserDn: "cn=%s"}}, true},
+		{"Unsupported scheme", &config.Auth{Ldap: &config.Ldap{Url: "http://localhost", UserDn: "cn=%s"}}, true},
+		{"No user DN or base DN", &config.Auth{Ldap: &config.Ldap{Url: "ldap://localhost"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewLdapAuthImpl(tt.authConfig); (err != nil) != tt.wantErr {
+				t.Errorf("NewLdapAuthImpl() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+const (
+	HashBcrypt   = "bcrypt"
+	HashArgon2id = "argon2id"
+)
+
+// argon2id parameters of new hashes, as recommended by RFC 9106 for memory constrained environments
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+)
+
+// argon2Slots limits how many argon2id hashes are computed at once, since each of them allocates
+// the memory given by its parameters, which is 64 MiB for new hashes
+var argon2Slots = make(chan struct{}, 4)
+
+var errInvalidCredentials = errors.New("invalid username or password")
+
+// HashPassword hashes a password with bcrypt or argon2id, in the format stored in password files
+func HashPassword(password string, algorithm string) (string, error) {
+	switch algorithm {
+	case HashBcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		return string(hash), err
+	case HashArgon2id:
+		salt := make([]byte, argon2SaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+	default:
+		return "", fmt.Errorf("unknown hash algorithm: %s", algorithm)
+	}
+}
+
+// hashAlgorithm returns the algorithm of a hash stored in a password file
+func hashAlgorithm(hash string) string {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		return HashArgon2id
+	}
+	return HashBcrypt
+}
+
+// comparePassword checks a password against a bcrypt or argon2id hash
+func comparePassword(hash string, password string) error {
+	if hashAlgorithm(hash) == HashArgon2id {
+		return compareArgon2id(hash, password)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		return errInvalidCredentials
+	}
+	return nil
+}
+
+// compareArgon2id checks a password against an argon2id hash in PHC string format,
+// such as $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>
+func compareArgon2id(hash string, password string) error {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return errors.New("invalid argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return errors.New("unsupported argon2id version")
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return fmt.Errorf("invalid argon2id parameters: %w", err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return fmt.Errorf("invalid argon2id salt: %w", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return fmt.Errorf("invalid argon2id key: %w", err)
+	}
+
+	argon2Slots <- struct{}{}
+	otherKey := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	<-argon2Slots
+	if subtle.ConstantTimeCompare(key, otherKey) != 1 {
+		return errInvalidCredentials
+	}
+	return nil
+}
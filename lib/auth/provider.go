@@ -2,27 +2,125 @@ package auth
 
 import (
 	"errors"
+	"fmt"
 	"github.com/c16a/hermes/lib/config"
+	"go.uber.org/zap"
 )
 
 type AuthorisationProvider interface {
 	Validate(string, string) error
 }
 
-func FetchProviderFromConfig(config *config.Config) (provider AuthorisationProvider, err error) {
-	authConfig := config.Server.Auth
+// FetchProvidersFromConfig returns the provider of the listeners without their own auth configuration,
+// which is nil if clients are not authenticated, and the providers of the other listeners by name.
+//
+// Listeners which use the same auth type share its provider.
+func FetchProvidersFromConfig(serverConfig *config.Config, logger *zap.Logger) (provider AuthorisationProvider, listenerProviders map[string]AuthorisationProvider, err error) {
+	authConfig := serverConfig.Server.Auth
+	if authConfig == nil {
+		return
+	}
 
-	if authConfig == nil || len(authConfig.Type) == 0 {
+	factory := &providerFactory{authConfig: authConfig, logger: logger, instances: make(map[string]AuthorisationProvider)}
+	providerTypes := authConfig.Providers
+	if len(providerTypes) == 0 && len(authConfig.Type) > 0 {
+		providerTypes = []string{authConfig.Type}
+	}
+	if provider, err = factory.chain(providerTypes, authConfig.Mode, authConfig.Anonymous); err != nil {
 		return
 	}
 
-	switch authConfig.Type {
+	listenerProviders = make(map[string]AuthorisationProvider, len(authConfig.Listeners))
+	for listener, listenerAuth := range authConfig.Listeners {
+		if listenerAuth == nil {
+			listenerAuth = &config.ListenerAuth{}
+		}
+		if listenerProviders[listener], err = factory.chain(listenerAuth.Providers, listenerAuth.Mode, listenerAuth.Anonymous); err != nil {
+			err = fmt.Errorf("auth of listener %s: %w", listener, err)
+			return
+		}
+	}
+	return
+}
+
+type providerFactory struct {
+	authConfig *config.Auth
+	logger     *zap.Logger
+	instances  map[string]AuthorisationProvider
+}
+
+// chain returns a provider which tries providers of several auth types, and lets anonymous clients in if there is a policy for them
+func (factory *providerFactory) chain(providerTypes []string, mode string, anonymous *config.Anonymous) (AuthorisationProvider, error) {
+	var requireAll bool
+	switch mode {
+	case "", "first":
+	case "all":
+		requireAll = true
+	default:
+		return nil, fmt.Errorf("invalid auth mode: %s", mode)
+	}
+
+	providers := make([]AuthorisationProvider, 0, len(providerTypes))
+	for _, providerType := range providerTypes {
+		provider, err := factory.provider(providerType)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, provider)
+	}
+
+	var provider AuthorisationProvider
+	switch len(providers) {
+	case 0:
+	case 1:
+		provider = providers[0]
+	default:
+		provider = NewChain(providers, requireAll)
+	}
+
+	if anonymous != nil {
+		var acl *Acl
+		if anonymous.Acl != nil {
+			var err error
+			if acl, err = LoadAcl(anonymous.Acl); err != nil {
+				return nil, fmt.Errorf("ACL of anonymous clients: %w", err)
+			}
+		}
+		provider = NewAnonymousProvider(provider, anonymous.Username, acl)
+	}
+	return provider, nil
+}
+
+// provider returns the provider of an auth type, which is created once
+func (factory *providerFactory) provider(providerType string) (provider AuthorisationProvider, err error) {
+	if provider, ok := factory.instances[providerType]; ok {
+		return provider, nil
+	}
+
+	authConfig := factory.authConfig
+	switch providerType {
 	case "ldap":
-		provider = &LdapAuthImpl{config: config}
+		provider, err = NewLdapAuthImpl(authConfig)
+		break
+	case "file":
+		provider, err = NewFileAuthImpl(authConfig.PasswordFile, factory.logger)
+		break
+	case "jwt":
+		provider, err = NewJwtAuthImpl(authConfig.Jwt)
+		break
+	case "certificate":
+		provider, err = NewCertificateAuthImpl(authConfig.CertificateUsername)
+		break
+	case "http":
+		provider, err = NewHttpAuthImpl(authConfig.Http, factory.logger)
 		break
 	default:
 		err = errors.New("no valid auth provider found")
 	}
 
-	return
+	if err != nil {
+		return nil, err
+	}
+	factory.instances[providerType] = provider
+	return provider, nil
 }
@@ -0,0 +1,432 @@
+package bridge
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/c16a/hermes/lib/config"
+	"github.com/c16a/hermes/lib/mqtt"
+	"github.com/c16a/hermes/lib/utils"
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bridgeUserProperty marks messages which have been forwarded over a bridge,
+// so that they are not forwarded back to where they came from
+const bridgeUserProperty = "hermes-bridge"
+
+const (
+	defaultKeepAlive         = 30
+	defaultMinReconnectDelay = 1
+	defaultMaxReconnectDelay = 60
+	defaultQueueSize         = 1024
+)
+
+// StartBridges starts a bridge for every remote broker in the configuration.
+//
+// The bridges keep running until they are closed, which must happen before the persistence provider is closed.
+func StartBridges(serverConfig *config.Config, ctx *mqtt.ServerContext, logger *zap.Logger) []io.Closer {
+	var bridges []io.Closer
+	for _, bridgeConfig := range serverConfig.Server.Bridges {
+		b := newBridge(bridgeConfig, ctx, logger)
+		go b.run()
+		bridges = append(bridges, b)
+	}
+	return bridges
+}
+
+// bridge forwards messages between this broker and a remote broker.
+//
+// Locally, the bridge is an internal client with a persistent session. While the link to
+// the remote broker is down, that client is disconnected, so outbound messages are saved
+// by the persistence provider and forwarded once the link is back up.
+type bridge struct {
+	config *config.Bridge
+	ctx    *mqtt.ServerContext
+	logger *zap.Logger
+
+	clientID  string
+	localConn io.Writer
+	outbound  chan *packets.Publish
+
+	mu     sync.Mutex
+	client *paho.Client
+	ready  chan struct{}
+
+	// stopped is cancelled once the bridge is closed
+	stopped context.Context
+	stop    context.CancelFunc
+}
+
+func newBridge(bridgeConfig *config.Bridge, ctx *mqtt.ServerContext, logger *zap.Logger) *bridge {
+	clientID := bridgeConfig.ClientID
+	if len(clientID) == 0 {
+		clientID = fmt.Sprintf("hermes-bridge-%s", bridgeConfig.Name)
+	}
+
+	queueSize := bridgeConfig.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+
+	b := &bridge{
+		config:   bridgeConfig,
+		ctx:      ctx,
+		logger:   logger.With(zap.String("bridge", bridgeConfig.Name)),
+		clientID: clientID,
+		outbound: make(chan *packets.Publish, queueSize),
+		ready:    make(chan struct{}),
+	}
+	b.localConn = mqtt.NewInternalConnection(b.enqueue)
+	b.stopped, b.stop = context.WithCancel(context.Background())
+	return b
+}
+
+// Close takes the link to the remote broker down for good.
+//
+// The local client is disconnected, so that its persistent session keeps outbound messages for the next start.
+// Messages still waiting in the outbound queue are lost.
+func (b *bridge) Close() error {
+	b.stop()
+	b.disconnect()
+	return nil
+}
+
+// disconnect takes the link down, and disconnects the local client
+func (b *bridge) disconnect() {
+	b.mu.Lock()
+	client := b.client
+	if client != nil {
+		b.client = nil
+		b.ready = make(chan struct{})
+	}
+	b.mu.Unlock()
+
+	if client != nil {
+		_ = client.Disconnect(&paho.Disconnect{})
+	}
+	b.ctx.Disconnect(b.localConn, &packets.Disconnect{})
+}
+
+func (b *bridge) run() {
+	b.subscribeLocally()
+	go b.forwardOutbound()
+
+	minDelay := time.Duration(b.config.MinReconnectDelay) * time.Second
+	if minDelay <= 0 {
+		minDelay = defaultMinReconnectDelay * time.Second
+	}
+	maxDelay := time.Duration(b.config.MaxReconnectDelay) * time.Second
+	if maxDelay < minDelay {
+		maxDelay = defaultMaxReconnectDelay * time.Second
+	}
+
+	delay := minDelay
+	for {
+		down, err := b.connect()
+		if b.stopped.Err() != nil {
+			// the bridge was closed while connecting
+			b.disconnect()
+			return
+		}
+		if err != nil {
+			b.logger.Error(fmt.Sprintf("Could not connect to %s, retrying in %s", b.config.Address, delay), zap.Error(err))
+			select {
+			case <-b.stopped.Done():
+				return
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > maxDelay {
+				delay = maxDelay
+			}
+			continue
+		}
+
+		b.logger.Info(fmt.Sprintf("Connected to %s", b.config.Address))
+		delay = minDelay
+		select {
+		case <-down:
+		case <-b.stopped.Done():
+			// Close takes the link down
+			return
+		}
+
+		b.logger.Info(fmt.Sprintf("Lost connection to %s", b.config.Address))
+		b.setClient(nil)
+		b.ctx.Disconnect(b.localConn, &packets.Disconnect{})
+	}
+}
+
+// subscribeLocally subscribes to all outbound topics on this broker.
+//
+// The local client starts off disconnected, so that messages are buffered until the link is up.
+func (b *bridge) subscribeLocally() {
+	subscriptions := make(map[string]packets.SubOptions, 0)
+	for _, topic := range b.config.Out {
+		subscriptions[topic.LocalPrefix+topic.Filter] = packets.SubOptions{QoS: topic.QoS}
+	}
+
+	b.ctx.AddInternalClient(b.localConn, b.clientID)
+	if len(subscriptions) > 0 {
+		b.ctx.Subscribe(b.localConn, &packets.Subscribe{Subscriptions: subscriptions})
+	}
+	b.ctx.Disconnect(b.localConn, &packets.Disconnect{})
+}
+
+// connect establishes the link to the remote broker, and returns a channel
+// which is closed once the link goes down again.
+func (b *bridge) connect() (<-chan struct{}, error) {
+	conn, err := b.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	down := make(chan struct{})
+	var once sync.Once
+	linkDown := func() {
+		once.Do(func() { close(down) })
+	}
+
+	client := paho.NewClient(paho.ClientConfig{
+		ClientID: b.clientID,
+		Conn:     conn,
+		Router:   paho.NewSingleHandlerRouter(b.receive),
+		OnClientError: func(err error) {
+			b.logger.Error("bridge connection failed", zap.Error(err))
+			linkDown()
+		},
+		OnServerDisconnect: func(disconnect *paho.Disconnect) {
+			b.logger.Info(fmt.Sprintf("Remote broker sent DISCONNECT with reason code %d", disconnect.ReasonCode))
+			linkDown()
+		},
+	})
+
+	keepAlive := b.config.KeepAlive
+	if keepAlive == 0 {
+		keepAlive = defaultKeepAlive
+	}
+
+	connectCtx, cancel := context.WithTimeout(b.stopped, 10*time.Second)
+	defer cancel()
+
+	// the remote session is kept, so that the remote broker buffers
+	// inbound messages for us while the link is down
+	_, err = client.Connect(connectCtx, &paho.Connect{
+		ClientID:     b.clientID,
+		KeepAlive:    keepAlive,
+		CleanStart:   false,
+		Username:     b.config.Username,
+		UsernameFlag: len(b.config.Username) > 0,
+		Password:     []byte(b.config.Password),
+		PasswordFlag: len(b.config.Password) > 0,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b.config.In) > 0 {
+		subscriptions := make(map[string]paho.SubscribeOptions, 0)
+		for _, topic := range b.config.In {
+			subscriptions[topic.RemotePrefix+topic.Filter] = paho.SubscribeOptions{
+				QoS:     topic.QoS,
+				NoLocal: true,
+			}
+		}
+		if _, err = client.Subscribe(connectCtx, &paho.Subscribe{Subscriptions: subscriptions}); err != nil {
+			_ = client.Disconnect(&paho.Disconnect{})
+			return nil, err
+		}
+	}
+
+	b.setClient(client)
+	// resuming the local session delivers everything buffered while the link was down
+	b.ctx.AddInternalClient(b.localConn, b.clientID)
+	return down, nil
+}
+
+func (b *bridge) dial() (net.Conn, error) {
+	if !b.config.Tls {
+		return net.DialTimeout("tcp", b.config.Address, 10*time.Second)
+	}
+
+	tlsConfig := &tls.Config{}
+	if len(b.config.CaFile) > 0 {
+		caBytes, err := ioutil.ReadFile(b.config.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBytes) {
+			return nil, errors.New("no certificates found in CA file")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", b.config.Address, tlsConfig)
+}
+
+// enqueue is called for every message delivered to the local bridge client.
+//
+// It must not block the delivery to other subscribers, so messages are dropped while the outbound queue is full.
+func (b *bridge) enqueue(publish *packets.Publish) {
+	if forwardedBy(publish.Properties) == b.config.Name {
+		// this message came in over this bridge, so don't send it back
+		return
+	}
+	select {
+	case b.outbound <- publish:
+	default:
+		b.ctx.Metrics().BridgeDropped(b.config.Name)
+		b.logger.Debug(fmt.Sprintf("Dropping message to %s, the outbound queue is full", publish.Topic))
+	}
+}
+
+// forwardOutbound publishes queued local messages to the remote broker,
+// holding on to a message until the link is up to deliver it, or the bridge is closed.
+func (b *bridge) forwardOutbound() {
+	for {
+		var publish *packets.Publish
+		select {
+		case <-b.stopped.Done():
+			return
+		case publish = <-b.outbound:
+		}
+
+		topic, qos, ok := b.mapTopic(publish.Topic, b.config.Out, false)
+		if !ok {
+			continue
+		}
+		if publish.QoS < qos {
+			qos = publish.QoS
+		}
+
+		if publish.Properties == nil {
+			publish.Properties = &packets.Properties{}
+		}
+		remotePublish := paho.PublishFromPacketPublish(publish)
+		remotePublish.Topic = topic
+		remotePublish.QoS = qos
+		remotePublish.PacketID = 0
+		remotePublish.Properties.User = markForwarded(remotePublish.Properties.User, b.config.Name)
+
+		for {
+			client := b.waitForClient()
+			if client == nil {
+				return
+			}
+			publishCtx, cancel := context.WithTimeout(b.stopped, 10*time.Second)
+			_, err := client.Publish(publishCtx, remotePublish)
+			cancel()
+			if err == nil {
+				break
+			}
+			b.logger.Error(fmt.Sprintf("failed to forward message to %s", topic), zap.Error(err))
+			select {
+			case <-b.stopped.Done():
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}
+}
+
+// receive is called for every message received from the remote broker
+func (b *bridge) receive(remotePublish *paho.Publish) {
+	if forwardedBy(remotePublish.Packet().Properties) == b.config.Name {
+		// this message went out over this bridge, and came straight back
+		return
+	}
+
+	topic, qos, ok := b.mapTopic(remotePublish.Topic, b.config.In, true)
+	if !ok {
+		return
+	}
+	if remotePublish.QoS < qos {
+		qos = remotePublish.QoS
+	}
+
+	publish := remotePublish.Packet()
+	publish.Topic = topic
+	publish.QoS = qos
+	publish.PacketID = 0
+	if publish.Properties == nil {
+		publish.Properties = &packets.Properties{}
+	}
+	publish.Properties.User = append(publish.Properties.User, packets.User{Key: bridgeUserProperty, Value: b.config.Name})
+	b.ctx.Publish(b.localConn, publish)
+}
+
+// mapTopic finds the bridge topic matching a topic, and swaps its prefix.
+//
+// If fromRemote is set, the remote prefix is swapped for the local prefix, and vice versa.
+func (b *bridge) mapTopic(topic string, bridgeTopics []*config.BridgeTopic, fromRemote bool) (string, byte, bool) {
+	for _, bridgeTopic := range bridgeTopics {
+		fromPrefix, toPrefix := bridgeTopic.LocalPrefix, bridgeTopic.RemotePrefix
+		if fromRemote {
+			fromPrefix, toPrefix = toPrefix, fromPrefix
+		}
+		if !strings.HasPrefix(topic, fromPrefix) {
+			continue
+		}
+		if matches, _, _ := utils.TopicMatches(strings.TrimPrefix(topic, fromPrefix), bridgeTopic.Filter); matches {
+			return toPrefix + strings.TrimPrefix(topic, fromPrefix), bridgeTopic.QoS, true
+		}
+	}
+	return "", 0, false
+}
+
+func (b *bridge) setClient(client *paho.Client) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.client = client
+	if client != nil {
+		close(b.ready)
+	} else {
+		b.ready = make(chan struct{})
+	}
+}
+
+// waitForClient returns the client of the link once it is up, or nil once the bridge is closed
+func (b *bridge) waitForClient() *paho.Client {
+	for {
+		b.mu.Lock()
+		client, ready := b.client, b.ready
+		b.mu.Unlock()
+
+		if b.stopped.Err() != nil {
+			return nil
+		}
+		if client != nil {
+			return client
+		}
+		select {
+		case <-ready:
+		case <-b.stopped.Done():
+		}
+	}
+}
+
+func forwardedBy(properties *packets.Properties) string {
+	if properties == nil {
+		return ""
+	}
+	for _, user := range properties.User {
+		if user.Key == bridgeUserProperty {
+			return user.Value
+		}
+	}
+	return ""
+}
+
+func markForwarded(userProperties paho.UserProperties, name string) paho.UserProperties {
+	return append(userProperties, paho.UserProperty{Key: bridgeUserProperty, Value: name})
+}
@@ -0,0 +1,173 @@
+package bridge
+
+import (
+	"github.com/c16a/hermes/lib/config"
+	"github.com/c16a/hermes/lib/mqtt"
+	"github.com/eclipse/paho.golang/packets"
+	"go.uber.org/zap"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBridge(t *testing.T) {
+	logger := zap.NewNop()
+
+	remoteCtx, err := mqtt.NewServerContext(&config.Config{
+		Server: &config.Server{
+			MaxQos:      2,
+			Persistence: &config.Persistence{},
+		},
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go mqtt.HandleMqttConnection(conn, remoteCtx)
+		}
+	}()
+
+	localConfig := &config.Config{
+		Server: &config.Server{
+			MaxQos:      2,
+			Persistence: &config.Persistence{},
+			Bridges: []*config.Bridge{
+				{
+					Name:    "central",
+					Address: listener.Addr().String(),
+					Out: []*config.BridgeTopic{
+						{Filter: "telemetry/#", RemotePrefix: "site1/", QoS: 1},
+					},
+					In: []*config.BridgeTopic{
+						{Filter: "commands/#", RemotePrefix: "site1/", QoS: 1},
+					},
+				},
+			},
+		},
+	}
+	localCtx, err := mqtt.NewServerContext(localConfig, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bridges := StartBridges(localConfig, localCtx, logger)
+
+	tests := []struct {
+		name         string
+		publishCtx   *mqtt.ServerContext
+		publishTopic string
+		observeCtx   *mqtt.ServerContext
+		observeTopic string
+	}{
+		{
+			"Local to remote with prefix",
+			localCtx,
+			"telemetry/temp",
+			remoteCtx,
+			"site1/telemetry/temp",
+		},
+		{
+			"Remote to local with prefix stripped",
+			remoteCtx,
+			"site1/commands/reboot",
+			localCtx,
+			"commands/reboot",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received := make(chan *packets.Publish, 100)
+			observer := mqtt.NewInternalConnection(func(publish *packets.Publish) {
+				received <- publish
+			})
+			tt.observeCtx.AddInternalClient(observer, "observer-"+tt.name)
+			tt.observeCtx.Subscribe(observer, &packets.Subscribe{
+				Subscriptions: map[string]packets.SubOptions{"#": {QoS: 1}},
+			})
+
+			// the bridge connects in the background, so keep publishing until it is up
+			ticker := time.NewTicker(100 * time.Millisecond)
+			defer ticker.Stop()
+			timeout := time.After(5 * time.Second)
+			for {
+				select {
+				case publish := <-received:
+					if publish.Topic == tt.observeTopic {
+						if string(publish.Payload) != "Hello World" {
+							t.Errorf("received payload %s", publish.Payload)
+						}
+						return
+					}
+				case <-ticker.C:
+					tt.publishCtx.Publish(nil, &packets.Publish{
+						Topic:   tt.publishTopic,
+						Payload: []byte("Hello World"),
+						QoS:     1,
+					})
+				case <-timeout:
+					t.Fatalf("no message received on %s", tt.observeTopic)
+				}
+			}
+		})
+	}
+
+	for _, b := range bridges {
+		if err := b.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// both ends of the link see the bridge client disconnect
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		remote, err := remoteCtx.Session("hermes-bridge-central")
+		if err != nil {
+			t.Fatal(err)
+		}
+		local, err := localCtx.Session("hermes-bridge-central")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !remote.Connected && !local.Connected {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("bridge is still connected after it was closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBridge_EnqueueFullQueue(t *testing.T) {
+	logger := zap.NewNop()
+	ctx, err := mqtt.NewServerContext(&config.Config{Server: &config.Server{MaxQos: 2}}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newBridge(&config.Bridge{Name: "central", QueueSize: 16}, ctx, logger)
+	for i := 0; i < 16; i++ {
+		b.enqueue(&packets.Publish{Topic: "telemetry/a"})
+	}
+
+	enqueued := make(chan struct{})
+	go func() {
+		b.enqueue(&packets.Publish{Topic: "telemetry/a"})
+		close(enqueued)
+	}()
+	select {
+	case <-enqueued:
+	case <-time.After(time.Second):
+		t.Fatal("enqueue() blocked on a full outbound queue")
+	}
+	if len(b.outbound) != 16 {
+		t.Errorf("outbound queue holds %d messages, want %d", len(b.outbound), 16)
+	}
+}
@@ -0,0 +1,693 @@
+package cluster
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/c16a/hermes/lib/config"
+	"github.com/c16a/hermes/lib/mqtt"
+	"github.com/c16a/hermes/lib/utils"
+	"github.com/eclipse/paho.golang/packets"
+	"go.uber.org/zap"
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	messageHello byte = iota + 1
+	messageInterest
+	messagePublish
+	messageTakeover
+	messageSession
+	messageOwned
+	messageEnded
+	messageChallenge
+	messageResponse
+)
+
+const (
+	minReconnectDelay = 500 * time.Millisecond
+	maxReconnectDelay = 30 * time.Second
+	handshakeTimeout  = 10 * time.Second
+	takeoverTimeout   = 5 * time.Second
+	writeTimeout      = 10 * time.Second
+	outboxSize        = 1024
+
+	// nonceSize is the size of the challenges exchanged by nodes, which are answered with
+	// an HMAC of the challenge keyed with the secret shared by all nodes
+	nonceSize = 32
+
+	// interestDelay gathers changes of the local topic filters, so that a burst
+	// of subscriptions only rebuilds and advertises them once
+	interestDelay = 50 * time.Millisecond
+)
+
+// message is exchanged between nodes, gob encoded
+type message struct {
+	Type    byte
+	NodeID  string
+	Filters []string
+
+	// Nonce challenges the other node to prove it knows the shared secret, and MAC answers the challenge
+	Nonce   []byte
+	MAC     []byte
+	Publish *packets.Publish
+
+	RequestID uint64
+	ClientID  string
+	Session   *mqtt.SessionState
+
+	// ClientIDs are the clients whose sessions the sending node owns, or no longer owns
+	ClientIDs []string
+}
+
+// Node is this broker's membership in a cluster of Hermes nodes.
+//
+// Every node dials every other node, and uses that connection to advertise the topic
+// filters it has subscribers for, and to forward messages the other node is interested in.
+// Messages received from other nodes are only delivered to local subscribers.
+type Node struct {
+	id       string
+	secret   string
+	ctx      *mqtt.ServerContext
+	logger   *zap.Logger
+	listener net.Listener
+	done     chan struct{}
+
+	mu       sync.RWMutex
+	closed   bool
+	joined   map[string]bool
+	links    map[string]*link
+	incoming map[string]net.Conn
+	interest map[string][]string
+
+	// owners maps client IDs to the ID of the node owning their session, as announced by the nodes
+	owners        map[string]string
+	pending       map[uint64]chan *message
+	lastRequestID uint64
+
+	// interestMu serialises advertising local topic filters,
+	// so that nodes never receive an outdated set after a newer one
+	interestMu      sync.Mutex
+	filters         []string
+	interestPending bool
+}
+
+// link is an outgoing connection to another node
+type link struct {
+	nodeID  string
+	conn    net.Conn
+	encoder *gob.Encoder
+	decoder *gob.Decoder
+	outbox  chan *message
+	done    chan struct{}
+	once    sync.Once
+}
+
+// StartCluster joins this broker to the cluster, either by relaying messages through Redis,
+// or by listening for other nodes and connecting to all configured peers.
+//
+// If clustering is not configured, no node is started and nil is returned.
+func StartCluster(serverConfig *config.Config, ctx *mqtt.ServerContext, logger *zap.Logger) (mqtt.ClusterNode, error) {
+	clusterConfig := serverConfig.Server.Cluster
+	if clusterConfig == nil {
+		return nil, nil
+	}
+	// returning the concrete types directly would turn a nil node into a non-nil interface
+	if clusterConfig.Redis != nil {
+		relay, err := startRedisRelay(clusterConfig, ctx, logger)
+		if err != nil {
+			return nil, err
+		}
+		return relay, nil
+	}
+	node, err := startNode(clusterConfig, ctx, logger)
+	if err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+func startNode(clusterConfig *config.Cluster, ctx *mqtt.ServerContext, logger *zap.Logger) (*Node, error) {
+	if len(clusterConfig.Peers) > 0 && len(clusterConfig.Secret) == 0 {
+		return nil, errors.New("cluster secret missing")
+	}
+
+	listener, err := net.Listen("tcp", clusterConfig.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	nodeID := clusterConfig.NodeID
+	if len(nodeID) == 0 {
+		nodeID = listener.Addr().String()
+	}
+
+	node := &Node{
+		id:       nodeID,
+		secret:   clusterConfig.Secret,
+		ctx:      ctx,
+		logger:   logger.With(zap.String("node", nodeID)),
+		listener: listener,
+		done:     make(chan struct{}),
+		joined:   make(map[string]bool, 0),
+		links:    make(map[string]*link, 0),
+		incoming: make(map[string]net.Conn, 0),
+		interest: make(map[string][]string, 0),
+		owners:   make(map[string]string, 0),
+		pending:  make(map[uint64]chan *message, 0),
+	}
+
+	node.logger.Info(fmt.Sprintf("Starting cluster listener on %s", listener.Addr().String()))
+	go node.acceptLoop()
+
+	for _, peer := range clusterConfig.Peers {
+		node.Join(peer)
+	}
+	ctx.JoinCluster(node)
+	return node, nil
+}
+
+// ID returns the ID of this node within the cluster
+func (node *Node) ID() string {
+	return node.id
+}
+
+// Addr returns the address this node listens on for other nodes
+func (node *Node) Addr() string {
+	return node.listener.Addr().String()
+}
+
+// Join connects to another node, and keeps reconnecting whenever the connection is lost
+func (node *Node) Join(address string) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	if node.joined[address] {
+		return
+	}
+	node.joined[address] = true
+	go node.maintainLink(address)
+}
+
+// Forward implements mqtt.ClusterNode
+func (node *Node) Forward(publish *packets.Publish) {
+	node.mu.RLock()
+	var targets []*link
+	for nodeID, filters := range node.interest {
+		if l, ok := node.links[nodeID]; ok && matchesAny(publish.Topic, filters) {
+			targets = append(targets, l)
+		}
+	}
+	node.mu.RUnlock()
+
+	for _, l := range targets {
+		l.send(&message{Type: messagePublish, Publish: publish})
+	}
+}
+
+// InterestChanged implements mqtt.ClusterNode.
+//
+// The topic filters are advertised shortly after, together with any other changes in the meantime.
+func (node *Node) InterestChanged() {
+	node.interestMu.Lock()
+	defer node.interestMu.Unlock()
+
+	if node.interestPending {
+		return
+	}
+	node.interestPending = true
+	time.AfterFunc(interestDelay, node.advertiseInterest)
+}
+
+// advertiseInterest sends the local topic filters to every other node, if they changed
+func (node *Node) advertiseInterest() {
+	node.interestMu.Lock()
+	defer node.interestMu.Unlock()
+
+	node.interestPending = false
+	filters := node.ctx.TopicFilters()
+	if reflect.DeepEqual(filters, node.filters) {
+		return
+	}
+	node.filters = filters
+
+	for _, l := range node.currentLinks() {
+		l.send(&message{Type: messageInterest, Filters: filters})
+	}
+}
+
+// currentLinks returns the links to all other nodes
+func (node *Node) currentLinks() []*link {
+	node.mu.RLock()
+	defer node.mu.RUnlock()
+
+	links := make([]*link, 0, len(node.links))
+	for _, l := range node.links {
+		links = append(links, l)
+	}
+	return links
+}
+
+// TakeOver implements mqtt.ClusterNode.
+//
+// Only the node owning the session of the client is asked to hand it over. Every other node is told that this node owns it now.
+func (node *Node) TakeOver(clientID string) *mqtt.SessionState {
+	requestID := atomic.AddUint64(&node.lastRequestID, 1)
+
+	node.mu.Lock()
+	owner := node.owners[clientID]
+	node.owners[clientID] = node.id
+	ownerLink, ok := node.links[owner]
+	if owner == node.id {
+		ok = false
+	}
+	replies := make(chan *message, 1)
+	if ok {
+		node.pending[requestID] = replies
+	}
+	others := make([]*link, 0, len(node.links))
+	for nodeID, l := range node.links {
+		if nodeID != owner {
+			others = append(others, l)
+		}
+	}
+	node.mu.Unlock()
+
+	for _, l := range others {
+		l.send(&message{Type: messageOwned, ClientIDs: []string{clientID}})
+	}
+	if !ok {
+		// no other node owns the session, or the one owning it is gone
+		return nil
+	}
+
+	defer func() {
+		node.mu.Lock()
+		delete(node.pending, requestID)
+		node.mu.Unlock()
+	}()
+
+	ownerLink.send(&message{Type: messageTakeover, RequestID: requestID, ClientID: clientID})
+	select {
+	case reply := <-replies:
+		return reply.Session
+	case <-time.After(takeoverTimeout):
+		node.logger.Error(fmt.Sprintf("Timed out taking over session for clientID: %s from node %s", clientID, owner))
+		return nil
+	}
+}
+
+// SessionEnded implements mqtt.SessionTracker, and tells every other node that this node no longer owns the session
+func (node *Node) SessionEnded(clientID string) {
+	node.mu.Lock()
+	owned := node.owners[clientID] == node.id
+	if owned {
+		delete(node.owners, clientID)
+	}
+	node.mu.Unlock()
+
+	if !owned {
+		return
+	}
+	for _, l := range node.currentLinks() {
+		l.send(&message{Type: messageEnded, ClientIDs: []string{clientID}})
+	}
+}
+
+// Owner returns the ID of the node owning the session of a client,
+// or an empty string if no node owns it
+func (node *Node) Owner(clientID string) string {
+	node.mu.RLock()
+	defer node.mu.RUnlock()
+	return node.owners[clientID]
+}
+
+func (node *Node) maintainLink(address string) {
+	delay := minReconnectDelay
+	for {
+		l, err := node.dial(address)
+		if err == errSelf {
+			return
+		}
+		if err != nil {
+			node.logger.Error(fmt.Sprintf("Could not connect to node at %s, retrying in %s", address, delay), zap.Error(err))
+			select {
+			case <-time.After(delay):
+			case <-node.done:
+				return
+			}
+			if delay *= 2; delay > maxReconnectDelay {
+				delay = maxReconnectDelay
+			}
+			continue
+		}
+
+		node.logger.Info(fmt.Sprintf("Connected to node %s at %s", l.nodeID, address))
+		delay = minReconnectDelay
+		node.serveLink(l)
+
+		select {
+		case <-node.done:
+			return
+		default:
+			node.logger.Info(fmt.Sprintf("Lost connection to node %s at %s", l.nodeID, address))
+		}
+	}
+}
+
+var errSelf = errors.New("cannot connect to self")
+
+// dial connects to another node, and exchanges hellos with it.
+//
+// Each node proves to the other that it knows the shared secret, by answering a challenge of the other node.
+func (node *Node) dial(address string) (*link, error) {
+	conn, err := net.DialTimeout("tcp", address, handshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// gob streams carry type information once, so the same encoder
+	// and decoder must be used for the lifetime of the connection
+	encoder, decoder := gob.NewEncoder(conn), gob.NewDecoder(conn)
+
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	reply, err := node.handshake(encoder, decoder)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	if reply.NodeID == node.id {
+		conn.Close()
+		return nil, errSelf
+	}
+
+	return &link{
+		nodeID:  reply.NodeID,
+		conn:    conn,
+		encoder: encoder,
+		decoder: decoder,
+		outbox:  make(chan *message, outboxSize),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// handshake sends a hello with a challenge, answers the challenge of the other node,
+// and returns its hello once it answered the challenge of this node
+func (node *Node) handshake(encoder *gob.Encoder, decoder *gob.Decoder) (*message, error) {
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	if err = encoder.Encode(&message{Type: messageHello, NodeID: node.id, Nonce: nonce}); err != nil {
+		return nil, err
+	}
+
+	var challenge message
+	if err = decoder.Decode(&challenge); err != nil {
+		return nil, err
+	}
+	if challenge.Type != messageChallenge {
+		return nil, errors.New("unexpected handshake reply")
+	}
+	if err = encoder.Encode(&message{Type: messageResponse, MAC: node.mac(messageResponse, challenge.Nonce)}); err != nil {
+		return nil, err
+	}
+
+	var reply message
+	if err = decoder.Decode(&reply); err != nil {
+		return nil, err
+	}
+	if reply.Type != messageHello {
+		return nil, errors.New("unexpected handshake reply")
+	}
+	if !hmac.Equal(reply.MAC, node.mac(messageHello, nonce)) {
+		return nil, errors.New("node at the other end does not know the cluster secret")
+	}
+	return &reply, nil
+}
+
+// authenticate challenges a node which connected to prove that it knows the shared secret,
+// and answers the challenge in its hello
+func (node *Node) authenticate(encoder *gob.Encoder, decoder *gob.Decoder, hello *message) bool {
+	if len(node.secret) == 0 {
+		return false
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return false
+	}
+	if err = encoder.Encode(&message{Type: messageChallenge, Nonce: nonce}); err != nil {
+		return false
+	}
+	var response message
+	if err = decoder.Decode(&response); err != nil || response.Type != messageResponse {
+		return false
+	}
+	if !hmac.Equal(response.MAC, node.mac(messageResponse, nonce)) {
+		return false
+	}
+	return encoder.Encode(&message{Type: messageHello, NodeID: node.id, MAC: node.mac(messageHello, hello.Nonce)}) == nil
+}
+
+// mac answers a challenge in a message of a type, so that the answer of one side can never be used for the other
+func (node *Node) mac(messageType byte, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(node.secret))
+	mac.Write([]byte{messageType})
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+	_, err := rand.Read(nonce)
+	return nonce, err
+}
+
+// serveLink writes queued messages to another node, until the connection is lost
+func (node *Node) serveLink(l *link) {
+	node.interestMu.Lock()
+	node.mu.Lock()
+	if node.closed {
+		node.mu.Unlock()
+		node.interestMu.Unlock()
+		l.close()
+		return
+	}
+	if existing, ok := node.links[l.nodeID]; ok {
+		existing.close()
+	}
+	node.links[l.nodeID] = l
+	var owned []string
+	for clientID, owner := range node.owners {
+		if owner == node.id {
+			owned = append(owned, clientID)
+		}
+	}
+	node.mu.Unlock()
+	// a new link starts off with the current topic filters of this node, and the sessions it owns
+	l.send(&message{Type: messageInterest, Filters: node.filters})
+	l.send(&message{Type: messageOwned, ClientIDs: owned})
+	node.interestMu.Unlock()
+
+	// the other node never writes after the handshake, so reading only detects a closed connection
+	go func() {
+		var ignored message
+		_ = l.decoder.Decode(&ignored)
+		l.close()
+	}()
+
+	for {
+		select {
+		case msg := <-l.outbox:
+			// a node which stops reading must not hold up this one
+			_ = l.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := l.encoder.Encode(msg); err != nil {
+				node.logger.Error(fmt.Sprintf("failed to send to node %s", l.nodeID), zap.Error(err))
+				l.close()
+			}
+		case <-l.done:
+			node.mu.Lock()
+			if node.links[l.nodeID] == l {
+				delete(node.links, l.nodeID)
+			}
+			node.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (node *Node) acceptLoop() {
+	for {
+		conn, err := node.listener.Accept()
+		if err != nil {
+			return
+		}
+		go node.handleIncoming(conn)
+	}
+}
+
+// handleIncoming reads topic filters and forwarded messages from another node
+func (node *Node) handleIncoming(conn net.Conn) {
+	defer conn.Close()
+
+	encoder, decoder := gob.NewEncoder(conn), gob.NewDecoder(conn)
+
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	var hello message
+	if err := decoder.Decode(&hello); err != nil || hello.Type != messageHello {
+		return
+	}
+	if !node.authenticate(encoder, decoder, &hello) {
+		node.logger.Error(fmt.Sprintf("Rejecting node %s which does not know the cluster secret", hello.NodeID))
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	remoteID := hello.NodeID
+	node.mu.Lock()
+	if node.closed {
+		node.mu.Unlock()
+		return
+	}
+	if existing, ok := node.incoming[remoteID]; ok {
+		existing.Close()
+	}
+	node.incoming[remoteID] = conn
+	node.mu.Unlock()
+
+	defer func() {
+		node.mu.Lock()
+		// the other node may have reconnected already
+		if node.incoming[remoteID] == conn {
+			delete(node.incoming, remoteID)
+			delete(node.interest, remoteID)
+			// the other node announces its sessions again once it reconnects
+			for clientID, owner := range node.owners {
+				if owner == remoteID {
+					delete(node.owners, clientID)
+				}
+			}
+		}
+		node.mu.Unlock()
+	}()
+
+	for {
+		var msg message
+		if err := decoder.Decode(&msg); err != nil {
+			return
+		}
+
+		switch msg.Type {
+		case messageInterest:
+			node.mu.Lock()
+			node.interest[remoteID] = msg.Filters
+			node.mu.Unlock()
+		case messagePublish:
+			if msg.Publish != nil {
+				node.ctx.RouteFromCluster(msg.Publish)
+			}
+		case messageTakeover:
+			node.handOver(remoteID, &msg)
+		case messageOwned:
+			node.mu.Lock()
+			for _, clientID := range msg.ClientIDs {
+				node.owners[clientID] = remoteID
+			}
+			node.mu.Unlock()
+		case messageEnded:
+			node.mu.Lock()
+			for _, clientID := range msg.ClientIDs {
+				if node.owners[clientID] == remoteID {
+					delete(node.owners, clientID)
+				}
+			}
+			node.mu.Unlock()
+		case messageSession:
+			node.mu.RLock()
+			replies, ok := node.pending[msg.RequestID]
+			node.mu.RUnlock()
+			if ok {
+				select {
+				case replies <- &msg:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// handOver releases the session of a client taken over by another node, and replies with its state
+func (node *Node) handOver(remoteID string, request *message) {
+	node.mu.Lock()
+	node.owners[request.ClientID] = remoteID
+	node.mu.Unlock()
+
+	state := node.ctx.ReleaseSession(request.ClientID)
+
+	node.mu.RLock()
+	l, ok := node.links[remoteID]
+	node.mu.RUnlock()
+	if !ok {
+		node.logger.Error(fmt.Sprintf("No connection to node %s to hand over session for clientID: %s", remoteID, request.ClientID))
+		return
+	}
+	l.send(&message{Type: messageSession, RequestID: request.RequestID, Session: state})
+}
+
+// Close leaves the cluster, and closes the connections to all other nodes
+func (node *Node) Close() error {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	if node.closed {
+		return nil
+	}
+	node.closed = true
+	close(node.done)
+
+	for _, l := range node.links {
+		l.close()
+	}
+	for _, conn := range node.incoming {
+		conn.Close()
+	}
+	return node.listener.Close()
+}
+
+// send queues a message for another node without blocking.
+//
+// If the other node falls so far behind that the queue is full, the link is closed. It is
+// established again, starting off with the current topic filters, but messages queued until then are lost.
+func (l *link) send(msg *message) {
+	select {
+	case l.outbox <- msg:
+	case <-l.done:
+	default:
+		l.close()
+	}
+}
+
+func (l *link) close() {
+	l.once.Do(func() {
+		close(l.done)
+		l.conn.Close()
+	})
+}
+
+func matchesAny(topic string, filters []string) bool {
+	for _, topicFilter := range filters {
+		if matches, _, _ := utils.TopicMatches(topic, topicFilter); matches {
+			return true
+		}
+	}
+	return false
+}
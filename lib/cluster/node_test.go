@@ -0,0 +1,287 @@
+package cluster
+
+import (
+	"bytes"
+	"github.com/c16a/hermes/lib/config"
+	"github.com/c16a/hermes/lib/mqtt"
+	"github.com/eclipse/paho.golang/packets"
+	"go.uber.org/zap"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func startTestNode(t *testing.T, nodeID string) (*Node, *mqtt.ServerContext) {
+	logger := zap.NewNop()
+	serverConfig := &config.Config{
+		Server: &config.Server{
+			MaxQos: 2,
+			Persistence: &config.Persistence{
+				Type:   "memory",
+				Badger: &config.Badger{MaxTableSize: 1 << 20, NumTables: 1},
+			},
+			Cluster: &config.Cluster{
+				NodeID:  nodeID,
+				Address: "127.0.0.1:0",
+				Secret:  "secret",
+			},
+		},
+	}
+	ctx, err := mqtt.NewServerContext(serverConfig, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, err := StartCluster(serverConfig, ctx, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return node.(*Node), ctx
+}
+
+func waitFor(t *testing.T, description string, condition func() bool) {
+	timeout := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(timeout) {
+			t.Fatalf("timed out waiting for %s", description)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (node *Node) interestOf(nodeID string) []string {
+	node.mu.RLock()
+	defer node.mu.RUnlock()
+	return node.interest[nodeID]
+}
+
+func (node *Node) linkCount() int {
+	node.mu.RLock()
+	defer node.mu.RUnlock()
+	return len(node.links)
+}
+
+func TestCluster(t *testing.T) {
+	nodes := make([]*Node, 3)
+	contexts := make([]*mqtt.ServerContext, 3)
+	for i, nodeID := range []string{"a", "b", "c"} {
+		nodes[i], contexts[i] = startTestNode(t, nodeID)
+	}
+	for _, node := range nodes {
+		for _, other := range nodes {
+			node.Join(other.Addr())
+		}
+	}
+	for _, node := range nodes {
+		waitFor(t, "links to every other node", func() bool { return node.linkCount() == len(nodes)-1 })
+	}
+
+	received := make(chan *packets.Publish, 10)
+	observer := mqtt.NewInternalConnection(func(publish *packets.Publish) {
+		received <- publish
+	})
+	contexts[2].AddInternalClient(observer, "observer")
+	contexts[2].Subscribe(observer, &packets.Subscribe{
+		Subscriptions: map[string]packets.SubOptions{"sensors/#": {QoS: 1}},
+	})
+
+	waitFor(t, "interest of node c", func() bool { return len(nodes[0].interestOf("c")) == 1 })
+	if filters := nodes[0].interestOf("b"); len(filters) != 0 {
+		t.Errorf("node b advertised filters %v without subscribers", filters)
+	}
+
+	tests := []struct {
+		name    string
+		topic   string
+		deliver bool
+	}{
+		{"Matching topic is forwarded", "sensors/temp", true},
+		{"Other topic is not forwarded", "actuators/fan", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contexts[0].Publish(nil, &packets.Publish{
+				Topic:   tt.topic,
+				Payload: []byte("Hello World"),
+				QoS:     1,
+			})
+
+			select {
+			case publish := <-received:
+				if !tt.deliver {
+					t.Fatalf("unexpected message on %s", publish.Topic)
+				}
+				if publish.Topic != tt.topic || string(publish.Payload) != "Hello World" {
+					t.Errorf("received %s on %s", publish.Payload, publish.Topic)
+				}
+			case <-time.After(500 * time.Millisecond):
+				if tt.deliver {
+					t.Fatalf("no message received on %s", tt.topic)
+				}
+			}
+		})
+	}
+
+	contexts[2].Unsubscribe(observer, &packets.Unsubscribe{Topics: []string{"sensors/#"}})
+	waitFor(t, "interest of node c to be withdrawn", func() bool { return len(nodes[0].interestOf("c")) == 0 })
+}
+
+func TestCluster_InvalidSecret(t *testing.T) {
+	node, _ := startTestNode(t, "a")
+	intruder, _ := startTestNode(t, "intruder")
+	intruder.secret = "wrong"
+
+	intruder.Join(node.Addr())
+	time.Sleep(200 * time.Millisecond)
+	if intruder.linkCount() != 0 {
+		t.Error("node with invalid secret joined the cluster")
+	}
+}
+
+func TestCluster_MissingSecret(t *testing.T) {
+	_, err := startNode(&config.Cluster{Address: "127.0.0.1:0", Peers: []string{"127.0.0.1:1"}}, nil, zap.NewNop())
+	if err == nil {
+		t.Error("node with peers started without a secret")
+	}
+}
+
+// recordingConn records everything written to it
+type recordingConn struct {
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	closed bool
+}
+
+func (conn *recordingConn) Write(p []byte) (int, error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.buf.Write(p)
+}
+
+func (conn *recordingConn) Close() error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.closed = true
+	return nil
+}
+
+func (conn *recordingConn) packets(t *testing.T) []*packets.ControlPacket {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	var controlPackets []*packets.ControlPacket
+	reader := bytes.NewReader(conn.buf.Bytes())
+	for reader.Len() > 0 {
+		cp, err := packets.ReadPacket(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		controlPackets = append(controlPackets, cp)
+	}
+	return controlPackets
+}
+
+func TestCluster_SessionTakeover(t *testing.T) {
+	nodeA, ctxA := startTestNode(t, "a")
+	nodeB, ctxB := startTestNode(t, "b")
+	nodeA.Join(nodeB.Addr())
+	nodeB.Join(nodeA.Addr())
+	waitFor(t, "links between nodes", func() bool { return nodeA.linkCount() == 1 && nodeB.linkCount() == 1 })
+
+	connect := &packets.Connect{ClientID: "durable", CleanStart: false}
+
+	// a persistent session on node a, with a message waiting for the disconnected client
+	connA := &recordingConn{}
+	ctxA.AddClient(connA, connect)
+	ctxA.Subscribe(connA, &packets.Subscribe{
+		Subscriptions: map[string]packets.SubOptions{"orders/#": {QoS: 1}},
+	})
+	ctxA.Disconnect(connA, &packets.Disconnect{})
+	ctxA.Publish(nil, &packets.Publish{Topic: "orders/1", Payload: []byte("first"), QoS: 1})
+	waitFor(t, "node b to learn the owner of the session", func() bool { return nodeB.Owner("durable") == "a" })
+
+	connB := &recordingConn{}
+	if _, sessionExists, _ := ctxB.AddClient(connB, connect); !sessionExists {
+		t.Fatal("session was not taken over by node b")
+	}
+	if owner := nodeA.Owner("durable"); owner != "b" {
+		t.Errorf("node a believes %s owns the session", owner)
+	}
+	if state := ctxA.ReleaseSession("durable"); state != nil {
+		t.Error("session was not removed from node a")
+	}
+
+	// the subscription moved along with the session
+	ctxB.Publish(nil, &packets.Publish{Topic: "orders/2", Payload: []byte("second"), QoS: 1})
+
+	var payloads []string
+	for _, cp := range connB.packets(t) {
+		if publish, ok := cp.Content.(*packets.Publish); ok {
+			payloads = append(payloads, string(publish.Payload))
+		}
+	}
+	if len(payloads) != 2 || payloads[0] != "first" || payloads[1] != "second" {
+		t.Errorf("node b delivered %v", payloads)
+	}
+
+	// connecting to node a again takes the session back, and disconnects the client from node b
+	if _, sessionExists, _ := ctxA.AddClient(&recordingConn{}, connect); !sessionExists {
+		t.Fatal("session was not taken back by node a")
+	}
+	controlPackets := connB.packets(t)
+	disconnect, ok := controlPackets[len(controlPackets)-1].Content.(*packets.Disconnect)
+	if !ok || disconnect.ReasonCode != packets.DisconnectSessionTakenOver {
+		t.Error("client was not sent a DISCONNECT with reason code Session taken over")
+	}
+	if !connB.closed {
+		t.Error("connection on node b was not closed")
+	}
+}
+
+func TestCluster_SessionOwners(t *testing.T) {
+	nodeA, ctxA := startTestNode(t, "a")
+	nodeB, _ := startTestNode(t, "b")
+	nodeA.Join(nodeB.Addr())
+	nodeB.Join(nodeA.Addr())
+	waitFor(t, "links between nodes", func() bool { return nodeA.linkCount() == 1 && nodeB.linkCount() == 1 })
+
+	// a session nobody else owns is claimed without waiting for other nodes
+	start := time.Now()
+	conn := &recordingConn{}
+	ctxA.AddClient(conn, &packets.Connect{ClientID: "fleeting", CleanStart: true})
+	if elapsed := time.Since(start); elapsed >= takeoverTimeout {
+		t.Errorf("claiming a new session took %s", elapsed)
+	}
+	waitFor(t, "node b to learn the owner of the session", func() bool { return nodeB.Owner("fleeting") == "a" })
+
+	// a clean session ends with its connection, and no node owns it any more
+	ctxA.Disconnect(conn, &packets.Disconnect{})
+	if owner := nodeA.Owner("fleeting"); owner != "" {
+		t.Errorf("node a believes %s owns an ended session", owner)
+	}
+	waitFor(t, "node b to forget the owner of the session", func() bool { return len(nodeB.Owner("fleeting")) == 0 })
+}
+
+func TestLink_SendToSlowNode(t *testing.T) {
+	conn, other := net.Pipe()
+	defer other.Close()
+	l := &link{nodeID: "slow", conn: conn, outbox: make(chan *message, 1), done: make(chan struct{})}
+
+	sent := make(chan struct{})
+	go func() {
+		l.send(&message{Type: messagePublish})
+		l.send(&message{Type: messagePublish})
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("send() blocked on a full outbox")
+	}
+
+	select {
+	case <-l.done:
+	default:
+		t.Error("link to a node which fell behind was not closed")
+	}
+}
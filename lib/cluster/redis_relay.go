@@ -0,0 +1,238 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"github.com/c16a/hermes/lib/config"
+	"github.com/c16a/hermes/lib/mqtt"
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/go-redis/redis/v8"
+	uuid "github.com/satori/go.uuid"
+	"go.uber.org/zap"
+	"strings"
+)
+
+const (
+	redisPublishChannel      = "hermes:cluster:publish"
+	redisNodeChannelPrefix   = "hermes:cluster:node:"
+	redisSessionOwnersKey    = "hermes:cluster:sessions"
+	redisTakeoverReplyPrefix = "hermes:cluster:takeover:"
+)
+
+// claimSession records a node as the owner of a session, and returns the previous owner
+var claimSession = redis.NewScript(`
+local owner = redis.call('HGET', KEYS[1], ARGV[1])
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+if owner then
+	return owner
+end
+return ''
+`)
+
+// releaseSession forgets the owner of a session, unless another node has claimed it meanwhile
+var releaseSession = redis.NewScript(`
+if redis.call('HGET', KEYS[1], ARGV[1]) == ARGV[2] then
+	return redis.call('HDEL', KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+// relayedPublish is a message relayed through Redis, tagged with the node it was published on
+type relayedPublish struct {
+	NodeID  string
+	Publish *packets.Publish
+}
+
+// takeoverRequest asks the node owning a session to hand it over
+type takeoverRequest struct {
+	ClientID string
+	ReplyKey string
+}
+
+// takeoverReply carries the state of a session handed over, which is nil if there was no session
+type takeoverReply struct {
+	Session *mqtt.SessionState
+}
+
+// RedisRelay connects stateless nodes sharing a Redis.
+//
+// Every message published on a node is relayed to all other nodes over Redis pub/sub,
+// tagged with the ID of the node so that it is not delivered twice there. Redis also
+// keeps track of which node owns the session of each client, until the session ends.
+type RedisRelay struct {
+	id     string
+	client *redis.Client
+	pubsub *redis.PubSub
+	ctx    *mqtt.ServerContext
+	logger *zap.Logger
+}
+
+func startRedisRelay(clusterConfig *config.Cluster, ctx *mqtt.ServerContext, logger *zap.Logger) (*RedisRelay, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     clusterConfig.Redis.Url,
+		Password: clusterConfig.Redis.Password,
+		DB:       0,
+	})
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	nodeID := clusterConfig.NodeID
+	if len(nodeID) == 0 {
+		nodeID = uuid.NewV4().String()
+	}
+
+	relay := &RedisRelay{
+		id:     nodeID,
+		client: client,
+		ctx:    ctx,
+		logger: logger.With(zap.String("node", nodeID)),
+	}
+
+	relay.pubsub = client.Subscribe(context.Background(), redisPublishChannel, redisNodeChannelPrefix+nodeID)
+	// wait for the subscription, so that no message is missed once this returns
+	if _, err := relay.pubsub.Receive(context.Background()); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	relay.logger.Info(fmt.Sprintf("Relaying messages through redis at %s", clusterConfig.Redis.Url))
+	go relay.receiveLoop()
+	ctx.JoinCluster(relay)
+	return relay, nil
+}
+
+// ID returns the ID of this node within the cluster
+func (relay *RedisRelay) ID() string {
+	return relay.id
+}
+
+// Forward implements mqtt.ClusterNode
+func (relay *RedisRelay) Forward(publish *packets.Publish) {
+	payload, err := encode(&relayedPublish{NodeID: relay.id, Publish: publish})
+	if err != nil {
+		relay.logger.Error("failed to encode message", zap.Error(err))
+		return
+	}
+	if err = relay.client.Publish(context.Background(), redisPublishChannel, payload).Err(); err != nil {
+		relay.logger.Error(fmt.Sprintf("failed to relay message to %s", publish.Topic), zap.Error(err))
+	}
+}
+
+// InterestChanged implements mqtt.ClusterNode.
+//
+// Redis pub/sub cannot filter by MQTT topic filters, so every node receives every message.
+func (relay *RedisRelay) InterestChanged() {}
+
+// TakeOver implements mqtt.ClusterNode.
+//
+// This node is atomically recorded as the owner of the session in Redis, and the previous owner, if any,
+// is asked to hand over the session.
+func (relay *RedisRelay) TakeOver(clientID string) *mqtt.SessionState {
+	background := context.Background()
+
+	owner, err := claimSession.Run(background, relay.client, []string{redisSessionOwnersKey}, clientID, relay.id).Text()
+	if err != nil {
+		relay.logger.Error("failed to record session owner", zap.Error(err))
+	}
+	if len(owner) == 0 || owner == relay.id {
+		return nil
+	}
+
+	request := &takeoverRequest{ClientID: clientID, ReplyKey: redisTakeoverReplyPrefix + uuid.NewV4().String()}
+	payload, err := encode(request)
+	if err != nil {
+		relay.logger.Error("failed to encode takeover request", zap.Error(err))
+		return nil
+	}
+	if err = relay.client.Publish(background, redisNodeChannelPrefix+owner, payload).Err(); err != nil {
+		relay.logger.Error("failed to request session takeover", zap.Error(err))
+		return nil
+	}
+
+	// the previous owner may be gone, in which case nobody replies
+	result, err := relay.client.BLPop(background, takeoverTimeout, request.ReplyKey).Result()
+	if err != nil {
+		relay.logger.Error(fmt.Sprintf("Timed out taking over session for clientID: %s", clientID), zap.Error(err))
+		return nil
+	}
+
+	var reply takeoverReply
+	if err = decode(result[1], &reply); err != nil {
+		relay.logger.Error("failed to decode session", zap.Error(err))
+		return nil
+	}
+	return reply.Session
+}
+
+// SessionEnded implements mqtt.SessionTracker, forgetting the owner of the session if it is still this node
+func (relay *RedisRelay) SessionEnded(clientID string) {
+	err := releaseSession.Run(context.Background(), relay.client, []string{redisSessionOwnersKey}, clientID, relay.id).Err()
+	if err != nil {
+		relay.logger.Error("failed to forget session owner", zap.Error(err))
+	}
+}
+
+// Close stops relaying messages, and disconnects from Redis
+func (relay *RedisRelay) Close() error {
+	_ = relay.pubsub.Close()
+	return relay.client.Close()
+}
+
+func (relay *RedisRelay) receiveLoop() {
+	for msg := range relay.pubsub.Channel() {
+		switch msg.Channel {
+		case redisPublishChannel:
+			var relayed relayedPublish
+			if err := decode(msg.Payload, &relayed); err != nil {
+				relay.logger.Error("failed to decode relayed message", zap.Error(err))
+				continue
+			}
+			if relayed.NodeID == relay.id || relayed.Publish == nil {
+				// already delivered when it was published here
+				continue
+			}
+			relay.ctx.RouteFromCluster(relayed.Publish)
+		default:
+			var request takeoverRequest
+			if err := decode(msg.Payload, &request); err != nil {
+				relay.logger.Error("failed to decode takeover request", zap.Error(err))
+				continue
+			}
+			relay.handOver(&request)
+		}
+	}
+}
+
+// handOver releases the session of a client taken over by another node, and replies with its state
+func (relay *RedisRelay) handOver(request *takeoverRequest) {
+	payload, err := encode(&takeoverReply{Session: relay.ctx.ReleaseSession(request.ClientID)})
+	if err != nil {
+		relay.logger.Error("failed to encode session", zap.Error(err))
+		return
+	}
+
+	_, err = relay.client.TxPipelined(context.Background(), func(pipeliner redis.Pipeliner) error {
+		pipeliner.RPush(context.Background(), request.ReplyKey, payload)
+		pipeliner.Expire(context.Background(), request.ReplyKey, takeoverTimeout)
+		return nil
+	})
+	if err != nil {
+		relay.logger.Error("failed to hand over session", zap.Error(err))
+	}
+}
+
+func encode(value interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decode(payload string, value interface{}) error {
+	return gob.NewDecoder(strings.NewReader(payload)).Decode(value)
+}
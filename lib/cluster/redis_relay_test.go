@@ -0,0 +1,134 @@
+package cluster
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"github.com/c16a/hermes/lib/config"
+	"github.com/c16a/hermes/lib/mqtt"
+	"github.com/eclipse/paho.golang/packets"
+	"go.uber.org/zap"
+	"testing"
+	"time"
+)
+
+func startTestRelay(t *testing.T, redisAddress string, nodeID string) (*RedisRelay, *mqtt.ServerContext) {
+	logger := zap.NewNop()
+	serverConfig := &config.Config{
+		Server: &config.Server{
+			MaxQos:      2,
+			Persistence: &config.Persistence{},
+			Cluster: &config.Cluster{
+				NodeID: nodeID,
+				Redis:  &config.Redis{Url: redisAddress},
+			},
+		},
+	}
+	ctx, err := mqtt.NewServerContext(serverConfig, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay, err := StartCluster(serverConfig, ctx, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return relay.(*RedisRelay), ctx
+}
+
+func TestRedisRelay(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	_, ctxA := startTestRelay(t, server.Addr(), "a")
+	_, ctxB := startTestRelay(t, server.Addr(), "b")
+
+	observers := make(map[*mqtt.ServerContext]chan *packets.Publish, 0)
+	for _, ctx := range []*mqtt.ServerContext{ctxA, ctxB} {
+		received := make(chan *packets.Publish, 10)
+		observer := mqtt.NewInternalConnection(func(publish *packets.Publish) {
+			received <- publish
+		})
+		ctx.AddInternalClient(observer, "observer")
+		ctx.Subscribe(observer, &packets.Subscribe{
+			Subscriptions: map[string]packets.SubOptions{"sensors/#": {QoS: 1}},
+		})
+		observers[ctx] = received
+	}
+
+	ctxA.Publish(nil, &packets.Publish{Topic: "sensors/temp", Payload: []byte("Hello World"), QoS: 1})
+
+	tests := []struct {
+		name string
+		ctx  *mqtt.ServerContext
+	}{
+		{"Delivered on the publishing node", ctxA},
+		{"Relayed to the other node", ctxB},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			select {
+			case publish := <-observers[tt.ctx]:
+				if publish.Topic != "sensors/temp" || string(publish.Payload) != "Hello World" {
+					t.Errorf("received %s on %s", publish.Payload, publish.Topic)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("no message received")
+			}
+
+			// the relayed copy must not be delivered again on the publishing node
+			select {
+			case publish := <-observers[tt.ctx]:
+				t.Errorf("message on %s delivered twice", publish.Topic)
+			case <-time.After(200 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestRedisRelay_SessionTakeover(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	relayA, ctxA := startTestRelay(t, server.Addr(), "a")
+	_, ctxB := startTestRelay(t, server.Addr(), "b")
+
+	connect := &packets.Connect{ClientID: "durable", CleanStart: false}
+	connA := &recordingConn{}
+	ctxA.AddClient(connA, connect)
+	ctxA.Subscribe(connA, &packets.Subscribe{
+		Subscriptions: map[string]packets.SubOptions{"orders/#": {QoS: 1}},
+	})
+
+	if _, sessionExists, _ := ctxB.AddClient(&recordingConn{}, connect); !sessionExists {
+		t.Fatal("session was not taken over by node b")
+	}
+	if owner := server.HGet(redisSessionOwnersKey, "durable"); owner != "b" {
+		t.Errorf("redis records %s as the owner", owner)
+	}
+
+	// a node no longer owning a session does not forget the owner when the session ends there
+	relayA.SessionEnded("durable")
+	if owner := server.HGet(redisSessionOwnersKey, "durable"); owner != "b" {
+		t.Errorf("redis records %s as the owner after the session ended on a previous owner", owner)
+	}
+
+	controlPackets := connA.packets(t)
+	if len(controlPackets) == 0 {
+		t.Fatal("client was not disconnected from node a")
+	}
+	disconnect, ok := controlPackets[len(controlPackets)-1].Content.(*packets.Disconnect)
+	if !ok || disconnect.ReasonCode != packets.DisconnectSessionTakenOver {
+		t.Error("client was not sent a DISCONNECT with reason code Session taken over")
+	}
+
+	if err = ctxB.DeleteSession("durable", packets.DisconnectNormalDisconnection); err != nil {
+		t.Fatal(err)
+	}
+	if owners, _ := server.HKeys(redisSessionOwnersKey); len(owners) > 0 {
+		t.Error("redis still records an owner of the ended session")
+	}
+}
@@ -12,20 +12,275 @@ type Server struct {
 	HttpAddress string       `json:"http,omitempty" yaml:"http,omitempty"`
 	MaxQos      byte         `json:"max_qos,omitempty" yaml:"max_qos,omitempty"`
 	Auth        *Auth        `json:"auth,omitempty" yaml:"auth,omitempty"`
+	Acl         *Acl         `json:"acl,omitempty" yaml:"acl,omitempty"`
 	Persistence *Persistence `json:"persistence,omitempty" yaml:"persistence,omitempty"`
+	Sys         *Sys         `json:"sys,omitempty" yaml:"sys,omitempty"`
+	Rewrites    []*Rewrite   `json:"rewrites,omitempty" yaml:"rewrites,omitempty"`
+	Bridges     []*Bridge    `json:"bridges,omitempty" yaml:"bridges,omitempty"`
+	Cluster     *Cluster     `json:"cluster,omitempty" yaml:"cluster,omitempty"`
+	Admin       *Admin       `json:"admin,omitempty" yaml:"admin,omitempty"`
+	Metrics     *Metrics     `json:"metrics,omitempty" yaml:"metrics,omitempty"`
+	Tracing     *Tracing     `json:"tracing,omitempty" yaml:"tracing,omitempty"`
+	RateLimits  *RateLimits  `json:"rate_limits,omitempty" yaml:"rate_limits,omitempty"`
+
+	// ShutdownTimeout is how long in seconds to wait for connections to be drained on shutdown
+	ShutdownTimeout int `json:"shutdown_timeout,omitempty" yaml:"shutdown_timeout,omitempty"`
+}
+
+// Admin stores the configuration of the admin HTTP API
+type Admin struct {
+	// Address is where the API listens, separately from the MQTT listeners
+	Address string `json:"address" yaml:"address"`
+
+	// Tokens are the bearer tokens allowed to use the API
+	Tokens []string `json:"tokens" yaml:"tokens"`
+
+	// Tls serves the API over HTTPS if set
+	Tls *Tls `json:"tls,omitempty" yaml:"tls,omitempty"`
+}
+
+// Metrics stores the configuration of the Prometheus metrics endpoint
+type Metrics struct {
+	// Address is where /metrics is served, separately from the MQTT listeners
+	Address string `json:"address" yaml:"address"`
+}
+
+// RateLimits stores the token bucket limits on what clients may do
+type RateLimits struct {
+	// Default limits every client without limits of its own. Users and Clients limit the clients of a username
+	// and clients by their client ID, and the limits of a client ID take precedence over those of a username.
+	// Every client has its own buckets.
+	Default *RateLimit            `json:"default,omitempty" yaml:"default,omitempty"`
+	Users   map[string]*RateLimit `json:"users,omitempty" yaml:"users,omitempty"`
+	Clients map[string]*RateLimit `json:"clients,omitempty" yaml:"clients,omitempty"`
+
+	// ConnectionsPerSecond limits the connection attempts from each IP address, with bursts of up to ConnectionBurst attempts
+	ConnectionsPerSecond float64 `json:"connections_per_second,omitempty" yaml:"connections_per_second,omitempty"`
+	ConnectionBurst      int     `json:"connection_burst,omitempty" yaml:"connection_burst,omitempty"`
+}
+
+// RateLimit stores the limits of a client. A rate which is not set is unlimited, and a burst defaults to one second of its rate.
+type RateLimit struct {
+	PublishesPerSecond float64 `json:"publishes_per_second,omitempty" yaml:"publishes_per_second,omitempty"`
+	PublishBurst       int     `json:"publish_burst,omitempty" yaml:"publish_burst,omitempty"`
+
+	// BytesPerSecond limits the payload bytes of published messages
+	BytesPerSecond float64 `json:"bytes_per_second,omitempty" yaml:"bytes_per_second,omitempty"`
+	ByteBurst      int     `json:"byte_burst,omitempty" yaml:"byte_burst,omitempty"`
+
+	// SubscribesPerSecond limits SUBSCRIBE packets, whatever the number of topic filters in them
+	SubscribesPerSecond float64 `json:"subscribes_per_second,omitempty" yaml:"subscribes_per_second,omitempty"`
+	SubscribeBurst      int     `json:"subscribe_burst,omitempty" yaml:"subscribe_burst,omitempty"`
+
+	// MaxViolations is the number of operations in a row which may exceed the limits before the client is disconnected.
+	// Clients are not disconnected if it is not set.
+	MaxViolations int `json:"max_violations,omitempty" yaml:"max_violations,omitempty"`
+}
+
+// Tracing stores the configuration of OpenTelemetry tracing
+type Tracing struct {
+	// Exporter is where spans are exported to, which is one of "otlp", "stdout" or "file"
+	Exporter string `json:"exporter" yaml:"exporter"`
+
+	// Endpoint is the host and port of the OTLP/HTTP receiver, which defaults to localhost:4318
+	Endpoint string `json:"endpoint,omitempty" yaml:"endpoint,omitempty"`
+
+	// Insecure exports over plain HTTP instead of HTTPS
+	Insecure bool `json:"insecure,omitempty" yaml:"insecure,omitempty"`
+
+	// Path is the file spans are appended to as JSON, for the file exporter
+	Path string `json:"path,omitempty" yaml:"path,omitempty"`
+
+	// ServiceName defaults to hermes
+	ServiceName string `json:"service_name,omitempty" yaml:"service_name,omitempty"`
+
+	// SampleRatio is the fraction of traces started by the broker which are sampled, and defaults to all of them.
+	// Messages which carry a trace context follow the sampling decision of their producer.
+	SampleRatio float64 `json:"sample_ratio,omitempty" yaml:"sample_ratio,omitempty"`
 }
 
 // Tls stores the TLS config for the server
 type Tls struct {
 	CertFile string `json:"cert,omitempty" yaml:"cert,omitempty"`
 	KeyFile  string `json:"key,omitempty" yaml:"key,omitempty"`
+
+	// ClientCaFile is a bundle of CA certificates client certificates are verified against
+	ClientCaFile string `json:"client_ca,omitempty" yaml:"client_ca,omitempty"`
+
+	// ClientAuth is "require" if clients must present a certificate, or "optional" if they may.
+	// It defaults to "require" if ClientCaFile is set.
+	ClientAuth string `json:"client_auth,omitempty" yaml:"client_auth,omitempty"`
+
+	// CrlFile is a certificate revocation list of the client CA, in PEM or DER format
+	CrlFile string `json:"crl,omitempty" yaml:"crl,omitempty"`
 }
 
+// Auth stores how clients are authenticated, and the configuration of each auth type
 type Auth struct {
-	Type     string `json:"type,omitempty" yaml:"type,omitempty"`
+	Type string `json:"type,omitempty" yaml:"type,omitempty"`
+
+	// Providers are auth types which are tried in order, and take precedence over Type.
+	// Mode is "first" if a client is let in by the first one which accepts it, or "all" if every one must accept it.
+	// It defaults to "first".
+	Providers []string `json:"providers,omitempty" yaml:"providers,omitempty"`
+	Mode      string   `json:"mode,omitempty" yaml:"mode,omitempty"`
+
+	// Anonymous lets clients without credentials in, if set
+	Anonymous *Anonymous `json:"anonymous,omitempty" yaml:"anonymous,omitempty"`
+
+	// Listeners authenticate the clients of a listener, which is "tcp" or "websocket", differently than the other listeners
+	Listeners map[string]*ListenerAuth `json:"listeners,omitempty" yaml:"listeners,omitempty"`
+
 	LdapHost string `json:"ldap_host,omitempty" yaml:"ldap_host,omitempty"`
 	LdapPort int    `json:"ldap_port,omitempty" yaml:"ldap_port,omitempty"`
 	LdapDn   string `json:"ldap_dn,omitempty" yaml:"ldap_dn,omitempty"`
+
+	// Ldap configures the ldap auth type. If it is not set, clients bind as cn=<username>,<LdapDn> on LdapHost and LdapPort.
+	Ldap *Ldap `json:"ldap,omitempty" yaml:"ldap,omitempty"`
+
+	// PasswordFile is the file of usernames and password hashes for the file auth type
+	PasswordFile string `json:"password_file,omitempty" yaml:"password_file,omitempty"`
+
+	Jwt *Jwt `json:"jwt,omitempty" yaml:"jwt,omitempty"`
+
+	// CertificateUsername is where the certificate auth type takes the username from, which is one of
+	// "cn" for the subject common name, or "san_dns", "san_email" or "san_uri" for the first subject alternative name
+	// of that type. It defaults to "cn".
+	CertificateUsername string `json:"certificate_username,omitempty" yaml:"certificate_username,omitempty"`
+
+	Http *HttpAuth `json:"http,omitempty" yaml:"http,omitempty"`
+}
+
+// ListenerAuth stores how the clients of a listener are authenticated, with the auth types of the auth section.
+// Clients of a listener without providers or anonymous access are not authenticated.
+type ListenerAuth struct {
+	Providers []string   `json:"providers,omitempty" yaml:"providers,omitempty"`
+	Mode      string     `json:"mode,omitempty" yaml:"mode,omitempty"`
+	Anonymous *Anonymous `json:"anonymous,omitempty" yaml:"anonymous,omitempty"`
+}
+
+// Anonymous stores the policy for clients which connect without a username, a password or a client certificate
+type Anonymous struct {
+	// Username is the username anonymous clients are known by to the ACL and hooks, and is empty if not set
+	Username string `json:"username,omitempty" yaml:"username,omitempty"`
+
+	// Acl applies to anonymous clients instead of the ACL of the broker, if set
+	Acl *Acl `json:"acl,omitempty" yaml:"acl,omitempty"`
+}
+
+// Ldap stores the configuration of the ldap auth type.
+//
+// Clients bind with the DN in UserDn if it is set. Otherwise, the broker binds as BindDn to search BaseDn
+// for the entry matching UserFilter, and then binds as that entry.
+type Ldap struct {
+	// Url is the server to connect to, such as ldap://ldap.example.com:389 or ldaps://ldap.example.com:636
+	Url string `json:"url" yaml:"url"`
+
+	// StartTls upgrades ldap:// connections to TLS before binding
+	StartTls bool `json:"start_tls,omitempty" yaml:"start_tls,omitempty"`
+
+	// CaFile is a bundle of CA certificates to verify the server with, instead of the system ones
+	CaFile string `json:"ca,omitempty" yaml:"ca,omitempty"`
+
+	// BindDn and BindPassword are the service account which searches for users and groups
+	BindDn       string `json:"bind_dn,omitempty" yaml:"bind_dn,omitempty"`
+	BindPassword string `json:"bind_password,omitempty" yaml:"bind_password,omitempty"`
+
+	// UserDn is the DN clients bind as, in which %s is replaced by the username, such as cn=%s,ou=users,dc=example,dc=com
+	UserDn string `json:"user_dn,omitempty" yaml:"user_dn,omitempty"`
+
+	// BaseDn is where users are searched, and UserFilter the filter they are searched with,
+	// in which %s is replaced by the username. The filter defaults to (uid=%s).
+	BaseDn     string `json:"base_dn,omitempty" yaml:"base_dn,omitempty"`
+	UserFilter string `json:"user_filter,omitempty" yaml:"user_filter,omitempty"`
+
+	// GroupBaseDn is where the groups of a user are searched, if set. GroupFilter is the filter they are searched with,
+	// in which %s is replaced by the DN of the user, and defaults to (member=%s). GroupAttribute is the attribute
+	// which names the group, and defaults to cn.
+	GroupBaseDn    string `json:"group_base_dn,omitempty" yaml:"group_base_dn,omitempty"`
+	GroupFilter    string `json:"group_filter,omitempty" yaml:"group_filter,omitempty"`
+	GroupAttribute string `json:"group_attribute,omitempty" yaml:"group_attribute,omitempty"`
+
+	// PoolSize is the maximum number of connections to the server, which defaults to 4
+	PoolSize int `json:"pool_size,omitempty" yaml:"pool_size,omitempty"`
+
+	// Timeout is the number of seconds to wait for the server, which defaults to 5
+	Timeout int `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+}
+
+// HttpAuth stores the configuration of the http auth type, which asks a webhook whether to let clients in
+type HttpAuth struct {
+	// Url is the endpoint requests are POSTed to
+	Url string `json:"url" yaml:"url"`
+
+	// Headers are sent with every request, for example to authenticate the broker to the endpoint
+	Headers map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+
+	// Authorize enables asking the endpoint whether clients may publish or subscribe on a topic
+	Authorize bool `json:"authorize,omitempty" yaml:"authorize,omitempty"`
+
+	// Timeout is the number of seconds to wait for a response, which defaults to 5
+	Timeout int `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+
+	// CacheTtl is the number of seconds responses are cached for. Responses are not cached if it is not set.
+	CacheTtl int `json:"cache_ttl,omitempty" yaml:"cache_ttl,omitempty"`
+
+	// FailurePolicy is "deny" or "allow", and decides what happens if the endpoint fails to respond. It defaults to "deny".
+	FailurePolicy string `json:"failure_policy,omitempty" yaml:"failure_policy,omitempty"`
+}
+
+// Jwt stores the configuration of the jwt auth type, which takes a JWT as the password
+type Jwt struct {
+	// Secrets are the keys of HS256 signed tokens
+	Secrets []string `json:"secrets,omitempty" yaml:"secrets,omitempty"`
+
+	// JwksFile is a JSON Web Key Set with the public keys of RS256 and ES256 signed tokens
+	JwksFile string `json:"jwks_file,omitempty" yaml:"jwks_file,omitempty"`
+
+	// Issuer and Audience are required in the iss and aud claims, if set
+	Issuer   string `json:"issuer,omitempty" yaml:"issuer,omitempty"`
+	Audience string `json:"audience,omitempty" yaml:"audience,omitempty"`
+
+	// UsernameClaim is the claim with the username of the client, which defaults to sub
+	UsernameClaim string `json:"username_claim,omitempty" yaml:"username_claim,omitempty"`
+
+	// ClientIDClaim is a claim with the client ID, or list of client IDs, the client must connect with
+	ClientIDClaim string `json:"client_id_claim,omitempty" yaml:"client_id_claim,omitempty"`
+
+	// PublishClaim and SubscribeClaim are claims with the lists of topic filters the client is restricted to
+	PublishClaim   string `json:"publish_claim,omitempty" yaml:"publish_claim,omitempty"`
+	SubscribeClaim string `json:"subscribe_claim,omitempty" yaml:"subscribe_claim,omitempty"`
+}
+
+// Acl stores the rules which decide where clients may publish and subscribe
+type Acl struct {
+	// File is a JSON file with the groups and rules, which are then not read from here
+	File string `json:"file,omitempty" yaml:"file,omitempty"`
+
+	// Default is the permission if no rule matches, which is "allow" or "deny", and defaults to "deny"
+	Default string `json:"default,omitempty" yaml:"default,omitempty"`
+
+	// Groups are the usernames in each group
+	Groups map[string][]string `json:"groups,omitempty" yaml:"groups,omitempty"`
+
+	Rules []*AclRule `json:"rules,omitempty" yaml:"rules,omitempty"`
+}
+
+// AclRule allows or denies publishing or subscribing on topics.
+//
+// A rule with neither a user nor a group applies to every client.
+type AclRule struct {
+	User  string `json:"user,omitempty" yaml:"user,omitempty"`
+	Group string `json:"group,omitempty" yaml:"group,omitempty"`
+
+	// Action is "publish" or "subscribe", or empty for both
+	Action string `json:"action,omitempty" yaml:"action,omitempty"`
+
+	// Topic is a topic filter, in which %u is replaced by the username and %c by the client ID
+	Topic string `json:"topic" yaml:"topic"`
+
+	// Permission is "allow" or "deny"
+	Permission string `json:"permission" yaml:"permission"`
 }
 
 type Badger struct {
@@ -39,9 +294,122 @@ type Redis struct {
 	Password string `json:"password" yaml:"password"`
 }
 
+// Raft stores the configuration for the Raft replicated persistence provider
+type Raft struct {
+	// NodeID uniquely identifies this node within the Raft cluster
+	NodeID string `json:"node_id" yaml:"node_id"`
+
+	// Address is where this node listens for the other Raft nodes, and must be reachable by them
+	Address string `json:"address" yaml:"address"`
+
+	// Dir stores the Raft log and snapshots, which are kept in memory if empty
+	Dir string `json:"dir,omitempty" yaml:"dir,omitempty"`
+
+	// Peers are the other nodes of the Raft cluster, used to bootstrap a new cluster
+	Peers []*RaftPeer `json:"peers,omitempty" yaml:"peers,omitempty"`
+
+	// Secret is shared by all nodes of the Raft cluster, which only accept connections from nodes knowing it.
+	// It is required if there are peers.
+	Secret string `json:"secret,omitempty" yaml:"secret,omitempty"`
+
+	// SnapshotThreshold is the number of log entries after which a snapshot is taken, and the log compacted
+	SnapshotThreshold uint64 `json:"snapshot_threshold,omitempty" yaml:"snapshot_threshold,omitempty"`
+
+	// SnapshotInterval is how often in seconds to check whether a snapshot should be taken
+	SnapshotInterval int `json:"snapshot_interval,omitempty" yaml:"snapshot_interval,omitempty"`
+}
+
+// RaftPeer is another node of the Raft cluster
+type RaftPeer struct {
+	NodeID  string `json:"node_id" yaml:"node_id"`
+	Address string `json:"address" yaml:"address"`
+}
+
 type Persistence struct {
 	Type string `json:"type" yaml:"type"`
 
 	Badger *Badger `json:"badger" yaml:"badger"`
 	Redis  *Redis  `json:"redis" yaml:"redis"`
+	Raft   *Raft   `json:"raft,omitempty" yaml:"raft,omitempty"`
+}
+
+// Sys stores the configuration for the $SYS broker statistics topics
+type Sys struct {
+	// Interval is the number of seconds between two consecutive publishes of statistics
+	Interval int `json:"interval,omitempty" yaml:"interval,omitempty"`
+
+	// Events enables publishing client lifecycle events under $SYS/events
+	Events bool `json:"events,omitempty" yaml:"events,omitempty"`
+
+	// Users are the usernames allowed to subscribe to $SYS topics
+	Users []string `json:"users,omitempty" yaml:"users,omitempty"`
+}
+
+// Rewrite stores a rule which rewrites topics before they are routed
+//
+// The pattern is a topic filter, where every + and # is captured
+// and can be referred to from the replacement as $1, $2 and so on.
+// If Regex is set, the pattern is a regular expression instead.
+type Rewrite struct {
+	Pattern     string `json:"pattern" yaml:"pattern"`
+	Replacement string `json:"replacement" yaml:"replacement"`
+	Regex       bool   `json:"regex,omitempty" yaml:"regex,omitempty"`
+}
+
+// Bridge stores the configuration of a bridge to a remote broker
+type Bridge struct {
+	Name      string `json:"name" yaml:"name"`
+	Address   string `json:"address" yaml:"address"`
+	ClientID  string `json:"client_id,omitempty" yaml:"client_id,omitempty"`
+	Username  string `json:"username,omitempty" yaml:"username,omitempty"`
+	Password  string `json:"password,omitempty" yaml:"password,omitempty"`
+	KeepAlive uint16 `json:"keep_alive,omitempty" yaml:"keep_alive,omitempty"`
+
+	// Tls enables TLS towards the remote broker, verified against CaFile if set,
+	// or the system roots otherwise
+	Tls    bool   `json:"tls,omitempty" yaml:"tls,omitempty"`
+	CaFile string `json:"ca_file,omitempty" yaml:"ca_file,omitempty"`
+
+	// MinReconnectDelay and MaxReconnectDelay bound the backoff between reconnection attempts, in seconds
+	MinReconnectDelay int `json:"min_reconnect_delay,omitempty" yaml:"min_reconnect_delay,omitempty"`
+	MaxReconnectDelay int `json:"max_reconnect_delay,omitempty" yaml:"max_reconnect_delay,omitempty"`
+
+	// QueueSize is the number of outbound messages waiting for the remote broker,
+	// beyond which further messages are dropped
+	QueueSize int `json:"queue_size,omitempty" yaml:"queue_size,omitempty"`
+
+	// Out lists the topics forwarded from this broker to the remote broker
+	Out []*BridgeTopic `json:"out,omitempty" yaml:"out,omitempty"`
+	// In lists the topics forwarded from the remote broker to this broker
+	In []*BridgeTopic `json:"in,omitempty" yaml:"in,omitempty"`
+}
+
+// BridgeTopic stores a topic filter forwarded over a bridge
+//
+// The filter is subscribed to under LocalPrefix on this broker and under RemotePrefix
+// on the remote broker, and forwarded topics have one prefix swapped for the other.
+type BridgeTopic struct {
+	Filter       string `json:"filter" yaml:"filter"`
+	LocalPrefix  string `json:"local_prefix,omitempty" yaml:"local_prefix,omitempty"`
+	RemotePrefix string `json:"remote_prefix,omitempty" yaml:"remote_prefix,omitempty"`
+	QoS          byte   `json:"qos,omitempty" yaml:"qos,omitempty"`
+}
+
+// Cluster stores the configuration for clustering with other Hermes nodes
+type Cluster struct {
+	// NodeID uniquely identifies this node within the cluster, and defaults to Address,
+	// or to a random ID when relaying through Redis
+	NodeID string `json:"node_id,omitempty" yaml:"node_id,omitempty"`
+
+	// Address is where this node listens for connections from other nodes
+	Address string `json:"address" yaml:"address"`
+
+	// Peers are the addresses of the other nodes in the cluster
+	Peers []string `json:"peers,omitempty" yaml:"peers,omitempty"`
+
+	// Secret is shared by all nodes of the cluster, and must be presented by a node to join it
+	Secret string `json:"secret,omitempty" yaml:"secret,omitempty"`
+
+	// Redis makes nodes relay messages through a shared Redis, instead of connecting to each other
+	Redis *Redis `json:"redis,omitempty" yaml:"redis,omitempty"`
 }
@@ -0,0 +1,246 @@
+package metrics
+
+import (
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"time"
+)
+
+const namespace = "hermes"
+
+// packetTypeNames are the label values of the MQTT control packet types
+var packetTypeNames = [...]string{
+	packets.CONNECT:     "connect",
+	packets.CONNACK:     "connack",
+	packets.PUBLISH:     "publish",
+	packets.PUBACK:      "puback",
+	packets.PUBREC:      "pubrec",
+	packets.PUBREL:      "pubrel",
+	packets.PUBCOMP:     "pubcomp",
+	packets.SUBSCRIBE:   "subscribe",
+	packets.SUBACK:      "suback",
+	packets.UNSUBSCRIBE: "unsubscribe",
+	packets.UNSUBACK:    "unsuback",
+	packets.PINGREQ:     "pingreq",
+	packets.PINGRESP:    "pingresp",
+	packets.DISCONNECT:  "disconnect",
+	packets.AUTH:        "auth",
+}
+
+// latencyBuckets cover everything from an in-memory operation to a slow network round trip, in seconds
+var latencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// Metrics collects the metrics of a broker.
+//
+// Every broker has its own registry, so that several brokers can live in one process.
+// All methods can be called on a nil Metrics, and then do nothing.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	connections        *prometheus.GaugeVec
+	connectionsTotal   *prometheus.CounterVec
+	packets            *prometheus.CounterVec
+	deliveryLatency    prometheus.Histogram
+	auth               *prometheus.CounterVec
+	rateLimited        *prometheus.CounterVec
+	bridgeDropped      *prometheus.CounterVec
+	offlineSaved       prometheus.Counter
+	offlineFetched     prometheus.Counter
+	offlineDiscarded   prometheus.Counter
+	persistenceLatency *prometheus.HistogramVec
+	persistenceErrors  *prometheus.CounterVec
+}
+
+// New creates the metrics of a broker
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		connections: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "connections",
+			Help:      "Number of open network connections, by transport.",
+		}, []string{"transport"}),
+		connectionsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "connections_total",
+			Help:      "Number of network connections accepted, by transport.",
+		}, []string{"transport"}),
+		packets: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "packets_total",
+			Help:      "Number of MQTT control packets, by type and direction.",
+		}, []string{"type", "direction"}),
+		deliveryLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "publish_deliver_latency_seconds",
+			Help:      "Time from routing a published message until it is delivered to a subscriber.",
+			Buckets:   latencyBuckets,
+		}),
+		auth: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "auth_total",
+			Help:      "Number of authentication attempts, by auth provider and result.",
+		}, []string{"provider", "result"}),
+		rateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rate_limited_total",
+			Help:      "Number of operations rejected for exceeding a rate limit, by limit.",
+		}, []string{"limit"}),
+		bridgeDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "bridge_dropped_total",
+			Help:      "Number of messages dropped because the outbound queue of a bridge was full, by bridge.",
+		}, []string{"bridge"}),
+		offlineSaved: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "offline_messages_saved_total",
+			Help:      "Number of messages saved for disconnected clients.",
+		}),
+		offlineFetched: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "offline_messages_fetched_total",
+			Help:      "Number of messages fetched for clients after they reconnected, excluding expired ones.",
+		}),
+		offlineDiscarded: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "offline_messages_discarded_total",
+			Help:      "Number of messages saved for clients which were deleted along with their sessions.",
+		}),
+		persistenceLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "persistence_operation_duration_seconds",
+			Help:      "Duration of persistence provider operations, by provider and operation.",
+			Buckets:   latencyBuckets,
+		}, []string{"provider", "operation"}),
+		persistenceErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "persistence_errors_total",
+			Help:      "Number of failed persistence provider operations, by provider and operation.",
+		}, []string{"provider", "operation"}),
+	}
+
+	m.registry.MustRegister(
+		m.connections,
+		m.connectionsTotal,
+		m.packets,
+		m.deliveryLatency,
+		m.auth,
+		m.rateLimited,
+		m.bridgeDropped,
+		m.offlineSaved,
+		m.offlineFetched,
+		m.offlineDiscarded,
+		m.persistenceLatency,
+		m.persistenceErrors,
+	)
+	return m
+}
+
+// Register adds collectors to the registry, such as gauges computed from the state of the broker
+func (m *Metrics) Register(collectors ...prometheus.Collector) {
+	if m == nil {
+		return
+	}
+	m.registry.MustRegister(collectors...)
+}
+
+// Handler serves all metrics in the Prometheus text exposition format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// ConnectionOpened counts a network connection accepted on a transport
+func (m *Metrics) ConnectionOpened(transport string) {
+	if m == nil {
+		return
+	}
+	m.connections.WithLabelValues(transport).Inc()
+	m.connectionsTotal.WithLabelValues(transport).Inc()
+}
+
+// ConnectionClosed counts a network connection closed on a transport
+func (m *Metrics) ConnectionClosed(transport string) {
+	if m == nil {
+		return
+	}
+	m.connections.WithLabelValues(transport).Dec()
+}
+
+// PacketReceived counts a control packet read from a client
+func (m *Metrics) PacketReceived(packetType byte) {
+	if m == nil {
+		return
+	}
+	m.packets.WithLabelValues(packetTypeName(packetType), "in").Inc()
+}
+
+// PacketSent counts a control packet written to a client
+func (m *Metrics) PacketSent(packetType byte) {
+	if m == nil {
+		return
+	}
+	m.packets.WithLabelValues(packetTypeName(packetType), "out").Inc()
+}
+
+func packetTypeName(packetType byte) string {
+	if int(packetType) < len(packetTypeNames) && len(packetTypeNames[packetType]) > 0 {
+		return packetTypeNames[packetType]
+	}
+	return "unknown"
+}
+
+// PublishDelivered observes how long a message took from being routed until it was delivered
+func (m *Metrics) PublishDelivered(latency time.Duration) {
+	if m == nil {
+		return
+	}
+	m.deliveryLatency.Observe(latency.Seconds())
+}
+
+// AuthAttempt counts an authentication attempt decided by an auth provider, which rejected the client if err is not nil
+func (m *Metrics) AuthAttempt(provider string, err error) {
+	if m == nil {
+		return
+	}
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	m.auth.WithLabelValues(provider, result).Inc()
+}
+
+// OfflineFetched counts messages fetched for a client from the persistence provider,
+// to be delivered now that it reconnected
+func (m *Metrics) OfflineFetched(count int) {
+	if m == nil {
+		return
+	}
+	m.offlineFetched.Add(float64(count))
+}
+
+// OfflineDiscarded counts messages saved for a client which were deleted along with its session
+func (m *Metrics) OfflineDiscarded(count int) {
+	if m == nil {
+		return
+	}
+	m.offlineDiscarded.Add(float64(count))
+}
+
+// RateLimited counts an operation rejected for exceeding a limit, which is one of "connections", "publishes",
+// "bytes" or "subscribes"
+func (m *Metrics) RateLimited(limit string) {
+	if m == nil {
+		return
+	}
+	m.rateLimited.WithLabelValues(limit).Inc()
+}
+
+// BridgeDropped counts a message dropped because the outbound queue of a bridge was full
+func (m *Metrics) BridgeDropped(bridge string) {
+	if m == nil {
+		return
+	}
+	m.bridgeDropped.WithLabelValues(bridge).Inc()
+}
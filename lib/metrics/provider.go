@@ -0,0 +1,203 @@
+package metrics
+
+import (
+	"github.com/c16a/hermes/lib/persistence"
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+// instrumentedProvider measures the latency and errors of every call to a persistence provider
+type instrumentedProvider struct {
+	provider     persistence.Provider
+	providerType string
+	metrics      *Metrics
+}
+
+// InstrumentProvider wraps a persistence provider, so that its operations are measured.
+//
+// Statistics of the provider are still reported, and sessions still stored, if the provider does so.
+// If the provider can count the messages saved for offline delivery, they are reported as a gauge.
+func InstrumentProvider(provider persistence.Provider, providerType string, m *Metrics) persistence.Provider {
+	if m == nil {
+		return provider
+	}
+	if counter, ok := provider.(persistence.OfflineCounter); ok {
+		m.Register(&offlineCollector{
+			counter: counter,
+			desc: prometheus.NewDesc(
+				prometheus.BuildFQName(namespace, "", "offline_messages"),
+				"Number of messages saved for disconnected clients, which are still waiting for them.",
+				nil, nil,
+			),
+		})
+	}
+	instrumented := &instrumentedProvider{provider: provider, providerType: providerType, metrics: m}
+	stats, isStatsProvider := provider.(persistence.StatsProvider)
+	sessions, isSessionStore := provider.(persistence.SessionStore)
+	sessionStore := &instrumentedSessionStore{store: sessions, instrumentedProvider: instrumented}
+	switch {
+	case isStatsProvider && isSessionStore:
+		return &struct {
+			*instrumentedProvider
+			persistence.StatsProvider
+			*instrumentedSessionStore
+		}{instrumented, stats, sessionStore}
+	case isStatsProvider:
+		return &struct {
+			*instrumentedProvider
+			persistence.StatsProvider
+		}{instrumented, stats}
+	case isSessionStore:
+		return &struct {
+			*instrumentedProvider
+			*instrumentedSessionStore
+		}{instrumented, sessionStore}
+	}
+	return instrumented
+}
+
+// observe records the duration of an operation started at start, and whether it failed
+func (p *instrumentedProvider) observe(operation string, start time.Time, err error) {
+	p.metrics.persistenceLatency.WithLabelValues(p.providerType, operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		p.metrics.persistenceErrors.WithLabelValues(p.providerType, operation).Inc()
+	}
+}
+
+func (p *instrumentedProvider) SaveForOfflineDelivery(clientId string, publish *packets.Publish) error {
+	start := time.Now()
+	err := p.provider.SaveForOfflineDelivery(clientId, publish)
+	p.observe("save_offline", start, err)
+	if err == nil {
+		p.metrics.offlineSaved.Inc()
+	}
+	return err
+}
+
+func (p *instrumentedProvider) GetMissedMessages(clientId string) ([]*packets.Publish, error) {
+	start := time.Now()
+	messages, err := p.provider.GetMissedMessages(clientId)
+	p.observe("get_missed", start, err)
+	return messages, err
+}
+
+func (p *instrumentedProvider) ReservePacketID(clientID string, packetID uint16) error {
+	start := time.Now()
+	err := p.provider.ReservePacketID(clientID, packetID)
+	p.observe("reserve_packet_id", start, err)
+	return err
+}
+
+func (p *instrumentedProvider) FreePacketID(clientID string, packetID uint16) error {
+	start := time.Now()
+	err := p.provider.FreePacketID(clientID, packetID)
+	p.observe("free_packet_id", start, err)
+	return err
+}
+
+func (p *instrumentedProvider) CheckForPacketIdReuse(clientID string, packetID uint16) (bool, error) {
+	start := time.Now()
+	reserved, err := p.provider.CheckForPacketIdReuse(clientID, packetID)
+	p.observe("check_packet_id", start, err)
+	return reserved, err
+}
+
+func (p *instrumentedProvider) GetPacketIDs(clientID string) ([]uint16, error) {
+	start := time.Now()
+	packetIDs, err := p.provider.GetPacketIDs(clientID)
+	p.observe("get_packet_ids", start, err)
+	return packetIDs, err
+}
+
+func (p *instrumentedProvider) ClearPacketIDs(clientID string) error {
+	start := time.Now()
+	err := p.provider.ClearPacketIDs(clientID)
+	p.observe("clear_packet_ids", start, err)
+	return err
+}
+
+func (p *instrumentedProvider) SaveDelayedMessage(message *persistence.DelayedMessage) error {
+	start := time.Now()
+	err := p.provider.SaveDelayedMessage(message)
+	p.observe("save_delayed", start, err)
+	return err
+}
+
+func (p *instrumentedProvider) GetDelayedMessages() ([]*persistence.DelayedMessage, error) {
+	start := time.Now()
+	messages, err := p.provider.GetDelayedMessages()
+	p.observe("get_delayed", start, err)
+	return messages, err
+}
+
+func (p *instrumentedProvider) DeleteDelayedMessage(id string) (bool, error) {
+	start := time.Now()
+	deleted, err := p.provider.DeleteDelayedMessage(id)
+	p.observe("delete_delayed", start, err)
+	return deleted, err
+}
+
+func (p *instrumentedProvider) Close() error {
+	return p.provider.Close()
+}
+
+// offlineCollector reports the messages saved for offline delivery, counted by the provider when the metrics are scraped
+type offlineCollector struct {
+	counter persistence.OfflineCounter
+	desc    *prometheus.Desc
+}
+
+func (c *offlineCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *offlineCollector) Collect(ch chan<- prometheus.Metric) {
+	count, err := c.counter.CountOfflineMessages()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.desc, err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(count))
+}
+
+// instrumentedSessionStore measures the operations of a provider which also stores sessions
+type instrumentedSessionStore struct {
+	store                persistence.SessionStore
+	instrumentedProvider *instrumentedProvider
+}
+
+func (p *instrumentedSessionStore) SaveSession(session *persistence.Session) error {
+	start := time.Now()
+	err := p.store.SaveSession(session)
+	p.instrumentedProvider.observe("save_session", start, err)
+	return err
+}
+
+func (p *instrumentedSessionStore) GetSession(clientID string) (*persistence.Session, error) {
+	start := time.Now()
+	session, err := p.store.GetSession(clientID)
+	p.instrumentedProvider.observe("get_session", start, err)
+	return session, err
+}
+
+func (p *instrumentedSessionStore) DeleteSession(clientID string) error {
+	start := time.Now()
+	err := p.store.DeleteSession(clientID)
+	p.instrumentedProvider.observe("delete_session", start, err)
+	return err
+}
+
+func (p *instrumentedSessionStore) SaveRetained(publish *packets.Publish) error {
+	start := time.Now()
+	err := p.store.SaveRetained(publish)
+	p.instrumentedProvider.observe("save_retained", start, err)
+	return err
+}
+
+func (p *instrumentedSessionStore) GetRetained() ([]*packets.Publish, error) {
+	start := time.Now()
+	messages, err := p.store.GetRetained()
+	p.instrumentedProvider.observe("get_retained", start, err)
+	return messages, err
+}
@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"errors"
+	"github.com/c16a/hermes/lib/persistence"
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"strings"
+	"testing"
+)
+
+// fakeProvider queues offline messages in memory, and fails to reserve packet IDs
+type fakeProvider struct {
+	persistence.Provider
+	messages []*packets.Publish
+}
+
+func (p *fakeProvider) SaveForOfflineDelivery(_ string, publish *packets.Publish) error {
+	p.messages = append(p.messages, publish)
+	return nil
+}
+
+func (p *fakeProvider) GetMissedMessages(string) ([]*packets.Publish, error) {
+	messages := p.messages
+	p.messages = nil
+	return messages, nil
+}
+
+func (p *fakeProvider) CountOfflineMessages() (int64, error) {
+	return int64(len(p.messages)), nil
+}
+
+func (p *fakeProvider) ReservePacketID(string, uint16) error {
+	return errors.New("disk full")
+}
+
+func TestInstrumentProvider(t *testing.T) {
+	m := New()
+	provider := InstrumentProvider(&fakeProvider{}, "memory", m)
+
+	if _, ok := provider.(persistence.StatsProvider); ok {
+		t.Error("instrumented provider reports stats the wrapped provider does not have")
+	}
+
+	_ = provider.SaveForOfflineDelivery("abcd", &packets.Publish{Topic: "foo"})
+	_ = provider.SaveForOfflineDelivery("abcd", &packets.Publish{Topic: "bar"})
+	if err := testutil.GatherAndCompare(m.registry, strings.NewReader(`
+# HELP hermes_offline_messages Number of messages saved for disconnected clients, which are still waiting for them.
+# TYPE hermes_offline_messages gauge
+hermes_offline_messages 2
+`), "hermes_offline_messages"); err != nil {
+		t.Error(err)
+	}
+	_, _ = provider.GetMissedMessages("abcd")
+	if saved := testutil.ToFloat64(m.offlineSaved); saved != 2 {
+		t.Errorf("offline messages saved = %v, want 2", saved)
+	}
+
+	if err := provider.ReservePacketID("abcd", 1); err == nil {
+		t.Error("error of the wrapped provider was swallowed")
+	}
+	if errs := testutil.ToFloat64(m.persistenceErrors.WithLabelValues("memory", "reserve_packet_id")); errs != 1 {
+		t.Errorf("errors = %v, want 1", errs)
+	}
+	if count := testutil.CollectAndCount(m.persistenceLatency); count != 3 {
+		t.Errorf("latency observed for %d operations, want 3", count)
+	}
+}
+
+// fakeSessionStore also stores sessions
+type fakeSessionStore struct {
+	fakeProvider
+	persistence.SessionStore
+}
+
+func TestInstrumentProvider_SessionStore(t *testing.T) {
+	provider := InstrumentProvider(&fakeSessionStore{}, "memory", New())
+	if _, ok := provider.(persistence.SessionStore); !ok {
+		t.Error("instrumented provider does not store sessions although the wrapped provider does")
+	}
+	if _, ok := provider.(persistence.StatsProvider); ok {
+		t.Error("instrumented provider reports stats the wrapped provider does not have")
+	}
+}
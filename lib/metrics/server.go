@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+)
+
+// Server serves /metrics on its own listener
+type Server struct {
+	listener   net.Listener
+	httpServer *http.Server
+	logger     *zap.Logger
+}
+
+// NewServer starts listening on an address for scrapes of the metrics.
+//
+// Requests are only served once Serve is called.
+func NewServer(address string, m *Metrics, logger *zap.Logger) (*Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.Handler())
+
+	return &Server{
+		listener:   listener,
+		httpServer: &http.Server{Handler: mux},
+		logger:     logger,
+	}, nil
+}
+
+// Addr returns the address the server listens on
+func (server *Server) Addr() net.Addr {
+	return server.listener.Addr()
+}
+
+// Serve serves requests until the server is closed
+func (server *Server) Serve() {
+	server.logger.Info(fmt.Sprintf("Starting metrics server on %s", server.listener.Addr()))
+
+	if err := server.httpServer.Serve(server.listener); err != nil && err != http.ErrServerClosed {
+		server.logger.Error("metrics server failed", zap.Error(err))
+	}
+}
+
+// Close stops accepting connections, and leaves requests in progress alone
+func (server *Server) Close() error {
+	return server.listener.Close()
+}
+
+// Shutdown stops accepting connections, and waits for requests in progress until the context is done
+func (server *Server) Shutdown(ctx context.Context) error {
+	return server.httpServer.Shutdown(ctx)
+}
@@ -0,0 +1,46 @@
+package mqtt
+
+import (
+	"github.com/c16a/hermes/lib/auth"
+)
+
+// isAuthorized checks the topics the identity of a client is restricted to, the ACL, or the one of its identity,
+// and the auth provider of its listener if it authorizes topics, for the client publishing or subscribing on a topic.
+// Of a chain which let the client in with the first provider accepting it, only that provider is asked.
+//
+// Messages published by the broker itself, which have no client, and clients in the same process, are always authorized.
+// Callers must not pass a nil client on behalf of a connection without one.
+func (ctx *ServerContext) isAuthorized(client *ConnectedClient, action auth.Action, topic string) bool {
+	if client == nil {
+		return true
+	}
+
+	ctx.mu.RLock()
+	_, isInternal := client.Connection.(*internalConn)
+	username, clientID, identity := client.Username, client.ClientID, client.identity
+	_, listener := connectionInfo(client.Connection)
+	ctx.mu.RUnlock()
+
+	if isInternal {
+		return true
+	}
+
+	acl := ctx.acl
+	var groups []string
+	if identity != nil {
+		if !identity.Allowed(action, topic) {
+			return false
+		}
+		if identity.Acl != nil {
+			acl = identity.Acl
+		}
+		groups = identity.Groups
+	}
+	if acl != nil && !acl.AllowedInGroups(username, clientID, groups, action, topic) {
+		return false
+	}
+	if provider := ctx.authProviderFor(listener); provider != nil {
+		return auth.Authorize(provider, identity, clientID, username, action, topic)
+	}
+	return true
+}
@@ -0,0 +1,88 @@
+package mqtt
+
+import (
+	"bytes"
+	"github.com/c16a/hermes/lib/auth"
+	"github.com/c16a/hermes/lib/config"
+	"github.com/eclipse/paho.golang/packets"
+	"go.uber.org/zap"
+	"sync"
+	"testing"
+)
+
+func TestServerContext_Acl(t *testing.T) {
+	acl, err := auth.NewAcl(&config.Acl{
+		Rules: []*config.AclRule{
+			{Topic: "public/#", Permission: "allow"},
+			{Topic: "clients/%c/#", Action: "publish", Permission: "allow"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &ServerContext{
+		connectedClientsMap: make(map[string]*ConnectedClient, 0),
+		mu:                  &sync.RWMutex{},
+		config: &config.Config{
+			Server: &config.Server{MaxQos: 2},
+		},
+		acl:    acl,
+		logger: zap.NewNop(),
+	}
+
+	var subscriber bytes.Buffer
+	ctx.AddClient(&subscriber, &packets.Connect{ClientID: "subscriber", Username: "alice"})
+	reasons := ctx.Subscribe(&subscriber, &packets.Subscribe{
+		Subscriptions: map[string]packets.SubOptions{"public/#": {QoS: 1}},
+	})
+	if len(reasons) != 1 || reasons[0] != packets.SubackGrantedQoS1 {
+		t.Errorf("Subscribe() = %v, want %v", reasons, []byte{packets.SubackGrantedQoS1})
+	}
+	reasons = ctx.Subscribe(&subscriber, &packets.Subscribe{
+		Subscriptions: map[string]packets.SubOptions{"clients/#": {QoS: 1}},
+	})
+	if len(reasons) != 1 || reasons[0] != packets.SubackNotauthorized {
+		t.Errorf("Subscribe() = %v, want %v", reasons, []byte{packets.SubackNotauthorized})
+	}
+
+	publisher := &bytes.Buffer{}
+	ctx.AddClient(publisher, &packets.Connect{ClientID: "publisher", Username: "bob"})
+	if code := ctx.Publish(publisher, &packets.Publish{Topic: "private/foo", QoS: 1}); code != packets.PubackNotAuthorized {
+		t.Errorf("Publish() = %d, want %d", code, packets.PubackNotAuthorized)
+	}
+	if code := ctx.Publish(publisher, &packets.Publish{Topic: "clients/publisher/status"}); code != packets.PubackSuccess {
+		t.Errorf("Publish() = %d, want %d", code, packets.PubackSuccess)
+	}
+	if code := ctx.Publish(publisher, &packets.Publish{Topic: "$delayed/10/private/foo"}); code != packets.PubackNotAuthorized {
+		t.Errorf("Publish() = %d for a delayed message, want %d", code, packets.PubackNotAuthorized)
+	}
+
+	// a denied QoS 0 message is neither acknowledged nor delivered
+	if err := handlePubQos0(publisher, &packets.Publish{Topic: "private/bar"}, ctx); err != nil {
+		t.Fatal(err)
+	}
+	if publisher.Len() > 0 {
+		t.Error("denied QoS 0 message was acknowledged")
+	}
+
+	// in-process clients are not subject to the ACL
+	internal := NewInternalConnection(func(*packets.Publish) {})
+	ctx.AddInternalClient(internal, "internal")
+	if code := ctx.Publish(internal, &packets.Publish{Topic: "public/foo", Payload: []byte("Hello World")}); code != packets.PubackSuccess {
+		t.Errorf("Publish() = %d for an in-process client, want %d", code, packets.PubackSuccess)
+	}
+	if code := ctx.Publish(internal, &packets.Publish{Topic: "private/foo"}); code != packets.PubackSuccess {
+		t.Errorf("Publish() = %d for an in-process client, want %d", code, packets.PubackSuccess)
+	}
+
+	cp, err := packets.ReadPacket(&subscriber)
+	if err != nil {
+		t.Fatalf("no message delivered: %v", err)
+	}
+	if publish := cp.Content.(*packets.Publish); publish.Topic != "public/foo" {
+		t.Errorf("message on %s was delivered", publish.Topic)
+	}
+	if subscriber.Len() > 0 {
+		t.Error("more than one message was delivered")
+	}
+}
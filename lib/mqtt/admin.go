@@ -0,0 +1,199 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"github.com/eclipse/paho.golang/packets"
+	"go.uber.org/zap"
+	"net"
+	"sort"
+)
+
+var (
+	// ErrClientNotFound is returned when there is no session for a client ID
+	ErrClientNotFound = errors.New("client not found")
+
+	// ErrClientNotConnected is returned when a client has a session, but is not connected over the network
+	ErrClientNotConnected = errors.New("client not connected")
+)
+
+// SessionInfo describes the session of a client
+type SessionInfo struct {
+	ClientID      string                      `json:"client_id"`
+	Username      string                      `json:"username,omitempty"`
+	RemoteAddress string                      `json:"remote_address,omitempty"`
+	Connected     bool                        `json:"connected"`
+	Internal      bool                        `json:"internal"`
+	CleanStart    bool                        `json:"clean_start"`
+	Subscriptions map[string]SubscriptionInfo `json:"subscriptions"`
+}
+
+// SubscriptionInfo describes the options of a subscription
+type SubscriptionInfo struct {
+	QoS               byte `json:"qos"`
+	NoLocal           bool `json:"no_local"`
+	RetainAsPublished bool `json:"retain_as_published"`
+	RetainHandling    byte `json:"retain_handling"`
+}
+
+// Sessions describes the sessions of all clients, connected or not, sorted by client ID
+func (ctx *ServerContext) Sessions() []*SessionInfo {
+	ctx.mu.RLock()
+	sessions := make([]*SessionInfo, 0, len(ctx.connectedClientsMap))
+	for _, client := range ctx.connectedClientsMap {
+		sessions = append(sessions, describeSession(client))
+	}
+	ctx.mu.RUnlock()
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ClientID < sessions[j].ClientID
+	})
+	return sessions
+}
+
+// Session describes the session of a client, or returns ErrClientNotFound if there is none
+func (ctx *ServerContext) Session(clientID string) (*SessionInfo, error) {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+
+	client, ok := ctx.connectedClientsMap[clientID]
+	if !ok {
+		return nil, ErrClientNotFound
+	}
+	return describeSession(client), nil
+}
+
+// KickClient disconnects a client connected over the network, sending it a DISCONNECT with the reason code.
+// Its session is kept if it is persistent.
+func (ctx *ServerContext) KickClient(clientID string, reasonCode byte) error {
+	ctx.mu.RLock()
+	client, ok := ctx.connectedClientsMap[clientID]
+	var connected bool
+	if ok {
+		_, isInternal := client.Connection.(*internalConn)
+		connected = client.IsConnected && !isInternal
+	}
+	ctx.mu.RUnlock()
+
+	if !ok {
+		return ErrClientNotFound
+	}
+	if !connected {
+		return ErrClientNotConnected
+	}
+
+	ctx.logger.Info(fmt.Sprintf("Disconnecting clientID: %s", clientID))
+	conn := client.Connection
+	disconnect := &packets.Disconnect{ReasonCode: reasonCode}
+	ctx.closeConnection(client, disconnect)
+	ctx.Disconnect(conn, disconnect)
+	return nil
+}
+
+// DeleteSession removes the session of a client, along with the messages saved for it.
+// If the client is connected, it is sent a DISCONNECT with the reason code first.
+func (ctx *ServerContext) DeleteSession(clientID string, reasonCode byte) error {
+	client := ctx.removeSession(clientID, reasonCode)
+	if client == nil {
+		return ErrClientNotFound
+	}
+
+	ctx.logger.Info(fmt.Sprintf("Deleted session for clientID: %s", clientID))
+	ctx.sessionEnded(clientID)
+	ctx.forgetSession(clientID)
+	if ctx.persistenceProvider != nil {
+		if messages, err := ctx.persistenceProvider.GetMissedMessages(clientID); err != nil {
+			ctx.logger.Error("failed to delete offline messages", zap.Error(err))
+		} else {
+			ctx.metrics.OfflineDiscarded(len(messages))
+		}
+		if err := ctx.persistenceProvider.ClearPacketIDs(clientID); err != nil {
+			ctx.logger.Error("failed to clear reserved packet IDs", zap.Error(err))
+		}
+	}
+
+	if len(client.Subscriptions) > 0 {
+		ctx.interestChanged()
+	}
+	return nil
+}
+
+// SubscribeClient subscribes a client to topic filters on its behalf, as if it had sent the SUBSCRIBE itself,
+// and returns the reason codes of the SUBACK it would have been sent.
+func (ctx *ServerContext) SubscribeClient(clientID string, subscribe *packets.Subscribe) ([]byte, error) {
+	client, err := ctx.getClient(clientID)
+	if err != nil {
+		return nil, err
+	}
+	return ctx.subscribe(client, subscribe), nil
+}
+
+// UnsubscribeClient unsubscribes a client from topic filters on its behalf, as if it had sent the UNSUBSCRIBE itself,
+// and returns the reason codes of the UNSUBACK it would have been sent.
+func (ctx *ServerContext) UnsubscribeClient(clientID string, unsubscribe *packets.Unsubscribe) ([]byte, error) {
+	client, err := ctx.getClient(clientID)
+	if err != nil {
+		return nil, err
+	}
+	return ctx.unsubscribe(client, unsubscribe), nil
+}
+
+func (ctx *ServerContext) getClient(clientID string) (*ConnectedClient, error) {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+
+	client, ok := ctx.connectedClientsMap[clientID]
+	if !ok {
+		return nil, ErrClientNotFound
+	}
+	return client, nil
+}
+
+// removeSession removes the session of a client, and returns it, or nil if there was none.
+//
+// If the client is connected, it is sent a DISCONNECT with the reason code.
+func (ctx *ServerContext) removeSession(clientID string, reasonCode byte) *ConnectedClient {
+	ctx.mu.Lock()
+	client, ok := ctx.connectedClientsMap[clientID]
+	if ok {
+		delete(ctx.connectedClientsMap, clientID)
+	}
+	ctx.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	if client.IsConnected {
+		disconnect := &packets.Disconnect{ReasonCode: reasonCode}
+		ctx.closeConnection(client, disconnect)
+		ctx.emitDisconnected(client, disconnect)
+		ctx.onDisconnect(client, disconnect)
+	}
+	return client
+}
+
+// describeSession must be called with the lock held
+func describeSession(client *ConnectedClient) *SessionInfo {
+	_, isInternal := client.Connection.(*internalConn)
+	session := &SessionInfo{
+		ClientID:      client.ClientID,
+		Username:      client.Username,
+		Connected:     client.IsConnected,
+		Internal:      isInternal,
+		CleanStart:    client.IsClean,
+		Subscriptions: make(map[string]SubscriptionInfo, len(client.Subscriptions)),
+	}
+	if addressable, ok := client.Connection.(interface{ RemoteAddr() net.Addr }); ok && client.IsConnected {
+		session.RemoteAddress = addressable.RemoteAddr().String()
+	}
+	for topicFilter, options := range client.Subscriptions {
+		session.Subscriptions[topicFilter] = SubscriptionInfo{
+			QoS:               options.QoS,
+			NoLocal:           options.NoLocal,
+			RetainAsPublished: options.RetainAsPublished,
+			RetainHandling:    options.RetainHandling,
+		}
+	}
+	return session
+}
@@ -0,0 +1,71 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/c16a/hermes/lib/auth"
+	"github.com/eclipse/paho.golang/packets"
+	"io"
+	"net"
+	"time"
+)
+
+// scheduleExpiry disconnects a client once its credentials expire, unless it has reconnected since
+func (ctx *ServerContext) scheduleExpiry(clientID string, conn io.Writer, expiresAt time.Time) {
+	time.AfterFunc(time.Until(expiresAt), func() {
+		select {
+		case <-ctx.done:
+			return
+		default:
+		}
+
+		ctx.mu.RLock()
+		client, ok := ctx.connectedClientsMap[clientID]
+		expired := ok && client.IsConnected && client.Connection == conn
+		ctx.mu.RUnlock()
+		if !expired {
+			return
+		}
+
+		ctx.logger.Info(fmt.Sprintf("Credentials expired for clientID: %s", clientID))
+		disconnect := &packets.Disconnect{ReasonCode: packets.DisconnectMaximumConnectTime}
+		ctx.closeConnection(client, disconnect)
+		ctx.Disconnect(conn, disconnect)
+	})
+}
+
+// authProviderFor returns the auth provider of a listener, which is nil if its clients are not authenticated
+func (ctx *ServerContext) authProviderFor(listener string) auth.AuthorisationProvider {
+	if authProvider, ok := ctx.listenerAuthProviders[listener]; ok {
+		return authProvider
+	}
+	return ctx.authProvider
+}
+
+// connectionInfo returns the remote address of a network connection, and the name of the listener which accepted it
+func connectionInfo(conn io.Writer) (remoteAddress string, listener string) {
+	if buffered, ok := conn.(*bufferedConn); ok {
+		return buffered.RemoteAddr().String(), buffered.listener
+	}
+	if netConn, ok := conn.(net.Conn); ok {
+		return netConn.RemoteAddr().String(), ""
+	}
+	return "", ""
+}
+
+// peerCertificate returns the verified client certificate of a TLS connection, if the client presented one
+func peerCertificate(conn io.Writer) *x509.Certificate {
+	if buffered, ok := conn.(*bufferedConn); ok {
+		conn = buffered.Conn
+	}
+	tlsConn, ok := conn.(interface{ ConnectionState() tls.ConnectionState })
+	if !ok {
+		return nil
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	return state.PeerCertificates[0]
+}
@@ -0,0 +1,177 @@
+package mqtt
+
+import (
+	"errors"
+	"github.com/c16a/hermes/lib/auth"
+	"github.com/c16a/hermes/lib/config"
+	"github.com/eclipse/paho.golang/packets"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// identityProvider identifies every client as alice, restricted to publishing under chat/alice
+type identityProvider struct {
+	expiresAt time.Time
+}
+
+func (p *identityProvider) Validate(string, string) error {
+	return nil
+}
+
+func (p *identityProvider) Authenticate(*auth.Credentials) (*auth.Identity, error) {
+	return &auth.Identity{Username: "alice", Publish: []string{"chat/alice/#"}, ExpiresAt: p.expiresAt}, nil
+}
+
+func TestServerContext_Identity(t *testing.T) {
+	ctx := &ServerContext{
+		connectedClientsMap: make(map[string]*ConnectedClient, 0),
+		mu:                  &sync.RWMutex{},
+		config: &config.Config{
+			Server: &config.Server{MaxQos: 2, Auth: &config.Auth{Type: "test"}},
+		},
+		authProvider: &identityProvider{expiresAt: time.Now().Add(200 * time.Millisecond)},
+		logger:       zap.NewNop(),
+	}
+
+	conn := &closableBuffer{}
+	connect := &packets.Connect{ClientID: "abcd", Username: "mallory", CleanStart: true}
+	if code, _, _ := ctx.AddClient(conn, connect); code != 0 {
+		t.Fatalf("AddClient() code = %d", code)
+	}
+	if client, _ := ctx.getClient("abcd"); client.Username != "alice" {
+		t.Errorf("client has username %s, want the one of its identity", client.Username)
+	}
+
+	if code := ctx.Publish(conn, &packets.Publish{Topic: "chat/bob/general", QoS: 1}); code != packets.PubackNotAuthorized {
+		t.Errorf("Publish() = %d outside the topics of the identity, want %d", code, packets.PubackNotAuthorized)
+	}
+	if code := ctx.Publish(conn, &packets.Publish{Topic: "chat/alice/general", QoS: 1}); code != packets.PubackSuccess {
+		t.Errorf("Publish() = %d within the topics of the identity, want %d", code, packets.PubackSuccess)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for ctx.checkForClient("abcd") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ctx.checkForClient("abcd") {
+		t.Fatal("client was not disconnected when its credentials expired")
+	}
+	cp, err := packets.ReadPacket(conn)
+	if err != nil {
+		t.Fatalf("no DISCONNECT written: %v", err)
+	}
+	if disconnect, ok := cp.Content.(*packets.Disconnect); !ok || disconnect.ReasonCode != packets.DisconnectMaximumConnectTime {
+		t.Errorf("wrote %s, want DISCONNECT with reason code %d", cp.PacketType(), packets.DisconnectMaximumConnectTime)
+	}
+}
+
+// topicAuthorizer lets everyone in, but only lets clients publish on their own topic
+type topicAuthorizer struct{}
+
+func (p *topicAuthorizer) Validate(string, string) error {
+	return nil
+}
+
+func (p *topicAuthorizer) Authorize(clientID string, _ string, action auth.Action, topic string) bool {
+	return action == auth.ActionPublish && topic == "devices/"+clientID
+}
+
+func TestServerContext_TopicAuthorizer(t *testing.T) {
+	ctx := &ServerContext{
+		connectedClientsMap: make(map[string]*ConnectedClient, 0),
+		mu:                  &sync.RWMutex{},
+		config: &config.Config{
+			Server: &config.Server{MaxQos: 2, Auth: &config.Auth{Type: "test"}},
+		},
+		authProvider: &topicAuthorizer{},
+		logger:       zap.NewNop(),
+	}
+
+	conn := &closableBuffer{}
+	if code, _, _ := ctx.AddClient(conn, &packets.Connect{ClientID: "abcd", CleanStart: true}); code != 0 {
+		t.Fatalf("AddClient() code = %d", code)
+	}
+	if code := ctx.Publish(conn, &packets.Publish{Topic: "devices/other", QoS: 1}); code != packets.PubackNotAuthorized {
+		t.Errorf("Publish() = %d on a topic denied by the provider, want %d", code, packets.PubackNotAuthorized)
+	}
+	if code := ctx.Publish(conn, &packets.Publish{Topic: "devices/abcd", QoS: 1}); code != packets.PubackSuccess {
+		t.Errorf("Publish() = %d on a topic allowed by the provider, want %d", code, packets.PubackSuccess)
+	}
+}
+
+// rejectingProvider refuses every client
+type rejectingProvider struct{}
+
+func (p *rejectingProvider) Validate(string, string) error {
+	return errors.New("invalid credentials")
+}
+
+func TestServerContext_ListenerAuth(t *testing.T) {
+	anonymousAcl, err := auth.NewAcl(&config.Acl{
+		Rules: []*config.AclRule{{Topic: "public/#", Permission: "allow"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &ServerContext{
+		connectedClientsMap: make(map[string]*ConnectedClient, 0),
+		mu:                  &sync.RWMutex{},
+		config: &config.Config{
+			Server: &config.Server{MaxQos: 2, Auth: &config.Auth{Type: "test"}},
+		},
+		authProvider:          auth.NewAnonymousProvider(&rejectingProvider{}, "guest", anonymousAcl),
+		listenerAuthProviders: map[string]auth.AuthorisationProvider{"websocket": nil},
+		logger:                zap.NewNop(),
+	}
+	acl, err := auth.NewAcl(&config.Acl{Default: "allow"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.acl = acl
+
+	newConn := func(listener string) *bufferedConn {
+		serverSide, clientSide := net.Pipe()
+		t.Cleanup(func() {
+			_ = clientSide.Close()
+		})
+		go func() {
+			_, _ = io.Copy(ioutil.Discard, clientSide)
+		}()
+		conn := newBufferedConn(serverSide, &ctx.stats)
+		conn.listener = listener
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+		return conn
+	}
+
+	tcpConn := newConn("tcp")
+	if code, _, _ := ctx.AddClient(tcpConn, &packets.Connect{ClientID: "c1", Username: "alice", Password: []byte("secret"), CleanStart: true}); code != 135 {
+		t.Errorf("AddClient() with rejected credentials on tcp code = %d, want 135", code)
+	}
+	if code, _, _ := ctx.AddClient(tcpConn, &packets.Connect{ClientID: "c1", CleanStart: true}); code != 0 {
+		t.Fatalf("AddClient() anonymously on tcp code = %d", code)
+	}
+	if client, _ := ctx.getClient("c1"); client.Username != "guest" {
+		t.Errorf("anonymous client has username %s, want guest", client.Username)
+	}
+	if code := ctx.Publish(tcpConn, &packets.Publish{Topic: "private/foo", QoS: 1}); code != packets.PubackNotAuthorized {
+		t.Errorf("Publish() = %d outside the anonymous ACL, want %d", code, packets.PubackNotAuthorized)
+	}
+	if code := ctx.Publish(tcpConn, &packets.Publish{Topic: "public/foo", QoS: 1}); code != packets.PubackSuccess {
+		t.Errorf("Publish() = %d within the anonymous ACL, want %d", code, packets.PubackSuccess)
+	}
+
+	websocketConn := newConn("websocket")
+	if code, _, _ := ctx.AddClient(websocketConn, &packets.Connect{ClientID: "c2", Username: "alice", Password: []byte("secret"), CleanStart: true}); code != 0 {
+		t.Fatalf("AddClient() on open websocket listener code = %d", code)
+	}
+	if code := ctx.Publish(websocketConn, &packets.Publish{Topic: "private/foo", QoS: 1}); code != packets.PubackSuccess {
+		t.Errorf("Publish() = %d by client of open listener, want the ACL of the broker to apply", code)
+	}
+}
@@ -0,0 +1,126 @@
+package mqtt
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+)
+
+// flushTimeout bounds every flush, so that a client which stops reading
+// cannot hold up the goroutines writing to it
+const flushTimeout = 10 * time.Second
+
+// bufferedConn wraps a network connection so that writes land in a buffer
+// which is flushed in batches by a single goroutine.
+//
+// Many small writes issued in quick succession (for example, a burst of
+// PUBLISH packets during fan-out) are coalesced into as few syscalls as possible.
+type bufferedConn struct {
+	net.Conn
+
+	// listener is the name of the listener which accepted the connection
+	listener string
+
+	stats  *brokerStats
+	mu     sync.Mutex
+	writer *bufio.Writer
+	flush  chan struct{}
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newBufferedConn(conn net.Conn, stats *brokerStats) *bufferedConn {
+	c := &bufferedConn{
+		Conn:   conn,
+		stats:  stats,
+		writer: bufio.NewWriter(conn),
+		flush:  make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	go c.flushLoop()
+	return c
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.stats.addBytesReceived(n)
+	return n, err
+}
+
+// Write buffers p and schedules a flush
+func (c *bufferedConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	n, err := c.writer.Write(p)
+	c.mu.Unlock()
+
+	c.stats.addBytesSent(n)
+	c.scheduleFlush()
+	return n, err
+}
+
+// writeParts buffers all parts as one contiguous frame, so that writes
+// from other goroutines cannot be interleaved between them.
+func (c *bufferedConn) writeParts(parts ...[]byte) error {
+	c.mu.Lock()
+	var err error
+	for _, part := range parts {
+		var n int
+		n, err = c.writer.Write(part)
+		c.stats.addBytesSent(n)
+		if err != nil {
+			break
+		}
+	}
+	c.mu.Unlock()
+
+	c.scheduleFlush()
+	return err
+}
+
+// Close flushes anything still buffered and closes the underlying connection
+func (c *bufferedConn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+		c.mu.Lock()
+		_ = c.flushBuffer()
+		c.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// abort closes the underlying connection without flushing, which also ends a flush in progress
+func (c *bufferedConn) abort() error {
+	return c.Conn.Close()
+}
+
+// flushBuffer writes everything buffered within flushTimeout, and must be called with mu held
+func (c *bufferedConn) flushBuffer() error {
+	_ = c.Conn.SetWriteDeadline(time.Now().Add(flushTimeout))
+	return c.writer.Flush()
+}
+
+func (c *bufferedConn) scheduleFlush() {
+	select {
+	case c.flush <- struct{}{}:
+	default:
+		// a flush is already pending, and will pick up this write
+	}
+}
+
+func (c *bufferedConn) flushLoop() {
+	for {
+		select {
+		case <-c.flush:
+			c.mu.Lock()
+			err := c.flushBuffer()
+			c.mu.Unlock()
+			if err != nil {
+				// nothing can be written anymore, so the client is disconnected once reading fails too
+				_ = c.Conn.Close()
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
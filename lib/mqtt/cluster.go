@@ -0,0 +1,231 @@
+package mqtt
+
+import (
+	"fmt"
+	"github.com/c16a/hermes/lib/utils"
+	"github.com/eclipse/paho.golang/packets"
+	"go.uber.org/zap"
+	"sort"
+	"strings"
+)
+
+// ClusterNode connects this broker to the other nodes of a cluster
+type ClusterNode interface {
+	// Forward sends a message published on this node to every other node with subscribers for it
+	Forward(publish *packets.Publish)
+
+	// InterestChanged is called whenever the topic filters subscribed to on this node may have changed
+	InterestChanged()
+
+	// TakeOver claims the session of a client for this node, before the client is connected here.
+	//
+	// If another node held the session, it disconnects the client there and
+	// the state of the session is returned, otherwise nil is returned.
+	TakeOver(clientID string) *SessionState
+}
+
+// SessionTracker is implemented by cluster nodes which keep track of the node owning each session
+type SessionTracker interface {
+	// SessionEnded is called once the session of a client has ended on this node,
+	// rather than being handed over to another node
+	SessionEnded(clientID string)
+}
+
+// SessionState is the state of a persistent session, as handed over between the nodes of a cluster
+type SessionState struct {
+	ClientID      string
+	Username      string
+	IsClean       bool
+	Subscriptions map[string]packets.SubOptions
+
+	// Messages are saved for offline delivery, and not yet delivered to the client
+	Messages []*packets.Publish
+
+	// PacketIDs are reserved for incoming QoS 2 messages which have not been released yet
+	PacketIDs []uint16
+}
+
+// JoinCluster makes this broker forward messages to, and receive messages from, the other nodes of a cluster
+func (ctx *ServerContext) JoinCluster(node ClusterNode) {
+	ctx.mu.Lock()
+	ctx.clusterNode = node
+	ctx.mu.Unlock()
+
+	node.InterestChanged()
+}
+
+// RouteFromCluster delivers a message forwarded by another node of the cluster.
+//
+// The message is only delivered to subscribers on this node, and never forwarded again.
+func (ctx *ServerContext) RouteFromCluster(publish *packets.Publish) {
+	ctx.route(publish)
+}
+
+// ReleaseSession hands over the session of a client to another node of the cluster.
+//
+// If the client is connected, it is sent a DISCONNECT with reason code Session taken over.
+// The session is removed from this node, and its state is returned. If there is no
+// session for the client, nil is returned.
+func (ctx *ServerContext) ReleaseSession(clientID string) *SessionState {
+	client := ctx.removeSession(clientID, packets.DisconnectSessionTakenOver)
+	if client == nil {
+		return nil
+	}
+
+	ctx.logger.Info(fmt.Sprintf("Handed over session for clientID: %s to another node", clientID))
+
+	state := &SessionState{
+		ClientID:      client.ClientID,
+		Username:      client.Username,
+		IsClean:       client.IsClean,
+		Subscriptions: client.Subscriptions,
+	}
+
+	if ctx.persistenceProvider != nil {
+		var err error
+		if state.Messages, err = ctx.persistenceProvider.GetMissedMessages(clientID); err != nil {
+			ctx.logger.Error("failed to fetch offline messages", zap.Error(err))
+		}
+		ctx.metrics.OfflineFetched(len(state.Messages))
+		if state.PacketIDs, err = ctx.persistenceProvider.GetPacketIDs(clientID); err != nil {
+			ctx.logger.Error("failed to fetch reserved packet IDs", zap.Error(err))
+		}
+		if err = ctx.persistenceProvider.ClearPacketIDs(clientID); err != nil {
+			ctx.logger.Error("failed to clear reserved packet IDs", zap.Error(err))
+		}
+	} else {
+		ctx.mu.RLock()
+		for packetID := range client.packetIDs {
+			state.PacketIDs = append(state.PacketIDs, packetID)
+		}
+		ctx.mu.RUnlock()
+	}
+
+	if len(client.Subscriptions) > 0 {
+		ctx.interestChanged()
+	}
+	return state
+}
+
+// restoreSession adopts the session of a client taken over from another node.
+//
+// The client is added as disconnected, so that connecting it afterwards
+// resumes the session and delivers the messages saved for it.
+func (ctx *ServerContext) restoreSession(state *SessionState) {
+	client := &ConnectedClient{
+		ClientID:      state.ClientID,
+		Username:      state.Username,
+		IsClean:       state.IsClean,
+		Subscriptions: state.Subscriptions,
+	}
+	if client.Subscriptions == nil {
+		client.Subscriptions = make(map[string]packets.SubOptions, 0)
+	}
+
+	if ctx.persistenceProvider != nil {
+		for _, publish := range state.Messages {
+			if err := ctx.persistenceProvider.SaveForOfflineDelivery(state.ClientID, publish); err != nil {
+				ctx.logger.Error("failed to save offline message", zap.Error(err))
+			}
+		}
+		for _, packetID := range state.PacketIDs {
+			if err := ctx.persistenceProvider.ReservePacketID(state.ClientID, packetID); err != nil {
+				ctx.logger.Error("failed to reserve packet ID", zap.Error(err))
+			}
+		}
+	} else if len(state.PacketIDs) > 0 {
+		client.packetIDs = make(map[uint16]bool, len(state.PacketIDs))
+		for _, packetID := range state.PacketIDs {
+			client.packetIDs[packetID] = true
+		}
+	}
+
+	ctx.mu.Lock()
+	ctx.connectedClientsMap[state.ClientID] = client
+	ctx.mu.Unlock()
+
+	if len(client.Subscriptions) > 0 {
+		ctx.interestChanged()
+	}
+}
+
+// takeOverSession claims the session of a client from the other nodes of the cluster,
+// and adopts it unless the client asked for a fresh session anyway.
+//
+// If no node holds the session, a session saved by the persistence provider is resumed instead.
+func (ctx *ServerContext) takeOverSession(connect *packets.Connect) {
+	var state *SessionState
+	if node := ctx.getClusterNode(); node != nil {
+		if state = node.TakeOver(connect.ClientID); state != nil {
+			ctx.logger.Info(fmt.Sprintf("Taking over session for clientID: %s from another node", connect.ClientID))
+		}
+	}
+	if connect.CleanStart {
+		return
+	}
+	if state == nil && !ctx.checkForClient(connect.ClientID) {
+		state = ctx.loadSession(connect.ClientID)
+	}
+	if state != nil {
+		ctx.restoreSession(state)
+	}
+}
+
+// TopicFilters returns the distinct topic filters subscribed to on this node, including those
+// of disconnected clients with persistent sessions. Shared subscriptions are reported by their
+// underlying topic filter.
+func (ctx *ServerContext) TopicFilters() []string {
+	ctx.mu.RLock()
+	filterSet := make(map[string]bool, 0)
+	for _, client := range ctx.connectedClientsMap {
+		for topicFilter := range client.Subscriptions {
+			levels, isShared, _, err := utils.GetTopicInfo(topicFilter)
+			if err != nil {
+				continue
+			}
+			if isShared {
+				topicFilter = strings.Join(levels, "/")
+			}
+			filterSet[topicFilter] = true
+		}
+	}
+	ctx.mu.RUnlock()
+
+	filters := make([]string, 0, len(filterSet))
+	for topicFilter := range filterSet {
+		filters = append(filters, topicFilter)
+	}
+	sort.Strings(filters)
+	return filters
+}
+
+// dispatch delivers a message to subscribers on this node, and forwards it to the other nodes of the cluster.
+// Retained messages are saved first, once for the whole cluster.
+func (ctx *ServerContext) dispatch(publish *packets.Publish) {
+	if publish.Retain {
+		ctx.saveRetained(publish)
+	}
+	ctx.route(publish)
+
+	if node := ctx.getClusterNode(); node != nil {
+		node.Forward(publish)
+	}
+}
+
+func (ctx *ServerContext) sessionEnded(clientID string) {
+	if tracker, ok := ctx.getClusterNode().(SessionTracker); ok {
+		tracker.SessionEnded(clientID)
+	}
+}
+
+func (ctx *ServerContext) interestChanged() {
+	if node := ctx.getClusterNode(); node != nil {
+		node.InterestChanged()
+	}
+}
+
+func (ctx *ServerContext) getClusterNode() ClusterNode {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+	return ctx.clusterNode
+}
@@ -3,9 +3,23 @@ package mqtt
 import "net"
 
 func HandleMqttConnection(conn net.Conn, ctx *ServerContext) {
-	handler := &MqttHandler{base: ctx, logger: ctx.logger}
+	HandleListenerConnection(conn, ctx, "")
+}
+
+// HandleListenerConnection serves MQTT on a connection accepted by a named listener, such as "tcp" or "websocket".
+// The name of the listener is passed on to auth providers.
+func HandleListenerConnection(conn net.Conn, ctx *ServerContext, listener string) {
+	bufConn := newBufferedConn(conn, &ctx.stats)
+	bufConn.listener = listener
+	defer bufConn.Close()
+
+	handler := &MqttHandler{base: ctx, metrics: ctx.metrics, tracer: ctx.tracer, logger: ctx.logger}
 
-	for true {
-		handler.Handle(conn)
+	for {
+		if err := handler.Handle(bufConn); err != nil {
+			// the connection was lost, or closed after a DISCONNECT
+			ctx.Disconnect(bufConn, nil)
+			return
+		}
 	}
 }
@@ -0,0 +1,105 @@
+package mqtt
+
+import (
+	"fmt"
+	"github.com/c16a/hermes/lib/persistence"
+	"github.com/c16a/hermes/lib/tracing"
+	"github.com/c16a/hermes/lib/utils"
+	"github.com/eclipse/paho.golang/packets"
+	uuid "github.com/satori/go.uuid"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"time"
+)
+
+// publishDelayed schedules a message published to $delayed/<seconds>/<topic>
+// for delivery once the delay has passed. The message already carries <topic>.
+//
+// If a persistence provider is configured, the message is saved so that it
+// survives a restart of the broker before it is delivered.
+func (ctx *ServerContext) publishDelayed(publish *packets.Publish, delay time.Duration) {
+	message := &persistence.DelayedMessage{
+		ID:        uuid.NewV4().String(),
+		DeliverAt: time.Now().Add(delay),
+		Publish:   publish,
+	}
+
+	saved := false
+	if ctx.persistenceProvider != nil {
+		_, span := ctx.tracer.Start(publish, "persistence.save_delayed", trace.SpanKindInternal)
+		err := ctx.persistenceProvider.SaveDelayedMessage(message)
+		tracing.End(span, err)
+		if err != nil {
+			ctx.logger.Error("failed to save delayed message", zap.Error(err))
+		}
+		saved = err == nil
+	}
+
+	ctx.logger.Info(fmt.Sprintf("Delaying publish to %s by %s", publish.Topic, delay))
+	ctx.scheduleDelayed(message, saved)
+}
+
+// delayedTopic splits a topic of the form $delayed/<seconds>/<topic> into the delay and <topic>.
+// Other topics are returned as they are, without a delay.
+func delayedTopic(topic string) (realTopic string, delay time.Duration, delayed bool, err error) {
+	if !utils.IsDelayedTopic(topic) {
+		return topic, 0, false, nil
+	}
+	delay, realTopic, err = utils.ParseDelayedTopic(topic)
+	return realTopic, delay, true, err
+}
+
+// restoreDelayedMessages schedules all delayed messages saved before a restart.
+//
+// Messages which should have been delivered while the broker was down are delivered immediately.
+// Brokers sharing the provider all schedule every message, and the first one to delete it delivers it.
+func (ctx *ServerContext) restoreDelayedMessages() {
+	if ctx.persistenceProvider == nil {
+		return
+	}
+
+	messages, err := ctx.persistenceProvider.GetDelayedMessages()
+	if err != nil {
+		ctx.logger.Error("failed to fetch delayed messages", zap.Error(err))
+		return
+	}
+
+	for _, message := range messages {
+		ctx.scheduleDelayed(message, true)
+	}
+}
+
+// scheduleDelayed delivers a delayed message once it is due.
+//
+// A saved message is only delivered if this broker deletes it, so that it is delivered once even if
+// other brokers share the provider. If it cannot be deleted, it is delivered anyway rather than lost.
+func (ctx *ServerContext) scheduleDelayed(message *persistence.DelayedMessage, saved bool) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	select {
+	case <-ctx.done:
+		// the broker is shutting down, and saved messages are scheduled again after a restart
+		return
+	default:
+	}
+	if ctx.delayedTimers == nil {
+		ctx.delayedTimers = make(map[string]*time.Timer, 0)
+	}
+	ctx.delayedTimers[message.ID] = time.AfterFunc(time.Until(message.DeliverAt), func() {
+		ctx.mu.Lock()
+		delete(ctx.delayedTimers, message.ID)
+		ctx.mu.Unlock()
+
+		if saved {
+			deleted, err := ctx.persistenceProvider.DeleteDelayedMessage(message.ID)
+			if err != nil {
+				ctx.logger.Error("failed to delete delayed message", zap.Error(err))
+			} else if !deleted {
+				// another broker delivered the message already
+				return
+			}
+		}
+		ctx.dispatch(message.Publish)
+	})
+}
@@ -0,0 +1,74 @@
+package mqtt
+
+import (
+	"github.com/c16a/hermes/lib/config"
+	"github.com/eclipse/paho.golang/packets"
+	"go.uber.org/zap"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sharedPersistenceProvider is saved to by several brokers, and reports whether another one deleted a delayed message first
+type sharedPersistenceProvider struct {
+	MockPersistenceProvider
+	deletedElsewhere bool
+}
+
+func (p *sharedPersistenceProvider) GetMissedMessages(string) ([]*packets.Publish, error) {
+	return nil, nil
+}
+
+func (p *sharedPersistenceProvider) DeleteDelayedMessage(string) (bool, error) {
+	return !p.deletedElsewhere, nil
+}
+
+func TestServerContext_PublishDelayed(t *testing.T) {
+	rewriter, err := newTopicRewriter([]*config.Rewrite{{Pattern: "^room/(.*)$", Replacement: "room/lobby/$1", Regex: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &sharedPersistenceProvider{}
+	ctx := &ServerContext{
+		connectedClientsMap: make(map[string]*ConnectedClient, 0),
+		mu:                  &sync.RWMutex{},
+		config:              &config.Config{Server: &config.Server{MaxQos: 2}},
+		persistenceProvider: provider,
+		rewriter:            rewriter,
+		logger:              zap.NewNop(),
+	}
+
+	received := make(chan *packets.Publish, 1)
+	subscriber := NewInternalConnection(func(publish *packets.Publish) {
+		received <- publish
+	})
+	ctx.AddInternalClient(subscriber, "subscriber")
+	ctx.Subscribe(subscriber, &packets.Subscribe{Subscriptions: map[string]packets.SubOptions{"room/#": {}}})
+
+	if code := ctx.Publish(nil, &packets.Publish{Topic: "$delayed/0/$SYS/broker/uptime"}); code != reasonSuccess {
+		t.Errorf("Publish() to a delayed $SYS topic = %d", code)
+	}
+	if len(ctx.delayedTimers) != 0 {
+		t.Error("message for a $SYS topic was scheduled")
+	}
+
+	if code := ctx.Publish(nil, &packets.Publish{Topic: "$delayed/0/room/1"}); code != reasonSuccess {
+		t.Fatalf("Publish() = %d", code)
+	}
+	select {
+	case publish := <-received:
+		if publish.Topic != "room/lobby/1" {
+			t.Errorf("delayed message was delivered to %s, want the topic rewritten once", publish.Topic)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("delayed message was not delivered")
+	}
+
+	provider.deletedElsewhere = true
+	ctx.Publish(nil, &packets.Publish{Topic: "$delayed/0/room/1"})
+	select {
+	case <-received:
+		t.Error("delayed message was delivered although another broker delivered it")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
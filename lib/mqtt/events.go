@@ -0,0 +1,138 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/eclipse/paho.golang/packets"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	eventConnected    = "connected"
+	eventDisconnected = "disconnected"
+	eventSubscribed   = "subscribed"
+	eventUnsubscribed = "unsubscribed"
+)
+
+// connectedEvent is published under $SYS/events/connected/<clientID>
+type connectedEvent struct {
+	ClientID        string `json:"client_id"`
+	Username        string `json:"username,omitempty"`
+	RemoteAddress   string `json:"remote_address,omitempty"`
+	ProtocolVersion byte   `json:"protocol_version"`
+	KeepAlive       uint16 `json:"keep_alive"`
+	CleanStart      bool   `json:"clean_start"`
+	Timestamp       int64  `json:"timestamp"`
+}
+
+// disconnectedEvent is published under $SYS/events/disconnected/<clientID>
+type disconnectedEvent struct {
+	ClientID   string `json:"client_id"`
+	Username   string `json:"username,omitempty"`
+	ReasonCode *byte  `json:"reason_code,omitempty"`
+	Reason     string `json:"reason"`
+	Timestamp  int64  `json:"timestamp"`
+}
+
+// subscriptionEvent is published under $SYS/events/subscribed/<clientID>
+// and $SYS/events/unsubscribed/<clientID>
+type subscriptionEvent struct {
+	ClientID  string   `json:"client_id"`
+	Username  string   `json:"username,omitempty"`
+	Topics    []string `json:"topics"`
+	Timestamp int64    `json:"timestamp"`
+}
+
+func (ctx *ServerContext) eventsEnabled() bool {
+	if ctx.config.Server == nil || ctx.config.Server.Sys == nil {
+		return false
+	}
+	return ctx.config.Server.Sys.Events
+}
+
+func (ctx *ServerContext) emitConnected(conn io.Writer, connect *packets.Connect) {
+	if !ctx.eventsEnabled() {
+		return
+	}
+
+	event := &connectedEvent{
+		ClientID:        connect.ClientID,
+		Username:        connect.Username,
+		ProtocolVersion: connect.ProtocolVersion,
+		KeepAlive:       connect.KeepAlive,
+		CleanStart:      connect.CleanStart,
+		Timestamp:       time.Now().Unix(),
+	}
+	if addressable, ok := conn.(interface{ RemoteAddr() net.Addr }); ok {
+		event.RemoteAddress = addressable.RemoteAddr().String()
+	}
+	ctx.emitEvent(eventConnected, connect.ClientID, event)
+}
+
+// emitDisconnected publishes a disconnected event.
+//
+// A nil disconnect packet means the connection was lost without a DISCONNECT.
+func (ctx *ServerContext) emitDisconnected(client *ConnectedClient, disconnect *packets.Disconnect) {
+	if !ctx.eventsEnabled() {
+		return
+	}
+
+	event := &disconnectedEvent{
+		ClientID:  client.ClientID,
+		Username:  client.Username,
+		Reason:    "Connection lost",
+		Timestamp: time.Now().Unix(),
+	}
+	if disconnect != nil {
+		reasonCode := disconnect.ReasonCode
+		event.ReasonCode = &reasonCode
+		event.Reason = disconnect.Reason()
+	}
+	ctx.emitEvent(eventDisconnected, client.ClientID, event)
+}
+
+func (ctx *ServerContext) emitSubscription(eventType string, client *ConnectedClient, topics []string) {
+	if !ctx.eventsEnabled() || len(topics) == 0 {
+		return
+	}
+
+	event := &subscriptionEvent{
+		ClientID:  client.ClientID,
+		Username:  client.Username,
+		Topics:    topics,
+		Timestamp: time.Now().Unix(),
+	}
+	ctx.emitEvent(eventType, client.ClientID, event)
+}
+
+// escapeTopicLevel percent-encodes the characters of a client ID which cannot appear in a single topic level,
+// so that the event topic of every client is a valid topic of its own
+func escapeTopicLevel(level string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(level); i++ {
+		switch c := level[i]; c {
+		case '%', '/', '+', '#', 0:
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		default:
+			escaped.WriteByte(c)
+		}
+	}
+	return escaped.String()
+}
+
+func (ctx *ServerContext) emitEvent(eventType string, clientID string, event interface{}) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		ctx.logger.Error("failed to encode event", zap.Error(err))
+		return
+	}
+
+	ctx.route(&packets.Publish{
+		Topic:   fmt.Sprintf("%s/events/%s/%s", sysTopicPrefix, eventType, escapeTopicLevel(clientID)),
+		Payload: payload,
+	})
+}
@@ -0,0 +1,178 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/c16a/hermes/lib/config"
+	"github.com/eclipse/paho.golang/packets"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"sync"
+	"testing"
+)
+
+func TestServerContext_Events(t *testing.T) {
+	tests := []struct {
+		name       string
+		action     func(ctx *ServerContext)
+		wantTopic  string
+		wantFields map[string]interface{}
+	}{
+		{
+			"Client connected",
+			func(ctx *ServerContext) {
+				ctx.AddClient(ioutil.Discard, &packets.Connect{
+					ClientID:        "abcd",
+					Username:        "user",
+					ProtocolVersion: 5,
+					KeepAlive:       30,
+					CleanStart:      true,
+				})
+			},
+			"$SYS/events/connected/abcd",
+			map[string]interface{}{
+				"client_id":        "abcd",
+				"username":         "user",
+				"protocol_version": float64(5),
+				"keep_alive":       float64(30),
+			},
+		},
+		{
+			"Client connected with a client ID which is not a topic level",
+			func(ctx *ServerContext) {
+				ctx.AddClient(ioutil.Discard, &packets.Connect{ClientID: "a/+#%", CleanStart: true})
+			},
+			"$SYS/events/connected/a%2F%2B%23%25",
+			map[string]interface{}{
+				"client_id": "a/+#%",
+			},
+		},
+		{
+			"Client disconnected",
+			func(ctx *ServerContext) {
+				ctx.AddClient(ioutil.Discard, &packets.Connect{ClientID: "abcd", CleanStart: true})
+				ctx.Disconnect(ioutil.Discard, &packets.Disconnect{ReasonCode: packets.DisconnectNormalDisconnection})
+			},
+			"$SYS/events/disconnected/abcd",
+			map[string]interface{}{
+				"client_id":   "abcd",
+				"reason_code": float64(0),
+			},
+		},
+		{
+			"Client connection lost",
+			func(ctx *ServerContext) {
+				ctx.AddClient(ioutil.Discard, &packets.Connect{ClientID: "abcd", CleanStart: true})
+				ctx.Disconnect(ioutil.Discard, nil)
+			},
+			"$SYS/events/disconnected/abcd",
+			map[string]interface{}{
+				"client_id": "abcd",
+				"reason":    "Connection lost",
+			},
+		},
+		{
+			"Client subscribed",
+			func(ctx *ServerContext) {
+				ctx.AddClient(ioutil.Discard, &packets.Connect{ClientID: "abcd", CleanStart: true})
+				ctx.Subscribe(ioutil.Discard, &packets.Subscribe{
+					Subscriptions: map[string]packets.SubOptions{"foo": {}},
+				})
+			},
+			"$SYS/events/subscribed/abcd",
+			map[string]interface{}{
+				"client_id": "abcd",
+				"topics":    []interface{}{"foo"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var monitor bytes.Buffer
+			ctx := &ServerContext{
+				connectedClientsMap: map[string]*ConnectedClient{
+					"monitor": {
+						ClientID:    "monitor",
+						Connection:  &monitor,
+						IsConnected: true,
+						Subscriptions: map[string]packets.SubOptions{
+							tt.wantTopic: {},
+						},
+					},
+				},
+				mu: &sync.RWMutex{},
+				config: &config.Config{
+					Server: &config.Server{
+						MaxQos: 2,
+						Sys:    &config.Sys{Events: true},
+					},
+				},
+				logger: zap.NewNop(),
+			}
+
+			tt.action(ctx)
+
+			cp, err := packets.ReadPacket(&monitor)
+			if err != nil {
+				t.Fatalf("no event received: %v", err)
+			}
+			publish := cp.Content.(*packets.Publish)
+			if publish.Topic != tt.wantTopic {
+				t.Errorf("event topic = %v, want %v", publish.Topic, tt.wantTopic)
+			}
+
+			var event map[string]interface{}
+			if err := json.Unmarshal(publish.Payload, &event); err != nil {
+				t.Fatalf("event payload is not JSON: %v", err)
+			}
+			for key, want := range tt.wantFields {
+				got, ok := event[key]
+				if !ok {
+					t.Errorf("event is missing %s", key)
+					continue
+				}
+				gotJson, _ := json.Marshal(got)
+				wantJson, _ := json.Marshal(want)
+				if !bytes.Equal(gotJson, wantJson) {
+					t.Errorf("event %s = %s, want %s", key, gotJson, wantJson)
+				}
+			}
+		})
+	}
+}
+
+func TestServerContext_ForgedEvents(t *testing.T) {
+	var monitor bytes.Buffer
+	ctx := &ServerContext{
+		connectedClientsMap: map[string]*ConnectedClient{
+			"monitor": {
+				ClientID:    "monitor",
+				Username:    "admin",
+				Connection:  &monitor,
+				IsConnected: true,
+				Subscriptions: map[string]packets.SubOptions{
+					"$SYS/events/connected/abcd": {},
+					"$sys/events/connected/abcd": {},
+					"$internal/foo":              {},
+				},
+			},
+		},
+		mu: &sync.RWMutex{},
+		config: &config.Config{
+			Server: &config.Server{
+				MaxQos: 2,
+				Sys:    &config.Sys{Users: []string{"admin"}},
+			},
+		},
+		logger: zap.NewNop(),
+	}
+	conn := &closableBuffer{}
+	ctx.AddClient(conn, &packets.Connect{ClientID: "forger", CleanStart: true})
+
+	for _, topic := range []string{"$SYS/events/connected/abcd", "$sys/events/connected/abcd", "$internal/foo"} {
+		ctx.Publish(conn, &packets.Publish{Topic: topic, Payload: []byte("{}")})
+	}
+	if monitor.Len() != 0 {
+		t.Error("client publish to a $ topic was delivered")
+	}
+}
@@ -0,0 +1,145 @@
+package mqtt
+
+import (
+	"github.com/eclipse/paho.golang/packets"
+	"io"
+)
+
+const (
+	reasonSuccess byte = 0x00
+
+	// reasonFailure is the lowest reason code reporting a failure, in every kind of acknowledgement
+	reasonFailure byte = 0x80
+)
+
+// Hook is called by the broker at every step of a client's lifecycle.
+//
+// Hooks may observe, modify the packets they are given, or veto an operation by
+// returning an MQTT reason code of 0x80 or above. Hooks are called in the order
+// they were added, and the first veto stops the remaining hooks from being called.
+// Embed BaseHook to only implement some of the methods.
+type Hook interface {
+	// OnConnect is called before a client is authenticated, and may reject the connection
+	OnConnect(conn io.Writer, connect *packets.Connect) byte
+
+	// OnAuth is called once the configured auth provider has accepted a client, and may still reject it
+	OnAuth(conn io.Writer, connect *packets.Connect) byte
+
+	// OnSubscribe is called for every topic filter of a SUBSCRIBE, and may reject the
+	// topic filter, or change its options. A returned reason code ends up in the SUBACK.
+	OnSubscribe(client *ConnectedClient, topicFilter string, options *packets.SubOptions) byte
+
+	// OnPublish is called for every message published by a client, after its topic has been rewritten.
+	// A returned reason code ends up in the PUBACK or PUBREC.
+	OnPublish(client *ConnectedClient, publish *packets.Publish) byte
+
+	// OnDeliver is called before a message is delivered to a client, with a copy of the message
+	// for that client alone, at the QoS it is delivered with. Returning false skips the delivery.
+	OnDeliver(client *ConnectedClient, publish *packets.Publish) bool
+
+	// OnDisconnect is called once a client has disconnected, with a nil packet if the connection was lost
+	OnDisconnect(client *ConnectedClient, disconnect *packets.Disconnect)
+}
+
+// BaseHook implements Hook without doing anything
+type BaseHook struct{}
+
+func (BaseHook) OnConnect(io.Writer, *packets.Connect) byte {
+	return reasonSuccess
+}
+
+func (BaseHook) OnAuth(io.Writer, *packets.Connect) byte {
+	return reasonSuccess
+}
+
+func (BaseHook) OnSubscribe(*ConnectedClient, string, *packets.SubOptions) byte {
+	return reasonSuccess
+}
+
+func (BaseHook) OnPublish(*ConnectedClient, *packets.Publish) byte {
+	return reasonSuccess
+}
+
+func (BaseHook) OnDeliver(*ConnectedClient, *packets.Publish) bool {
+	return true
+}
+
+func (BaseHook) OnDisconnect(*ConnectedClient, *packets.Disconnect) {}
+
+// AddHook adds a hook to the end of the chain
+func (ctx *ServerContext) AddHook(hook Hook) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	// the slice is copied, so that a chain handed out by getHooks never changes
+	hooks := make([]Hook, 0, len(ctx.hooks)+1)
+	ctx.hooks = append(append(hooks, ctx.hooks...), hook)
+}
+
+func (ctx *ServerContext) getHooks() []Hook {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+	return ctx.hooks
+}
+
+func (ctx *ServerContext) onConnect(conn io.Writer, connect *packets.Connect) byte {
+	for _, hook := range ctx.getHooks() {
+		if code := hook.OnConnect(conn, connect); code >= reasonFailure {
+			return code
+		}
+	}
+	return reasonSuccess
+}
+
+func (ctx *ServerContext) onAuth(conn io.Writer, connect *packets.Connect) byte {
+	for _, hook := range ctx.getHooks() {
+		if code := hook.OnAuth(conn, connect); code >= reasonFailure {
+			return code
+		}
+	}
+	return reasonSuccess
+}
+
+func (ctx *ServerContext) onSubscribe(client *ConnectedClient, topicFilter string, options *packets.SubOptions) byte {
+	for _, hook := range ctx.getHooks() {
+		if code := hook.OnSubscribe(client, topicFilter, options); code >= reasonFailure {
+			return code
+		}
+	}
+	return reasonSuccess
+}
+
+func (ctx *ServerContext) onPublish(client *ConnectedClient, publish *packets.Publish) byte {
+	for _, hook := range ctx.getHooks() {
+		if code := hook.OnPublish(client, publish); code >= reasonFailure {
+			return code
+		}
+	}
+	return reasonSuccess
+}
+
+func (ctx *ServerContext) onDeliver(client *ConnectedClient, publish *packets.Publish) bool {
+	for _, hook := range ctx.getHooks() {
+		if !hook.OnDeliver(client, publish) {
+			return false
+		}
+	}
+	return true
+}
+
+func (ctx *ServerContext) onDisconnect(client *ConnectedClient, disconnect *packets.Disconnect) {
+	for _, hook := range ctx.getHooks() {
+		hook.OnDisconnect(client, disconnect)
+	}
+}
+
+// copyPublish copies a message, so that changes to the copy and its properties leave the original intact
+func copyPublish(publish *packets.Publish) *packets.Publish {
+	publishCopy := *publish
+	if publish.Properties != nil {
+		properties := *publish.Properties
+		properties.User = append([]packets.User(nil), publish.Properties.User...)
+		publishCopy.Properties = &properties
+	}
+	return &publishCopy
+}
@@ -0,0 +1,146 @@
+package mqtt
+
+import (
+	"bytes"
+	"github.com/c16a/hermes/lib/config"
+	"github.com/eclipse/paho.golang/packets"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testHook rejects anything under "forbidden/", and tags every message with the publishing client
+type testHook struct {
+	BaseHook
+	disconnected []string
+}
+
+func (h *testHook) OnConnect(_ io.Writer, connect *packets.Connect) byte {
+	if strings.HasPrefix(connect.ClientID, "forbidden") {
+		return 0x85
+	}
+	return 0
+}
+
+func (h *testHook) OnSubscribe(_ *ConnectedClient, topicFilter string, options *packets.SubOptions) byte {
+	if strings.HasPrefix(topicFilter, "forbidden/") {
+		return packets.SubackNotauthorized
+	}
+	if options.QoS > 1 {
+		options.QoS = 1
+	}
+	return 0
+}
+
+func (h *testHook) OnPublish(client *ConnectedClient, publish *packets.Publish) byte {
+	if strings.HasPrefix(publish.Topic, "forbidden/") {
+		return packets.PubackNotAuthorized
+	}
+	if client != nil {
+		if publish.Properties == nil {
+			publish.Properties = &packets.Properties{}
+		}
+		publish.Properties.User = append(publish.Properties.User, packets.User{Key: "publisher", Value: client.ClientID})
+	}
+	return 0
+}
+
+func (h *testHook) OnDeliver(client *ConnectedClient, _ *packets.Publish) bool {
+	return client.ClientID != "muted"
+}
+
+func (h *testHook) OnDisconnect(client *ConnectedClient, _ *packets.Disconnect) {
+	h.disconnected = append(h.disconnected, client.ClientID)
+}
+
+func TestServerContext_Hooks(t *testing.T) {
+	newContext := func() (*ServerContext, *testHook) {
+		ctx := &ServerContext{
+			connectedClientsMap: make(map[string]*ConnectedClient, 0),
+			mu:                  &sync.RWMutex{},
+			config: &config.Config{
+				Server: &config.Server{MaxQos: 2},
+			},
+			logger: zap.NewNop(),
+		}
+		hook := &testHook{}
+		ctx.AddHook(hook)
+		return ctx, hook
+	}
+
+	t.Run("Connect is rejected", func(t *testing.T) {
+		ctx, _ := newContext()
+		if code, _, _ := ctx.AddClient(ioutil.Discard, &packets.Connect{ClientID: "forbidden-client"}); code != 0x85 {
+			t.Errorf("AddClient() code = %d, want %d", code, 0x85)
+		}
+		if ctx.checkForClient("forbidden-client") {
+			t.Error("rejected client was added")
+		}
+	})
+
+	t.Run("Subscribe is rejected and changed", func(t *testing.T) {
+		ctx, _ := newContext()
+		ctx.AddClient(ioutil.Discard, &packets.Connect{ClientID: "abcd"})
+
+		reasons := ctx.Subscribe(ioutil.Discard, &packets.Subscribe{
+			Subscriptions: map[string]packets.SubOptions{"forbidden/foo": {QoS: 1}},
+		})
+		if len(reasons) != 1 || reasons[0] != packets.SubackNotauthorized {
+			t.Errorf("Subscribe() = %v, want %v", reasons, []byte{packets.SubackNotauthorized})
+		}
+
+		reasons = ctx.Subscribe(ioutil.Discard, &packets.Subscribe{
+			Subscriptions: map[string]packets.SubOptions{"foo": {QoS: 2}},
+		})
+		if len(reasons) != 1 || reasons[0] != packets.SubackGrantedQoS1 {
+			t.Errorf("Subscribe() = %v, want %v", reasons, []byte{packets.SubackGrantedQoS1})
+		}
+	})
+
+	t.Run("Publish is rejected and enriched", func(t *testing.T) {
+		ctx, _ := newContext()
+		var subscriber, muted bytes.Buffer
+		ctx.AddClient(&subscriber, &packets.Connect{ClientID: "subscriber"})
+		ctx.AddClient(&muted, &packets.Connect{ClientID: "muted"})
+		ctx.AddClient(ioutil.Discard, &packets.Connect{ClientID: "publisher"})
+		for _, conn := range []io.Writer{&subscriber, &muted} {
+			ctx.Subscribe(conn, &packets.Subscribe{
+				Subscriptions: map[string]packets.SubOptions{"#": {}},
+			})
+		}
+
+		if code := ctx.Publish(ioutil.Discard, &packets.Publish{Topic: "forbidden/foo"}); code != packets.PubackNotAuthorized {
+			t.Errorf("Publish() = %d, want %d", code, packets.PubackNotAuthorized)
+		}
+		if code := ctx.Publish(ioutil.Discard, &packets.Publish{Topic: "foo", Payload: []byte("Hello World")}); code != packets.PubackSuccess {
+			t.Errorf("Publish() = %d, want %d", code, packets.PubackSuccess)
+		}
+
+		if muted.Len() > 0 {
+			t.Error("delivery to muted client was not skipped")
+		}
+		cp, err := packets.ReadPacket(&subscriber)
+		if err != nil {
+			t.Fatalf("no message delivered: %v", err)
+		}
+		publish := cp.Content.(*packets.Publish)
+		if publish.Topic != "foo" {
+			t.Errorf("rejected message on %s was delivered", publish.Topic)
+		}
+		if publish.Properties == nil || len(publish.Properties.User) != 1 || publish.Properties.User[0].Value != "publisher" {
+			t.Error("message was not enriched with the publisher")
+		}
+	})
+
+	t.Run("Disconnect is observed", func(t *testing.T) {
+		ctx, hook := newContext()
+		ctx.AddClient(ioutil.Discard, &packets.Connect{ClientID: "abcd", CleanStart: true})
+		ctx.Disconnect(ioutil.Discard, nil)
+		if len(hook.disconnected) != 1 || hook.disconnected[0] != "abcd" {
+			t.Errorf("hook observed disconnects %v", hook.disconnected)
+		}
+	})
+}
@@ -0,0 +1,68 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"github.com/eclipse/paho.golang/packets"
+	"go.uber.org/zap"
+	"io"
+)
+
+// internalConn is the connection of a client living inside the broker process.
+//
+// Messages delivered to such a client are handed over to a callback,
+// instead of being encoded and written to a network connection.
+type internalConn struct {
+	onPublish func(*packets.Publish)
+}
+
+// NewInternalConnection creates a connection for a client inside the broker process.
+//
+// The returned connection identifies the client in calls such as Subscribe and Disconnect,
+// just like a network connection does. onPublish is called for every message delivered to
+// the client, and must not block for long, since it is called while the message is being routed.
+func NewInternalConnection(onPublish func(*packets.Publish)) io.Writer {
+	return &internalConn{onPublish: onPublish}
+}
+
+func (conn *internalConn) Write([]byte) (int, error) {
+	return 0, errors.New("internal connections only accept messages")
+}
+
+// AddInternalClient adds a client living inside the broker process.
+//
+// Internal clients are trusted and skip authentication. Their sessions are persistent,
+// so messages are saved for them while they are disconnected, and delivered again when
+// they are added back. This also holds across restarts if a persistence provider is configured.
+//
+// A client connected over the network with the same ID is disconnected with reason code Session taken over,
+// and the internal client takes over its session.
+func (ctx *ServerContext) AddInternalClient(conn io.Writer, clientID string) {
+	connect := &packets.Connect{ClientID: clientID}
+
+	if err := ctx.KickClient(clientID, packets.DisconnectSessionTakenOver); err == nil {
+		ctx.logger.Info(fmt.Sprintf("Session of clientID: %s taken over by an internal client", clientID))
+	}
+
+	if ctx.checkForClient(clientID) {
+		ctx.doUpdateClient(clientID, "", nil, conn)
+	} else {
+		ctx.doAddClient(conn, connect, nil)
+	}
+
+	if ctx.persistenceProvider != nil {
+		if err := ctx.sendMissedMessages(clientID, conn); err != nil {
+			ctx.logger.Error("failed to fetch offline messages", zap.Error(err))
+		}
+	}
+}
+
+// writePublish writes a single message to a connection
+func writePublish(conn io.Writer, publish *packets.Publish) error {
+	if internal, ok := conn.(*internalConn); ok {
+		internal.onPublish(publish)
+		return nil
+	}
+	_, err := publish.WriteTo(conn)
+	return err
+}
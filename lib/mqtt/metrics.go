@@ -0,0 +1,42 @@
+package mqtt
+
+import (
+	"github.com/c16a/hermes/lib/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"sync/atomic"
+)
+
+// Metrics returns the metrics of the broker
+func (ctx *ServerContext) Metrics() *metrics.Metrics {
+	return ctx.metrics
+}
+
+// registerMetrics adds the metrics computed from the state of the broker when they are scraped
+func (ctx *ServerContext) registerMetrics() {
+	counter := func(name string, help string, value *uint64) prometheus.Collector {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{Namespace: "hermes", Name: name, Help: help}, func() float64 {
+			return float64(atomic.LoadUint64(value))
+		})
+	}
+
+	ctx.metrics.Register(
+		counter("bytes_received_total", "Number of bytes read from network connections.", &ctx.stats.bytesReceived),
+		counter("bytes_sent_total", "Number of bytes written to network connections.", &ctx.stats.bytesSent),
+		counter("messages_received_total", "Number of messages published to the broker.", &ctx.stats.messagesReceived),
+		counter("messages_sent_total", "Number of messages delivered to subscribers.", &ctx.stats.messagesSent),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "hermes",
+			Name:      "subscriptions",
+			Help:      "Number of subscriptions, including those of disconnected clients with persistent sessions.",
+		}, func() float64 {
+			ctx.mu.RLock()
+			defer ctx.mu.RUnlock()
+
+			var subscriptions int
+			for _, client := range ctx.connectedClientsMap {
+				subscriptions += len(client.Subscriptions)
+			}
+			return float64(subscriptions)
+		}),
+	)
+}
@@ -8,10 +8,11 @@ import (
 type MqttBase interface {
 	AddClient(io.Writer, *packets.Connect) (reasonCode byte, sessionExists bool, maxQos byte)
 	Disconnect(io.Writer, *packets.Disconnect)
-	Publish(*packets.Publish)
+	Publish(io.Writer, *packets.Publish) byte
 	Subscribe(io.Writer, *packets.Subscribe) []byte
 	Unsubscribe(io.Writer, *packets.Unsubscribe) []byte
 
+	IsPacketIDReserved(io.Writer, *packets.Publish) (bool, error)
 	ReservePacketID(io.Writer, *packets.Publish) error
 	FreePacketID(io.Writer, *packets.Pubrel) error
 }
@@ -2,29 +2,50 @@ package mqtt
 
 import (
 	"errors"
+	"github.com/c16a/hermes/lib/metrics"
+	"github.com/c16a/hermes/lib/tracing"
 	"github.com/eclipse/paho.golang/packets"
 	"github.com/eclipse/paho.golang/paho"
 	uuid "github.com/satori/go.uuid"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"io"
 )
 
+// errConnectRefused is returned once a CONNECT was refused, and the connection closed
+var errConnectRefused = errors.New("connection refused")
+
+// MqttHandler handles the packets of a single connection
 type MqttHandler struct {
-	base   MqttBase
-	logger *zap.Logger
+	base    MqttBase
+	metrics *metrics.Metrics
+	tracer  *tracing.Tracer
+	logger  *zap.Logger
+
+	// connected is set once a CONNECT succeeded, and packets other than CONNECT are dropped before
+	connected bool
 }
 
-func (handler *MqttHandler) Handle(readWriter io.ReadWriter) {
+// Handle reads a single packet off the connection and handles it.
+//
+// An error is returned only if the connection can no longer be read from.
+func (handler *MqttHandler) Handle(readWriter io.ReadWriter) error {
 	cPacket, err := packets.ReadPacket(readWriter)
 	if err != nil {
-		return
+		return err
 	}
+	handler.metrics.PacketReceived(cPacket.Type)
 
 	handler.logger.With(
 		zap.Uint16("packetID", cPacket.PacketID()),
 		zap.String("type", cPacket.PacketType()),
 	).Info("Received packet")
 
+	if !handler.connected && cPacket.Type != packets.CONNECT {
+		handler.logger.Info("Dropping packet received before CONNECT", zap.String("type", cPacket.PacketType()))
+		return nil
+	}
+
 	var packetHandler func(io.ReadWriter, *packets.ControlPacket, MqttBase) error
 
 	switch cPacket.Type {
@@ -48,12 +69,30 @@ func (handler *MqttHandler) Handle(readWriter io.ReadWriter) {
 	case packets.PINGREQ:
 		packetHandler = handlePingRequest
 	default:
-		return
+		return nil
+	}
+
+	if publish, ok := cPacket.Content.(*packets.Publish); ok {
+		// the message carries the receive span on, so that everything the broker does with it is part of it
+		spanCtx, span := handler.tracer.Start(publish, "receive", trace.SpanKindConsumer)
+		handler.tracer.Inject(spanCtx, publish)
+		defer span.End()
 	}
 
 	err = packetHandler(readWriter, cPacket, handler.base)
+	if errors.Is(err, errConnectRefused) {
+		handler.metrics.PacketSent(packets.CONNACK)
+		return err
+	}
 	if err != nil {
 		handler.logger.Error("error handling packet", zap.Error(err))
+	} else {
+		if cPacket.Type == packets.CONNECT {
+			handler.connected = true
+		}
+		if responseType, ok := responseTypeFor(cPacket); ok {
+			handler.metrics.PacketSent(responseType)
+		}
 	}
 
 	handler.logger.With(
@@ -61,7 +100,7 @@ func (handler *MqttHandler) Handle(readWriter io.ReadWriter) {
 		zap.String("type", cPacket.PacketType()),
 	).Info("Writing packet")
 
-	return
+	return nil
 }
 
 func handleConnect(readWriter io.ReadWriter, controlPacket *packets.ControlPacket, base MqttBase) error {
@@ -85,8 +124,17 @@ func handleConnect(readWriter io.ReadWriter, controlPacket *packets.ControlPacke
 		},
 	}
 
-	_, err := connAckPacket.WriteTo(readWriter)
-	return err
+	if _, err := connAckPacket.WriteTo(readWriter); err != nil {
+		return err
+	}
+	if reasonCode >= reasonFailure {
+		// the client must not go on sending packets after a refused CONNECT
+		if closer, ok := readWriter.(io.Closer); ok {
+			_ = closer.Close()
+		}
+		return errConnectRefused
+	}
+	return nil
 }
 
 func handleDisconnect(readWriter io.ReadWriter, controlPacket *packets.ControlPacket, base MqttBase) error {
@@ -119,7 +167,7 @@ func handlePublish(readWriter io.ReadWriter, controlPacket *packets.ControlPacke
 
 	switch publishPacket.QoS {
 	case 0:
-		return handlePubQos0(publishPacket, base)
+		return handlePubQos0(readWriter, publishPacket, base)
 	case 1:
 		return handlePubQoS1(readWriter, publishPacket, base)
 	case 2:
@@ -129,42 +177,49 @@ func handlePublish(readWriter io.ReadWriter, controlPacket *packets.ControlPacke
 	return nil
 }
 
-func handlePubQos0(publishPacket *packets.Publish, base MqttBase) error {
-	base.Publish(publishPacket)
+func handlePubQos0(readWriter io.ReadWriter, publishPacket *packets.Publish, base MqttBase) error {
+	base.Publish(readWriter, publishPacket)
 	return nil
 }
 
 func handlePubQoS1(readWriter io.ReadWriter, publishPacket *packets.Publish, base MqttBase) error {
 	pubAck := packets.Puback{
-		ReasonCode: packets.PubackSuccess,
+		ReasonCode: base.Publish(readWriter, publishPacket),
 		PacketID:   publishPacket.PacketID,
 	}
 
 	_, err := pubAck.WriteTo(readWriter)
-	if err != nil {
-		return err
-	}
-	base.Publish(publishPacket)
-	return nil
+	return err
 }
 
+// handlePubQos2 acknowledges a QoS 2 PUBLISH and passes it on exactly once.
+//
+// The packet ID stays reserved until the client sends PUBREL, and a PUBLISH
+// arriving for a reserved packet ID is a retransmission which is only acknowledged.
 func handlePubQos2(readWriter io.ReadWriter, publishPacket *packets.Publish, base MqttBase) error {
 	pubReceived := packets.Pubrec{
 		ReasonCode: packets.PubrecSuccess,
 		PacketID:   publishPacket.PacketID,
 	}
 
-	err := base.ReservePacketID(readWriter, publishPacket)
+	reserved, err := base.IsPacketIDReserved(readWriter, publishPacket)
+	if err == nil && !reserved {
+		err = base.ReservePacketID(readWriter, publishPacket)
+	}
 	if err != nil {
 		pubReceived.ReasonCode = packets.PubrecImplementationSpecificError
+	} else if !reserved {
+		pubReceived.ReasonCode = base.Publish(readWriter, publishPacket)
+		if pubReceived.ReasonCode >= reasonFailure {
+			// a rejected message is not expected to be released with PUBREL
+			_ = base.FreePacketID(readWriter, &packets.Pubrel{PacketID: publishPacket.PacketID})
+		}
 	}
 
-	_, err = pubReceived.WriteTo(readWriter)
-	if err != nil {
-		return err
+	if _, writeErr := pubReceived.WriteTo(readWriter); writeErr != nil {
+		return writeErr
 	}
-	base.Publish(publishPacket)
-	return nil
+	return err
 }
 
 func handlePubRel(readWriter io.ReadWriter, controlPacket *packets.ControlPacket, base MqttBase) error {
@@ -195,8 +250,13 @@ func handleSubscribe(readWriter io.ReadWriter, controlPacket *packets.ControlPac
 		Reasons:  base.Subscribe(readWriter, subscribePacket),
 	}
 
-	_, err := subAck.WriteTo(readWriter)
-	return err
+	if _, err := subAck.WriteTo(readWriter); err != nil {
+		return err
+	}
+	if sender, ok := base.(RetainedSender); ok {
+		sender.SendRetained(readWriter)
+	}
+	return nil
 }
 
 func handleUnsubscribe(readWriter io.ReadWriter, controlPacket *packets.ControlPacket, base MqttBase) error {
@@ -213,3 +273,27 @@ func handleUnsubscribe(readWriter io.ReadWriter, controlPacket *packets.ControlP
 	_, err := unsubAck.WriteTo(readWriter)
 	return err
 }
+
+// responseTypeFor returns the type of the packet written in response to a packet, if any
+func responseTypeFor(controlPacket *packets.ControlPacket) (byte, bool) {
+	switch controlPacket.Type {
+	case packets.CONNECT:
+		return packets.CONNACK, true
+	case packets.PUBLISH:
+		switch controlPacket.Content.(*packets.Publish).QoS {
+		case 1:
+			return packets.PUBACK, true
+		case 2:
+			return packets.PUBREC, true
+		}
+	case packets.PUBREL:
+		return packets.PUBCOMP, true
+	case packets.SUBSCRIBE:
+		return packets.SUBACK, true
+	case packets.UNSUBSCRIBE:
+		return packets.UNSUBACK, true
+	case packets.PINGREQ:
+		return packets.PINGRESP, true
+	}
+	return 0, false
+}
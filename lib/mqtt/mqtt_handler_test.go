@@ -0,0 +1,263 @@
+package mqtt
+
+import (
+	"bytes"
+	"github.com/c16a/hermes/lib/config"
+	"github.com/eclipse/paho.golang/packets"
+	"go.uber.org/zap"
+	"io"
+	"sync"
+	"testing"
+)
+
+func TestHandlePubQos2(t *testing.T) {
+	publish := func(packetID uint16, dup bool) *packets.Publish {
+		return &packets.Publish{
+			Topic:     "foo",
+			Payload:   []byte("Hello World"),
+			QoS:       2,
+			PacketID:  packetID,
+			Duplicate: dup,
+		}
+	}
+
+	tests := []struct {
+		name              string
+		reserved          map[uint16]bool
+		publish           *packets.Publish
+		publishReasonCode byte
+		wantPublished     int
+		wantReserved      bool
+		wantReasonCode    byte
+	}{
+		{
+			"Fresh packet ID is published and reserved",
+			map[uint16]bool{},
+			publish(1, false),
+			packets.PubrecSuccess,
+			1,
+			true,
+			packets.PubrecSuccess,
+		},
+		{
+			"Retransmission of reserved packet ID is not published",
+			map[uint16]bool{1: true},
+			publish(1, true),
+			packets.PubrecSuccess,
+			0,
+			true,
+			packets.PubrecSuccess,
+		},
+		{
+			"Other reserved packet IDs do not affect a fresh one",
+			map[uint16]bool{2: true},
+			publish(1, false),
+			packets.PubrecSuccess,
+			1,
+			true,
+			packets.PubrecSuccess,
+		},
+		{
+			"Rejected message is acknowledged with the reason code, and its packet ID freed",
+			map[uint16]bool{},
+			publish(1, false),
+			packets.PubrecNotAuthorized,
+			1,
+			false,
+			packets.PubrecNotAuthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := &MockMqttBase{reserved: tt.reserved, publishReasonCode: tt.publishReasonCode}
+			var conn bytes.Buffer
+
+			if err := handlePubQos2(&conn, tt.publish, base); err != nil {
+				t.Fatalf("handlePubQos2() error = %v", err)
+			}
+
+			if base.published != tt.wantPublished {
+				t.Errorf("handlePubQos2() published %d times, want %d", base.published, tt.wantPublished)
+			}
+			if base.reserved[tt.publish.PacketID] != tt.wantReserved {
+				t.Errorf("handlePubQos2() reserved = %v, want %v", base.reserved[tt.publish.PacketID], tt.wantReserved)
+			}
+
+			cp, err := packets.ReadPacket(&conn)
+			if err != nil {
+				t.Fatalf("no PUBREC written: %v", err)
+			}
+			pubrec, ok := cp.Content.(*packets.Pubrec)
+			if !ok {
+				t.Fatalf("handlePubQos2() wrote %s, want PUBREC", cp.PacketType())
+			}
+			if pubrec.ReasonCode != tt.wantReasonCode || pubrec.PacketID != tt.publish.PacketID {
+				t.Errorf("handlePubQos2() wrote PUBREC %d for packet %d", pubrec.ReasonCode, pubrec.PacketID)
+			}
+		})
+	}
+}
+
+func TestHandlePubQos2_WithoutPersistence(t *testing.T) {
+	ctx := &ServerContext{
+		connectedClientsMap: make(map[string]*ConnectedClient, 0),
+		mu:                  &sync.RWMutex{},
+		config:              &config.Config{Server: &config.Server{MaxQos: 2}},
+		logger:              zap.NewNop(),
+	}
+
+	var delivered int
+	subscriber := NewInternalConnection(func(*packets.Publish) {
+		delivered++
+	})
+	ctx.AddInternalClient(subscriber, "subscriber")
+	ctx.Subscribe(subscriber, &packets.Subscribe{Subscriptions: map[string]packets.SubOptions{"foo": {QoS: 2}}})
+
+	conn := &closableBuffer{}
+	ctx.AddClient(conn, &packets.Connect{ClientID: "publisher", CleanStart: true})
+	conn.Reset()
+
+	publish := &packets.Publish{Topic: "foo", QoS: 2, PacketID: 1}
+	for i := 0; i < 2; i++ {
+		if err := handlePubQos2(conn, publish, ctx); err != nil {
+			t.Fatalf("handlePubQos2() error = %v", err)
+		}
+		cp, err := packets.ReadPacket(conn)
+		if err != nil {
+			t.Fatalf("no PUBREC written: %v", err)
+		}
+		if pubrec := cp.Content.(*packets.Pubrec); pubrec.ReasonCode != packets.PubrecSuccess {
+			t.Errorf("handlePubQos2() wrote PUBREC %d", pubrec.ReasonCode)
+		}
+	}
+	if delivered != 1 {
+		t.Errorf("message was delivered %d times, want once", delivered)
+	}
+
+	if err := ctx.FreePacketID(conn, &packets.Pubrel{PacketID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if reserved, _ := ctx.IsPacketIDReserved(conn, publish); reserved {
+		t.Error("packet ID is still reserved after PUBREL")
+	}
+}
+
+// scriptedConn reads the packets a client sent off a buffer, and records what is written back
+type scriptedConn struct {
+	io.Reader
+	closableBuffer
+}
+
+// recordingClusterNode records the messages forwarded to other nodes
+type recordingClusterNode struct {
+	forwarded []*packets.Publish
+}
+
+func (node *recordingClusterNode) Forward(publish *packets.Publish) {
+	node.forwarded = append(node.forwarded, publish)
+}
+
+func (node *recordingClusterNode) InterestChanged() {}
+
+func (node *recordingClusterNode) TakeOver(string) *SessionState {
+	return nil
+}
+
+func TestMqttHandler_RefusedConnect(t *testing.T) {
+	clusterNode := &recordingClusterNode{}
+	ctx := &ServerContext{
+		connectedClientsMap: make(map[string]*ConnectedClient, 0),
+		mu:                  &sync.RWMutex{},
+		config:              &config.Config{Server: &config.Server{MaxQos: 2}},
+		authProvider:        &rejectingProvider{},
+		clusterNode:         clusterNode,
+		logger:              zap.NewNop(),
+	}
+
+	var delivered []*packets.Publish
+	subscriber := NewInternalConnection(func(publish *packets.Publish) {
+		delivered = append(delivered, publish)
+	})
+	ctx.AddInternalClient(subscriber, "subscriber")
+	ctx.Subscribe(subscriber, &packets.Subscribe{Subscriptions: map[string]packets.SubOptions{"#": {}}})
+
+	var sent bytes.Buffer
+	if _, err := (&packets.Connect{ClientID: "intruder", UsernameFlag: true, Username: "alice", PasswordFlag: true, Password: []byte("wrong")}).WriteTo(&sent); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&packets.Publish{Topic: "a", QoS: 1, PacketID: 1, Payload: []byte("x")}).WriteTo(&sent); err != nil {
+		t.Fatal(err)
+	}
+	conn := &scriptedConn{Reader: &sent}
+	handler := &MqttHandler{base: ctx, logger: zap.NewNop()}
+
+	if err := handler.Handle(conn); err == nil {
+		t.Error("Handle() went on after a refused CONNECT")
+	}
+	if !conn.closed {
+		t.Error("connection was not closed after a refused CONNECT")
+	}
+	if err := handler.Handle(conn); err != nil {
+		t.Fatalf("Handle() error = %v", err)
+	}
+	if code := ctx.Publish(conn, &packets.Publish{Topic: "a", Payload: []byte("x")}); code != packets.PubackNotAuthorized {
+		t.Errorf("Publish() from a connection without a client = %d, want %d", code, packets.PubackNotAuthorized)
+	}
+
+	if len(delivered) != 0 {
+		t.Errorf("%d messages of a refused client were delivered", len(delivered))
+	}
+	if len(clusterNode.forwarded) != 0 {
+		t.Errorf("%d messages of a refused client were routed to other nodes", len(clusterNode.forwarded))
+	}
+
+	cp, err := packets.ReadPacket(&conn.Buffer)
+	if err != nil {
+		t.Fatalf("no CONNACK written: %v", err)
+	}
+	if connack, ok := cp.Content.(*packets.Connack); !ok || connack.ReasonCode < reasonFailure {
+		t.Errorf("Handle() wrote %s, want a failing CONNACK", cp.PacketType())
+	}
+	if conn.Len() != 0 {
+		t.Error("Handle() answered a PUBLISH sent after a refused CONNECT")
+	}
+}
+
+type MockMqttBase struct {
+	reserved          map[uint16]bool
+	published         int
+	publishReasonCode byte
+}
+
+func (m *MockMqttBase) AddClient(io.Writer, *packets.Connect) (byte, bool, byte) {
+	return 0, false, 2
+}
+
+func (m *MockMqttBase) Disconnect(io.Writer, *packets.Disconnect) {}
+
+func (m *MockMqttBase) Publish(io.Writer, *packets.Publish) byte {
+	m.published++
+	return m.publishReasonCode
+}
+
+func (m *MockMqttBase) Subscribe(io.Writer, *packets.Subscribe) []byte {
+	return nil
+}
+
+func (m *MockMqttBase) Unsubscribe(io.Writer, *packets.Unsubscribe) []byte {
+	return nil
+}
+
+func (m *MockMqttBase) IsPacketIDReserved(_ io.Writer, publish *packets.Publish) (bool, error) {
+	return m.reserved[publish.PacketID], nil
+}
+
+func (m *MockMqttBase) ReservePacketID(_ io.Writer, publish *packets.Publish) error {
+	m.reserved[publish.PacketID] = true
+	return nil
+}
+
+func (m *MockMqttBase) FreePacketID(_ io.Writer, pubRel *packets.Pubrel) error {
+	delete(m.reserved, pubRel.PacketID)
+	return nil
+}
@@ -0,0 +1,108 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/eclipse/paho.golang/packets"
+	"io"
+	"time"
+)
+
+// publishHeader holds the fields of a PUBLISH which can differ between
+// recipients of the same message, but cannot be patched after encoding.
+type publishHeader struct {
+	qos    byte
+	retain bool
+}
+
+// publishEncoder encodes a PUBLISH once per distinct publishHeader,
+// and reuses the encoded bytes for every recipient sharing that header.
+type publishEncoder struct {
+	publish *packets.Publish
+	encoded map[publishHeader]*encodedPublish
+
+	// createdAt is when routing the message started
+	createdAt time.Time
+}
+
+func newPublishEncoder(publish *packets.Publish) *publishEncoder {
+	return &publishEncoder{
+		publish:   publish,
+		encoded:   make(map[publishHeader]*encodedPublish, 0),
+		createdAt: time.Now(),
+	}
+}
+
+func (encoder *publishEncoder) encode(qos byte, retain bool) (*encodedPublish, error) {
+	header := publishHeader{qos: qos, retain: retain}
+	if encoded, ok := encoder.encoded[header]; ok {
+		return encoded, nil
+	}
+
+	publish := *encoder.publish
+	publish.QoS = qos
+	publish.Retain = retain
+	publish.Duplicate = false
+	publish.PacketID = 0
+
+	var buf bytes.Buffer
+	if _, err := publish.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+
+	encoded := &encodedPublish{
+		bytes:          buf.Bytes(),
+		packetIDOffset: -1,
+	}
+	if qos > 0 {
+		encoded.packetIDOffset = fixedHeaderLength(encoded.bytes) + 2 + len(publish.Topic)
+	}
+	encoder.encoded[header] = encoded
+	return encoded, nil
+}
+
+// encodedPublish is the wire format of a PUBLISH.
+//
+// For QoS 0, the bytes are written as they are. For QoS 1 and 2, the packet ID
+// at packetIDOffset is patched for each recipient while writing.
+type encodedPublish struct {
+	bytes          []byte
+	packetIDOffset int
+}
+
+func (encoded *encodedPublish) writeTo(w io.Writer, packetID uint16) error {
+	if encoded.packetIDOffset < 0 {
+		_, err := w.Write(encoded.bytes)
+		return err
+	}
+
+	var id [2]byte
+	binary.BigEndian.PutUint16(id[:], packetID)
+
+	before := encoded.bytes[:encoded.packetIDOffset]
+	after := encoded.bytes[encoded.packetIDOffset+2:]
+
+	if conn, ok := w.(*bufferedConn); ok {
+		return conn.writeParts(before, id[:], after)
+	}
+
+	patched := make([]byte, len(encoded.bytes))
+	copy(patched, before)
+	copy(patched[len(before):], id[:])
+	copy(patched[len(before)+2:], after)
+	_, err := w.Write(patched)
+	return err
+}
+
+// fixedHeaderLength returns the length of the fixed header of an encoded packet,
+// which is the packet type byte followed by the variable length remaining length.
+func fixedHeaderLength(encoded []byte) int {
+	length := 1
+	for _, b := range encoded[1:] {
+		length++
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	return length
+}
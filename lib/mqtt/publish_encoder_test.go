@@ -0,0 +1,100 @@
+package mqtt
+
+import (
+	"bytes"
+	"github.com/eclipse/paho.golang/packets"
+	"reflect"
+	"testing"
+)
+
+func TestPublishEncoder_Encode(t *testing.T) {
+	type args struct {
+		qos      byte
+		retain   bool
+		packetID uint16
+	}
+	tests := []struct {
+		name    string
+		publish *packets.Publish
+		args    args
+	}{
+		{
+			"QoS 0",
+			&packets.Publish{
+				Topic:      "foo",
+				Payload:    []byte("Hello World"),
+				QoS:        0,
+				Properties: &packets.Properties{},
+			},
+			args{0, false, 0},
+		},
+		{
+			"QoS 1 with patched packet ID",
+			&packets.Publish{
+				Topic:      "foo/bar",
+				Payload:    []byte("Hello World"),
+				QoS:        1,
+				PacketID:   42,
+				Properties: &packets.Properties{},
+			},
+			args{1, false, 7},
+		},
+		{
+			"QoS 2 downgraded to QoS 1 with retain",
+			&packets.Publish{
+				Topic:      "foo/bar/baz",
+				Payload:    bytes.Repeat([]byte("a"), 200),
+				QoS:        2,
+				PacketID:   42,
+				Retain:     true,
+				Properties: &packets.Properties{ContentType: "text/plain"},
+			},
+			args{1, true, 65535},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoder := newPublishEncoder(tt.publish)
+			encoded, err := encoder.encode(tt.args.qos, tt.args.retain)
+			if err != nil {
+				t.Fatalf("encode() error = %v", err)
+			}
+
+			var buf bytes.Buffer
+			if err := encoded.writeTo(&buf, tt.args.packetID); err != nil {
+				t.Fatalf("writeTo() error = %v", err)
+			}
+
+			cp, err := packets.ReadPacket(&buf)
+			if err != nil {
+				t.Fatalf("ReadPacket() error = %v", err)
+			}
+			got, ok := cp.Content.(*packets.Publish)
+			if !ok {
+				t.Fatalf("decoded packet is a %s, want PUBLISH", cp.PacketType())
+			}
+
+			if got.QoS != tt.args.qos {
+				t.Errorf("QoS = %v, want %v", got.QoS, tt.args.qos)
+			}
+			// the retain flag is not unpacked by ReadPacket, so read it off the fixed header
+			if gotRetain := cp.Flags&1 == 1; gotRetain != tt.args.retain {
+				t.Errorf("Retain = %v, want %v", gotRetain, tt.args.retain)
+			}
+			if got.PacketID != tt.args.packetID {
+				t.Errorf("PacketID = %v, want %v", got.PacketID, tt.args.packetID)
+			}
+			if got.Topic != tt.publish.Topic {
+				t.Errorf("Topic = %v, want %v", got.Topic, tt.publish.Topic)
+			}
+			if !reflect.DeepEqual(got.Payload, tt.publish.Payload) {
+				t.Errorf("Payload = %v, want %v", got.Payload, tt.publish.Payload)
+			}
+
+			again, _ := encoder.encode(tt.args.qos, tt.args.retain)
+			if again != encoded {
+				t.Errorf("encode() did not reuse the encoded packet")
+			}
+		})
+	}
+}
@@ -0,0 +1,298 @@
+package mqtt
+
+import (
+	"fmt"
+	"github.com/c16a/hermes/lib/config"
+	"github.com/eclipse/paho.golang/packets"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// connackConnectionRateExceeded is the CONNACK reason code for connection attempts exceeding a limit
+	connackConnectionRateExceeded byte = 0x9F
+
+	// maxTrackedAddresses bounds the connection buckets, and maxTrackedClients the buckets of clients.
+	// Once there are more, buckets which refilled are forgotten, or else the one used least recently.
+	maxTrackedAddresses = 10000
+	maxTrackedClients   = 10000
+)
+
+// tokenBucket allows operations at a rate, with bursts of up to its capacity.
+//
+// A nil bucket allows everything.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	// used is when tokens were last taken
+	used time.Time
+}
+
+// newTokenBucket creates a full bucket, or returns nil if the rate is unlimited
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	capacity := float64(burst)
+	if capacity <= 0 {
+		capacity = math.Max(rate, 1)
+	}
+	now := time.Now()
+	return &tokenBucket{rate: rate, burst: capacity, tokens: capacity, last: now, used: now}
+}
+
+// take removes tokens from the bucket if there are enough of them.
+//
+// Amounts larger than the capacity are taken once the bucket is full, which leaves it in debt.
+func (b *tokenBucket) take(amount float64) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.refill(now)
+	b.used = now
+	if b.tokens < amount && b.tokens < b.burst {
+		return false
+	}
+	b.tokens -= amount
+	return true
+}
+
+// full checks if the bucket has refilled, in which case it is no different from a new one
+func (b *tokenBucket) full(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+func (b *tokenBucket) lastUsed() time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// rateLimiter holds the buckets of clients, and limits connection attempts from each IP address.
+//
+// A nil rate limiter allows everything.
+type rateLimiter struct {
+	config *config.RateLimits
+
+	mu          sync.Mutex
+	connections map[string]*tokenBucket
+	clients     map[clientKey]*clientLimiter
+}
+
+// clientKey identifies the buckets of a client, which are not shared with another user of the same client ID
+type clientKey struct {
+	clientID string
+	username string
+}
+
+func newRateLimiter(rateLimits *config.RateLimits) *rateLimiter {
+	if rateLimits == nil {
+		return nil
+	}
+	return &rateLimiter{
+		config:      rateLimits,
+		connections: make(map[string]*tokenBucket),
+		clients:     make(map[clientKey]*clientLimiter),
+	}
+}
+
+// allowConnection takes a connection attempt from the bucket of the IP address of a client
+func (limiter *rateLimiter) allowConnection(remoteAddress string) bool {
+	if limiter == nil || limiter.config.ConnectionsPerSecond <= 0 || len(remoteAddress) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddress)
+	if err != nil {
+		host = remoteAddress
+	}
+
+	limiter.mu.Lock()
+	bucket, ok := limiter.connections[host]
+	if !ok {
+		if len(limiter.connections) >= maxTrackedAddresses {
+			limiter.sweepConnections(time.Now())
+		}
+		bucket = newTokenBucket(limiter.config.ConnectionsPerSecond, limiter.config.ConnectionBurst)
+		limiter.connections[host] = bucket
+	}
+	limiter.mu.Unlock()
+
+	return bucket.take(1)
+}
+
+// sweepConnections forgets the addresses whose buckets refilled,
+// or the address which attempted to connect least recently if none did
+func (limiter *rateLimiter) sweepConnections(now time.Time) {
+	var oldest string
+	var oldestUsed time.Time
+	for address, b := range limiter.connections {
+		if b.full(now) {
+			delete(limiter.connections, address)
+		} else if used := b.lastUsed(); oldestUsed.IsZero() || used.Before(oldestUsed) {
+			oldest, oldestUsed = address, used
+		}
+	}
+	if len(limiter.connections) >= maxTrackedAddresses {
+		delete(limiter.connections, oldest)
+	}
+}
+
+// forClient returns the buckets of a client, or nil if no limits apply to it.
+//
+// The buckets are kept once the client disconnects, whether its session is kept or not, so that
+// reconnecting does not refill them. They are forgotten once they refill, as new buckets would be full as well.
+func (limiter *rateLimiter) forClient(clientID string, username string) *clientLimiter {
+	if limiter == nil {
+		return nil
+	}
+	limits, ok := limiter.config.Clients[clientID]
+	if !ok {
+		if limits, ok = limiter.config.Users[username]; !ok || len(username) == 0 {
+			limits = limiter.config.Default
+		}
+	}
+	if limits == nil {
+		return nil
+	}
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	now := time.Now()
+	key := clientKey{clientID: clientID, username: username}
+	if client, ok := limiter.clients[key]; ok {
+		// a client disconnected for its violations starts counting them anew
+		atomic.StoreInt32(&client.violations, 0)
+		client.connected = now
+		return client
+	}
+	if len(limiter.clients) >= maxTrackedClients {
+		limiter.sweepClients(now)
+	}
+	client := &clientLimiter{
+		publishes:     newTokenBucket(limits.PublishesPerSecond, limits.PublishBurst),
+		bytes:         newTokenBucket(limits.BytesPerSecond, limits.ByteBurst),
+		subscribes:    newTokenBucket(limits.SubscribesPerSecond, limits.SubscribeBurst),
+		maxViolations: int32(limits.MaxViolations),
+		connected:     now,
+	}
+	limiter.clients[key] = client
+	return client
+}
+
+// sweepClients forgets the clients whose buckets all refilled,
+// or the client which connected least recently if none did
+func (limiter *rateLimiter) sweepClients(now time.Time) {
+	var oldest clientKey
+	var oldestConnected time.Time
+	for key, client := range limiter.clients {
+		if client.publishes.full(now) && client.bytes.full(now) && client.subscribes.full(now) {
+			delete(limiter.clients, key)
+		} else if oldestConnected.IsZero() || client.connected.Before(oldestConnected) {
+			oldest, oldestConnected = key, client.connected
+		}
+	}
+	if len(limiter.clients) >= maxTrackedClients {
+		delete(limiter.clients, oldest)
+	}
+}
+
+// clientLimiter holds the buckets of a client, and counts the operations in a row which exceeded them.
+//
+// A nil client limiter allows everything.
+type clientLimiter struct {
+	publishes     *tokenBucket
+	bytes         *tokenBucket
+	subscribes    *tokenBucket
+	maxViolations int32
+	violations    int32
+
+	// connected is when the client last connected, guarded by the mutex of the rate limiter
+	connected time.Time
+}
+
+// allowPublish takes a message of a size from the buckets of the client. If it is not allowed, limit names the
+// limit it exceeded, and disconnect is true if the client has exceeded its limits too often in a row.
+func (limiter *clientLimiter) allowPublish(size int) (allowed bool, limit string, disconnect bool) {
+	if limiter == nil {
+		return true, "", false
+	}
+	if !limiter.publishes.take(1) {
+		return false, "publishes", limiter.violated()
+	}
+	if !limiter.bytes.take(float64(size)) {
+		return false, "bytes", limiter.violated()
+	}
+	atomic.StoreInt32(&limiter.violations, 0)
+	return true, "", false
+}
+
+// allowSubscribe takes a SUBSCRIBE from the bucket of the client, like allowPublish
+func (limiter *clientLimiter) allowSubscribe() (allowed bool, disconnect bool) {
+	if limiter == nil {
+		return true, false
+	}
+	if !limiter.subscribes.take(1) {
+		return false, limiter.violated()
+	}
+	atomic.StoreInt32(&limiter.violations, 0)
+	return true, false
+}
+
+func (limiter *clientLimiter) violated() bool {
+	violations := atomic.AddInt32(&limiter.violations, 1)
+	return limiter.maxViolations > 0 && violations >= limiter.maxViolations
+}
+
+// newClientLimiter returns the buckets of a client connected over a connection.
+// Clients in the same process are not limited.
+func (ctx *ServerContext) newClientLimiter(conn io.Writer, clientID string, username string) *clientLimiter {
+	if _, isInternal := conn.(*internalConn); isInternal {
+		return nil
+	}
+	return ctx.rateLimiter.forClient(clientID, username)
+}
+
+// limiterOf returns the buckets of a client
+func (ctx *ServerContext) limiterOf(client *ConnectedClient) *clientLimiter {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+	return client.limiter
+}
+
+// disconnectForRate disconnects a client which exceeded its limits too often in a row
+func (ctx *ServerContext) disconnectForRate(client *ConnectedClient) {
+	ctx.logger.Info(fmt.Sprintf("Disconnecting clientID: %s for exceeding its rate limits", client.ClientID))
+
+	ctx.mu.RLock()
+	conn := client.Connection
+	ctx.mu.RUnlock()
+
+	disconnect := &packets.Disconnect{ReasonCode: packets.DisconnectMessageRateTooHigh}
+	ctx.closeConnection(client, disconnect)
+	ctx.Disconnect(conn, disconnect)
+}
@@ -0,0 +1,217 @@
+package mqtt
+
+import (
+	"fmt"
+	"github.com/c16a/hermes/lib/config"
+	"github.com/eclipse/paho.golang/packets"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket_Take(t *testing.T) {
+	bucket := newTokenBucket(10, 3)
+	for i := 0; i < 3; i++ {
+		if !bucket.take(1) {
+			t.Fatalf("take() %d within the burst was refused", i)
+		}
+	}
+	if bucket.take(1) {
+		t.Error("take() beyond the burst was allowed")
+	}
+	time.Sleep(150 * time.Millisecond)
+	if !bucket.take(1) {
+		t.Error("take() was refused after the bucket refilled")
+	}
+
+	bytes := newTokenBucket(100, 0)
+	if !bytes.take(500) {
+		t.Error("take() of more than the capacity was refused from a full bucket")
+	}
+	if bytes.take(1) {
+		t.Error("take() was allowed from a bucket in debt")
+	}
+
+	var unlimited *tokenBucket
+	if !unlimited.take(1000) {
+		t.Error("take() was refused by an unlimited bucket")
+	}
+}
+
+func TestRateLimiter_ForClient(t *testing.T) {
+	limiter := newRateLimiter(&config.RateLimits{
+		Default: &config.RateLimit{PublishesPerSecond: 1},
+		Users:   map[string]*config.RateLimit{"alice": {PublishesPerSecond: 10}},
+		Clients: map[string]*config.RateLimit{"sensor-1": {PublishesPerSecond: 100}},
+	})
+
+	tests := []struct {
+		name     string
+		clientID string
+		username string
+		want     float64
+	}{
+		{"Default", "abcd", "bob", 1},
+		{"User", "abcd", "alice", 10},
+		{"Client ID takes precedence over user", "sensor-1", "alice", 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := limiter.forClient(tt.clientID, tt.username).publishes.rate; got != tt.want {
+				t.Errorf("forClient() publish rate = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if newRateLimiter(&config.RateLimits{}).forClient("abcd", "bob") != nil {
+		t.Error("forClient() limited a client without limits")
+	}
+}
+
+func TestServerContext_RateLimits(t *testing.T) {
+	ctx := &ServerContext{
+		connectedClientsMap: make(map[string]*ConnectedClient, 0),
+		mu:                  &sync.RWMutex{},
+		config:              &config.Config{Server: &config.Server{MaxQos: 2}},
+		rateLimiter: newRateLimiter(&config.RateLimits{
+			Default: &config.RateLimit{
+				PublishesPerSecond:  1,
+				PublishBurst:        2,
+				BytesPerSecond:      1,
+				ByteBurst:           10,
+				SubscribesPerSecond: 1,
+				MaxViolations:       3,
+			},
+		}),
+		logger: zap.NewNop(),
+	}
+
+	conn := &closableBuffer{}
+	if code, _, _ := ctx.AddClient(conn, &packets.Connect{ClientID: "abcd", CleanStart: true}); code != 0 {
+		t.Fatalf("AddClient() code = %d", code)
+	}
+
+	if code := ctx.Subscribe(conn, &packets.Subscribe{Subscriptions: map[string]packets.SubOptions{"a": {}}}); code[0] != packets.SubackGrantedQoS0 {
+		t.Errorf("Subscribe() within the limit = %v", code)
+	}
+	if code := ctx.Subscribe(conn, &packets.Subscribe{Subscriptions: map[string]packets.SubOptions{"a": {}, "b": {}}}); len(code) != 2 || code[0] != packets.SubackQuotaexceeded {
+		t.Errorf("Subscribe() beyond the limit = %v, want %d for each topic", code, packets.SubackQuotaexceeded)
+	}
+
+	if code := ctx.Publish(conn, &packets.Publish{Topic: "a", QoS: 1, Payload: make([]byte, 20)}); code != packets.PubackSuccess {
+		t.Errorf("Publish() within the limit = %d", code)
+	}
+	if code := ctx.Publish(conn, &packets.Publish{Topic: "a", QoS: 1, Payload: []byte("x")}); code != packets.PubackQuotaExceeded {
+		t.Errorf("Publish() beyond the byte limit = %d, want %d", code, packets.PubackQuotaExceeded)
+	}
+	if code := ctx.Publish(conn, &packets.Publish{Topic: "a", QoS: 1}); code != packets.PubackQuotaExceeded {
+		t.Errorf("Publish() beyond the publish limit = %d, want %d", code, packets.PubackQuotaExceeded)
+	}
+	if !ctx.checkForClient("abcd") {
+		t.Fatal("client was disconnected before exceeding the maximum violations")
+	}
+	_ = ctx.Publish(conn, &packets.Publish{Topic: "a", QoS: 1})
+	if ctx.checkForClient("abcd") {
+		t.Fatal("client was not disconnected after exceeding its limits too often")
+	}
+	if !conn.closed {
+		t.Error("connection of the client was not closed")
+	}
+
+	var disconnect *packets.Disconnect
+	for disconnect == nil {
+		cp, err := packets.ReadPacket(conn)
+		if err != nil {
+			t.Fatalf("no DISCONNECT written: %v", err)
+		}
+		disconnect, _ = cp.Content.(*packets.Disconnect)
+	}
+	if disconnect.ReasonCode != packets.DisconnectMessageRateTooHigh {
+		t.Errorf("DISCONNECT reason code = %d, want %d", disconnect.ReasonCode, packets.DisconnectMessageRateTooHigh)
+	}
+}
+
+func TestServerContext_RateLimitsAcrossSessions(t *testing.T) {
+	ctx := &ServerContext{
+		connectedClientsMap: make(map[string]*ConnectedClient, 0),
+		mu:                  &sync.RWMutex{},
+		config:              &config.Config{Server: &config.Server{MaxQos: 2}},
+		rateLimiter: newRateLimiter(&config.RateLimits{
+			Default: &config.RateLimit{PublishesPerSecond: 0.01, PublishBurst: 1},
+		}),
+		logger: zap.NewNop(),
+	}
+
+	conn := &closableBuffer{}
+	ctx.AddClient(conn, &packets.Connect{ClientID: "abcd", CleanStart: true})
+	if code := ctx.Publish(conn, &packets.Publish{Topic: "a", QoS: 1}); code != packets.PubackSuccess {
+		t.Fatalf("Publish() within the limit = %d", code)
+	}
+	ctx.Disconnect(conn, &packets.Disconnect{})
+
+	conn = &closableBuffer{}
+	ctx.AddClient(conn, &packets.Connect{ClientID: "abcd", CleanStart: true})
+	if code := ctx.Publish(conn, &packets.Publish{Topic: "a", QoS: 1}); code != packets.PubackQuotaExceeded {
+		t.Errorf("Publish() after reconnecting with a clean start = %d, want %d", code, packets.PubackQuotaExceeded)
+	}
+
+	other := &closableBuffer{}
+	ctx.AddClient(other, &packets.Connect{ClientID: "abcd", Username: "bob", CleanStart: true})
+	if code := ctx.Publish(other, &packets.Publish{Topic: "a", QoS: 1}); code != packets.PubackSuccess {
+		t.Errorf("Publish() by another user of the client ID = %d", code)
+	}
+}
+
+func TestRateLimiter_TrackedAddresses(t *testing.T) {
+	limiter := newRateLimiter(&config.RateLimits{ConnectionsPerSecond: 0.01, ConnectionBurst: 1})
+	for i := 0; i < maxTrackedAddresses; i++ {
+		limiter.allowConnection(fmt.Sprintf("10.0.%d.%d:1883", i/256, i%256))
+	}
+	if !limiter.allowConnection("192.168.0.1:1883") {
+		t.Error("connection from a new address was limited once the tracked addresses were full")
+	}
+	if len(limiter.connections) != maxTrackedAddresses {
+		t.Errorf("tracked addresses = %d, want %d", len(limiter.connections), maxTrackedAddresses)
+	}
+	if _, ok := limiter.connections["10.0.0.0"]; ok {
+		t.Error("address which connected least recently was not forgotten")
+	}
+}
+
+func TestServerContext_ConnectionRateLimit(t *testing.T) {
+	ctx := &ServerContext{
+		connectedClientsMap: make(map[string]*ConnectedClient, 0),
+		mu:                  &sync.RWMutex{},
+		config:              &config.Config{Server: &config.Server{MaxQos: 2}},
+		rateLimiter:         newRateLimiter(&config.RateLimits{ConnectionsPerSecond: 0.1, ConnectionBurst: 2}),
+		logger:              zap.NewNop(),
+	}
+
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, clientSide)
+	}()
+	conn := newBufferedConn(serverSide, &ctx.stats)
+	defer conn.Close()
+
+	for i := 0; i < 2; i++ {
+		if code, _, _ := ctx.AddClient(conn, &packets.Connect{ClientID: "abcd", CleanStart: true}); code != 0 {
+			t.Fatalf("AddClient() %d within the burst code = %d", i, code)
+		}
+	}
+	if code, _, _ := ctx.AddClient(conn, &packets.Connect{ClientID: "abcd", CleanStart: true}); code != connackConnectionRateExceeded {
+		t.Errorf("AddClient() beyond the limit code = %d, want %d", code, connackConnectionRateExceeded)
+	}
+
+	if !ctx.rateLimiter.allowConnection("10.0.0.2:1883") {
+		t.Error("connection from another address was limited")
+	}
+	if !ctx.rateLimiter.allowConnection("") {
+		t.Error("client in the same process was limited")
+	}
+}
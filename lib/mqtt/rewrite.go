@@ -0,0 +1,84 @@
+package mqtt
+
+import (
+	"fmt"
+	"github.com/c16a/hermes/lib/config"
+	"regexp"
+	"strings"
+)
+
+// topicRewriter rewrites topics and topic filters according to the configured rules.
+//
+// Rules are tried in order, and only the first matching rule is applied.
+type topicRewriter struct {
+	rules []*rewriteRule
+}
+
+type rewriteRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+func newTopicRewriter(rewrites []*config.Rewrite) (*topicRewriter, error) {
+	if len(rewrites) == 0 {
+		return nil, nil
+	}
+
+	rewriter := &topicRewriter{}
+	for _, rewrite := range rewrites {
+		expr := rewrite.Pattern
+		if !rewrite.Regex {
+			expr = levelPatternToRegex(rewrite.Pattern)
+		}
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rewrite pattern %s: %w", rewrite.Pattern, err)
+		}
+		rewriter.rules = append(rewriter.rules, &rewriteRule{
+			pattern:     pattern,
+			replacement: rewrite.Replacement,
+		})
+	}
+	return rewriter, nil
+}
+
+// levelPatternToRegex converts a topic filter such as legacy/+/temp
+// into an anchored regular expression capturing every wildcard level.
+func levelPatternToRegex(pattern string) string {
+	levels := strings.Split(pattern, "/")
+	for index, level := range levels {
+		switch {
+		case level == "+":
+			levels[index] = "([^/]+)"
+		case level == "#" && index == len(levels)-1:
+			levels[index] = "(.+)"
+		default:
+			levels[index] = regexp.QuoteMeta(level)
+		}
+	}
+	return "^" + strings.Join(levels, "/") + "$"
+}
+
+// rewrite applies the first matching rule to a topic.
+//
+// Topic filters are rewritten the same way, so that a subscription to legacy/+/temp
+// is rewritten just like a publish to legacy/device1/temp would be.
+// The share name of a shared subscription is kept as it is.
+func (rewriter *topicRewriter) rewrite(topic string) string {
+	if rewriter == nil {
+		return topic
+	}
+
+	prefix := ""
+	if levels := strings.SplitN(topic, "/", 3); len(levels) == 3 && strings.EqualFold(levels[0], "$share") {
+		prefix = levels[0] + "/" + levels[1] + "/"
+		topic = levels[2]
+	}
+
+	for _, rule := range rewriter.rules {
+		if rule.pattern.MatchString(topic) {
+			return prefix + rule.pattern.ReplaceAllString(topic, rule.replacement)
+		}
+	}
+	return prefix + topic
+}
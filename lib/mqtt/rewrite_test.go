@@ -0,0 +1,109 @@
+package mqtt
+
+import (
+	"github.com/c16a/hermes/lib/config"
+	"testing"
+)
+
+func TestTopicRewriter_Rewrite(t *testing.T) {
+	rewrites := []*config.Rewrite{
+		{
+			Pattern:     "legacy/+/temp",
+			Replacement: "devices/$1/telemetry/temp",
+		},
+		{
+			Pattern:     "old/+/+/#",
+			Replacement: "new/${2}/${1}/$3",
+		},
+		{
+			Pattern:     "^sensors/(\\d+)$",
+			Replacement: "devices/sensor-$1",
+			Regex:       true,
+		},
+	}
+	tests := []struct {
+		name  string
+		topic string
+		want  string
+	}{
+		{
+			"Publish topic with single level wildcard",
+			"legacy/device1/temp",
+			"devices/device1/telemetry/temp",
+		},
+		{
+			"Subscription filter is rewritten symmetrically",
+			"legacy/+/temp",
+			"devices/+/telemetry/temp",
+		},
+		{
+			"Shared subscription keeps its share name",
+			"$share/group/legacy/device1/temp",
+			"$share/group/devices/device1/telemetry/temp",
+		},
+		{
+			"Multi level wildcard",
+			"old/a/b/c/d",
+			"new/b/a/c/d",
+		},
+		{
+			"Regex rule",
+			"sensors/42",
+			"devices/sensor-42",
+		},
+		{
+			"Unmatched topic",
+			"legacy/device1/humidity",
+			"legacy/device1/humidity",
+		},
+		{
+			"Partial match is not rewritten",
+			"legacy/device1/temp/extra",
+			"legacy/device1/temp/extra",
+		},
+	}
+
+	rewriter, err := newTopicRewriter(rewrites)
+	if err != nil {
+		t.Fatalf("newTopicRewriter() error = %v", err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rewriter.rewrite(tt.topic); got != tt.want {
+				t.Errorf("rewrite() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewTopicRewriter(t *testing.T) {
+	tests := []struct {
+		name     string
+		rewrites []*config.Rewrite
+		wantErr  bool
+	}{
+		{
+			"No rules",
+			nil,
+			false,
+		},
+		{
+			"Invalid regex",
+			[]*config.Rewrite{
+				{
+					Pattern: "foo/(",
+					Regex:   true,
+				},
+			},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newTopicRewriter(tt.rewrites)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newTopicRewriter() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
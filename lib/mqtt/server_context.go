@@ -5,23 +5,48 @@ import (
 	"fmt"
 	"github.com/c16a/hermes/lib/auth"
 	"github.com/c16a/hermes/lib/config"
+	"github.com/c16a/hermes/lib/metrics"
 	"github.com/c16a/hermes/lib/persistence"
+	"github.com/c16a/hermes/lib/tracing"
 	"github.com/c16a/hermes/lib/utils"
 	"github.com/eclipse/paho.golang/packets"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"io"
 	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // ServerContext stores the state of the cluster node
 type ServerContext struct {
+	// stats must be the first field to keep its counters 64-bit aligned
+	stats brokerStats
+
 	connectedClientsMap map[string]*ConnectedClient
 	mu                  *sync.RWMutex
 	config              *config.Config
 	authProvider        auth.AuthorisationProvider
+
+	// listenerAuthProviders authenticate the clients of listeners with their own auth configuration, and are nil for open listeners
+	listenerAuthProviders map[string]auth.AuthorisationProvider
+
+	acl                 *auth.Acl
 	persistenceProvider persistence.Provider
+	rewriter            *topicRewriter
+	clusterNode         ClusterNode
+	hooks               []Hook
+	metrics             *metrics.Metrics
+	tracer              *tracing.Tracer
+	rateLimiter         *rateLimiter
+
+	// delayedTimers holds the timers of all scheduled delayed messages, by message ID
+	delayedTimers map[string]*time.Timer
+	done          chan struct{}
+	closeOnce     sync.Once
 
 	logger *zap.Logger
 }
@@ -30,63 +55,145 @@ type ServerContext struct {
 //
 // This should only be called once per cluster node.
 func NewServerContext(c *config.Config, logger *zap.Logger) (*ServerContext, error) {
-	authProvider, err := auth.FetchProviderFromConfig(c)
+	authProvider, listenerAuthProviders, err := auth.FetchProvidersFromConfig(c, logger)
 	if err != nil {
+		// clients must not be let in without authentication because of a broken auth setup
 		logger.Error("auth provider setup failed", zap.Error(err))
+		return nil, err
+	}
+	if authProvider == nil {
+		logger.Warn("no auth configured, all clients are allowed to connect")
 	}
 
 	var providerSetupFn func(*config.Config, *zap.Logger) (persistence.Provider, error)
 	var persistenceProvider persistence.Provider
-	switch c.Server.Persistence.Type {
-	case "memory":
-		providerSetupFn = persistence.NewBadgerProvider
-	case "redis":
-		providerSetupFn = persistence.NewRedisProvider
+	if c.Server.Persistence != nil {
+		switch c.Server.Persistence.Type {
+		case "memory":
+			providerSetupFn = persistence.NewBadgerProvider
+		case "redis":
+			providerSetupFn = persistence.NewRedisProvider
+		case "raft":
+			providerSetupFn = persistence.NewRaftProvider
+		}
 	}
 
+	brokerMetrics := metrics.New()
 	if providerSetupFn == nil {
 		logger.Error("persistence provider cannot be chosen")
 	} else {
 		persistenceProvider, err = providerSetupFn(c, logger)
 		if err != nil {
 			logger.Error("persistence provider setup failed", zap.Error(err))
+		} else {
+			persistenceProvider = metrics.InstrumentProvider(persistenceProvider, c.Server.Persistence.Type, brokerMetrics)
 		}
 	}
 
-	return &ServerContext{
-		mu:                  &sync.RWMutex{},
-		connectedClientsMap: make(map[string]*ConnectedClient, 0),
-		config:              c,
-		authProvider:        authProvider,
-		persistenceProvider: persistenceProvider,
-		logger:              logger,
-	}, nil
+	rewriter, err := newTopicRewriter(c.Server.Rewrites)
+	if err != nil {
+		return nil, err
+	}
+
+	acl, err := auth.FetchAclFromConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	tracer, err := tracing.New(c.Server.Tracing)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := &ServerContext{
+		stats:                 brokerStats{startTime: time.Now()},
+		mu:                    &sync.RWMutex{},
+		connectedClientsMap:   make(map[string]*ConnectedClient, 0),
+		config:                c,
+		authProvider:          authProvider,
+		listenerAuthProviders: listenerAuthProviders,
+		acl:                   acl,
+		persistenceProvider:   persistenceProvider,
+		rewriter:              rewriter,
+		metrics:               brokerMetrics,
+		tracer:                tracer,
+		rateLimiter:           newRateLimiter(c.Server.RateLimits),
+		delayedTimers:         make(map[string]*time.Timer, 0),
+		done:                  make(chan struct{}),
+		logger:                logger,
+	}
+
+	ctx.registerMetrics()
+	ctx.restoreDelayedMessages()
+
+	if c.Server.Sys != nil && c.Server.Sys.Interval > 0 {
+		go ctx.publishSysStatsPeriodically(time.Duration(c.Server.Sys.Interval) * time.Second)
+	}
+
+	return ctx, nil
 }
 
 func (ctx *ServerContext) AddClient(conn io.Writer, connect *packets.Connect) (code byte, sessionExists bool, maxQos byte) {
 	maxQos = ctx.config.Server.MaxQos
 
-	if ctx.authProvider != nil {
-		if authError := ctx.authProvider.Validate(connect.Username, string(connect.Password)); authError != nil {
+	remoteAddress, listener := connectionInfo(conn)
+	if !ctx.rateLimiter.allowConnection(remoteAddress) {
+		ctx.metrics.RateLimited("connections")
+		ctx.logger.Info(fmt.Sprintf("connection rate exceeded for clientID: %s from %s", connect.ClientID, remoteAddress))
+		code = connackConnectionRateExceeded
+		return
+	}
+
+	if code = ctx.onConnect(conn, connect); code >= reasonFailure {
+		ctx.logger.Info(fmt.Sprintf("connection rejected by hook for clientID: %s", connect.ClientID))
+		return
+	}
+
+	var identity *auth.Identity
+	if authProvider := ctx.authProviderFor(listener); authProvider != nil {
+		var authError error
+		identity, authError = auth.Authenticate(authProvider, &auth.Credentials{
+			ClientID:      connect.ClientID,
+			Username:      connect.Username,
+			Password:      string(connect.Password),
+			Certificate:   peerCertificate(conn),
+			RemoteAddress: remoteAddress,
+			Listener:      listener,
+		})
+		ctx.metrics.AuthAttempt(auth.DecidedBy(identity, authError), authError)
+		if authError != nil {
 			code = 135
 			sessionExists = false
-			ctx.logger.Error("auth failed")
+			ctx.logger.Error("auth failed", zap.Error(authError))
 			return
 		}
+		// the provider may identify the client by something else than the username it connects with
+		connect.Username = identity.Username
 		ctx.logger.Info(fmt.Sprintf("auth succeeed for user: %s", connect.Username))
 	}
 
+	if code = ctx.onAuth(conn, connect); code >= reasonFailure {
+		ctx.logger.Info(fmt.Sprintf("auth rejected by hook for clientID: %s", connect.ClientID))
+		return
+	}
+
+	// the session may live on another node of the cluster
+	ctx.takeOverSession(connect)
+
 	clientExists := ctx.checkForClient(connect.ClientID)
 	clientRequestForFreshSession := connect.CleanStart
 	if clientExists {
 		if clientRequestForFreshSession {
 			// If client asks for fresh session, delete existing ones
 			ctx.logger.Info(fmt.Sprintf("Removing old connection for clientID: %s", connect.ClientID))
+			ctx.mu.Lock()
 			delete(ctx.connectedClientsMap, connect.ClientID)
-			ctx.doAddClient(conn, connect)
+			ctx.mu.Unlock()
+			ctx.doAddClient(conn, connect, identity)
+			ctx.interestChanged()
 		} else {
 			ctx.logger.Info(fmt.Sprintf("Updating clientID: %s with new connection", connect.ClientID))
-			ctx.doUpdateClient(connect.ClientID, conn)
+			ctx.doUpdateClient(connect.ClientID, connect.Username, identity, conn)
 			if ctx.persistenceProvider != nil {
 				ctx.logger.Info(fmt.Sprintf("Fetching missed messages for clientID: %s", connect.ClientID))
 				err := ctx.sendMissedMessages(connect.ClientID, conn)
@@ -96,148 +203,447 @@ func (ctx *ServerContext) AddClient(conn io.Writer, connect *packets.Connect) (c
 			}
 		}
 	} else {
-		ctx.doAddClient(conn, connect)
+		ctx.doAddClient(conn, connect, identity)
+	}
+
+	if identity != nil && !identity.ExpiresAt.IsZero() {
+		ctx.scheduleExpiry(connect.ClientID, conn, identity.ExpiresAt)
+	}
+
+	if clientRequestForFreshSession && ctx.persistenceProvider != nil {
+		// QoS 2 packet IDs reserved by a previous session (possibly before a restart) must not
+		// cause messages of the fresh session to be treated as retransmissions
+		if err := ctx.persistenceProvider.ClearPacketIDs(connect.ClientID); err != nil {
+			ctx.logger.Error("failed to clear reserved packet IDs", zap.Error(err))
+		}
+		ctx.forgetSession(connect.ClientID)
+	} else if client, err := ctx.getClient(connect.ClientID); err == nil {
+		ctx.saveSession(client)
 	}
 	code = 0
 	sessionExists = clientExists && !clientRequestForFreshSession
+
+	ctx.emitConnected(conn, connect)
 	return
 }
 
+// Disconnect marks the client on a connection as disconnected,
+// and removes it altogether if it does not have a persistent session.
+//
+// A nil disconnect packet means the connection was lost without a DISCONNECT.
 func (ctx *ServerContext) Disconnect(conn io.Writer, disconnect *packets.Disconnect) {
-	var clientIdToRemove string
-	shouldDelete := false
-	for clientID, client := range ctx.connectedClientsMap {
-		if client.Connection == conn {
-			clientIdToRemove = clientID
-			if client.IsClean {
-				shouldDelete = true
-			}
+	ctx.mu.Lock()
+	var clientToRemove *ConnectedClient
+	for _, client := range ctx.connectedClientsMap {
+		// a lost connection is only relevant if the client was not disconnected already
+		if client.Connection == conn && (disconnect != nil || client.IsConnected) {
+			clientToRemove = client
+			break
 		}
 	}
 
-	if shouldDelete {
-		ctx.logger.Info(fmt.Sprintf("Deleting connection for clientID: %s", clientIdToRemove))
-		delete(ctx.connectedClientsMap, clientIdToRemove)
-	} else {
-		ctx.logger.Info(fmt.Sprintf("Marking connection as disconnected for clientID: %s", clientIdToRemove))
-		ctx.mu.Lock()
-		ctx.connectedClientsMap[clientIdToRemove].IsConnected = false
+	if clientToRemove == nil {
 		ctx.mu.Unlock()
+		return
+	}
+
+	if clientToRemove.IsClean {
+		ctx.logger.Info(fmt.Sprintf("Deleting connection for clientID: %s", clientToRemove.ClientID))
+		delete(ctx.connectedClientsMap, clientToRemove.ClientID)
+	} else {
+		ctx.logger.Info(fmt.Sprintf("Marking connection as disconnected for clientID: %s", clientToRemove.ClientID))
+		clientToRemove.IsConnected = false
+	}
+	ctx.mu.Unlock()
+
+	ctx.emitDisconnected(clientToRemove, disconnect)
+	ctx.onDisconnect(clientToRemove, disconnect)
+	if clientToRemove.IsClean {
+		ctx.sessionEnded(clientToRemove.ClientID)
+		if len(clientToRemove.Subscriptions) > 0 {
+			ctx.interestChanged()
+		}
+	}
+}
+
+// Publish publishes a message to a topic on behalf of the client on a connection,
+// and returns the reason code to acknowledge the message with.
+//
+// Messages published to $delayed/<seconds>/<topic> are delivered to <topic> after the delay,
+// and everything below applies to <topic>.
+// The topic is rewritten according to the configured rewrite rules before anything else.
+// Clients are not allowed to publish to topics starting with $, such as $SYS, and such messages are dropped.
+// Hooks may then change or reject the message.
+//
+// A nil connection publishes a message on behalf of the broker itself.
+func (ctx *ServerContext) Publish(conn io.Writer, publish *packets.Publish) (code byte) {
+	if ctx.tracer != nil {
+		// the trace context of the message is replaced, so the caller keeps its own
+		publish = copyPublish(publish)
+	}
+	spanCtx, span := ctx.tracer.Start(publish, "publish", trace.SpanKindInternal)
+	ctx.tracer.Inject(spanCtx, publish)
+	defer func() {
+		span.SetAttributes(attribute.Int("mqtt.reason_code", int(code)))
+		if code >= reasonFailure {
+			span.SetStatus(codes.Error, "publish rejected")
+		}
+		span.End()
+	}()
+
+	topic, delay, delayed, err := delayedTopic(publish.Topic)
+	if err != nil {
+		ctx.logger.Info(fmt.Sprintf("Dropping publish to %s", publish.Topic), zap.Error(err))
+		return packets.PubackTopicNameInvalid
+	}
+	if rewrittenTopic := ctx.rewriter.rewrite(topic); rewrittenTopic != publish.Topic {
+		rewrittenPublish := *publish
+		rewrittenPublish.Topic = rewrittenTopic
+		publish = &rewrittenPublish
+	}
+
+	if isReservedTopic(publish.Topic) {
+		ctx.logger.Info(fmt.Sprintf("Dropping client publish to %s", publish.Topic))
+		return reasonSuccess
+	}
+
+	var client *ConnectedClient
+	if conn != nil {
+		if client, err = ctx.getClientForConnection(conn); err != nil {
+			// only connections which completed a CONNECT may publish
+			ctx.logger.Info(fmt.Sprintf("Dropping publish to %s from a connection without a client", publish.Topic))
+			return packets.PubackNotAuthorized
+		}
+		if allowed, limit, disconnect := ctx.limiterOf(client).allowPublish(len(publish.Payload)); !allowed {
+			ctx.metrics.RateLimited(limit)
+			if disconnect {
+				ctx.disconnectForRate(client)
+			}
+			return packets.PubackQuotaExceeded
+		}
+	}
+	if !ctx.isAuthorized(client, auth.ActionPublish, publish.Topic) {
+		// there is no acknowledgement for QoS 0, so the message is dropped silently
+		ctx.logger.Info(fmt.Sprintf("Publish to %s denied for clientID: %s", publish.Topic, client.ClientID))
+		return packets.PubackNotAuthorized
+	}
+	if code := ctx.onPublish(client, publish); code >= reasonFailure {
+		ctx.logger.Info(fmt.Sprintf("Publish to %s rejected by hook", publish.Topic))
+		return code
 	}
+
+	ctx.stats.addMessageReceived()
+
+	if delayed {
+		ctx.publishDelayed(publish, delay)
+		return reasonSuccess
+	}
+	ctx.dispatch(publish)
+	return reasonSuccess
 }
 
-// Publish publishes a message to a topic
-func (ctx *ServerContext) Publish(publish *packets.Publish) {
-	var shareNameClientMap = make(map[string][]*ConnectedClient, 0)
+// route delivers a message to all matching subscribers.
+//
+// The message is encoded once for every distinct combination of QoS and retain flag
+// across its recipients, and the encoded bytes are reused for all of them.
+func (ctx *ServerContext) route(publish *packets.Publish) {
+	encoder := newPublishEncoder(publish)
+
+	var offlineClients []*ConnectedClient
+	var deliveries []*delivery
+	var shareNameClientMap = make(map[string][]*delivery, 0)
+
+	ctx.mu.RLock()
 	for _, client := range ctx.connectedClientsMap {
 		topicToTarget := publish.Topic
-		for topicFilter, _ := range client.Subscriptions {
+		var clientDelivery *delivery
+		for topicFilter, options := range client.Subscriptions {
 			matches, isShared, shareName := utils.TopicMatches(topicToTarget, topicFilter)
 			if matches {
 				if !isShared {
-					// non-shared subscriptions
-					if !client.IsConnected && !client.IsClean && ctx.persistenceProvider != nil {
-						// save for offline usage
-						ctx.logger.Info(fmt.Sprintf("Saving offline delivery message for clientID: %s", client.ClientID))
-						err := ctx.persistenceProvider.SaveForOfflineDelivery(client.ClientID, publish)
-						if err != nil {
-							ctx.logger.Error("failed to save offline message", zap.Error(err))
-						}
-					}
-					if client.IsConnected {
-						// send direct message
-						publish.WriteTo(client.Connection)
+					// non-shared subscriptions are delivered once per client,
+					// with the highest QoS across all matching subscriptions
+					if clientDelivery == nil {
+						clientDelivery = &delivery{client: client, options: options}
+					} else if options.QoS > clientDelivery.options.QoS {
+						clientDelivery.options = options
 					}
 				} else {
 					// share subscriptions
 					if len(shareNameClientMap[shareName]) == 0 {
-						shareNameClientMap[shareName] = make([]*ConnectedClient, 0)
+						shareNameClientMap[shareName] = make([]*delivery, 0)
 					}
-					shareNameClientMap[shareName] = append(shareNameClientMap[shareName], client)
+					shareNameClientMap[shareName] = append(shareNameClientMap[shareName], &delivery{client: client, options: options})
 				}
 			}
 		}
-	}
 
-	for _, clients := range shareNameClientMap {
-		onlineClients := make([]*ConnectedClient, 0)
-		for _, c := range clients {
-			if c.IsConnected {
-				onlineClients = append(onlineClients, c)
-			}
+		if clientDelivery == nil {
+			continue
+		}
+		if client.IsConnected {
+			deliveries = append(deliveries, clientDelivery)
+		} else if !client.IsClean && ctx.persistenceProvider != nil {
+			offlineClients = append(offlineClients, client)
+		}
+	}
+	ctx.mu.RUnlock()
+
+	for _, client := range offlineClients {
+		// save for offline usage
+		ctx.logger.Info(fmt.Sprintf("Saving offline delivery message for clientID: %s", client.ClientID))
+		_, span := ctx.tracer.Start(publish, "persistence.save_offline", trace.SpanKindInternal)
+		err := ctx.persistenceProvider.SaveForOfflineDelivery(client.ClientID, publish)
+		tracing.End(span, err)
+		if err != nil {
+			ctx.logger.Error("failed to save offline message", zap.Error(err))
 		}
+	}
+
+	for _, d := range deliveries {
+		// send direct message
+		ctx.deliver(encoder, d)
+	}
 
-		var client *ConnectedClient
+	for _, clients := range shareNameClientMap {
+		var d *delivery
 		if len(clients) == 1 {
-			client = clients[0]
+			d = clients[0]
 		} else {
-			rand.Seed(time.Now().Unix())
-			s := rand.NewSource(time.Now().Unix())
+			s := rand.NewSource(time.Now().UnixNano())
 			r := rand.New(s) // initialize local pseudorandom generator
 			luckyClientIndex := r.Intn(len(clients))
-			client = clients[luckyClientIndex]
+			d = clients[luckyClientIndex]
+		}
+		ctx.deliver(encoder, d)
+	}
+}
+
+// deliver writes an encoded publish to a single recipient,
+// downgrading the QoS to what the recipient has subscribed with.
+func (ctx *ServerContext) deliver(encoder *publishEncoder, d *delivery) {
+	routedAt := encoder.createdAt
+	qos := encoder.publish.QoS
+	if d.options.QoS < qos {
+		qos = d.options.QoS
+	}
+	retain := encoder.publish.Retain && d.options.RetainAsPublished
+
+	_, span := ctx.tracer.Start(encoder.publish, "deliver", trace.SpanKindProducer)
+	span.SetAttributes(attribute.String("mqtt.client_id", d.client.ClientID))
+	defer span.End()
+
+	if len(ctx.getHooks()) > 0 {
+		clientPublish := copyPublish(encoder.publish)
+		clientPublish.QoS = qos
+		clientPublish.Retain = retain
+		if !ctx.onDeliver(d.client, clientPublish) {
+			return
 		}
-		publish.WriteTo(client.Connection)
+		// hooks may have changed the message for this client alone, so it is encoded separately
+		encoder = newPublishEncoder(clientPublish)
+		qos, retain = clientPublish.QoS, clientPublish.Retain
+	}
+
+	if internal, ok := d.client.Connection.(*internalConn); ok {
+		// internal clients get their own copy, and need no encoding
+		publish := *encoder.publish
+		publish.QoS = qos
+		publish.Retain = retain
+		publish.Duplicate = false
+		publish.PacketID = 0
+		internal.onPublish(&publish)
+		ctx.stats.addMessageSent()
+		ctx.metrics.PublishDelivered(time.Since(routedAt))
+		return
+	}
+
+	encoded, err := encoder.encode(qos, retain)
+	if err != nil {
+		ctx.logger.Error("failed to encode publish", zap.Error(err))
+		return
+	}
+
+	var packetID uint16
+	if qos > 0 {
+		packetID = d.client.nextPacketID()
+	}
+	if err = encoded.writeTo(d.client.Connection, packetID); err != nil {
+		ctx.logger.Error(fmt.Sprintf("failed to deliver message to clientID: %s", d.client.ClientID), zap.Error(err))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return
 	}
+	ctx.stats.addMessageSent()
+	ctx.metrics.PacketSent(packets.PUBLISH)
+	ctx.metrics.PublishDelivered(time.Since(routedAt))
 }
 
 func (ctx *ServerContext) Subscribe(conn io.Writer, subscribe *packets.Subscribe) []byte {
-	ctx.mu.Lock()
-	defer ctx.mu.Unlock()
+	subscriber, err := ctx.getClientForConnection(conn)
+	if err != nil {
+		return nil
+	}
+	if allowed, disconnect := ctx.limiterOf(subscriber).allowSubscribe(); !allowed {
+		ctx.metrics.RateLimited("subscribes")
+		if disconnect {
+			ctx.disconnectForRate(subscriber)
+		}
+		subAckBytes := make([]byte, 0, len(subscribe.Subscriptions))
+		for range subscribe.Subscriptions {
+			subAckBytes = append(subAckBytes, packets.SubackQuotaexceeded)
+		}
+		return subAckBytes
+	}
+	return ctx.subscribe(subscriber, subscribe)
+}
 
+func (ctx *ServerContext) subscribe(subscriber *ConnectedClient, subscribe *packets.Subscribe) []byte {
 	var subAckBytes []byte
-	for _, client := range ctx.connectedClientsMap {
-		if conn == client.Connection {
-			for topic, options := range subscribe.Subscriptions {
-				client.Subscriptions[topic] = options
-				var subAckByte byte
+	var subscribedTopics []string
+	subscriptions := make(map[string]packets.SubOptions, 0)
+	for topic, options := range subscribe.Subscriptions {
+		topic = ctx.rewriter.rewrite(topic)
+		var subAckByte byte
+
+		if isSysTopic(topic) && !ctx.canReadSysTopics(subscriber) {
+			subAckBytes = append(subAckBytes, packets.SubackNotauthorized)
+			continue
+		}
+		if !isSysTopic(topic) && !ctx.isAuthorized(subscriber, auth.ActionSubscribe, topic) {
+			ctx.logger.Info(fmt.Sprintf("Subscription to %s denied for clientID: %s", topic, subscriber.ClientID))
+			subAckBytes = append(subAckBytes, packets.SubackNotauthorized)
+			continue
+		}
+		// hooks are called without holding the lock, so that they may call back into the broker
+		if code := ctx.onSubscribe(subscriber, topic, &options); code >= reasonFailure {
+			subAckBytes = append(subAckBytes, code)
+			continue
+		}
+		subscriptions[topic] = options
+		subscribedTopics = append(subscribedTopics, topic)
 
-				if options.QoS > ctx.config.Server.MaxQos {
-					subAckByte = packets.SubackImplementationspecificerror
-				} else {
-					switch options.QoS {
-					case 0:
-						subAckByte = packets.SubackGrantedQoS0
-						break
-					case 1:
-						subAckByte = packets.SubackGrantedQoS1
-						break
-					case 2:
-						subAckByte = packets.SubackGrantedQoS2
-						break
-					default:
-						subAckByte = packets.SubackUnspecifiederror
-					}
-				}
-				subAckBytes = append(subAckBytes, subAckByte)
+		if options.QoS > ctx.config.Server.MaxQos {
+			subAckByte = packets.SubackImplementationspecificerror
+		} else {
+			switch options.QoS {
+			case 0:
+				subAckByte = packets.SubackGrantedQoS0
+				break
+			case 1:
+				subAckByte = packets.SubackGrantedQoS1
+				break
+			case 2:
+				subAckByte = packets.SubackGrantedQoS2
+				break
+			default:
+				subAckByte = packets.SubackUnspecifiederror
+			}
+		}
+		subAckBytes = append(subAckBytes, subAckByte)
+	}
+
+	retainedStored := ctx.sessionStore() != nil
+	ctx.mu.Lock()
+	for topic, options := range subscriptions {
+		_, exists := subscriber.Subscriptions[topic]
+		subscriber.Subscriptions[topic] = options
+		if retainedStored && wantsRetained(topic, options, exists) {
+			if subscriber.retainedFilters == nil {
+				subscriber.retainedFilters = make(map[string]packets.SubOptions, 0)
 			}
+			subscriber.retainedFilters[topic] = options
 		}
 	}
+	ctx.mu.Unlock()
+
+	ctx.emitSubscription(eventSubscribed, subscriber, subscribedTopics)
+	if len(subscribedTopics) > 0 {
+		ctx.saveSession(subscriber)
+		ctx.interestChanged()
+	}
+	if _, ok := subscriber.Connection.(*internalConn); ok {
+		// internal clients are not sent a SUBACK to wait for
+		ctx.SendRetained(subscriber.Connection)
+	}
 	return subAckBytes
 }
 
 func (ctx *ServerContext) Unsubscribe(conn io.Writer, unsubscribe *packets.Unsubscribe) []byte {
-	client, _ := ctx.getClientForConnection(conn)
+	client, err := ctx.getClientForConnection(conn)
+	if err != nil {
+		var unsubAckBytes []byte
+		for range unsubscribe.Topics {
+			unsubAckBytes = append(unsubAckBytes, packets.UnsubackUnspecifiedError)
+		}
+		return unsubAckBytes
+	}
+	return ctx.unsubscribe(client, unsubscribe)
+}
 
+func (ctx *ServerContext) unsubscribe(client *ConnectedClient, unsubscribe *packets.Unsubscribe) []byte {
 	var unsubAckBytes []byte
+	var unsubscribedTopics []string
+	ctx.mu.Lock()
 	for _, topic := range unsubscribe.Topics {
+		topic = ctx.rewriter.rewrite(topic)
 		_, ok := client.Subscriptions[topic]
 		if ok {
 			delete(client.Subscriptions, topic)
+			unsubscribedTopics = append(unsubscribedTopics, topic)
 			unsubAckBytes = append(unsubAckBytes, packets.UnsubackSuccess)
 		} else {
 			unsubAckBytes = append(unsubAckBytes, packets.UnsubackNoSubscriptionFound)
 		}
 	}
+	ctx.mu.Unlock()
+
+	ctx.emitSubscription(eventUnsubscribed, client, unsubscribedTopics)
+	if len(unsubscribedTopics) > 0 {
+		ctx.saveSession(client)
+		ctx.interestChanged()
+	}
 	return unsubAckBytes
 }
 
+// IsPacketIDReserved checks if the packet ID of an incoming QoS 2 PUBLISH
+// is still reserved, in which case the PUBLISH is a retransmission.
+//
+// Without a persistence provider, packet IDs are reserved in memory for as long as the session lives.
+func (ctx *ServerContext) IsPacketIDReserved(conn io.Writer, publish *packets.Publish) (bool, error) {
+	client, err := ctx.getClientForConnection(conn)
+	if err != nil {
+		return false, err
+	}
+	if ctx.persistenceProvider == nil {
+		ctx.mu.RLock()
+		defer ctx.mu.RUnlock()
+		return client.packetIDs[publish.PacketID], nil
+	}
+	_, span := ctx.tracer.Start(publish, "persistence.check_packet_id", trace.SpanKindInternal)
+	reserved, err := ctx.persistenceProvider.CheckForPacketIdReuse(client.ClientID, publish.PacketID)
+	tracing.End(span, err)
+	return reserved, err
+}
+
 func (ctx *ServerContext) ReservePacketID(conn io.Writer, publish *packets.Publish) error {
 	client, err := ctx.getClientForConnection(conn)
 	if err != nil {
 		return err
 	}
-	return ctx.persistenceProvider.ReservePacketID(client.ClientID, publish.PacketID)
+	if ctx.persistenceProvider == nil {
+		ctx.mu.Lock()
+		defer ctx.mu.Unlock()
+		if client.packetIDs == nil {
+			client.packetIDs = make(map[uint16]bool, 0)
+		}
+		client.packetIDs[publish.PacketID] = true
+		return nil
+	}
+	_, span := ctx.tracer.Start(publish, "persistence.reserve_packet_id", trace.SpanKindInternal)
+	err = ctx.persistenceProvider.ReservePacketID(client.ClientID, publish.PacketID)
+	tracing.End(span, err)
+	return err
 }
 
 func (ctx *ServerContext) FreePacketID(conn io.Writer, pubRel *packets.Pubrel) error {
@@ -245,6 +651,12 @@ func (ctx *ServerContext) FreePacketID(conn io.Writer, pubRel *packets.Pubrel) e
 	if err != nil {
 		return err
 	}
+	if ctx.persistenceProvider == nil {
+		ctx.mu.Lock()
+		defer ctx.mu.Unlock()
+		delete(client.packetIDs, pubRel.PacketID)
+		return nil
+	}
 	return ctx.persistenceProvider.FreePacketID(client.ClientID, pubRel.PacketID)
 }
 
@@ -277,9 +689,10 @@ func (ctx *ServerContext) sendMissedMessages(clientId string, conn io.Writer) er
 	if err != nil {
 		return err
 	}
+	ctx.metrics.OfflineFetched(len(missedMessages))
 
 	for _, msg := range missedMessages {
-		if _, writeErr := msg.WriteTo(conn); writeErr != nil {
+		if writeErr := writePublish(conn, msg); writeErr != nil {
 			if ctx.persistenceProvider.SaveForOfflineDelivery(clientId, msg) != nil {
 				ctx.logger.Error("failed to save offline message", zap.Error(err))
 			}
@@ -288,10 +701,13 @@ func (ctx *ServerContext) sendMissedMessages(clientId string, conn io.Writer) er
 	return nil
 }
 
-func (ctx *ServerContext) doAddClient(conn io.Writer, connect *packets.Connect) {
+func (ctx *ServerContext) doAddClient(conn io.Writer, connect *packets.Connect, identity *auth.Identity) {
 	newClient := &ConnectedClient{
 		Connection:    conn,
 		ClientID:      connect.ClientID,
+		Username:      connect.Username,
+		identity:      identity,
+		limiter:       ctx.newClientLimiter(conn, connect.ClientID, connect.Username),
 		IsClean:       connect.CleanStart,
 		IsConnected:   true,
 		Subscriptions: make(map[string]packets.SubOptions, 0),
@@ -303,16 +719,55 @@ func (ctx *ServerContext) doAddClient(conn io.Writer, connect *packets.Connect)
 	ctx.mu.Unlock()
 }
 
-func (ctx *ServerContext) doUpdateClient(clientID string, conn io.Writer) {
-	ctx.connectedClientsMap[clientID].Connection = conn
+func (ctx *ServerContext) doUpdateClient(clientID string, username string, identity *auth.Identity, conn io.Writer) {
+	limiter := ctx.newClientLimiter(conn, clientID, username)
+
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	client := ctx.connectedClientsMap[clientID]
+	client.limiter = limiter
+	client.Connection = conn
+	client.Username = username
+	client.identity = identity
+	client.IsConnected = true
 }
 
 // ConnectedClient stores the information about a currently connected client
 type ConnectedClient struct {
 	Connection    io.Writer
 	ClientID      string
+	Username      string
 	ClientGroup   string
 	IsConnected   bool
 	IsClean       bool
 	Subscriptions map[string]packets.SubOptions
+
+	// identity is what the auth provider knows about the client
+	identity     *auth.Identity
+	limiter      *clientLimiter
+	lastPacketID uint32
+
+	// packetIDs are reserved for incoming QoS 2 messages if there is no persistence provider to reserve them in
+	packetIDs map[uint16]bool
+
+	// retainedFilters are subscribed to, and still need the retained messages matching them sent
+	retainedFilters map[string]packets.SubOptions
+}
+
+// nextPacketID returns the packet ID to use for the next
+// QoS 1 or QoS 2 message sent to this client
+func (client *ConnectedClient) nextPacketID() uint16 {
+	for {
+		// packet ID 0 is not allowed, so skip over it on wrap around
+		if id := uint16(atomic.AddUint32(&client.lastPacketID, 1)); id != 0 {
+			return id
+		}
+	}
+}
+
+// delivery is a single recipient for a published message
+type delivery struct {
+	client  *ConnectedClient
+	options packets.SubOptions
 }
@@ -1,6 +1,8 @@
 package mqtt
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"github.com/c16a/hermes/lib/auth"
 	"github.com/c16a/hermes/lib/config"
@@ -9,7 +11,10 @@ import (
 	"go.uber.org/zap"
 	"io"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
 )
@@ -398,7 +403,7 @@ func TestServerContext_Publish(t *testing.T) {
 				persistenceProvider: tt.fields.persistenceProvider,
 				logger:              zap.NewNop(),
 			}
-			ctx.Publish(tt.args.publish)
+			ctx.Publish(nil, tt.args.publish)
 		})
 	}
 }
@@ -553,6 +558,105 @@ func TestServerContext_Subscribe(t *testing.T) {
 			},
 			[]byte{packets.SubackImplementationspecificerror},
 		},
+		{
+			"Subscribing to $SYS without authorization",
+			fields{
+				map[string]*ConnectedClient{
+					"abcd": {
+						ClientID:      "abcd",
+						Username:      "guest",
+						Connection:    ioutil.Discard,
+						Subscriptions: make(map[string]packets.SubOptions, 0),
+					},
+				},
+				&sync.RWMutex{},
+				&config.Config{
+					Server: &config.Server{
+						MaxQos: 2,
+						Sys:    &config.Sys{Users: []string{"admin"}},
+					},
+				},
+				nil,
+				&MockPersistenceProvider{},
+			},
+			args{
+				ioutil.Discard,
+				&packets.Subscribe{
+					Subscriptions: map[string]packets.SubOptions{
+						"$SYS/#": {
+							QoS: 0,
+						},
+					},
+				},
+			},
+			[]byte{packets.SubackNotauthorized},
+		},
+		{
+			"Subscribing to $SYS in lower case without authorization",
+			fields{
+				map[string]*ConnectedClient{
+					"abcd": {
+						ClientID:      "abcd",
+						Username:      "guest",
+						Connection:    ioutil.Discard,
+						Subscriptions: make(map[string]packets.SubOptions, 0),
+					},
+				},
+				&sync.RWMutex{},
+				&config.Config{
+					Server: &config.Server{
+						MaxQos: 2,
+						Sys:    &config.Sys{Users: []string{"admin"}},
+					},
+				},
+				nil,
+				&MockPersistenceProvider{},
+			},
+			args{
+				ioutil.Discard,
+				&packets.Subscribe{
+					Subscriptions: map[string]packets.SubOptions{
+						"$sys/#": {
+							QoS: 0,
+						},
+					},
+				},
+			},
+			[]byte{packets.SubackNotauthorized},
+		},
+		{
+			"Subscribing to $SYS with authorization",
+			fields{
+				map[string]*ConnectedClient{
+					"abcd": {
+						ClientID:      "abcd",
+						Username:      "admin",
+						Connection:    ioutil.Discard,
+						Subscriptions: make(map[string]packets.SubOptions, 0),
+					},
+				},
+				&sync.RWMutex{},
+				&config.Config{
+					Server: &config.Server{
+						MaxQos: 2,
+						Sys:    &config.Sys{Users: []string{"admin"}},
+					},
+				},
+				nil,
+				&MockPersistenceProvider{},
+			},
+			args{
+				ioutil.Discard,
+				&packets.Subscribe{
+					Subscriptions: map[string]packets.SubOptions{
+						"$SYS/#": {
+							QoS: 0,
+						},
+					},
+				},
+			},
+			[]byte{packets.SubackGrantedQoS0},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -643,6 +747,7 @@ func TestServerContext_Unsubscribe(t *testing.T) {
 }
 
 type MockPersistenceProvider struct {
+	closed bool
 }
 
 func (m *MockPersistenceProvider) ReservePacketID(clientID string, packetID uint16) error {
@@ -657,6 +762,31 @@ func (m *MockPersistenceProvider) CheckForPacketIdReuse(clientID string, packetI
 	return false, nil
 }
 
+func (m *MockPersistenceProvider) GetPacketIDs(clientID string) ([]uint16, error) {
+	return nil, nil
+}
+
+func (m *MockPersistenceProvider) ClearPacketIDs(clientID string) error {
+	return nil
+}
+
+func (m *MockPersistenceProvider) SaveDelayedMessage(message *persistence.DelayedMessage) error {
+	return nil
+}
+
+func (m *MockPersistenceProvider) GetDelayedMessages() ([]*persistence.DelayedMessage, error) {
+	return nil, nil
+}
+
+func (m *MockPersistenceProvider) DeleteDelayedMessage(id string) (bool, error) {
+	return true, nil
+}
+
+func (m *MockPersistenceProvider) Close() error {
+	m.closed = true
+	return nil
+}
+
 func (m *MockPersistenceProvider) SaveForOfflineDelivery(clientId string, publish *packets.Publish) error {
 	return nil
 }
@@ -680,3 +810,76 @@ func (m *MockAuthProvider) Validate(username string, password string) error {
 	}
 	return nil
 }
+
+func TestServerContext_PublishTracing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.json")
+	ctx, err := NewServerContext(&config.Config{
+		Server: &config.Server{
+			MaxQos:  2,
+			Tracing: &config.Tracing{Exporter: "file", Path: path},
+		},
+	}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var subscriber bytes.Buffer
+	ctx.AddClient(&subscriber, &packets.Connect{ClientID: "subscriber"})
+	ctx.Subscribe(&subscriber, &packets.Subscribe{
+		Subscriptions: map[string]packets.SubOptions{"foo": {}},
+	})
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	const traceparent = "00-" + traceID + "-00f067aa0ba902b7-01"
+	publish := &packets.Publish{
+		Topic:      "foo",
+		Payload:    []byte("Hello World"),
+		Properties: &packets.Properties{User: []packets.User{{Key: "traceparent", Value: traceparent}}},
+	}
+	ctx.Publish(nil, publish)
+
+	if publish.Properties.User[0].Value != traceparent {
+		t.Error("trace context of the published message was changed")
+	}
+
+	cp, err := packets.ReadPacket(&subscriber)
+	if err != nil {
+		t.Fatalf("no message delivered: %v", err)
+	}
+	delivered := cp.Content.(*packets.Publish)
+	if delivered.Properties == nil || len(delivered.Properties.User) != 1 {
+		t.Fatal("delivered message carries no trace context")
+	}
+	if value := delivered.Properties.User[0].Value; !strings.Contains(value, traceID) || value == traceparent {
+		t.Errorf("delivered message carries traceparent %s, want a child of %s", value, traceparent)
+	}
+
+	if err := ctx.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	spans := make(map[string]string)
+	decoder := json.NewDecoder(file)
+	for {
+		var span struct {
+			Name        string
+			SpanContext struct{ TraceID string }
+		}
+		if err := decoder.Decode(&span); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		spans[span.Name] = span.SpanContext.TraceID
+	}
+	for _, name := range []string{"publish", "deliver"} {
+		if spans[name] != traceID {
+			t.Errorf("%s span has trace ID %q, want %s", name, spans[name], traceID)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package mqtt
+
+import (
+	"fmt"
+	"github.com/c16a/hermes/lib/persistence"
+	"github.com/c16a/hermes/lib/utils"
+	"github.com/eclipse/paho.golang/packets"
+	"go.uber.org/zap"
+	"io"
+)
+
+// RetainedSender is implemented by bases which keep retained messages
+type RetainedSender interface {
+	// SendRetained sends the retained messages for the subscriptions just acknowledged on a connection
+	SendRetained(io.Writer)
+}
+
+// sessionStore returns the persistence provider if it also stores sessions and retained messages
+func (ctx *ServerContext) sessionStore() persistence.SessionStore {
+	store, _ := ctx.persistenceProvider.(persistence.SessionStore)
+	return store
+}
+
+// saveSession saves the persistent session of a client, so that it can be resumed
+// even once no node of the cluster holds it anymore
+func (ctx *ServerContext) saveSession(client *ConnectedClient) {
+	store := ctx.sessionStore()
+	if store == nil || client.IsClean {
+		return
+	}
+
+	ctx.mu.RLock()
+	session := &persistence.Session{
+		ClientID:      client.ClientID,
+		Username:      client.Username,
+		Subscriptions: make(map[string]packets.SubOptions, len(client.Subscriptions)),
+	}
+	for topicFilter, options := range client.Subscriptions {
+		session.Subscriptions[topicFilter] = options
+	}
+	ctx.mu.RUnlock()
+
+	if err := store.SaveSession(session); err != nil {
+		ctx.logger.Error("failed to save session", zap.Error(err))
+	}
+}
+
+func (ctx *ServerContext) forgetSession(clientID string) {
+	if store := ctx.sessionStore(); store != nil {
+		if err := store.DeleteSession(clientID); err != nil {
+			ctx.logger.Error("failed to delete session", zap.Error(err))
+		}
+	}
+}
+
+// loadSession returns the saved state of a session, or nil if there is none
+func (ctx *ServerContext) loadSession(clientID string) *SessionState {
+	store := ctx.sessionStore()
+	if store == nil {
+		return nil
+	}
+	session, err := store.GetSession(clientID)
+	if err != nil {
+		ctx.logger.Error("failed to load session", zap.Error(err))
+		return nil
+	}
+	if session == nil {
+		return nil
+	}
+
+	ctx.logger.Info(fmt.Sprintf("Resuming saved session for clientID: %s", clientID))
+	// offline messages and reserved packet IDs are still saved for the client
+	return &SessionState{
+		ClientID:      session.ClientID,
+		Username:      session.Username,
+		Subscriptions: session.Subscriptions,
+	}
+}
+
+// saveRetained keeps a message published with the retain flag, or deletes the one of its topic if it has no payload
+func (ctx *ServerContext) saveRetained(publish *packets.Publish) {
+	store := ctx.sessionStore()
+	if store == nil {
+		return
+	}
+	if err := store.SaveRetained(publish); err != nil {
+		ctx.logger.Error("failed to save retained message", zap.Error(err))
+	}
+}
+
+// wantsRetained reports whether the retained messages are sent for a subscription,
+// which depends on its retain handling option and whether it existed already.
+// They are never sent for shared subscriptions.
+func wantsRetained(topicFilter string, options packets.SubOptions, exists bool) bool {
+	if _, isShared, _, err := utils.GetTopicInfo(topicFilter); err != nil || isShared {
+		return false
+	}
+	switch options.RetainHandling {
+	case 0:
+		return true
+	case 1:
+		return !exists
+	}
+	return false
+}
+
+// SendRetained implements RetainedSender.
+//
+// Every retained message is sent once, even if it matches several of the subscriptions.
+func (ctx *ServerContext) SendRetained(conn io.Writer) {
+	client, err := ctx.getClientForConnection(conn)
+	if err != nil {
+		return
+	}
+	ctx.mu.Lock()
+	filters := client.retainedFilters
+	client.retainedFilters = nil
+	ctx.mu.Unlock()
+	if len(filters) == 0 {
+		return
+	}
+
+	messages, err := ctx.sessionStore().GetRetained()
+	if err != nil {
+		ctx.logger.Error("failed to fetch retained messages", zap.Error(err))
+		return
+	}
+	canReadSysTopics := ctx.canReadSysTopics(client)
+	for _, publish := range messages {
+		if isSysTopic(publish.Topic) && !canReadSysTopics {
+			continue
+		}
+		for topicFilter, options := range filters {
+			if matches, _, _ := utils.TopicMatches(publish.Topic, topicFilter); matches {
+				// messages sent because of a new subscription always keep the retain flag
+				options.RetainAsPublished = true
+				ctx.deliver(newPublishEncoder(publish), &delivery{client: client, options: options})
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package mqtt
+
+import (
+	"github.com/c16a/hermes/lib/config"
+	"github.com/c16a/hermes/lib/persistence"
+	"github.com/eclipse/paho.golang/packets"
+	"go.uber.org/zap"
+	"sync"
+	"testing"
+)
+
+// storingPersistenceProvider also stores sessions and retained messages in memory
+type storingPersistenceProvider struct {
+	sharedPersistenceProvider
+	sessions map[string]*persistence.Session
+	retained map[string]*packets.Publish
+}
+
+func newStoringPersistenceProvider() *storingPersistenceProvider {
+	return &storingPersistenceProvider{
+		sessions: make(map[string]*persistence.Session, 0),
+		retained: make(map[string]*packets.Publish, 0),
+	}
+}
+
+func (p *storingPersistenceProvider) SaveSession(session *persistence.Session) error {
+	p.sessions[session.ClientID] = session
+	return nil
+}
+
+func (p *storingPersistenceProvider) GetSession(clientID string) (*persistence.Session, error) {
+	return p.sessions[clientID], nil
+}
+
+func (p *storingPersistenceProvider) DeleteSession(clientID string) error {
+	delete(p.sessions, clientID)
+	return nil
+}
+
+func (p *storingPersistenceProvider) SaveRetained(publish *packets.Publish) error {
+	if len(publish.Payload) == 0 {
+		delete(p.retained, publish.Topic)
+	} else {
+		p.retained[publish.Topic] = publish
+	}
+	return nil
+}
+
+func (p *storingPersistenceProvider) GetRetained() ([]*packets.Publish, error) {
+	var messages []*packets.Publish
+	for _, publish := range p.retained {
+		messages = append(messages, publish)
+	}
+	return messages, nil
+}
+
+func newStoringServerContext(provider persistence.Provider) *ServerContext {
+	return &ServerContext{
+		connectedClientsMap: make(map[string]*ConnectedClient, 0),
+		mu:                  &sync.RWMutex{},
+		config:              &config.Config{Server: &config.Server{MaxQos: 2}},
+		persistenceProvider: provider,
+		logger:              zap.NewNop(),
+	}
+}
+
+func TestServerContext_Retained(t *testing.T) {
+	ctx := newStoringServerContext(newStoringPersistenceProvider())
+	ctx.Publish(nil, &packets.Publish{Topic: "room/1", Payload: []byte("hello"), Retain: true})
+	ctx.Publish(nil, &packets.Publish{Topic: "room/2", Payload: []byte("hello"), Retain: true})
+	ctx.Publish(nil, &packets.Publish{Topic: "room/2", Retain: true})
+
+	var received []*packets.Publish
+	subscriber := NewInternalConnection(func(publish *packets.Publish) {
+		received = append(received, publish)
+	})
+	ctx.AddInternalClient(subscriber, "subscriber")
+
+	ctx.Subscribe(subscriber, &packets.Subscribe{Subscriptions: map[string]packets.SubOptions{"room/#": {}}})
+	if len(received) != 1 || received[0].Topic != "room/1" || !received[0].Retain {
+		t.Fatalf("received %v for a new subscription, want the retained message of room/1", received)
+	}
+
+	received = nil
+	ctx.Subscribe(subscriber, &packets.Subscribe{Subscriptions: map[string]packets.SubOptions{"room/#": {RetainHandling: 1}}})
+	ctx.Subscribe(subscriber, &packets.Subscribe{Subscriptions: map[string]packets.SubOptions{"room/+": {RetainHandling: 2}}})
+	ctx.Subscribe(subscriber, &packets.Subscribe{Subscriptions: map[string]packets.SubOptions{"$share/group/room/#": {}}})
+	if len(received) != 0 {
+		t.Errorf("received %d retained messages, want none", len(received))
+	}
+}
+
+func TestServerContext_ResumeSavedSession(t *testing.T) {
+	provider := newStoringPersistenceProvider()
+	ctx := newStoringServerContext(provider)
+	conn := &closableBuffer{}
+	ctx.AddClient(conn, &packets.Connect{ClientID: "abcd", Username: "alice"})
+	ctx.Subscribe(conn, &packets.Subscribe{Subscriptions: map[string]packets.SubOptions{"foo/#": {QoS: 1}}})
+
+	if session := provider.sessions["abcd"]; session == nil || session.Subscriptions["foo/#"].QoS != 1 {
+		t.Fatalf("saved session %v", session)
+	}
+
+	// another broker sharing the provider resumes the session
+	other := newStoringServerContext(provider)
+	_, sessionExists, _ := other.AddClient(&closableBuffer{}, &packets.Connect{ClientID: "abcd", Username: "alice"})
+	if !sessionExists {
+		t.Error("saved session was not resumed")
+	}
+	client, err := other.getClient("abcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(client.Subscriptions) != 1 {
+		t.Errorf("resumed session has subscriptions %v", client.Subscriptions)
+	}
+
+	other.AddClient(&closableBuffer{}, &packets.Connect{ClientID: "abcd", CleanStart: true})
+	if _, ok := provider.sessions["abcd"]; ok {
+		t.Error("session was still saved after a clean start")
+	}
+}
@@ -0,0 +1,114 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"github.com/eclipse/paho.golang/packets"
+	"go.uber.org/zap"
+	"io"
+	"sync"
+	"time"
+)
+
+// tracerFlushTimeout bounds exporting the remaining spans on Close
+const tracerFlushTimeout = 5 * time.Second
+
+// DisconnectAll sends a DISCONNECT with the reason code to every client connected over the network,
+// and closes its connection. Persistent sessions are kept, just like for any other disconnect.
+//
+// Connections are closed concurrently. Once shutdownCtx is done, the connections still flushing,
+// such as those of clients which stopped reading, are closed without waiting for their DISCONNECT.
+func (ctx *ServerContext) DisconnectAll(shutdownCtx context.Context, reasonCode byte) {
+	ctx.mu.RLock()
+	var clients []*ConnectedClient
+	for _, client := range ctx.connectedClientsMap {
+		if _, isInternal := client.Connection.(*internalConn); client.IsConnected && !isInternal {
+			clients = append(clients, client)
+		}
+	}
+	ctx.mu.RUnlock()
+
+	disconnect := &packets.Disconnect{ReasonCode: reasonCode}
+	var wg sync.WaitGroup
+	for _, client := range clients {
+		wg.Add(1)
+		go func(client *ConnectedClient, conn io.Writer) {
+			defer wg.Done()
+			ctx.closeConnection(client, disconnect)
+			ctx.Disconnect(conn, disconnect)
+		}(client, client.Connection)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-shutdownCtx.Done():
+		for _, client := range clients {
+			if conn, ok := client.Connection.(*bufferedConn); ok {
+				_ = conn.abort()
+			}
+		}
+		<-closed
+	}
+}
+
+// Close stops publishing $SYS statistics and delayed messages, closes the auth and persistence providers,
+// and exports the remaining spans if tracing is enabled.
+//
+// Delayed messages saved by the persistence provider are published after the broker is started again.
+func (ctx *ServerContext) Close() error {
+	var err error
+	ctx.closeOnce.Do(func() {
+		if ctx.done != nil {
+			close(ctx.done)
+		}
+
+		ctx.mu.Lock()
+		for id, timer := range ctx.delayedTimers {
+			timer.Stop()
+			delete(ctx.delayedTimers, id)
+		}
+		ctx.mu.Unlock()
+
+		// providers shared by several listeners are closed once for each of them, which they tolerate
+		if closer, ok := ctx.authProvider.(io.Closer); ok {
+			_ = closer.Close()
+		}
+		for _, authProvider := range ctx.listenerAuthProviders {
+			if closer, ok := authProvider.(io.Closer); ok {
+				_ = closer.Close()
+			}
+		}
+		if ctx.persistenceProvider != nil {
+			err = ctx.persistenceProvider.Close()
+		}
+
+		flushCtx, cancel := context.WithTimeout(context.Background(), tracerFlushTimeout)
+		defer cancel()
+		if tracerErr := ctx.tracer.Shutdown(flushCtx); tracerErr != nil {
+			ctx.logger.Error("failed to export spans", zap.Error(tracerErr))
+		}
+	})
+	return err
+}
+
+// closeConnection sends a DISCONNECT to a client connected over the network, and closes its connection.
+//
+// Buffered connections flush everything written to them before they are closed.
+func (ctx *ServerContext) closeConnection(client *ConnectedClient, disconnect *packets.Disconnect) {
+	if _, isInternal := client.Connection.(*internalConn); isInternal {
+		return
+	}
+	if _, err := disconnect.WriteTo(client.Connection); err != nil {
+		ctx.logger.Error(fmt.Sprintf("failed to disconnect clientID: %s", client.ClientID), zap.Error(err))
+	} else {
+		ctx.metrics.PacketSent(packets.DISCONNECT)
+	}
+	if closer, ok := client.Connection.(io.Closer); ok {
+		_ = closer.Close()
+	}
+}
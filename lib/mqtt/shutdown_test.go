@@ -0,0 +1,159 @@
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"github.com/c16a/hermes/lib/config"
+	"github.com/c16a/hermes/lib/persistence"
+	"github.com/eclipse/paho.golang/packets"
+	"go.uber.org/zap"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// closableBuffer records what is written to a connection, and whether it was closed
+type closableBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *closableBuffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestServerContext_DisconnectAll(t *testing.T) {
+	ctx := &ServerContext{
+		connectedClientsMap: make(map[string]*ConnectedClient, 0),
+		mu:                  &sync.RWMutex{},
+		config:              &config.Config{Server: &config.Server{MaxQos: 2}},
+		logger:              zap.NewNop(),
+	}
+
+	network := &closableBuffer{}
+	ctx.AddClient(network, &packets.Connect{ClientID: "network"})
+	internal := NewInternalConnection(func(*packets.Publish) {})
+	ctx.AddInternalClient(internal, "internal")
+
+	ctx.DisconnectAll(context.Background(), packets.DisconnectServerShuttingDown)
+
+	cp, err := packets.ReadPacket(&network.Buffer)
+	if err != nil {
+		t.Fatalf("no DISCONNECT written: %v", err)
+	}
+	if disconnect, ok := cp.Content.(*packets.Disconnect); !ok || disconnect.ReasonCode != packets.DisconnectServerShuttingDown {
+		t.Error("client was not sent a DISCONNECT with reason code Server shutting down")
+	}
+	if !network.closed {
+		t.Error("connection was not closed")
+	}
+
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+	if client, ok := ctx.connectedClientsMap["network"]; !ok || client.IsConnected {
+		t.Error("persistent session was not kept as disconnected")
+	}
+	if !ctx.connectedClientsMap["internal"].IsConnected {
+		t.Error("internal client was disconnected")
+	}
+}
+
+func TestServerContext_DisconnectAllNotReading(t *testing.T) {
+	ctx := &ServerContext{
+		connectedClientsMap: make(map[string]*ConnectedClient, 0),
+		mu:                  &sync.RWMutex{},
+		config:              &config.Config{Server: &config.Server{MaxQos: 2}},
+		logger:              zap.NewNop(),
+	}
+
+	// nothing is ever read from the other end of the pipe, so every write to it blocks
+	server, client := net.Pipe()
+	defer client.Close()
+	ctx.AddClient(newBufferedConn(server, &brokerStats{}), &packets.Connect{ClientID: "stuck"})
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	ctx.DisconnectAll(shutdownCtx, packets.DisconnectServerShuttingDown)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("DisconnectAll() took %s with a client which does not read", elapsed)
+	}
+
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+	if ctx.connectedClientsMap["stuck"].IsConnected {
+		t.Error("client was not disconnected")
+	}
+}
+
+func TestServerContext_AddInternalClientTakesOver(t *testing.T) {
+	ctx := &ServerContext{
+		connectedClientsMap: make(map[string]*ConnectedClient, 0),
+		mu:                  &sync.RWMutex{},
+		config:              &config.Config{Server: &config.Server{MaxQos: 2}},
+		logger:              zap.NewNop(),
+	}
+
+	network := &closableBuffer{}
+	ctx.AddClient(network, &packets.Connect{ClientID: "abcd"})
+	internal := NewInternalConnection(func(*packets.Publish) {})
+	ctx.AddInternalClient(internal, "abcd")
+
+	cp, err := packets.ReadPacket(&network.Buffer)
+	if err != nil {
+		t.Fatalf("no DISCONNECT written: %v", err)
+	}
+	if disconnect, ok := cp.Content.(*packets.Disconnect); !ok || disconnect.ReasonCode != packets.DisconnectSessionTakenOver {
+		t.Error("network client was not sent a DISCONNECT with reason code Session taken over")
+	}
+	if !network.closed {
+		t.Error("connection of the network client was not closed")
+	}
+	if client, err := ctx.getClientForConnection(internal); err != nil || !client.IsConnected {
+		t.Error("internal client did not take over the session")
+	}
+}
+
+func TestServerContext_Close(t *testing.T) {
+	provider := &MockPersistenceProvider{}
+	ctx := &ServerContext{
+		connectedClientsMap: make(map[string]*ConnectedClient, 0),
+		mu:                  &sync.RWMutex{},
+		config:              &config.Config{Server: &config.Server{MaxQos: 2}},
+		persistenceProvider: provider,
+		rewriter:            &topicRewriter{},
+		done:                make(chan struct{}),
+		logger:              zap.NewNop(),
+	}
+
+	received := make(chan *packets.Publish, 1)
+	observer := NewInternalConnection(func(publish *packets.Publish) {
+		// the mock provider hands out a missed message on foo
+		if publish.Topic == "bar" {
+			received <- publish
+		}
+	})
+	ctx.AddInternalClient(observer, "observer")
+	ctx.Subscribe(observer, &packets.Subscribe{Subscriptions: map[string]packets.SubOptions{"bar": {}}})
+
+	ctx.scheduleDelayed(&persistence.DelayedMessage{
+		ID:        "delayed",
+		DeliverAt: time.Now().Add(50 * time.Millisecond),
+		Publish:   &packets.Publish{Topic: "bar"},
+	}, true)
+
+	if err := ctx.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !provider.closed {
+		t.Error("persistence provider was not closed")
+	}
+
+	select {
+	case <-received:
+		t.Error("delayed message was published after close")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
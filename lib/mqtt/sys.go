@@ -0,0 +1,143 @@
+package mqtt
+
+import (
+	"fmt"
+	"github.com/c16a/hermes/lib/persistence"
+	"github.com/c16a/hermes/lib/utils"
+	"github.com/eclipse/paho.golang/packets"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const sysTopicPrefix = "$SYS"
+
+// brokerStats stores the counters published under $SYS/broker.
+//
+// All counters are updated atomically, and must stay at the top of the struct
+// to remain 64-bit aligned on 32-bit platforms.
+type brokerStats struct {
+	messagesReceived uint64
+	messagesSent     uint64
+	bytesReceived    uint64
+	bytesSent        uint64
+
+	startTime time.Time
+}
+
+func (stats *brokerStats) addMessageReceived() {
+	atomic.AddUint64(&stats.messagesReceived, 1)
+}
+
+func (stats *brokerStats) addMessageSent() {
+	atomic.AddUint64(&stats.messagesSent, 1)
+}
+
+func (stats *brokerStats) addBytesReceived(n int) {
+	atomic.AddUint64(&stats.bytesReceived, uint64(n))
+}
+
+func (stats *brokerStats) addBytesSent(n int) {
+	atomic.AddUint64(&stats.bytesSent, uint64(n))
+}
+
+// isSysTopic checks if a topic, or topic filter, belongs to the $SYS hierarchy.
+//
+// Topics are matched regardless of case, so $SYS is compared the same way.
+func isSysTopic(topic string) bool {
+	levels, _, _, err := utils.GetTopicInfo(topic)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(levels[0], sysTopicPrefix)
+}
+
+// isReservedTopic checks if the first level of a topic starts with $,
+// which is reserved for the broker itself, such as $SYS.
+func isReservedTopic(topic string) bool {
+	return strings.HasPrefix(topic, "$")
+}
+
+// canReadSysTopics checks if a client is allowed to subscribe to $SYS topics
+func (ctx *ServerContext) canReadSysTopics(client *ConnectedClient) bool {
+	sysConfig := ctx.config.Server.Sys
+	if sysConfig == nil {
+		return false
+	}
+	for _, username := range sysConfig.Users {
+		if username == client.Username {
+			return true
+		}
+	}
+	return false
+}
+
+// publishSysStatsPeriodically publishes broker statistics every interval
+func (ctx *ServerContext) publishSysStatsPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ctx.publishSysStats()
+		case <-ctx.done:
+			return
+		}
+	}
+}
+
+func (ctx *ServerContext) publishSysStats() {
+	for topic, value := range ctx.collectSysStats() {
+		ctx.route(&packets.Publish{
+			Topic:   fmt.Sprintf("%s/broker/%s", sysTopicPrefix, topic),
+			Payload: []byte(value),
+		})
+	}
+}
+
+// collectSysStats computes the current broker statistics, keyed by their topic under $SYS/broker
+func (ctx *ServerContext) collectSysStats() map[string]string {
+	var connected, disconnected, subscriptions int
+
+	ctx.mu.RLock()
+	for _, client := range ctx.connectedClientsMap {
+		if client.IsConnected {
+			connected++
+		} else {
+			disconnected++
+		}
+		subscriptions += len(client.Subscriptions)
+	}
+	ctx.mu.RUnlock()
+
+	var retained int
+	if store := ctx.sessionStore(); store != nil {
+		if messages, err := store.GetRetained(); err == nil {
+			retained = len(messages)
+		}
+	}
+
+	stats := map[string]string{
+		"uptime":               strconv.FormatInt(int64(time.Since(ctx.stats.startTime).Seconds()), 10),
+		"clients/connected":    strconv.Itoa(connected),
+		"clients/disconnected": strconv.Itoa(disconnected),
+		"clients/total":        strconv.Itoa(connected + disconnected),
+		"subscriptions/count":  strconv.Itoa(subscriptions),
+		"retained/count":       strconv.Itoa(retained),
+		"messages/received":    strconv.FormatUint(atomic.LoadUint64(&ctx.stats.messagesReceived), 10),
+		"messages/sent":        strconv.FormatUint(atomic.LoadUint64(&ctx.stats.messagesSent), 10),
+		"bytes/received":       strconv.FormatUint(atomic.LoadUint64(&ctx.stats.bytesReceived), 10),
+		"bytes/sent":           strconv.FormatUint(atomic.LoadUint64(&ctx.stats.bytesSent), 10),
+	}
+
+	if statsProvider, ok := ctx.persistenceProvider.(persistence.StatsProvider); ok {
+		providerType := ctx.config.Server.Persistence.Type
+		for name, value := range statsProvider.Stats() {
+			stats[fmt.Sprintf("persistence/%s/%s", providerType, name)] = strconv.FormatInt(value, 10)
+		}
+	}
+
+	return stats
+}
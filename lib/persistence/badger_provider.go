@@ -9,6 +9,7 @@ import (
 	"github.com/eclipse/paho.golang/packets"
 	uuid "github.com/satori/go.uuid"
 	"go.uber.org/zap"
+	"strconv"
 	"time"
 )
 
@@ -49,13 +50,25 @@ func openDB(config *config.Config) (*badger.DB, error) {
 	return badger.Open(opts)
 }
 
+// clientPrefix returns the prefix of the keys holding one kind of data of a client.
+//
+// The client ID is length-prefixed, so that the prefix of a client never matches the keys of another one,
+// whatever characters their IDs contain.
+func clientPrefix(kind string, clientID string) string {
+	return fmt.Sprintf("%s:%d:%s:", kind, len(clientID), clientID)
+}
+
+func packetKey(clientID string, packetID uint16) []byte {
+	return []byte(fmt.Sprintf("%s%d", clientPrefix("packet", clientID), packetID))
+}
+
 func (b *BadgerProvider) SaveForOfflineDelivery(clientId string, publish *packets.Publish) error {
 	return b.db.Update(func(txn *badger.Txn) error {
 		payloadBytes, err := getBytes(publish)
 		if err != nil {
 			return err
 		}
-		key := fmt.Sprintf("%s:%s", clientId, uuid.NewV4().String())
+		key := clientPrefix("message", clientId) + uuid.NewV4().String()
 		var entry *badger.Entry
 		if publish.Properties == nil || publish.Properties.MessageExpiry == nil {
 			entry = badger.NewEntry([]byte(key), payloadBytes)
@@ -73,7 +86,7 @@ func (b *BadgerProvider) GetMissedMessages(clientID string) ([]*packets.Publish,
 	err := b.db.View(func(txn *badger.Txn) error {
 		it := txn.NewIterator(badger.DefaultIteratorOptions)
 		defer it.Close()
-		prefix := []byte(clientID)
+		prefix := []byte(clientPrefix("message", clientID))
 		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
 			item := it.Item()
 			if err := item.Value(func(val []byte) error {
@@ -82,7 +95,7 @@ func (b *BadgerProvider) GetMissedMessages(clientID string) ([]*packets.Publish,
 					return err
 				}
 				messages = append(messages, publish)
-				keysToFlush = append(keysToFlush, item.Key())
+				keysToFlush = append(keysToFlush, item.KeyCopy(nil))
 				return nil
 			}); err != nil {
 				return err
@@ -103,25 +116,42 @@ func (b *BadgerProvider) GetMissedMessages(clientID string) ([]*packets.Publish,
 	return messages, err
 }
 
+func (b *BadgerProvider) CountOfflineMessages() (int64, error) {
+	var count int64
+	err := b.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		prefix := []byte("message:")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
 func (b *BadgerProvider) ReservePacketID(clientID string, packetID uint16) error {
 	return b.db.Update(func(txn *badger.Txn) error {
-		key := fmt.Sprintf("packet:%s:%d", clientID, packetID)
-		return txn.Set([]byte(key), []byte{PacketReserved})
+		return txn.Set(packetKey(clientID, packetID), []byte{PacketReserved})
 	})
 }
 
 func (b *BadgerProvider) FreePacketID(clientID string, packetID uint16) error {
 	return b.db.Update(func(txn *badger.Txn) error {
-		key := fmt.Sprintf("packet:%s:%d", clientID, packetID)
-		return txn.Delete([]byte(key))
+		return txn.Delete(packetKey(clientID, packetID))
 	})
 }
 
 func (b *BadgerProvider) CheckForPacketIdReuse(clientID string, packetID uint16) (bool, error) {
 	reuseFlag := false
 	err := b.db.View(func(txn *badger.Txn) error {
-		key := fmt.Sprintf("packet:%s:%d", clientID, packetID)
-		item, err := txn.Get([]byte(key))
+		item, err := txn.Get(packetKey(clientID, packetID))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
 		if err != nil {
 			return err
 		}
@@ -136,3 +166,107 @@ func (b *BadgerProvider) CheckForPacketIdReuse(clientID string, packetID uint16)
 	})
 	return reuseFlag, err
 }
+
+func (b *BadgerProvider) GetPacketIDs(clientID string) ([]uint16, error) {
+	var packetIDs []uint16
+	err := b.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		prefix := []byte(clientPrefix("packet", clientID))
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			packetID, err := strconv.ParseUint(string(it.Item().Key()[len(prefix):]), 10, 16)
+			if err != nil {
+				return err
+			}
+			packetIDs = append(packetIDs, uint16(packetID))
+		}
+		return nil
+	})
+	return packetIDs, err
+}
+
+func (b *BadgerProvider) ClearPacketIDs(clientID string) error {
+	return b.db.Update(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		var keysToDelete [][]byte
+		prefix := []byte(clientPrefix("packet", clientID))
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			keysToDelete = append(keysToDelete, it.Item().KeyCopy(nil))
+		}
+		for _, key := range keysToDelete {
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BadgerProvider) SaveDelayedMessage(message *DelayedMessage) error {
+	return b.db.Update(func(txn *badger.Txn) error {
+		messageBytes, err := getBytes(message)
+		if err != nil {
+			return err
+		}
+		key := fmt.Sprintf("delayed:%s", message.ID)
+		return txn.Set([]byte(key), messageBytes)
+	})
+}
+
+func (b *BadgerProvider) GetDelayedMessages() ([]*DelayedMessage, error) {
+	messages := make([]*DelayedMessage, 0)
+
+	err := b.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte("delayed:")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			if err := it.Item().Value(func(val []byte) error {
+				message, err := getDelayedMessage(val)
+				if err != nil {
+					return err
+				}
+				messages = append(messages, message)
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return messages, err
+}
+
+func (b *BadgerProvider) DeleteDelayedMessage(id string) (bool, error) {
+	var deleted bool
+	err := b.db.Update(func(txn *badger.Txn) error {
+		key := []byte(fmt.Sprintf("delayed:%s", id))
+		if _, err := txn.Get(key); err == badger.ErrKeyNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		deleted = true
+		return txn.Delete(key)
+	})
+	return deleted, err
+}
+
+func (b *BadgerProvider) Stats() map[string]int64 {
+	lsm, vlog := b.db.Size()
+	return map[string]int64{
+		"size/lsm":  lsm,
+		"size/vlog": vlog,
+	}
+}
+
+func (b *BadgerProvider) Close() error {
+	return b.db.Close()
+}
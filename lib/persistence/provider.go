@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/gob"
 	"github.com/eclipse/paho.golang/packets"
+	"time"
 )
 
 type Provider interface {
@@ -13,6 +14,59 @@ type Provider interface {
 	ReservePacketID(clientID string, packetID uint16) error
 	FreePacketID(clientID string, packetID uint16) error
 	CheckForPacketIdReuse(clientID string, packetID uint16) (bool, error)
+	GetPacketIDs(clientID string) ([]uint16, error)
+	ClearPacketIDs(clientID string) error
+
+	SaveDelayedMessage(message *DelayedMessage) error
+	GetDelayedMessages() ([]*DelayedMessage, error)
+
+	// DeleteDelayedMessage deletes a delayed message, and reports whether it was still saved.
+	// Only one of several brokers sharing the provider deletes the message, and so delivers it.
+	DeleteDelayedMessage(id string) (bool, error)
+
+	// Close flushes anything not yet written, and releases everything held by the provider
+	Close() error
+}
+
+// DelayedMessage is a message which should only be published once DeliverAt has passed
+type DelayedMessage struct {
+	ID        string
+	DeliverAt time.Time
+	Publish   *packets.Publish
+}
+
+// SessionStore is implemented by providers which also store persistent sessions and retained messages,
+// so that they outlive the broker holding them.
+type SessionStore interface {
+	SaveSession(session *Session) error
+
+	// GetSession returns nil if no session is saved for the client
+	GetSession(clientID string) (*Session, error)
+	DeleteSession(clientID string) error
+
+	// SaveRetained saves the retained message of a topic, or deletes it if the message has no payload
+	SaveRetained(publish *packets.Publish) error
+	GetRetained() ([]*packets.Publish, error)
+}
+
+// Session is a persistent session, along with the subscriptions of its client
+type Session struct {
+	ClientID      string
+	Username      string
+	Subscriptions map[string]packets.SubOptions
+}
+
+// OfflineCounter is implemented by providers which can count the messages saved for offline delivery,
+// for all clients together. Messages which expired are not counted, as far as the provider can tell.
+type OfflineCounter interface {
+	CountOfflineMessages() (int64, error)
+}
+
+// StatsProvider is implemented by providers which can report statistics about themselves.
+//
+// The keys of the returned map are slash separated names, such as "pool/hits".
+type StatsProvider interface {
+	Stats() map[string]int64
 }
 
 func getBytes(bundle interface{}) ([]byte, error) {
@@ -32,4 +86,13 @@ func getPublishPacket(src []byte) (*packets.Publish, error) {
 	var publish packets.Publish
 	err := decoder.Decode(&publish)
 	return &publish, err
-}
\ No newline at end of file
+}
+
+func getDelayedMessage(src []byte) (*DelayedMessage, error) {
+	buf := bytes.NewBuffer(src)
+	decoder := gob.NewDecoder(buf)
+
+	var message DelayedMessage
+	err := decoder.Decode(&message)
+	return &message, err
+}
@@ -0,0 +1,87 @@
+package persistence
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"github.com/c16a/hermes/lib/config"
+	"github.com/eclipse/paho.golang/packets"
+	"go.uber.org/zap"
+	"reflect"
+	"testing"
+)
+
+// testClientsApart checks that the data of clients whose IDs overlap, or contain glob characters, is kept apart
+func testClientsApart(t *testing.T, provider Provider) {
+	clientIDs := []string{"a", "a:b", "a:1", "ab", "*", "packet"}
+	for i, clientID := range clientIDs {
+		if err := provider.ReservePacketID(clientID, uint16(i+1)); err != nil {
+			t.Fatal(err)
+		}
+		if err := provider.SaveForOfflineDelivery(clientID, &packets.Publish{Topic: clientID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, clientID := range clientIDs {
+		packetIDs, err := provider.GetPacketIDs(clientID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []uint16{uint16(i + 1)}; !reflect.DeepEqual(packetIDs, want) {
+			t.Errorf("GetPacketIDs(%q) = %v, want %v", clientID, packetIDs, want)
+		}
+	}
+
+	if err := provider.ClearPacketIDs("*"); err != nil {
+		t.Fatal(err)
+	}
+	if err := provider.ClearPacketIDs("a"); err != nil {
+		t.Fatal(err)
+	}
+	for i, clientID := range clientIDs {
+		reserved, err := provider.CheckForPacketIdReuse(clientID, uint16(i+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cleared := clientID == "*" || clientID == "a"; reserved == cleared {
+			t.Errorf("packet ID of %q reserved = %v after clearing those of \"*\" and \"a\"", clientID, reserved)
+		}
+	}
+
+	if count, err := provider.(OfflineCounter).CountOfflineMessages(); err != nil || count != int64(len(clientIDs)) {
+		t.Errorf("CountOfflineMessages() = %d, %v, want %d", count, err, len(clientIDs))
+	}
+	for _, clientID := range clientIDs {
+		messages, err := provider.GetMissedMessages(clientID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(messages) != 1 || messages[0].Topic != clientID {
+			t.Errorf("GetMissedMessages(%q) = %v, want only its own message", clientID, messages)
+		}
+	}
+}
+
+func TestRedisProvider_ClientsApart(t *testing.T) {
+	server := miniredis.RunT(t)
+	provider, err := NewRedisProvider(&config.Config{
+		Server: &config.Server{Persistence: &config.Persistence{Redis: &config.Redis{Url: server.Addr()}}},
+	}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.Close()
+
+	testClientsApart(t, provider)
+}
+
+func TestBadgerProvider_ClientsApart(t *testing.T) {
+	provider, err := NewBadgerProvider(&config.Config{
+		Server: &config.Server{Persistence: &config.Persistence{Badger: &config.Badger{MaxTableSize: 1 << 20, NumTables: 1}}},
+	}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.Close()
+
+	testClientsApart(t, provider)
+}
@@ -0,0 +1,218 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/gob"
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/hashicorp/raft"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	raftCommandSaveMessage byte = iota + 1
+	raftCommandTakeMessages
+	raftCommandReservePacketID
+	raftCommandFreePacketID
+	raftCommandClearPacketIDs
+	raftCommandSaveDelayed
+	raftCommandDeleteDelayed
+	raftCommandSaveSession
+	raftCommandDeleteSession
+	raftCommandSaveRetained
+)
+
+// raftResponses is how many responses are kept, so that a retried command is not applied twice
+const raftResponses = 1024
+
+// raftCommand is a change to the replicated state, as stored in the Raft log
+type raftCommand struct {
+	Type     byte
+	ClientID string
+	PacketID uint16
+	Message  *raftMessage
+	Delayed  *DelayedMessage
+	Session  *Session
+	ID       string
+
+	// RequestID is the same for every attempt to apply a command
+	RequestID string
+}
+
+// raftMessage is a message saved for offline delivery
+type raftMessage struct {
+	Publish *packets.Publish
+
+	// ExpiresAt is set by the node saving the message, so that every node agrees on it
+	ExpiresAt time.Time
+}
+
+func newRaftMessage(publish *packets.Publish) *raftMessage {
+	message := &raftMessage{Publish: publish}
+	if publish.Properties != nil && publish.Properties.MessageExpiry != nil {
+		message.ExpiresAt = time.Now().Add(time.Duration(*publish.Properties.MessageExpiry) * time.Second)
+	}
+	return message
+}
+
+func (message *raftMessage) expired() bool {
+	return !message.ExpiresAt.IsZero() && !time.Now().Before(message.ExpiresAt)
+}
+
+// raftState is the state replicated across all nodes
+type raftState struct {
+	Messages  map[string][]*raftMessage
+	PacketIDs map[string]map[uint16]bool
+	Delayed   map[string]*DelayedMessage
+	Sessions  map[string]*Session
+
+	// Retained are the retained messages, by topic
+	Retained map[string]*raftMessage
+
+	// Responses are those of the latest commands, by request ID, and RequestIDs are in the order they were applied
+	Responses  map[string][]*packets.Publish
+	RequestIDs []string
+}
+
+func newRaftState() *raftState {
+	return &raftState{
+		Messages:  make(map[string][]*raftMessage, 0),
+		PacketIDs: make(map[string]map[uint16]bool, 0),
+		Delayed:   make(map[string]*DelayedMessage, 0),
+		Sessions:  make(map[string]*Session, 0),
+		Retained:  make(map[string]*raftMessage, 0),
+		Responses: make(map[string][]*packets.Publish, 0),
+	}
+}
+
+// remember keeps the response of a command, forgetting the oldest one if there are too many
+func (state *raftState) remember(requestID string, response []*packets.Publish) {
+	state.Responses[requestID] = response
+	state.RequestIDs = append(state.RequestIDs, requestID)
+	if len(state.RequestIDs) > raftResponses {
+		delete(state.Responses, state.RequestIDs[0])
+		state.RequestIDs = state.RequestIDs[1:]
+	}
+}
+
+// raftFSM applies committed commands to the replicated state
+type raftFSM struct {
+	mu    sync.RWMutex
+	state *raftState
+}
+
+// Apply implements raft.FSM.
+//
+// Taking messages returns the messages which have not expired yet, and deleting a delayed message returns it
+// if it was still saved. Everything else returns nil. A command applied again with the same request ID,
+// such as one retried after a timeout, is not applied twice and returns its first response.
+func (f *raftFSM) Apply(log *raft.Log) interface{} {
+	var cmd raftCommand
+	if err := gob.NewDecoder(bytes.NewReader(log.Data)).Decode(&cmd); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	response, applied := f.state.Responses[cmd.RequestID]
+	if !applied {
+		response = f.state.apply(&cmd)
+		if len(cmd.RequestID) > 0 {
+			f.state.remember(cmd.RequestID, response)
+		}
+	}
+	if response == nil {
+		return nil
+	}
+	return response
+}
+
+func (state *raftState) apply(cmd *raftCommand) []*packets.Publish {
+	switch cmd.Type {
+	case raftCommandSaveMessage:
+		state.Messages[cmd.ClientID] = append(state.Messages[cmd.ClientID], cmd.Message)
+	case raftCommandTakeMessages:
+		messages := state.Messages[cmd.ClientID]
+		delete(state.Messages, cmd.ClientID)
+
+		// expiry only affects the response, so that the state stays the same on every node
+		publishes := make([]*packets.Publish, 0, len(messages))
+		for _, message := range messages {
+			if !message.expired() {
+				publishes = append(publishes, message.Publish)
+			}
+		}
+		return publishes
+	case raftCommandReservePacketID:
+		if state.PacketIDs[cmd.ClientID] == nil {
+			state.PacketIDs[cmd.ClientID] = make(map[uint16]bool, 0)
+		}
+		state.PacketIDs[cmd.ClientID][cmd.PacketID] = true
+	case raftCommandFreePacketID:
+		delete(state.PacketIDs[cmd.ClientID], cmd.PacketID)
+	case raftCommandClearPacketIDs:
+		delete(state.PacketIDs, cmd.ClientID)
+	case raftCommandSaveDelayed:
+		state.Delayed[cmd.Delayed.ID] = cmd.Delayed
+	case raftCommandDeleteDelayed:
+		if message, ok := state.Delayed[cmd.ID]; ok {
+			delete(state.Delayed, cmd.ID)
+			return []*packets.Publish{message.Publish}
+		}
+	case raftCommandSaveSession:
+		state.Sessions[cmd.Session.ClientID] = cmd.Session
+	case raftCommandDeleteSession:
+		delete(state.Sessions, cmd.ClientID)
+	case raftCommandSaveRetained:
+		if len(cmd.Message.Publish.Payload) == 0 {
+			delete(state.Retained, cmd.Message.Publish.Topic)
+		} else {
+			state.Retained[cmd.Message.Publish.Topic] = cmd.Message
+		}
+	}
+	return nil
+}
+
+// Snapshot implements raft.FSM
+func (f *raftFSM) Snapshot() (raft.FSMSnapshot, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	// encoding here keeps later commands out of the snapshot
+	stateBytes, err := getBytes(f.state)
+	if err != nil {
+		return nil, err
+	}
+	return &raftSnapshot{state: stateBytes}, nil
+}
+
+// Restore implements raft.FSM
+func (f *raftFSM) Restore(snapshot io.ReadCloser) error {
+	defer snapshot.Close()
+
+	state := newRaftState()
+	if err := gob.NewDecoder(snapshot).Decode(state); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.state = state
+	f.mu.Unlock()
+	return nil
+}
+
+type raftSnapshot struct {
+	state []byte
+}
+
+func (s *raftSnapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := sink.Write(s.state); err != nil {
+		_ = sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *raftSnapshot) Release() {}
@@ -0,0 +1,517 @@
+package persistence
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/c16a/hermes/lib/config"
+	badger "github.com/dgraph-io/badger/v2"
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	uuid "github.com/satori/go.uuid"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	raftApplyTimeout     = 10 * time.Second
+	raftTransportTimeout = 10 * time.Second
+	raftRetainSnapshots  = 2
+)
+
+// Connections to a Raft node start with one of these bytes, so that the Raft transport
+// and requests forwarded to the leader can share a single address.
+const (
+	raftConnTransport byte = 'R'
+	raftConnForward   byte = 'F'
+)
+
+// raftNonceSize is the size of the challenge sent to every connection, which is answered with
+// an HMAC of the challenge keyed with the secret shared by all nodes
+const raftNonceSize = 32
+
+var errNoRaftLeader = errors.New("no raft leader elected")
+
+// RaftProvider replicates all persisted state across a cluster of nodes using Raft.
+//
+// Changes are committed through the leader, and followers forward their changes to it.
+// Reads are served from the local copy of the state, which may briefly lag behind the leader.
+type RaftProvider struct {
+	raft      *raft.Raft
+	fsm       *raftFSM
+	transport *raft.NetworkTransport
+	db        *badger.DB
+	secret    []byte
+	logger    *zap.Logger
+}
+
+// forwardResponse is the reply of the leader to a forwarded command
+type forwardResponse struct {
+	Messages []*packets.Publish
+	Error    string
+}
+
+func NewRaftProvider(config *config.Config, logger *zap.Logger) (Provider, error) {
+	raftConfig := config.Server.Persistence.Raft
+	if raftConfig == nil {
+		return nil, errors.New("raft configuration missing")
+	}
+
+	listener, err := net.Listen("tcp", raftConfig.Address)
+	if err != nil {
+		return nil, err
+	}
+	return newRaftProvider(raftConfig, listener, logger)
+}
+
+func newRaftProvider(raftConfig *config.Raft, listener net.Listener, logger *zap.Logger) (*RaftProvider, error) {
+	if len(raftConfig.Peers) > 0 && len(raftConfig.Secret) == 0 {
+		listener.Close()
+		return nil, errors.New("raft secret missing")
+	}
+	logWriter := zap.NewStdLog(logger).Writer()
+
+	r := &RaftProvider{
+		fsm:    &raftFSM{state: newRaftState()},
+		secret: []byte(raftConfig.Secret),
+		logger: logger,
+	}
+
+	var logStore raft.LogStore
+	var stableStore raft.StableStore
+	var snapshotStore raft.SnapshotStore
+	if len(raftConfig.Dir) == 0 {
+		inmemStore := raft.NewInmemStore()
+		logStore, stableStore = inmemStore, inmemStore
+		snapshotStore = raft.NewInmemSnapshotStore()
+	} else {
+		db, err := badger.Open(badger.DefaultOptions(filepath.Join(raftConfig.Dir, "log")).WithLogger(nil))
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		r.db = db
+		badgerStore := &raftBadgerStore{db: db}
+		logStore, stableStore = badgerStore, badgerStore
+		if snapshotStore, err = raft.NewFileSnapshotStore(raftConfig.Dir, raftRetainSnapshots, logWriter); err != nil {
+			listener.Close()
+			db.Close()
+			return nil, err
+		}
+	}
+
+	raftNodeConfig := raft.DefaultConfig()
+	raftNodeConfig.LocalID = raft.ServerID(raftConfig.NodeID)
+	raftNodeConfig.Logger = hclog.New(&hclog.LoggerOptions{
+		Name:   "raft",
+		Level:  hclog.Warn,
+		Output: logWriter,
+	})
+	if raftConfig.SnapshotThreshold > 0 {
+		raftNodeConfig.SnapshotThreshold = raftConfig.SnapshotThreshold
+	}
+	if raftConfig.SnapshotInterval > 0 {
+		raftNodeConfig.SnapshotInterval = time.Duration(raftConfig.SnapshotInterval) * time.Second
+	}
+
+	streamLayer := newRaftStreamLayer(listener, r.secret, r.serveForward)
+	r.transport = raft.NewNetworkTransport(streamLayer, 3, raftTransportTimeout, logWriter)
+
+	hasState, err := raft.HasExistingState(logStore, stableStore, snapshotStore)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	if r.raft, err = raft.NewRaft(raftNodeConfig, r.fsm, logStore, stableStore, snapshotStore, r.transport); err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	if !hasState {
+		// every node bootstraps with the same configuration, so it does not matter which one is first
+		servers := []raft.Server{{ID: raftNodeConfig.LocalID, Address: r.transport.LocalAddr()}}
+		for _, peer := range raftConfig.Peers {
+			servers = append(servers, raft.Server{ID: raft.ServerID(peer.NodeID), Address: raft.ServerAddress(peer.Address)})
+		}
+		if err = r.raft.BootstrapCluster(raft.Configuration{Servers: servers}).Error(); err != nil && err != raft.ErrCantBootstrap {
+			r.Close()
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+func (r *RaftProvider) SaveForOfflineDelivery(clientId string, publish *packets.Publish) error {
+	_, err := r.apply(&raftCommand{Type: raftCommandSaveMessage, ClientID: clientId, Message: newRaftMessage(publish)})
+	return err
+}
+
+func (r *RaftProvider) GetMissedMessages(clientId string) ([]*packets.Publish, error) {
+	return r.apply(&raftCommand{Type: raftCommandTakeMessages, ClientID: clientId})
+}
+
+func (r *RaftProvider) CountOfflineMessages() (int64, error) {
+	r.fsm.mu.RLock()
+	defer r.fsm.mu.RUnlock()
+
+	var count int64
+	for _, messages := range r.fsm.state.Messages {
+		for _, message := range messages {
+			if !message.expired() {
+				count++
+			}
+		}
+	}
+	return count, nil
+}
+
+func (r *RaftProvider) ReservePacketID(clientID string, packetID uint16) error {
+	_, err := r.apply(&raftCommand{Type: raftCommandReservePacketID, ClientID: clientID, PacketID: packetID})
+	return err
+}
+
+func (r *RaftProvider) FreePacketID(clientID string, packetID uint16) error {
+	_, err := r.apply(&raftCommand{Type: raftCommandFreePacketID, ClientID: clientID, PacketID: packetID})
+	return err
+}
+
+func (r *RaftProvider) CheckForPacketIdReuse(clientID string, packetID uint16) (bool, error) {
+	r.fsm.mu.RLock()
+	defer r.fsm.mu.RUnlock()
+	return r.fsm.state.PacketIDs[clientID][packetID], nil
+}
+
+func (r *RaftProvider) GetPacketIDs(clientID string) ([]uint16, error) {
+	r.fsm.mu.RLock()
+	defer r.fsm.mu.RUnlock()
+
+	var packetIDs []uint16
+	for packetID := range r.fsm.state.PacketIDs[clientID] {
+		packetIDs = append(packetIDs, packetID)
+	}
+	sort.Slice(packetIDs, func(i, j int) bool { return packetIDs[i] < packetIDs[j] })
+	return packetIDs, nil
+}
+
+func (r *RaftProvider) ClearPacketIDs(clientID string) error {
+	_, err := r.apply(&raftCommand{Type: raftCommandClearPacketIDs, ClientID: clientID})
+	return err
+}
+
+func (r *RaftProvider) SaveDelayedMessage(message *DelayedMessage) error {
+	_, err := r.apply(&raftCommand{Type: raftCommandSaveDelayed, Delayed: message})
+	return err
+}
+
+func (r *RaftProvider) GetDelayedMessages() ([]*DelayedMessage, error) {
+	r.fsm.mu.RLock()
+	defer r.fsm.mu.RUnlock()
+
+	messages := make([]*DelayedMessage, 0, len(r.fsm.state.Delayed))
+	for _, message := range r.fsm.state.Delayed {
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+func (r *RaftProvider) DeleteDelayedMessage(id string) (bool, error) {
+	messages, err := r.apply(&raftCommand{Type: raftCommandDeleteDelayed, ID: id})
+	return len(messages) > 0, err
+}
+
+// SaveSession implements SessionStore
+func (r *RaftProvider) SaveSession(session *Session) error {
+	_, err := r.apply(&raftCommand{Type: raftCommandSaveSession, Session: session})
+	return err
+}
+
+// GetSession implements SessionStore
+func (r *RaftProvider) GetSession(clientID string) (*Session, error) {
+	r.fsm.mu.RLock()
+	defer r.fsm.mu.RUnlock()
+	return r.fsm.state.Sessions[clientID], nil
+}
+
+// DeleteSession implements SessionStore
+func (r *RaftProvider) DeleteSession(clientID string) error {
+	_, err := r.apply(&raftCommand{Type: raftCommandDeleteSession, ClientID: clientID})
+	return err
+}
+
+// SaveRetained implements SessionStore
+func (r *RaftProvider) SaveRetained(publish *packets.Publish) error {
+	_, err := r.apply(&raftCommand{Type: raftCommandSaveRetained, Message: newRaftMessage(publish)})
+	return err
+}
+
+// GetRetained implements SessionStore, leaving out expired messages
+func (r *RaftProvider) GetRetained() ([]*packets.Publish, error) {
+	r.fsm.mu.RLock()
+	defer r.fsm.mu.RUnlock()
+
+	publishes := make([]*packets.Publish, 0, len(r.fsm.state.Retained))
+	for _, message := range r.fsm.state.Retained {
+		if !message.expired() {
+			publishes = append(publishes, message.Publish)
+		}
+	}
+	return publishes, nil
+}
+
+// Stats implements StatsProvider
+func (r *RaftProvider) Stats() map[string]int64 {
+	stats := map[string]int64{
+		"raft/state":         int64(r.raft.State()),
+		"raft/last_index":    int64(r.raft.LastIndex()),
+		"raft/applied_index": int64(r.raft.AppliedIndex()),
+	}
+	if future := r.raft.GetConfiguration(); future.Error() == nil {
+		stats["raft/nodes"] = int64(len(future.Configuration().Servers))
+	}
+	return stats
+}
+
+// apply commits a command through the leader, and waits until it has been applied.
+//
+// The command keeps its request ID across retries, so that it is applied only once
+// even if an attempt timed out after the command was committed.
+func (r *RaftProvider) apply(cmd *raftCommand) ([]*packets.Publish, error) {
+	cmd.RequestID = uuid.NewV4().String()
+	data, err := getBytes(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(raftApplyTimeout)
+	for {
+		if r.raft.State() == raft.Leader {
+			messages, err := r.applyAsLeader(data)
+			if err != raft.ErrNotLeader && err != raft.ErrLeadershipLost {
+				return messages, err
+			}
+		} else if leaderAddress, _ := r.raft.LeaderWithID(); len(leaderAddress) > 0 {
+			messages, err := r.forward(leaderAddress, data)
+			if err == nil {
+				return messages, nil
+			}
+			r.logger.Debug(fmt.Sprintf("failed to forward command to leader at %s", leaderAddress), zap.Error(err))
+		}
+
+		// a leader is being elected
+		if time.Now().After(deadline) {
+			return nil, errNoRaftLeader
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (r *RaftProvider) applyAsLeader(data []byte) ([]*packets.Publish, error) {
+	future := r.raft.Apply(data, raftApplyTimeout)
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+
+	switch response := future.Response().(type) {
+	case error:
+		return nil, response
+	case []*packets.Publish:
+		return response, nil
+	}
+	return nil, nil
+}
+
+// forward sends a command to the leader, and waits for its response
+func (r *RaftProvider) forward(leaderAddress raft.ServerAddress, data []byte) ([]*packets.Publish, error) {
+	conn, err := net.DialTimeout("tcp", string(leaderAddress), raftTransportTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(raftApplyTimeout))
+	if err = raftHandshake(conn, raftConnForward, r.secret); err != nil {
+		return nil, err
+	}
+	if err = gob.NewEncoder(conn).Encode(data); err != nil {
+		return nil, err
+	}
+
+	var response forwardResponse
+	if err = gob.NewDecoder(conn).Decode(&response); err != nil {
+		return nil, err
+	}
+	if len(response.Error) > 0 {
+		return nil, errors.New(response.Error)
+	}
+	return response.Messages, nil
+}
+
+// serveForward applies a command forwarded by a follower
+func (r *RaftProvider) serveForward(conn net.Conn) {
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(raftApplyTimeout))
+	var data []byte
+	if err := gob.NewDecoder(conn).Decode(&data); err != nil {
+		return
+	}
+
+	var response forwardResponse
+	if r.raft.State() != raft.Leader {
+		response.Error = raft.ErrNotLeader.Error()
+	} else if messages, err := r.applyAsLeader(data); err != nil {
+		response.Error = err.Error()
+	} else {
+		response.Messages = messages
+	}
+	_ = gob.NewEncoder(conn).Encode(&response)
+}
+
+// Close stops this node, and releases everything held by it
+func (r *RaftProvider) Close() error {
+	var err error
+	if r.raft != nil {
+		err = r.raft.Shutdown().Error()
+	}
+	if r.transport != nil {
+		_ = r.transport.Close()
+	}
+	if r.db != nil {
+		_ = r.db.Close()
+	}
+	return err
+}
+
+// raftStreamLayer hands Raft the connections meant for its transport,
+// and passes forwarded commands on to the provider.
+//
+// Only connections proving that they know the shared secret are accepted,
+// and none at all if there is no secret.
+type raftStreamLayer struct {
+	net.Listener
+
+	conns   chan net.Conn
+	secret  []byte
+	forward func(net.Conn)
+	done    chan struct{}
+}
+
+func newRaftStreamLayer(listener net.Listener, secret []byte, forward func(net.Conn)) *raftStreamLayer {
+	s := &raftStreamLayer{
+		Listener: listener,
+		conns:    make(chan net.Conn),
+		secret:   secret,
+		forward:  forward,
+		done:     make(chan struct{}),
+	}
+	go s.acceptLoop()
+	return s
+}
+
+func (s *raftStreamLayer) acceptLoop() {
+	defer close(s.done)
+	for {
+		conn, err := s.Listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.route(conn)
+	}
+}
+
+func (s *raftStreamLayer) route(conn net.Conn) {
+	connType := make([]byte, 1)
+	_ = conn.SetDeadline(time.Now().Add(raftTransportTimeout))
+	if _, err := io.ReadFull(conn, connType); err != nil || !s.authenticate(conn, connType[0]) {
+		conn.Close()
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	switch connType[0] {
+	case raftConnTransport:
+		select {
+		case s.conns <- conn:
+		case <-s.done:
+			conn.Close()
+		}
+	case raftConnForward:
+		s.forward(conn)
+	default:
+		conn.Close()
+	}
+}
+
+// Accept implements net.Listener, returning only connections meant for the Raft transport
+func (s *raftStreamLayer) Accept() (net.Conn, error) {
+	select {
+	case conn := <-s.conns:
+		return conn, nil
+	case <-s.done:
+		return nil, errors.New("raft listener closed")
+	}
+}
+
+// Dial implements raft.StreamLayer
+func (s *raftStreamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", string(address), timeout)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	if err = raftHandshake(conn, raftConnTransport, s.secret); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// authenticate challenges a connection to prove that it knows the shared secret
+func (s *raftStreamLayer) authenticate(conn net.Conn, connType byte) bool {
+	if len(s.secret) == 0 {
+		return false
+	}
+	nonce := make([]byte, raftNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return false
+	}
+	if _, err := conn.Write(nonce); err != nil {
+		return false
+	}
+	mac := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(conn, mac); err != nil {
+		return false
+	}
+	return hmac.Equal(mac, raftMAC(s.secret, connType, nonce))
+}
+
+// raftHandshake opens a connection of a type, and answers the challenge of the node with the shared secret
+func raftHandshake(conn net.Conn, connType byte, secret []byte) error {
+	if _, err := conn.Write([]byte{connType}); err != nil {
+		return err
+	}
+	nonce := make([]byte, raftNonceSize)
+	if _, err := io.ReadFull(conn, nonce); err != nil {
+		return err
+	}
+	_, err := conn.Write(raftMAC(secret, connType, nonce))
+	return err
+}
+
+func raftMAC(secret []byte, connType byte, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte{connType})
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,313 @@
+package persistence
+
+import (
+	"fmt"
+	"github.com/c16a/hermes/lib/config"
+	badger "github.com/dgraph-io/badger/v2"
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func startRaftCluster(t *testing.T, size int) []*RaftProvider {
+	listeners := make([]net.Listener, size)
+	peers := make([]*config.RaftPeer, size)
+	for i := range listeners {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners[i] = listener
+		peers[i] = &config.RaftPeer{NodeID: fmt.Sprintf("node-%d", i), Address: listener.Addr().String()}
+	}
+
+	providers := make([]*RaftProvider, size)
+	for i, listener := range listeners {
+		var otherPeers []*config.RaftPeer
+		for j, peer := range peers {
+			if j != i {
+				otherPeers = append(otherPeers, peer)
+			}
+		}
+		raftConfig := &config.Raft{NodeID: peers[i].NodeID, Peers: otherPeers, Secret: "secret"}
+		if i == 0 {
+			// one node keeps its log and snapshots on disk, the others in memory
+			raftConfig.Dir = t.TempDir()
+		}
+		provider, err := newRaftProvider(raftConfig, listener, zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		providers[i] = provider
+	}
+	return providers
+}
+
+func waitForRaft(t *testing.T, description string, condition func() bool) {
+	timeout := time.Now().Add(10 * time.Second)
+	for !condition() {
+		if time.Now().After(timeout) {
+			t.Fatalf("timed out waiting for %s", description)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func findLeader(providers []*RaftProvider) (leader *RaftProvider, followers []*RaftProvider) {
+	for _, provider := range providers {
+		if provider.raft.State() == raft.Leader {
+			leader = provider
+		} else {
+			followers = append(followers, provider)
+		}
+	}
+	return
+}
+
+func TestRaftProvider(t *testing.T) {
+	providers := startRaftCluster(t, 3)
+	defer func() {
+		for _, provider := range providers {
+			_ = provider.Close()
+		}
+	}()
+
+	waitForRaft(t, "leader election", func() bool {
+		leader, _ := findLeader(providers)
+		return leader != nil
+	})
+	leader, followers := findLeader(providers)
+
+	// changes made on a follower are forwarded to the leader, and replicated to every node
+	if err := followers[0].ReservePacketID("client", 7); err != nil {
+		t.Fatal(err)
+	}
+	for _, provider := range providers {
+		waitForRaft(t, "packet ID to be replicated", func() bool {
+			reserved, _ := provider.CheckForPacketIdReuse("client", 7)
+			return reserved
+		})
+	}
+
+	// nodes which do not know the secret cannot change the state
+	data, err := getBytes(&raftCommand{Type: raftCommandReservePacketID, ClientID: "intruder", PacketID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	intruder := &RaftProvider{secret: []byte("wrong")}
+	if _, err = intruder.forward(leader.transport.LocalAddr(), data); err == nil {
+		t.Error("command forwarded with the wrong secret was applied")
+	}
+
+	if err = followers[0].SaveSession(&Session{ClientID: "client", Subscriptions: map[string]packets.SubOptions{"foo/#": {QoS: 1}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = followers[1].SaveRetained(&packets.Publish{Topic: "foo", Payload: []byte("bar"), Retain: true}); err != nil {
+		t.Fatal(err)
+	}
+	for _, provider := range providers {
+		waitForRaft(t, "session and retained message to be replicated", func() bool {
+			session, _ := provider.GetSession("client")
+			retained, _ := provider.GetRetained()
+			return session != nil && len(session.Subscriptions) == 1 && len(retained) == 1
+		})
+	}
+
+	if err = followers[0].SaveForOfflineDelivery("client", &packets.Publish{Topic: "foo", Payload: []byte("bar")}); err != nil {
+		t.Fatal(err)
+	}
+	waitForRaft(t, "offline message to be counted", func() bool {
+		count, _ := followers[1].CountOfflineMessages()
+		return count == 1
+	})
+	messages, err := followers[1].GetMissedMessages("client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].Topic != "foo" {
+		t.Errorf("got %d missed messages", len(messages))
+	}
+	if messages, _ = leader.GetMissedMessages("client"); len(messages) != 0 {
+		t.Error("missed messages were delivered twice")
+	}
+
+	if err = leader.raft.Snapshot().Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the remaining nodes elect a new leader, and keep accepting changes
+	_ = leader.Close()
+	providers = followers
+	waitForRaft(t, "leader re-election", func() bool {
+		leader, _ := findLeader(providers)
+		return leader != nil
+	})
+
+	if err = providers[0].SaveDelayedMessage(&DelayedMessage{ID: "delayed", DeliverAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	waitForRaft(t, "delayed message to be replicated", func() bool {
+		delayed, _ := providers[1].GetDelayedMessages()
+		return len(delayed) == 1
+	})
+}
+
+func TestRaftFSM_SnapshotRestore(t *testing.T) {
+	fsm := &raftFSM{state: newRaftState()}
+	commands := []*raftCommand{
+		{Type: raftCommandReservePacketID, ClientID: "client", PacketID: 1},
+		{Type: raftCommandReservePacketID, ClientID: "client", PacketID: 2},
+		{Type: raftCommandFreePacketID, ClientID: "client", PacketID: 1},
+		{Type: raftCommandSaveMessage, ClientID: "client", Message: &raftMessage{Publish: &packets.Publish{Topic: "foo"}}},
+		{Type: raftCommandSaveDelayed, Delayed: &DelayedMessage{ID: "delayed"}},
+	}
+	for i, cmd := range commands {
+		data, err := getBytes(cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response := fsm.Apply(&raft.Log{Index: uint64(i + 1), Data: data}); response != nil {
+			t.Fatalf("command %d failed: %v", i, response)
+		}
+	}
+
+	snapshot, err := fsm.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &raftTestSink{}
+	if err = snapshot.Persist(sink); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := &raftFSM{state: newRaftState()}
+	if err = restored.Restore(sink); err != nil {
+		t.Fatal(err)
+	}
+
+	state := restored.state
+	if !state.PacketIDs["client"][2] || state.PacketIDs["client"][1] {
+		t.Errorf("restored packet IDs %v", state.PacketIDs["client"])
+	}
+	if len(state.Messages["client"]) != 1 {
+		t.Errorf("restored %d messages", len(state.Messages["client"]))
+	}
+	if _, ok := state.Delayed["delayed"]; !ok {
+		t.Error("delayed message was not restored")
+	}
+}
+
+func TestRaftFSM_RetriedCommand(t *testing.T) {
+	fsm := &raftFSM{state: newRaftState()}
+	commands := []*raftCommand{
+		{Type: raftCommandSaveMessage, ClientID: "client", Message: &raftMessage{Publish: &packets.Publish{Topic: "foo"}}, RequestID: "save"},
+		{Type: raftCommandSaveMessage, ClientID: "client", Message: &raftMessage{Publish: &packets.Publish{Topic: "foo"}}, RequestID: "save"},
+		{Type: raftCommandTakeMessages, ClientID: "client", RequestID: "take"},
+		{Type: raftCommandTakeMessages, ClientID: "client", RequestID: "take"},
+	}
+	for i, cmd := range commands {
+		data, err := getBytes(cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response := fsm.Apply(&raft.Log{Index: uint64(i + 1), Data: data})
+		if cmd.Type != raftCommandTakeMessages {
+			continue
+		}
+		// the retry gets the messages taken by the first attempt
+		if messages, _ := response.([]*packets.Publish); len(messages) != 1 {
+			t.Errorf("command %d took %d messages, want 1", i, len(messages))
+		}
+	}
+
+	for i := 0; i < raftResponses; i++ {
+		fsm.state.remember(fmt.Sprintf("request-%d", i), nil)
+	}
+	if len(fsm.state.Responses) != raftResponses || len(fsm.state.RequestIDs) != raftResponses {
+		t.Errorf("kept %d responses, want %d", len(fsm.state.Responses), raftResponses)
+	}
+}
+
+func TestRaftBadgerStore(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store := &raftBadgerStore{db: db}
+
+	var logs []*raft.Log
+	for index := uint64(1); index <= 10; index++ {
+		logs = append(logs, &raft.Log{Index: index, Term: 1, Data: []byte{byte(index)}})
+	}
+	if err = store.StoreLogs(logs); err != nil {
+		t.Fatal(err)
+	}
+	// compaction removes the oldest entries
+	if err = store.DeleteRange(1, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		got      func() (uint64, error)
+		expected uint64
+	}{
+		{"First index after compaction", store.FirstIndex, 5},
+		{"Last index", store.LastIndex, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.got()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.expected {
+				t.Errorf("got %d, want %d", got, tt.expected)
+			}
+		})
+	}
+
+	var log raft.Log
+	if err = store.GetLog(3, &log); err != raft.ErrLogNotFound {
+		t.Errorf("compacted entry returned %v", err)
+	}
+	if err = store.GetLog(7, &log); err != nil || log.Data[0] != 7 {
+		t.Errorf("entry 7 returned %v", err)
+	}
+
+	if err = store.SetUint64([]byte("term"), 3); err != nil {
+		t.Fatal(err)
+	}
+	if term, _ := store.GetUint64([]byte("term")); term != 3 {
+		t.Errorf("got term %d", term)
+	}
+}
+
+// raftTestSink is an in-memory snapshot sink
+type raftTestSink struct {
+	data []byte
+	read int
+}
+
+func (s *raftTestSink) Write(p []byte) (int, error) {
+	s.data = append(s.data, p...)
+	return len(p), nil
+}
+
+func (s *raftTestSink) Read(p []byte) (int, error) {
+	if s.read >= len(s.data) {
+		return 0, io.EOF
+	}
+	n := copy(p, s.data[s.read:])
+	s.read += n
+	return n, nil
+}
+
+func (s *raftTestSink) Close() error  { return nil }
+func (s *raftTestSink) ID() string    { return "test" }
+func (s *raftTestSink) Cancel() error { return nil }
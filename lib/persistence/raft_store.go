@@ -0,0 +1,144 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	badger "github.com/dgraph-io/badger/v2"
+	"github.com/hashicorp/raft"
+)
+
+var (
+	raftLogPrefix    = []byte("raft:log:")
+	raftStablePrefix = []byte("raft:stable:")
+)
+
+// raftBadgerStore keeps the Raft log and stable state in badger
+type raftBadgerStore struct {
+	db *badger.DB
+}
+
+func raftLogKey(index uint64) []byte {
+	key := make([]byte, len(raftLogPrefix)+8)
+	copy(key, raftLogPrefix)
+	binary.BigEndian.PutUint64(key[len(raftLogPrefix):], index)
+	return key
+}
+
+func (s *raftBadgerStore) FirstIndex() (uint64, error) {
+	return s.edgeIndex(false)
+}
+
+func (s *raftBadgerStore) LastIndex() (uint64, error) {
+	return s.edgeIndex(true)
+}
+
+// edgeIndex returns the first or last index of the log, or 0 if the log is empty
+func (s *raftBadgerStore) edgeIndex(last bool) (uint64, error) {
+	var index uint64
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Reverse = last
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		seek := raftLogPrefix
+		if last {
+			seek = append(append([]byte{}, raftLogPrefix...), 0xFF)
+		}
+		it.Seek(seek)
+		if it.ValidForPrefix(raftLogPrefix) {
+			index = binary.BigEndian.Uint64(it.Item().Key()[len(raftLogPrefix):])
+		}
+		return nil
+	})
+	return index, err
+}
+
+func (s *raftBadgerStore) GetLog(index uint64, log *raft.Log) error {
+	return s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(raftLogKey(index))
+		if err == badger.ErrKeyNotFound {
+			return raft.ErrLogNotFound
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			return gob.NewDecoder(bytes.NewReader(val)).Decode(log)
+		})
+	})
+}
+
+func (s *raftBadgerStore) StoreLog(log *raft.Log) error {
+	return s.StoreLogs([]*raft.Log{log})
+}
+
+func (s *raftBadgerStore) StoreLogs(logs []*raft.Log) error {
+	batch := s.db.NewWriteBatch()
+	defer batch.Cancel()
+
+	for _, log := range logs {
+		logBytes, err := getBytes(log)
+		if err != nil {
+			return err
+		}
+		if err = batch.Set(raftLogKey(log.Index), logBytes); err != nil {
+			return err
+		}
+	}
+	return batch.Flush()
+}
+
+func (s *raftBadgerStore) DeleteRange(min, max uint64) error {
+	batch := s.db.NewWriteBatch()
+	defer batch.Cancel()
+
+	for index := min; index <= max; index++ {
+		if err := batch.Delete(raftLogKey(index)); err != nil {
+			return err
+		}
+		if index == max {
+			// max may be the largest uint64
+			break
+		}
+	}
+	return batch.Flush()
+}
+
+func (s *raftBadgerStore) Set(key []byte, val []byte) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(append(append([]byte{}, raftStablePrefix...), key...), val)
+	})
+}
+
+func (s *raftBadgerStore) Get(key []byte) ([]byte, error) {
+	var val []byte
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(append(append([]byte{}, raftStablePrefix...), key...))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		val, err = item.ValueCopy(nil)
+		return err
+	})
+	return val, err
+}
+
+func (s *raftBadgerStore) SetUint64(key []byte, val uint64) error {
+	valBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(valBytes, val)
+	return s.Set(key, valBytes)
+}
+
+func (s *raftBadgerStore) GetUint64(key []byte) (uint64, error) {
+	val, err := s.Get(key)
+	if err != nil || len(val) != 8 {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(val), nil
+}
@@ -2,12 +2,13 @@ package persistence
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"github.com/c16a/hermes/lib/config"
 	"github.com/eclipse/paho.golang/packets"
 	"github.com/go-redis/redis/v8"
 	"go.uber.org/zap"
+	"sort"
+	"strconv"
 	"time"
 )
 
@@ -81,38 +82,108 @@ func (r *RedisProvider) GetMissedMessages(clientId string) ([]*packets.Publish,
 
 }
 
+func (r *RedisProvider) CountOfflineMessages() (int64, error) {
+	var count int64
+	iter := r.client.Scan(context.Background(), 0, "urn:messages:*", 0).Iterator()
+	for iter.Next(context.Background()) {
+		length, err := r.client.LLen(context.Background(), iter.Val()).Result()
+		if err != nil {
+			return 0, err
+		}
+		count += length
+	}
+	return count, iter.Err()
+}
+
+// packetIDsKey returns the key of the set holding the packet IDs reserved by a client
+func packetIDsKey(clientID string) string {
+	return fmt.Sprintf("urn:packets:%s", clientID)
+}
+
 func (r *RedisProvider) ReservePacketID(clientID string, packetID uint16) error {
 	_, err := r.client.TxPipelined(context.Background(), func(pipeliner redis.Pipeliner) error {
-		key := fmt.Sprintf("urn:packets:%s:%d", clientID, packetID)
-		pipeliner.Set(context.Background(), key, PacketReserved, 24*time.Hour)
+		key := packetIDsKey(clientID)
+		pipeliner.SAdd(context.Background(), key, packetID)
+		pipeliner.Expire(context.Background(), key, 24*time.Hour)
 		return nil
 	})
 	return err
 }
 
 func (r *RedisProvider) FreePacketID(clientID string, packetID uint16) error {
-	_, err := r.client.TxPipelined(context.Background(), func(pipeliner redis.Pipeliner) error {
-		key := fmt.Sprintf("urn:packets:%s:%d", clientID, packetID)
-		pipeliner.Del(context.Background(), key)
-		return nil
-	})
-	return err
+	return r.client.SRem(context.Background(), packetIDsKey(clientID), packetID).Err()
 }
 
 func (r *RedisProvider) CheckForPacketIdReuse(clientID string, packetID uint16) (bool, error) {
-	reuseFlag := false
-	_, err := r.client.TxPipelined(context.Background(), func(pipeliner redis.Pipeliner) error {
-		key := fmt.Sprintf("urn:packets:%s:%d", clientID, packetID)
-		resBytes, err := pipeliner.Get(context.Background(), key).Bytes()
+	return r.client.SIsMember(context.Background(), packetIDsKey(clientID), packetID).Result()
+}
+
+func (r *RedisProvider) GetPacketIDs(clientID string) ([]uint16, error) {
+	members, err := r.client.SMembers(context.Background(), packetIDsKey(clientID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	var packetIDs []uint16
+	for _, member := range members {
+		packetID, err := strconv.ParseUint(member, 10, 16)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		if resBytes[0] == PacketReserved {
-			reuseFlag = true
-		} else {
-			return errors.New("some weird error")
+		packetIDs = append(packetIDs, uint16(packetID))
+	}
+	sort.Slice(packetIDs, func(i, j int) bool { return packetIDs[i] < packetIDs[j] })
+	return packetIDs, nil
+}
+
+func (r *RedisProvider) ClearPacketIDs(clientID string) error {
+	return r.client.Del(context.Background(), packetIDsKey(clientID)).Err()
+}
+
+const delayedMessagesKey = "urn:delayed"
+
+func (r *RedisProvider) SaveDelayedMessage(message *DelayedMessage) error {
+	messageBytes, err := getBytes(message)
+	if err != nil {
+		return err
+	}
+	return r.client.HSet(context.Background(), delayedMessagesKey, message.ID, messageBytes).Err()
+}
+
+func (r *RedisProvider) GetDelayedMessages() ([]*DelayedMessage, error) {
+	messages := make([]*DelayedMessage, 0)
+
+	payloads, err := r.client.HGetAll(context.Background(), delayedMessagesKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, payload := range payloads {
+		message, err := getDelayedMessage([]byte(payload))
+		if err != nil {
+			continue
 		}
-		return nil
-	})
-	return reuseFlag, err
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+func (r *RedisProvider) DeleteDelayedMessage(id string) (bool, error) {
+	deleted, err := r.client.HDel(context.Background(), delayedMessagesKey, id).Result()
+	return deleted > 0, err
+}
+
+func (r *RedisProvider) Stats() map[string]int64 {
+	poolStats := r.client.PoolStats()
+	return map[string]int64{
+		"pool/hits":        int64(poolStats.Hits),
+		"pool/misses":      int64(poolStats.Misses),
+		"pool/timeouts":    int64(poolStats.Timeouts),
+		"pool/total_conns": int64(poolStats.TotalConns),
+		"pool/idle_conns":  int64(poolStats.IdleConns),
+		"pool/stale_conns": int64(poolStats.StaleConns),
+	}
+}
+
+func (r *RedisProvider) Close() error {
+	return r.client.Close()
 }
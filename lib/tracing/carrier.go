@@ -0,0 +1,49 @@
+package tracing
+
+import (
+	"github.com/eclipse/paho.golang/packets"
+)
+
+// userPropertiesCarrier reads and writes trace context in the user properties of a message
+type userPropertiesCarrier struct {
+	publish *packets.Publish
+}
+
+// Get returns the value of the first user property with the key
+func (c *userPropertiesCarrier) Get(key string) string {
+	if c.publish.Properties == nil {
+		return ""
+	}
+	for _, user := range c.publish.Properties.User {
+		if user.Key == key {
+			return user.Value
+		}
+	}
+	return ""
+}
+
+// Set replaces all user properties with the key by a single one with the value
+func (c *userPropertiesCarrier) Set(key string, value string) {
+	if c.publish.Properties == nil {
+		c.publish.Properties = &packets.Properties{}
+	}
+	users := make([]packets.User, 0, len(c.publish.Properties.User)+1)
+	for _, user := range c.publish.Properties.User {
+		if user.Key != key {
+			users = append(users, user)
+		}
+	}
+	c.publish.Properties.User = append(users, packets.User{Key: key, Value: value})
+}
+
+// Keys returns the keys of all user properties
+func (c *userPropertiesCarrier) Keys() []string {
+	if c.publish.Properties == nil {
+		return nil
+	}
+	keys := make([]string, 0, len(c.publish.Properties.User))
+	for _, user := range c.publish.Properties.User {
+		keys = append(keys, user.Key)
+	}
+	return keys
+}
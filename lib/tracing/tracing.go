@@ -0,0 +1,133 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"github.com/c16a/hermes/lib/config"
+	"github.com/eclipse/paho.golang/packets"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"os"
+)
+
+const (
+	instrumentationName = "github.com/c16a/hermes"
+	defaultServiceName  = "hermes"
+)
+
+// Tracer records spans for the messages passing through a broker.
+//
+// Trace context travels with messages in a traceparent user property, as defined by W3C Trace Context,
+// so that the spans of a broker connect those of the producers and consumers of a message.
+// All methods can be called on a nil Tracer, and then do nothing.
+type Tracer struct {
+	provider   *sdktrace.TracerProvider
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+	file       io.Closer
+}
+
+// New sets up tracing as configured, or returns nil if tracing is not configured
+func New(tracingConfig *config.Tracing) (*Tracer, error) {
+	if tracingConfig == nil {
+		return nil, nil
+	}
+
+	t := &Tracer{propagator: propagation.TraceContext{}}
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch tracingConfig.Exporter {
+	case "otlp":
+		options := []otlptracehttp.Option{}
+		if len(tracingConfig.Endpoint) > 0 {
+			options = append(options, otlptracehttp.WithEndpoint(tracingConfig.Endpoint))
+		}
+		if tracingConfig.Insecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), options...)
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "file":
+		var file *os.File
+		if file, err = os.OpenFile(tracingConfig.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err == nil {
+			t.file = file
+			exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+		}
+	default:
+		return nil, fmt.Errorf("unknown trace exporter: %s", tracingConfig.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	serviceName := tracingConfig.ServiceName
+	if len(serviceName) == 0 {
+		serviceName = defaultServiceName
+	}
+	sampleRatio := tracingConfig.SampleRatio
+	if sampleRatio <= 0 {
+		sampleRatio = 1
+	}
+
+	t.provider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName))),
+		// a message which is part of a sampled trace is always traced through the broker
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+	)
+	t.tracer = t.provider.Tracer(instrumentationName)
+	return t, nil
+}
+
+// Start starts a span for an operation on a message, as a child of the trace context the message carries
+func (t *Tracer) Start(publish *packets.Publish, name string, kind trace.SpanKind) (context.Context, trace.Span) {
+	if t == nil {
+		return context.Background(), trace.SpanFromContext(context.Background())
+	}
+	parent := t.propagator.Extract(context.Background(), &userPropertiesCarrier{publish: publish})
+	return t.tracer.Start(parent, name,
+		trace.WithSpanKind(kind),
+		trace.WithAttributes(
+			semconv.MessagingSystemKey.String("mqtt"),
+			semconv.MessagingDestinationKey.String(publish.Topic),
+		),
+	)
+}
+
+// Inject replaces the trace context a message carries with the span in a context
+func (t *Tracer) Inject(ctx context.Context, publish *packets.Publish) {
+	if t == nil {
+		return
+	}
+	t.propagator.Inject(ctx, &userPropertiesCarrier{publish: publish})
+}
+
+// Shutdown exports all spans not yet exported, and stops the exporter
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	err := t.provider.Shutdown(ctx)
+	if t.file != nil {
+		_ = t.file.Close()
+	}
+	return err
+}
+
+// End ends a span, and marks it as failed if there is an error
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,102 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/c16a/hermes/lib/config"
+	"github.com/eclipse/paho.golang/packets"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const parentTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestUserPropertiesCarrier(t *testing.T) {
+	publish := &packets.Publish{Topic: "foo"}
+	carrier := &userPropertiesCarrier{publish: publish}
+
+	if value := carrier.Get("traceparent"); value != "" {
+		t.Errorf("Get() = %s on a message without properties", value)
+	}
+
+	carrier.Set("traceparent", "first")
+	carrier.Set("tracestate", "state")
+	carrier.Set("traceparent", "second")
+
+	if value := carrier.Get("traceparent"); value != "second" {
+		t.Errorf("Get() = %s, want %s", value, "second")
+	}
+	if keys := carrier.Keys(); len(keys) != 2 {
+		t.Errorf("Keys() = %v, want a single traceparent and tracestate", keys)
+	}
+}
+
+func TestNew(t *testing.T) {
+	tracer, err := New(nil)
+	if err != nil || tracer != nil {
+		t.Fatalf("New(nil) = %v, %v, want no tracer", tracer, err)
+	}
+	// a nil tracer does nothing
+	publish := &packets.Publish{Topic: "foo"}
+	ctx, span := tracer.Start(publish, "publish", trace.SpanKindInternal)
+	tracer.Inject(ctx, publish)
+	span.End()
+	if publish.Properties != nil {
+		t.Error("nil tracer injected trace context")
+	}
+
+	if _, err := New(&config.Tracing{Exporter: "zipkin"}); err == nil {
+		t.Error("New() accepted an unknown exporter")
+	}
+}
+
+func TestTracer_Propagation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.json")
+	tracer, err := New(&config.Tracing{Exporter: "file", Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publish := &packets.Publish{
+		Topic:      "foo",
+		Properties: &packets.Properties{User: []packets.User{{Key: "traceparent", Value: parentTraceparent}}},
+	}
+	ctx, span := tracer.Start(publish, "receive", trace.SpanKindConsumer)
+	tracer.Inject(ctx, publish)
+	span.End()
+
+	traceparent := (&userPropertiesCarrier{publish: publish}).Get("traceparent")
+	if !strings.HasPrefix(traceparent, "00-4bf92f3577b34da6a3ce929d0e0e4736-") || traceparent == parentTraceparent {
+		t.Errorf("injected traceparent %s, want a child of %s", traceparent, parentTraceparent)
+	}
+	if len(publish.Properties.User) != 1 {
+		t.Errorf("message carries %d user properties, want 1", len(publish.Properties.User))
+	}
+
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var exported struct {
+		Name   string
+		Parent struct {
+			TraceID string
+			SpanID  string
+		}
+	}
+	if err := json.NewDecoder(file).Decode(&exported); err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if exported.Name != "receive" || exported.Parent.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || exported.Parent.SpanID != "00f067aa0ba902b7" {
+		t.Errorf("exported span %+v, want receive span with the remote parent", exported)
+	}
+}
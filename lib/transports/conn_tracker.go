@@ -0,0 +1,73 @@
+package transports
+
+import (
+	"context"
+	"github.com/c16a/hermes/lib/mqtt"
+	"net"
+	"sync"
+)
+
+// connTracker keeps track of the open connections of a server, so that they can be closed with it
+type connTracker struct {
+	transport string
+
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	closed   bool
+	handlers sync.WaitGroup
+}
+
+func newConnTracker(transport string) *connTracker {
+	return &connTracker{transport: transport, conns: make(map[net.Conn]struct{}, 0)}
+}
+
+// handle serves MQTT on a connection until it is closed
+func (tracker *connTracker) handle(conn net.Conn, ctx *mqtt.ServerContext) {
+	tracker.mu.Lock()
+	if tracker.closed {
+		// accepted just before the server was shut down
+		tracker.mu.Unlock()
+		conn.Close()
+		return
+	}
+	tracker.conns[conn] = struct{}{}
+	tracker.handlers.Add(1)
+	tracker.mu.Unlock()
+
+	ctx.Metrics().ConnectionOpened(tracker.transport)
+	defer func() {
+		ctx.Metrics().ConnectionClosed(tracker.transport)
+		tracker.mu.Lock()
+		delete(tracker.conns, conn)
+		tracker.mu.Unlock()
+		tracker.handlers.Done()
+	}()
+
+	mqtt.HandleListenerConnection(conn, ctx, tracker.transport)
+}
+
+// closeAll closes all open connections, and waits until their handlers have returned or the context is done.
+//
+// A handler finishes with the packet it is handling when its connection is closed,
+// so that for example a message being published is saved or delivered.
+func (tracker *connTracker) closeAll(ctx context.Context) error {
+	tracker.mu.Lock()
+	tracker.closed = true
+	for conn := range tracker.conns {
+		conn.Close()
+	}
+	tracker.mu.Unlock()
+
+	handled := make(chan struct{})
+	go func() {
+		tracker.handlers.Wait()
+		close(handled)
+	}()
+
+	select {
+	case <-handled:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -1,6 +1,7 @@
 package transports
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"github.com/c16a/hermes/lib/config"
@@ -9,7 +10,18 @@ import (
 	"net"
 )
 
-func StartTcpServer(serverConfig *config.Config, ctx *mqtt.ServerContext, logger *zap.Logger) {
+// TcpServer accepts MQTT connections over TCP, optionally secured with TLS
+type TcpServer struct {
+	listener net.Listener
+	conns    *connTracker
+	ctx      *mqtt.ServerContext
+	logger   *zap.Logger
+}
+
+// NewTcpServer starts listening on the configured TCP address.
+//
+// Connections are only accepted once Serve is called.
+func NewTcpServer(serverConfig *config.Config, ctx *mqtt.ServerContext, logger *zap.Logger) (*TcpServer, error) {
 	var listener net.Listener
 	var listenerErr error
 
@@ -19,31 +31,51 @@ func StartTcpServer(serverConfig *config.Config, ctx *mqtt.ServerContext, logger
 	if tlsConfigFromFile == nil {
 		listener, listenerErr = net.Listen("tcp", tcpAddress)
 	} else {
-		if len(tlsConfigFromFile.CertFile) == 0 || len(tlsConfigFromFile.KeyFile) == 0 {
-			// TCP config invalid - don't start TCP server
-			return
-		}
-		cert, err := tls.LoadX509KeyPair(tlsConfigFromFile.CertFile, tlsConfigFromFile.KeyFile)
+		tlsConfig, err := newTlsConfig(tlsConfigFromFile)
 		if err != nil {
-			// Could not read certs - don't start TCP server
-			return
+			return nil, err
 		}
-		tlsConfig := tls.Config{Certificates: []tls.Certificate{cert}}
-		listener, listenerErr = tls.Listen("tcp", tcpAddress, &tlsConfig)
+		listener, listenerErr = tls.Listen("tcp", tcpAddress, tlsConfig)
 	}
 
 	if listenerErr != nil {
-		return
+		return nil, listenerErr
 	}
-	defer listener.Close()
 
-	logger.Info(fmt.Sprintf("Starting TCP server on %s", tcpAddress))
+	return &TcpServer{
+		listener: listener,
+		conns:    newConnTracker("tcp"),
+		ctx:      ctx,
+		logger:   logger,
+	}, nil
+}
+
+// Addr returns the address the server listens on
+func (server *TcpServer) Addr() net.Addr {
+	return server.listener.Addr()
+}
+
+// Serve accepts connections until the server is closed
+func (server *TcpServer) Serve() {
+	server.logger.Info(fmt.Sprintf("Starting TCP server on %s", server.listener.Addr()))
 
 	for {
-		conn, err := listener.Accept()
+		conn, err := server.listener.Accept()
 		if err != nil {
 			return
 		}
-		go mqtt.HandleMqttConnection(conn, ctx)
+		go server.conns.handle(conn, server.ctx)
 	}
 }
+
+// Close stops accepting connections, and leaves open connections alone
+func (server *TcpServer) Close() error {
+	return server.listener.Close()
+}
+
+// Shutdown stops accepting connections, closes all open connections,
+// and waits until they have been handled or the context is done
+func (server *TcpServer) Shutdown(ctx context.Context) error {
+	_ = server.listener.Close()
+	return server.conns.closeAll(ctx)
+}
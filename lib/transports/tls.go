@@ -0,0 +1,110 @@
+package transports
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/c16a/hermes/lib/config"
+	"io/ioutil"
+	"time"
+)
+
+// newTlsConfig builds the TLS configuration of a listener, which verifies client certificates
+// if a client CA is configured
+func newTlsConfig(tlsConfigFromFile *config.Tls) (*tls.Config, error) {
+	if len(tlsConfigFromFile.CertFile) == 0 || len(tlsConfigFromFile.KeyFile) == 0 {
+		return nil, fmt.Errorf("tls config needs both a cert and a key file")
+	}
+	cert, err := tls.LoadX509KeyPair(tlsConfigFromFile.CertFile, tlsConfigFromFile.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if len(tlsConfigFromFile.ClientCaFile) == 0 {
+		if len(tlsConfigFromFile.ClientAuth) > 0 || len(tlsConfigFromFile.CrlFile) > 0 {
+			return nil, errors.New("client certificate verification needs a client CA file")
+		}
+		return tlsConfig, nil
+	}
+
+	caBytes, err := ioutil.ReadFile(tlsConfigFromFile.ClientCaFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.ClientCAs = x509.NewCertPool()
+	if !tlsConfig.ClientCAs.AppendCertsFromPEM(caBytes) {
+		return nil, fmt.Errorf("no certificates in client CA file %s", tlsConfigFromFile.ClientCaFile)
+	}
+
+	switch tlsConfigFromFile.ClientAuth {
+	case "", "require":
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("invalid client auth: %s", tlsConfigFromFile.ClientAuth)
+	}
+
+	if len(tlsConfigFromFile.CrlFile) > 0 {
+		crlBytes, err := ioutil.ReadFile(tlsConfigFromFile.CrlFile)
+		if err != nil {
+			return nil, err
+		}
+		// ParseCRL accepts both PEM and DER, and works with all Go versions the module supports
+		crl, err := x509.ParseCRL(crlBytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CRL file %s: %w", tlsConfigFromFile.CrlFile, err)
+		}
+		if !signedByAny(crl, caBytes) {
+			return nil, fmt.Errorf("CRL file %s is not signed by a CA of the client CA file", tlsConfigFromFile.CrlFile)
+		}
+		tlsConfig.VerifyPeerCertificate = func(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+			return checkRevocation(crl, verifiedChains)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// signedByAny reports whether a CRL is signed by one of the PEM encoded certificates
+func signedByAny(crl *pkix.CertificateList, pemBytes []byte) bool {
+	for {
+		var block *pem.Block
+		if block, pemBytes = pem.Decode(pemBytes); block == nil {
+			return false
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil && cert.CheckCRLSignature(crl) == nil {
+			return true
+		}
+	}
+}
+
+// checkRevocation rejects client certificates revoked by the CRL.
+//
+// The CRL is only trusted if it is signed by a CA of the verified chain.
+func checkRevocation(crl *pkix.CertificateList, verifiedChains [][]*x509.Certificate) error {
+	for _, chain := range verifiedChains {
+		if len(chain) < 2 {
+			continue
+		}
+		leaf, issuer := chain[0], chain[1]
+		if issuer.CheckCRLSignature(crl) != nil {
+			continue
+		}
+		if crl.HasExpired(time.Now()) {
+			return errors.New("the CRL of the client CA has expired")
+		}
+		for _, revoked := range crl.TBSCertList.RevokedCertificates {
+			if revoked.SerialNumber.Cmp(leaf.SerialNumber) == 0 {
+				return fmt.Errorf("client certificate %s has been revoked", leaf.SerialNumber)
+			}
+		}
+	}
+	return nil
+}
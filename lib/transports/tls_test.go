@@ -0,0 +1,169 @@
+package transports
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/c16a/hermes/lib/config"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCertificate struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCertificate(t *testing.T, serial int64, commonName string, issuer *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parent, signer := template, key
+	if issuer == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	} else {
+		parent, signer = issuer.cert, issuer.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCertificate{cert: cert, key: key}
+}
+
+func (c *testCertificate) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+func writePem(t *testing.T, path string, blockType string, der []byte) string {
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestNewTlsConfig_ClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCertificate(t, 1, "Test CA", nil)
+	otherCa := newTestCertificate(t, 1, "Other CA", nil)
+	server := newTestCertificate(t, 2, "localhost", ca)
+	device := newTestCertificate(t, 3, "device-1", ca)
+	revokedDevice := newTestCertificate(t, 4, "device-2", ca)
+	strangerDevice := newTestCertificate(t, 5, "device-3", otherCa)
+
+	serverKey, err := x509.MarshalECPrivateKey(server.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Hour),
+		NextUpdate: time.Now().Add(time.Hour),
+		RevokedCertificates: []pkix.RevokedCertificate{
+			{SerialNumber: revokedDevice.cert.SerialNumber, RevocationTime: time.Now()},
+		},
+	}, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tlsConfig, err := newTlsConfig(&config.Tls{
+		CertFile:     writePem(t, filepath.Join(dir, "server.crt"), "CERTIFICATE", server.cert.Raw),
+		KeyFile:      writePem(t, filepath.Join(dir, "server.key"), "EC PRIVATE KEY", serverKey),
+		ClientCaFile: writePem(t, filepath.Join(dir, "ca.crt"), "CERTIFICATE", ca.cert.Raw),
+		CrlFile:      writePem(t, filepath.Join(dir, "ca.crl"), "X509 CRL", crl),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherCrl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Hour),
+		NextUpdate: time.Now().Add(time.Hour),
+	}, otherCa.cert, otherCa.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = newTlsConfig(&config.Tls{
+		CertFile:     filepath.Join(dir, "server.crt"),
+		KeyFile:      filepath.Join(dir, "server.key"),
+		ClientCaFile: filepath.Join(dir, "ca.crt"),
+		CrlFile:      writePem(t, filepath.Join(dir, "other.crl"), "X509 CRL", otherCrl),
+	})
+	if err == nil {
+		t.Error("CRL signed by another CA was accepted")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	tests := []struct {
+		name    string
+		client  *testCertificate
+		wantErr bool
+	}{
+		{"Certificate issued by the client CA", device, false},
+		{"Revoked certificate", revokedDevice, true},
+		{"Certificate issued by another CA", strangerDevice, true},
+		{"No certificate", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConfig := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+			if tt.client != nil {
+				clientConfig.Certificates = []tls.Certificate{tt.client.tlsCertificate()}
+			}
+
+			// a real connection, since the client does not read the alert if its certificate is rejected
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			go func() {
+				if clientConn, err := tls.Dial("tcp", listener.Addr().String(), clientConfig); err == nil {
+					clientConn.Close()
+				}
+			}()
+
+			serverConn, err := listener.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer serverConn.Close()
+			tlsConn := tls.Server(serverConn, tlsConfig)
+			err = tlsConn.Handshake()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Handshake() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName != "device-1" {
+				t.Error("client certificate is not available after the handshake")
+			}
+		})
+	}
+}
@@ -1,30 +1,81 @@
 package transports
 
 import (
+	"context"
 	"fmt"
 	"github.com/c16a/hermes/lib/config"
 	"github.com/c16a/hermes/lib/mqtt"
 	"github.com/gorilla/websocket"
 	"go.uber.org/zap"
-	"log"
+	"net"
 	"net/http"
 )
 
-func StartWebSocketServer(serverConfig *config.Config, ctx *mqtt.ServerContext, logger *zap.Logger) {
+// WebSocketServer accepts MQTT connections over WebSocket on the /socket path
+type WebSocketServer struct {
+	listener   net.Listener
+	httpServer *http.Server
+	conns      *connTracker
+	logger     *zap.Logger
+}
+
+// NewWebSocketServer starts listening on the configured HTTP address.
+//
+// Connections are only accepted once Serve is called.
+func NewWebSocketServer(serverConfig *config.Config, ctx *mqtt.ServerContext, logger *zap.Logger) (*WebSocketServer, error) {
+	listener, err := net.Listen("tcp", serverConfig.Server.HttpAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &WebSocketServer{
+		listener: listener,
+		conns:    newConnTracker("websocket"),
+		logger:   logger,
+	}
+
 	upgrader := websocket.Upgrader{}
 
-	httpAddr := serverConfig.Server.HttpAddress
-	http.HandleFunc("/socket", func(writer http.ResponseWriter, request *http.Request) {
+	// every server has its own mux, so that several brokers can live in one process
+	mux := http.NewServeMux()
+	mux.HandleFunc("/socket", func(writer http.ResponseWriter, request *http.Request) {
 		c, err := upgrader.Upgrade(writer, request, nil)
 		if err != nil {
-			log.Print("upgrade:", err)
+			logger.Error("upgrade failed", zap.Error(err))
 			return
 		}
 		defer c.Close()
 
-		go mqtt.HandleMqttConnection(c.UnderlyingConn(), ctx)
+		server.conns.handle(c.UnderlyingConn(), ctx)
 	})
+	server.httpServer = &http.Server{Handler: mux}
+
+	return server, nil
+}
+
+// Addr returns the address the server listens on
+func (server *WebSocketServer) Addr() net.Addr {
+	return server.listener.Addr()
+}
+
+// Serve accepts connections until the server is closed
+func (server *WebSocketServer) Serve() {
+	server.logger.Info(fmt.Sprintf("Starting Websocket server on %s", server.listener.Addr()))
+
+	if err := server.httpServer.Serve(server.listener); err != nil && err != http.ErrServerClosed {
+		server.logger.Error("websocket server failed", zap.Error(err))
+	}
+}
+
+// Close stops accepting connections, and leaves open connections alone
+func (server *WebSocketServer) Close() error {
+	return server.listener.Close()
+}
 
-	logger.Info(fmt.Sprintf("Starting Websocket server on %s", httpAddr))
-	log.Fatal(http.ListenAndServe(httpAddr, nil))
+// Shutdown stops accepting connections, closes all open connections,
+// and waits until they have been handled or the context is done
+func (server *WebSocketServer) Shutdown(ctx context.Context) error {
+	_ = server.httpServer.Close()
+	// upgraded connections are no longer tracked by the HTTP server
+	return server.conns.closeAll(ctx)
 }
@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DelayedTopicPrefix = "$delayed"
+
+// IsDelayedTopic checks if a topic is of the form $delayed/<seconds>/<topic>
+func IsDelayedTopic(topic string) bool {
+	return strings.HasPrefix(topic, DelayedTopicPrefix+"/")
+}
+
+// ParseDelayedTopic splits a topic of the form $delayed/<seconds>/<topic>
+// into the delay, and the topic to publish to once the delay has passed.
+func ParseDelayedTopic(topic string) (delay time.Duration, realTopic string, err error) {
+	levels := strings.SplitN(topic, "/", 3)
+	if len(levels) != 3 || levels[0] != DelayedTopicPrefix || len(levels[2]) == 0 {
+		return 0, "", errors.New("invalid delayed topic")
+	}
+
+	seconds, err := strconv.ParseUint(levels[1], 10, 32)
+	if err != nil {
+		return 0, "", errors.New("invalid delay in delayed topic")
+	}
+
+	if strings.ContainsAny(levels[2], "+#") {
+		return 0, "", errors.New("delayed topic cannot contain wildcards")
+	}
+
+	return time.Duration(seconds) * time.Second, levels[2], nil
+}
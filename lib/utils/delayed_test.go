@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDelayedTopic(t *testing.T) {
+	type args struct {
+		topic string
+	}
+	tests := []struct {
+		name          string
+		args          args
+		wantDelay     time.Duration
+		wantRealTopic string
+		wantErr       bool
+	}{
+		{
+			"Delayed topic",
+			args{
+				"$delayed/10/devices/1/commands",
+			},
+			10 * time.Second,
+			"devices/1/commands",
+			false,
+		},
+		{
+			"Zero delay",
+			args{
+				"$delayed/0/foo",
+			},
+			0,
+			"foo",
+			false,
+		},
+		{
+			"Missing topic",
+			args{
+				"$delayed/10",
+			},
+			0,
+			"",
+			true,
+		},
+		{
+			"Empty topic",
+			args{
+				"$delayed/10/",
+			},
+			0,
+			"",
+			true,
+		},
+		{
+			"Invalid delay",
+			args{
+				"$delayed/soon/foo",
+			},
+			0,
+			"",
+			true,
+		},
+		{
+			"Negative delay",
+			args{
+				"$delayed/-5/foo",
+			},
+			0,
+			"",
+			true,
+		},
+		{
+			"Wildcard topic",
+			args{
+				"$delayed/10/foo/#",
+			},
+			0,
+			"",
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotDelay, gotRealTopic, err := ParseDelayedTopic(tt.args.topic)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseDelayedTopic() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if gotDelay != tt.wantDelay {
+				t.Errorf("ParseDelayedTopic() gotDelay = %v, want %v", gotDelay, tt.wantDelay)
+			}
+			if gotRealTopic != tt.wantRealTopic {
+				t.Errorf("ParseDelayedTopic() gotRealTopic = %v, want %v", gotRealTopic, tt.wantRealTopic)
+			}
+		})
+	}
+}
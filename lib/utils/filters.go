@@ -27,10 +27,18 @@ func TopicMatches(topic string, topicFilter string) (matches bool, isShared bool
 
 	incomingTopicChunks := strings.Split(topic, "/")
 
+	// Topics starting with $ (such as $SYS) cannot be matched by a wildcard at the first level
+	if strings.HasPrefix(topic, "$") && (levels[0] == "#" || levels[0] == "+") {
+		return false, false, ""
+	}
+
 	for index, level := range levels {
 		if strings.EqualFold(level, "#") {
 			return true, isShared, shareName
 		}
+		if index >= len(incomingTopicChunks) {
+			return false, false, ""
+		}
 		if strings.EqualFold(level, "+") {
 			continue
 		} else {
@@ -40,5 +48,9 @@ func TopicMatches(topic string, topicFilter string) (matches bool, isShared bool
 		}
 	}
 
+	if len(levels) != len(incomingTopicChunks) {
+		return false, false, ""
+	}
+
 	return true, isShared, shareName
 }
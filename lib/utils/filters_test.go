@@ -162,6 +162,56 @@ func TestTopicMatches(t *testing.T) {
 			true,
 			"consumer",
 		},
+		{
+			"Test 8",
+			args{
+				"sport/tennis",
+				"sport/tennis/player1",
+			},
+			false,
+			false,
+			"",
+		},
+		{
+			"Test 9",
+			args{
+				"sport/tennis/player1",
+				"sport/tennis",
+			},
+			false,
+			false,
+			"",
+		},
+		{
+			"Test 10",
+			args{
+				"$SYS/broker/uptime",
+				"#",
+			},
+			false,
+			false,
+			"",
+		},
+		{
+			"Test 11",
+			args{
+				"$SYS/broker/uptime",
+				"+/broker/uptime",
+			},
+			false,
+			false,
+			"",
+		},
+		{
+			"Test 12",
+			args{
+				"$SYS/broker/uptime",
+				"$SYS/#",
+			},
+			true,
+			false,
+			"",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {